@@ -1,18 +1,40 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	semver "github.com/hashicorp/go-version"
+	"github.com/kairos-io/kairos-init/pkg/api"
 	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/generate"
+	"github.com/kairos-io/kairos-init/pkg/image"
+	"github.com/kairos-io/kairos-init/pkg/manifest"
+	"github.com/kairos-io/kairos-init/pkg/release"
+	"github.com/kairos-io/kairos-init/pkg/rootfs"
+	"github.com/kairos-io/kairos-init/pkg/sbom"
 	"github.com/kairos-io/kairos-init/pkg/stages"
+	"github.com/kairos-io/kairos-init/pkg/sysext"
+	"github.com/kairos-io/kairos-init/pkg/system"
+	"github.com/kairos-io/kairos-init/pkg/testboot"
+	"github.com/kairos-io/kairos-init/pkg/tracing"
 	"github.com/kairos-io/kairos-init/pkg/validation"
 	"github.com/kairos-io/kairos-init/pkg/values"
 	"github.com/kairos-io/kairos-sdk/types"
 	"github.com/mudler/yip/pkg/schema"
 	"github.com/sanity-io/litter"
+	"gopkg.in/yaml.v3"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -21,21 +43,47 @@ func main() {
 	var variant string
 	var ksProvider string
 	var version string
+	var configFile string
+	var packageOverlays string
+	var printRelease bool
+	var rootfsDir string
+	var rootfsRunner string
+	var rootfsSnapshots bool
+	var dryRunStage string
+	var sanBoot bool
 	var err error
 
 	flag.StringVar(&config.DefaultConfig.Level, "l", "info", "set the log level")
-	flag.StringVar(&config.DefaultConfig.Stage, "s", "all", "set the stage to run")
+	flag.StringVar(&config.DefaultConfig.Stage, "s", "all", "set the stage to run: install, init, all or upgrade to update an already initialized rootfs")
 	flag.StringVar(&config.DefaultConfig.Model, "m", "generic", "model to build for, like generic or rpi4")
 	flag.StringVar(&variant, "v", "core", "variant to build (core or standard for k3s flavor) (shorthand: -v)")
-	flag.StringVar(&ksProvider, "k", "k3s", "Kubernetes provider (shorthand: -k)")
-	flag.StringVar(&config.DefaultConfig.KubernetesVersion, "k8sversion", "latest", "Kubernetes version for provider")
+	flag.StringVar(&ksProvider, "k", "k3s", "Kubernetes provider: k3s, k0s or rke2 (shorthand: -k)")
+	flag.StringVar(&config.DefaultConfig.KubernetesVersion, "k8sversion", values.LatestKubernetesVersion, "Kubernetes version for provider")
+	flag.StringVar(&config.DefaultConfig.ProviderVersion, "provider-version", "", "provider-kairos version to install on standard images instead of the pinned one")
 	flag.StringVar(&config.DefaultConfig.Registry, "r", "quay.io/kairos", "registry and org where the image is gonna be pushed. This is mainly used on upgrades to search for available images to upgrade to")
 	flag.StringVar(&trusted, "t", "false", "init the system for Trusted Boot, changes bootloader to systemd")
 	flag.StringVar(&config.DefaultConfig.FrameworkVersion, "f", values.GetFrameworkVersion(), "set the framework version to use")
 	flag.BoolVar(&validate, "validate", false, "validate the running os to see if it all the pieces are in place")
 	flag.BoolVar(&config.DefaultConfig.Fips, "fips", false, "use fips framework. For FIPS 140-2 compliance images")
+	flag.BoolVar(&sanBoot, "san-boot", false, "enable the multipath feature for SAN booted nodes, with the multipath and iscsi tools, their services and their dracut modules in the initrd")
 	flag.StringVar(&version, "version", "", "set a version number to use for the generated system. Its used to identify this system for upgrades and such. Required.")
 	flag.BoolVar(&config.DefaultConfig.Extensions, "stage-extensions", false, "enable stage extensions mode")
+	flag.BoolVar(&config.DefaultConfig.Kernel.Headers, "kernel-headers", false, "install the headers for the installed kernel, needed for dkms and eBPF tooling")
+	flag.StringVar(&config.DefaultConfig.SecureBootVerify, "secure-boot-verify", "", "verify the shim, grub and kernel signatures after init, warn or fail if the secure boot chain is broken")
+	flag.BoolVar(&config.DefaultConfig.Reproducible, "reproducible", false, "reproducible build, use SOURCE_DATE_EPOCH for the timestamps, clear the per build state and sort the generated lists so builds on the same base are byte identical")
+	flag.BoolVar(&config.DefaultConfig.Offline, "offline", false, "assert that the build needs no network: fail before the stages run if any of them downloads from a remote host or repo")
+	flag.BoolVar(&config.DefaultConfig.NoRollback, "no-rollback", false, "keep the packages that a failed stage installed to debug it, instead of removing them so the half installed layer is not shipped")
+	flag.StringVar(&config.DefaultConfig.Profile, "profile", "", "package profile to install: recovery only installs what the recovery system needs to boot and reset the node, for small recovery only images. Empty installs the full set")
+	flag.BoolVar(&config.DefaultConfig.NoLive, "no-live", false, "skip the packages that the initrd only needs to boot the live and installer media, for images that are only installed to disk")
+	flag.BoolVar(&config.DefaultConfig.ShowPackageOutput, "show-package-output", false, "log the output of the package managers as they run at info level, instead of at debug level")
+	flag.BoolVar(&config.DefaultConfig.Check, "check", false, "run the conformance checks after the build and fail it if the rootfs does not meet the kairos requirements")
+	flag.BoolVar(&printRelease, "print-release", false, "print the kairos-release file that would be generated for this system and exit")
+	flag.StringVar(&packageOverlays, "package-overlay", "", "comma separated yaml or json files with extra entries for the package maps, applied in order on top of the embedded ones")
+	flag.StringVar(&rootfsDir, "rootfs", "", "run on this rootfs directory instead of the running system, with chroot or bwrap. Files passed as flags are copied into it, other paths are inside the rootfs")
+	flag.StringVar(&rootfsRunner, "rootfs-runner", "", "run on the rootfs with chroot or bwrap (default: bwrap if available, chroot otherwise)")
+	flag.BoolVar(&rootfsSnapshots, "rootfs-snapshots", false, "run each stage on an overlayfs snapshot of the rootfs, applied only if the stage succeeds so a failed one can be retried without redoing the previous ones")
+	flag.StringVar(&dryRunStage, "dry-run-stage", "", "run the given stage on a throwaway overlayfs snapshot of the rootfs and print the files it would change as json")
+	flag.StringVar(&configFile, "c", "", "path to a yaml config file with extra options. Flags passed in the command line take precedence over the values in the file")
 	showHelp := flag.Bool("help", false, "show help")
 
 	// Custom usage function
@@ -50,9 +98,64 @@ func main() {
 
 	flag.Parse()
 
+	// Run everything on the given rootfs, the flags and subcommands are handled by the kairos-init run there
+	if rootfsDir != "" {
+		os.Exit(runRootfs(rootfs.Options{
+			Path:        rootfsDir,
+			Runner:      rootfsRunner,
+			Stage:       config.DefaultConfig.Stage,
+			Snapshots:   rootfsSnapshots,
+			DryRunStage: dryRunStage,
+		}))
+	}
+	if rootfsSnapshots || dryRunStage != "" {
+		fmt.Fprintf(os.Stderr, "Error: --rootfs-snapshots and --dry-run-stage need --rootfs\n")
+		os.Exit(1)
+	}
+
+	// Load the config file on top of the defaults and then re-apply the flags that were explicitly set
+	// so they take precedence over the file. Their values are saved before loading, as the flags bound to
+	// the config would return the file values after it
+	setFlags := map[string]bool{}
+	flagValues := map[string]string{}
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+		flagValues[f.Name] = f.Value.String()
+	})
+	if configFile != "" {
+		err = config.DefaultConfig.LoadFromFile(configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		for name, value := range flagValues {
+			_ = flag.Set(name, value)
+		}
+		// Variant and provider are not bound to the config directly, so use the file values unless passed as flags
+		if !setFlags["v"] && config.DefaultConfig.Variant != "" {
+			variant = config.DefaultConfig.Variant.String()
+		}
+		if !setFlags["k"] && config.DefaultConfig.KubernetesProvider != "" {
+			ksProvider = string(config.DefaultConfig.KubernetesProvider)
+		}
+	}
+
 	// Set the trusted boot flag to true
 	if strings.ToLower(trusted) == "true" || strings.ToLower(trusted) == "1" {
 		config.DefaultConfig.TrustedBoot = true
+	} else if setFlags["t"] {
+		config.DefaultConfig.TrustedBoot = false
+	}
+
+	// SAN boot is the multipath feature, which can also be enabled in the config file
+	if sanBoot {
+		if config.DefaultConfig.Fips {
+			fmt.Fprintf(os.Stderr, "Error: --san-boot is not available with fips, as the fips initrd omits the iscsi dracut modules\n")
+			os.Exit(1)
+		}
+		if !slices.Contains(config.DefaultConfig.Features, values.MultipathFeature.String()) {
+			config.DefaultConfig.Features = append(config.DefaultConfig.Features, values.MultipathFeature.String())
+		}
 	}
 
 	if *showHelp {
@@ -84,12 +187,112 @@ func main() {
 		}
 	}
 
-	if config.DefaultConfig.KubernetesVersion == "latest" {
+	if config.DefaultConfig.KubernetesVersion == values.LatestKubernetesVersion {
 		// Set default variant
 		config.DefaultConfig.KubernetesVersion = ""
 	}
 
-	logger := types.NewKairosLogger("kairos-init", config.DefaultConfig.Level, false)
+	if packageOverlays != "" {
+		config.DefaultConfig.PackageOverlays = strings.Split(packageOverlays, ",")
+	}
+	for _, overlay := range config.DefaultConfig.PackageOverlays {
+		if err = values.LoadPackageOverlay(overlay); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if err = values.ValidateProfile(config.DefaultConfig); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if err = values.ValidateKernelCmdline(config.DefaultConfig); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if err = stages.ValidateSizeBudget(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if err = stages.ValidatePreflight(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if config.DefaultConfig.Reproducible {
+		if err = config.SetSourceDateEpoch(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// Compare the manifests of two builds
+	if flag.Arg(0) == "diff" {
+		os.Exit(runDiff(flag.Args()[1:]))
+	}
+
+	// Generate a Containerfile to build a Kairos image from a base image
+	if flag.Arg(0) == "generate" {
+		os.Exit(runGenerate(flag.Args()[1:]))
+	}
+
+	// Build and push a Kairos image straight from a base image, without a Dockerfile
+	if flag.Arg(0) == "image" {
+		os.Exit(runImage(flag.Args()[1:], rootfsRunner))
+	}
+
+	// Boot the built image in QEMU and check that it reaches the Kairos agent
+	if flag.Arg(0) == "test-boot" {
+		os.Exit(runTestBoot(flag.Args()[1:]))
+	}
+
+	// Print the provenance attestation predicate for an already built image
+	if flag.Arg(0) == "attest" {
+		os.Exit(runAttest(flag.Args()[1:]))
+	}
+
+	// Print the recommended OCI labels for an already built image
+	if flag.Arg(0) == "labels" {
+		os.Exit(runLabels(flag.Args()[1:]))
+	}
+
+	// Verify that an already built rootfs meets the kairos requirements
+	if flag.Arg(0) == "check" {
+		os.Exit(runCheck(flag.Args()[1:]))
+	}
+
+	// Check the embedded package maps, for development and CI
+	if flag.Arg(0) == "validate" {
+		os.Exit(runValidate())
+	}
+
+	// Remove what a previous run added to the base image
+	if flag.Arg(0) == "undo" {
+		os.Exit(runUndo(flag.Args()[1:]))
+	}
+
+	// Report the boot artifacts of an already built image, for tooling that needs to find them
+	if flag.Arg(0) == "artifacts" {
+		artifacts, err := system.GetArtifacts("/")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		out, _ := json.MarshalIndent(artifacts, "", "  ")
+		fmt.Println(string(out))
+		os.Exit(0)
+	}
+
+	// BuildKit shows the output of the RUN steps as plain text, so dont colorize the logs
+	if system.UnderBuildKit() {
+		_ = os.Setenv("NO_COLOR", "1")
+	}
+
+	// Keep the console clean when printing the release, so the output can be redirected to a file
+	logger := types.NewKairosLogger("kairos-init", config.DefaultConfig.Level, printRelease)
 	logger.Infof("Starting kairos-init version %s", values.GetVersion())
 	logger.Debug(litter.Sdump(values.GetFullVersion()))
 
@@ -131,6 +334,16 @@ func main() {
 
 	var runStages schema.YipConfig
 
+	if printRelease {
+		r := release.New(system.DetectSystem(logger), config.DefaultConfig, logger)
+		fmt.Print(r.String())
+		if err = r.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if validate {
 		validator := validation.NewValidator(logger)
 		err = validator.Validate()
@@ -142,25 +355,155 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Export traces of the run if an OTLP endpoint is set
+	if traceErr := tracing.Init(fmt.Sprintf("kairos-init %s", config.DefaultConfig.Stage)); traceErr != nil {
+		logger.Logger.Warn().Err(traceErr).Msg("Tracing disabled")
+	}
+
+	// Fail right away instead of building a trusted boot image that doesn't boot
+	if config.DefaultConfig.TrustedBoot && config.DefaultConfig.Stage != "" {
+		if err = values.CheckTrustedBootSupport(system.DetectSystem(logger)); err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+	}
+	if config.DefaultConfig.Variant == config.StandardVariant && config.DefaultConfig.Stage != "" {
+		if err = values.CheckKubernetesProviderSupport(system.DetectSystem(logger), config.DefaultConfig.KubernetesProvider); err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	// Only one run at a time on the system, or their package manager operations would interleave
+	unlock := func() {}
 	if config.DefaultConfig.Stage != "" {
+		if unlock, err = system.Lock("/"); err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+		defer unlock()
+	}
+
+	// Keep track of the base image so the run can be undone
+	if config.DefaultConfig.Stage == "install" || config.DefaultConfig.Stage == "all" {
+		if baselineErr := manifest.RecordBaseline(system.DetectSystem(logger), logger); baselineErr != nil {
+			logger.Logger.Warn().Err(baselineErr).Msg("Could not record the baseline, undo will not be available")
+		}
+	}
+
+	// Keep track of the rootfs before the stages run, to know what goes in the extension
+	if config.DefaultConfig.Sysext.Enabled {
+		if err = sysext.Snapshot(logger); err != nil {
+			logger.Error(err)
+			unlock()
+			os.Exit(1)
+		}
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+	if config.DefaultConfig.Stage != "" {
+		// Pick up where an interrupted run of the same stage stopped
+		if err = stages.Resume(system.DetectSystem(logger), logger); err != nil {
+			logger.Error(err)
+			unlock()
+			os.Exit(1)
+		}
 		logger.Infof("Running stage %s", config.DefaultConfig.Stage)
 		switch config.DefaultConfig.Stage {
 		case "install":
-			runStages, err = stages.RunInstallStage(logger)
+			runStages, err = stages.RunInstallStage(ctx, logger)
 		case "init":
-			runStages, err = stages.RunInitStage(logger)
+			runStages, err = stages.RunInitStage(ctx, logger)
 		case "all":
-			runStages, err = stages.RunAllStages(logger)
+			if stages.IsInitialized() {
+				logger.Logger.Warn().Msg("The rootfs is already initialized, use the upgrade stage to only update the kairos components")
+			}
+			runStages, err = stages.RunAllStages(ctx, logger)
+		case "upgrade":
+			runStages, err = stages.RunUpgradeStage(ctx, logger)
 		default:
-			logger.Errorf("Unknown stage %s. Valid values are install, init and all", config.DefaultConfig.Stage)
+			logger.Errorf("Unknown stage %s. Valid values are install, init, all and upgrade", config.DefaultConfig.Stage)
+			unlock()
 			os.Exit(1)
 		}
 	}
 
+	// Verify the secure boot chain once the kernel is in place, or the full rootfs if the conformance checks are enabled
+	if err == nil && config.DefaultConfig.Stage != "install" {
+		if config.DefaultConfig.Check {
+			report := validation.NewValidator(logger).Check()
+			if config.DefaultConfig.Report.Output != "" {
+				out, _ := json.MarshalIndent(report, "", "  ")
+				path := filepath.Join(config.DefaultConfig.Report.Output, "check.json")
+				if writeErr := config.DefaultConfig.WriteFile(path, append(out, '\n'), 0644); writeErr != nil {
+					logger.Logger.Warn().Err(writeErr).Msg("Could not write the check results")
+				}
+			}
+			err = report.Error()
+		} else {
+			err = validation.NewValidator(logger).CheckBootChain()
+		}
+	}
+
+	// Generate the SBOM once all the packages for the stage are in
+	if err == nil && config.DefaultConfig.SBOM.Enabled {
+		err = sbom.Generate(system.DetectSystem(logger), logger)
+	}
+
+	// Pack what the stages added into the extension, once the image is complete
+	if err == nil && config.DefaultConfig.Sysext.Enabled && config.DefaultConfig.Stage != "install" {
+		err = sysext.Build(system.DetectSystem(logger), logger)
+	}
+
+	// Check the licenses of the installed packages against the denylist
+	if err == nil && (config.DefaultConfig.Licenses.Report || len(config.DefaultConfig.Licenses.Deny) > 0) {
+		err = sbom.GenerateLicenseReport(system.DetectSystem(logger), logger)
+	}
+
+	// Show where the build time went, even if the build failed
+	if reportErr := stages.WriteBuildReport(logger); reportErr != nil {
+		logger.Logger.Warn().Err(reportErr).Msg("Could not write the build report")
+	}
+	if traceErr := tracing.Flush(err); traceErr != nil {
+		logger.Logger.Warn().Err(traceErr).Msg("Could not export the traces")
+	}
+
+	// Describe the boot artifacts so AuroraBoot can build the media without probing the rootfs
+	if err == nil && config.DefaultConfig.Stage != "install" {
+		if artifactsErr := system.WriteArtifacts(); artifactsErr != nil {
+			logger.Logger.Warn().Err(artifactsErr).Msg("Could not write the artifacts description")
+		}
+	}
+
+	// Keep track of what went into the image, we don't fail the build if we cant write it
+	if err == nil {
+		if manifestErr := manifest.Generate(system.DetectSystem(logger), runStages, logger); manifestErr != nil {
+			logger.Logger.Warn().Err(manifestErr).Msg("Could not write the build manifest")
+		}
+	}
+
+	// Leave an interrupted build ready to be resumed, with a manifest of what got in so far
+	if stages.Interrupted(err) {
+		logger.Error(err)
+		stages.CleanupInterrupted(system.DetectSystem(logger), logger)
+		if manifestErr := manifest.Generate(system.DetectSystem(logger), runStages, logger); manifestErr != nil {
+			logger.Logger.Warn().Err(manifestErr).Msg("Could not write the partial build manifest")
+		}
+		stages.WriteErrorReport(err, logger)
+		unlock()
+		os.Exit(stages.ExitInterrupted)
+	}
+
 	if err != nil {
 		logger.Error(err)
+		stages.WriteErrorReport(err, logger)
+		unlock()
 		os.Exit(1)
 	}
+	if stateErr := stages.ClearState(); stateErr != nil {
+		logger.Logger.Warn().Err(stateErr).Msg("Could not remove the state of the interrupted build")
+	}
 
 	litter.Config.HideZeroValues = true
 	litter.Config.HidePrivateFields = true
@@ -173,3 +516,356 @@ func main() {
 	}
 
 }
+
+// runDiff prints the differences between two manifests and returns the exit code
+func runDiff(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "output the diff as json")
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s diff [--json] manifestA.json manifestB.json\n", os.Args[0])
+		return 1
+	}
+	a, err := manifest.Load(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 1
+	}
+	b, err := manifest.Load(fs.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 1
+	}
+	diff := manifest.DiffManifests(a, b)
+	if *asJSON {
+		out, _ := json.MarshalIndent(diff, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		fmt.Print(diff.String())
+	}
+	return 0
+}
+
+// runCheck runs the conformance checks on the rootfs, prints the results as json and returns the exit code
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	output := fs.String("output", "", "write the results to this file instead of stdout")
+	_ = fs.Parse(args)
+
+	// Keep the console clean so the results can be piped
+	logger := types.NewKairosLogger("kairos-init", config.DefaultConfig.Level, *output == "")
+	report := validation.NewValidator(logger).Check()
+	out, _ := json.MarshalIndent(report, "", "  ")
+	if *output != "" {
+		if err := os.WriteFile(*output, append(out, '\n'), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			return 1
+		}
+	} else {
+		fmt.Println(string(out))
+	}
+	if err := report.Error(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
+
+// runValidate checks the embedded package maps, printing the problems found, and returns the exit code
+func runValidate() int {
+	errs := values.ValidatePackageMaps()
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Println("All package maps are valid")
+	return 0
+}
+
+// runUndo removes the packages and files added since the base image, or prints them with --dry-run, and returns the
+// exit code
+func runUndo(args []string) int {
+	fs := flag.NewFlagSet("undo", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "print what would be removed as json without removing it")
+	_ = fs.Parse(args)
+
+	logger := types.NewKairosLogger("kairos-init", config.DefaultConfig.Level, *dryRun)
+	// Same as the stage runs, so the packages and files are not removed while a run adds them
+	if !*dryRun {
+		unlock, err := system.Lock("/")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			return 1
+		}
+		defer unlock()
+	}
+	plan, err := manifest.GetUndoPlan(system.DetectSystem(logger))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 1
+	}
+	if *dryRun {
+		out, _ := json.MarshalIndent(plan, "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+	if err = manifest.Undo(plan, logger); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
+
+// runLabels prints the recommended OCI labels for the image, or writes them to a file, and returns the exit code
+func runLabels(args []string) int {
+	fs := flag.NewFlagSet("labels", flag.ExitOnError)
+	output := fs.String("output", "", "write the labels to this file instead of stdout")
+	_ = fs.Parse(args)
+
+	m, err := manifest.Load(manifest.Path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 1
+	}
+	r, err := release.Load(release.Path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 1
+	}
+	out, _ := json.MarshalIndent(manifest.Labels(m, r), "", "  ")
+	if *output != "" {
+		if err = os.WriteFile(*output, append(out, '\n'), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			return 1
+		}
+		return 0
+	}
+	fmt.Println(string(out))
+	return 0
+}
+
+// runGenerate prints the requested generated file and returns the exit code
+func runGenerate(args []string) int {
+	if len(args) > 0 && args[0] == "sync" {
+		return runSync(args[1:])
+	}
+	if len(args) == 0 || args[0] != "dockerfile" {
+		fmt.Fprintf(os.Stderr, "Usage: %s generate dockerfile --base image [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s generate sync --distro distro --version version [options] upstream...\n", os.Args[0])
+		return 1
+	}
+	var opts generate.DockerfileOptions
+	fs := flag.NewFlagSet("generate dockerfile", flag.ExitOnError)
+	fs.StringVar(&opts.Base, "base", "", "base image to kairosify, like ubuntu:24.04. Required")
+	fs.StringVar(&opts.InitImage, "init-image", fmt.Sprintf("quay.io/kairos/kairos-init:%s", values.GetVersion()), "kairos-init image to copy the binary from")
+	fs.StringVar(&opts.Version, "version", "v0.0.1", "version number to use for the generated system")
+	fs.StringVar(&opts.Variant, "v", "", "variant to build (core or standard)")
+	fs.StringVar(&opts.Model, "m", "", "model to build for, like generic or rpi4")
+	fs.BoolVar(&opts.TrustedBoot, "t", false, "init the system for Trusted Boot")
+	fs.StringVar(&opts.Provider, "k", "", "Kubernetes provider")
+	fs.StringVar(&opts.KubernetesVersion, "k8sversion", "", "Kubernetes version for provider")
+	fs.StringVar(&opts.ConfigFile, "c", "", "kairos-init config file in the build context to use")
+	_ = fs.Parse(args[1:])
+
+	out, err := generate.Dockerfile(opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 1
+	}
+	fmt.Print(out)
+	return 0
+}
+
+// runSync compares the package maps against the upstream package lists, printing the differences and the proposed
+// overlay, and returns the exit code. The global flags, like the variant, model or config file, select the packages
+func runSync(args []string) int {
+	opts := generate.SyncOptions{Options: api.Options{Config: config.DefaultConfig}}
+	fs := flag.NewFlagSet("generate sync", flag.ExitOnError)
+	fs.StringVar(&opts.System.Distro, "distro", "", "distro to compare, like ubuntu or rocky. Required")
+	fs.StringVar(&opts.System.Version, "version", "", "distro version to compare, like 24.04")
+	fs.StringVar(&opts.System.Codename, "codename", "", "distro codename to compare, only needed if there is no version")
+	fs.StringVar(&opts.System.Arch, "arch", values.ArchAMD64.String(), "arch to compare, amd64 or arm64")
+	fs.StringVar(&opts.Map, "map", "base", "package map to propose the missing packages for")
+	asJSON := fs.Bool("json", false, "output the report as json")
+	overlay := fs.String("overlay", "", "write the proposed package overlay to this file")
+	_ = fs.Parse(args)
+	if opts.System.Distro == "" || fs.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s generate sync --distro distro --version version [options] upstream...\n", os.Args[0])
+		return 1
+	}
+
+	var upstream []string
+	for _, path := range fs.Args() {
+		pkgs, err := generate.UpstreamPackages(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			return 1
+		}
+		upstream = append(upstream, pkgs...)
+	}
+	report, err := generate.Sync(opts, upstream)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 1
+	}
+	if *overlay != "" && len(report.Overlay.Packages) > 0 {
+		out, _ := yaml.Marshal(report.Overlay)
+		if err = os.WriteFile(*overlay, out, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			return 1
+		}
+	}
+	if *asJSON {
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		fmt.Print(report.String())
+	}
+	return 0
+}
+
+// signalContext returns a context that is cancelled on SIGTERM, like the one CI sends on a timeout, or on ctrl-c, so
+// the run stops its package managers and exits instead of leaving them running and holding their locks
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// runRootfs runs kairos-init with the same args on the rootfs and returns its exit code
+func runRootfs(opts rootfs.Options) int {
+	// Keep stdout for the changes on a dry run
+	logger := types.NewKairosLogger("kairos-init", config.DefaultConfig.Level, opts.DryRunStage != "")
+	opts.Flags = os.Args[1 : len(os.Args)-flag.NArg()]
+	opts.Command = flag.Args()
+	ctx, stop := signalContext()
+	defer stop()
+	err := rootfs.Run(ctx, opts, logger)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if stages.Interrupted(err) {
+		return stages.ExitInterrupted
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
+
+// runImage builds an image from a base image with the global flags and returns the exit code
+func runImage(args []string, runner string) int {
+	opts := image.Options{Rootfs: rootfs.Options{
+		Runner: runner,
+		Flags:  os.Args[1 : len(os.Args)-flag.NArg()],
+	}}
+	fs := flag.NewFlagSet("image", flag.ExitOnError)
+	fs.StringVar(&opts.Base, "base", "", "base image to kairosify, like ubuntu:24.04. Required")
+	fs.StringVar(&opts.Tag, "tag", "", "reference to push the resulting image to. Required")
+	fs.StringVar(&opts.Output, "output", "", "write the image as a tarball to this file instead of pushing it")
+	fs.StringVar(&opts.Arch, "arch", runtime.GOARCH, "arch of the base image to pull")
+	_ = fs.Parse(args)
+	if opts.Base == "" || opts.Tag == "" {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] image --base image --tag image [--output file] [--arch arch]\n", os.Args[0])
+		return 1
+	}
+
+	logger := types.NewKairosLogger("kairos-init", config.DefaultConfig.Level, false)
+	ctx, stop := signalContext()
+	defer stop()
+	err := image.Build(ctx, opts, logger)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if stages.Interrupted(err) {
+		return stages.ExitInterrupted
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
+
+// runTestBoot boots the image with each firmware and prints the results, and returns the exit code
+func runTestBoot(args []string) int {
+	opts := testboot.Options{}
+	fs := flag.NewFlagSet("test-boot", flag.ExitOnError)
+	fs.StringVar(&opts.Image, "image", "", "image to boot, from the local docker daemon or a registry")
+	fs.StringVar(&opts.Rootfs, "rootfs", "", "rootfs dir to boot instead of an image")
+	firmwares := fs.String("firmware", "", "comma separated firmwares to boot with, bios and efi. Defaults to both on amd64 and efi on arm64")
+	fs.BoolVar(&opts.TrustedBoot, "trusted-boot", false, "build a signed UKI ISO and boot it with efi")
+	fs.StringVar(&opts.Keys, "keys", "", "dir with the secure boot keys to sign the UKI with, for --trusted-boot")
+	fs.StringVar(&opts.AuroraBoot, "auroraboot", testboot.DefaultAuroraBoot, "AuroraBoot image to build the ISO with")
+	arch := fs.String("arch", runtime.GOARCH, "arch of the image")
+	fs.IntVar(&opts.Memory, "memory", 4096, "memory of the VM in MiB")
+	fs.IntVar(&opts.CPUs, "cpus", 2, "cpus of the VM")
+	fs.DurationVar(&opts.Timeout, "timeout", 10*time.Minute, "how long to wait for each boot to reach the agent")
+	fs.StringVar(&opts.Expect, "expect", "", "regex the serial console has to match instead of the test marker")
+	fs.StringVar(&opts.Output, "output", "", "dir to keep the ISO and the serial logs in")
+	asJSON := fs.Bool("json", false, "print the results as json")
+	_ = fs.Parse(args)
+	if opts.Image == "" && opts.Rootfs == "" {
+		fmt.Fprintf(os.Stderr, "Usage: %s test-boot --image image|--rootfs dir [--firmware bios,efi] [--trusted-boot --keys dir] [--json]\n", os.Args[0])
+		return 1
+	}
+	opts.Arch = values.Architecture(*arch)
+	if *firmwares != "" {
+		opts.Firmwares = strings.Split(*firmwares, ",")
+	} else if opts.Arch == values.ArchAMD64 {
+		opts.Firmwares = []string{testboot.BIOS, testboot.EFI}
+	} else {
+		opts.Firmwares = []string{testboot.EFI}
+	}
+
+	logger := types.NewKairosLogger("kairos-init", config.DefaultConfig.Level, *asJSON)
+	results, err := testboot.Run(opts, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 1
+	}
+	if *asJSON {
+		out, _ := json.MarshalIndent(results, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		for _, result := range results {
+			status := "booted"
+			if !result.Booted {
+				status = "FAILED: " + result.Error
+			}
+			fmt.Printf("%s (trusted boot: %t): %s in %.0fs, log in %s\n", result.Firmware, result.TrustedBoot, status, result.Seconds, result.Log)
+		}
+	}
+	if err = testboot.Failed(results); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
+
+// runAttest prints the provenance predicate for the image, or writes it to a file, and returns the exit code
+func runAttest(args []string) int {
+	fs := flag.NewFlagSet("attest", flag.ExitOnError)
+	base := fs.String("base", "", "base image the image was built from, like ubuntu:24.04")
+	output := fs.String("output", "", "write the predicate to this file instead of stdout")
+	_ = fs.Parse(args)
+
+	m, err := manifest.Load(manifest.Path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 1
+	}
+	out, _ := json.MarshalIndent(manifest.Attestation(m, *base), "", "  ")
+	if *output != "" {
+		if err = os.WriteFile(*output, append(out, '\n'), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			return 1
+		}
+		return 0
+	}
+	fmt.Println(string(out))
+	return 0
+}
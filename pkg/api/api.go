@@ -0,0 +1,123 @@
+// Package api resolves what kairos-init would do for a system and set of options, without running anything, so other
+// tools can embed kairos-init instead of shelling out to it. Breaking changes bump Version.
+package api
+
+import (
+	"fmt"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/stages"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// Version is the version of the api
+const Version = "v1"
+
+// System is the system to resolve for, like the os-release of the base image
+type System struct {
+	// Distro is the os-release ID, like ubuntu or rocky
+	Distro string
+	// Version is the os-release VERSION_ID, like 24.04
+	Version string
+	// Codename is the os-release VERSION_CODENAME, only needed if there is no version
+	Codename string
+	// Arch is amd64 or arm64
+	Arch string
+}
+
+// Options are the kairos-init options to resolve with
+type Options struct {
+	// Config is the kairos-init config, same as the config file and flags. Variant, Model and TrustedBoot are read from it
+	Config config.Config
+	// Logger defaults to a null logger
+	Logger *types.KairosLogger
+}
+
+// Package is a resolved package, with the package map, distro or family, arch and constraint that selected it
+type Package = values.PackageProvenance
+
+// system returns the values.System for the api system and options
+func (s System) system(opts Options) (values.System, error) {
+	family, ok := values.DistroFamilies[values.Distro(s.Distro)]
+	if !ok {
+		return values.System{}, fmt.Errorf("unsupported distro: %s", s.Distro)
+	}
+	arch := values.Architecture(s.Arch)
+	if arch != values.ArchAMD64 && arch != values.ArchARM64 {
+		return values.System{}, fmt.Errorf("unsupported arch: %s", s.Arch)
+	}
+	model := opts.Config.Model
+	if model == "" {
+		model = values.Generic.String()
+	}
+	variant := opts.Config.Variant
+	if variant == "" {
+		variant = config.CoreVariant
+	}
+	return values.System{
+		Name:        s.Distro,
+		Distro:      values.Distro(s.Distro),
+		Family:      family,
+		Version:     s.Version,
+		Arch:        arch,
+		Codename:    s.Codename,
+		Variant:     variant,
+		Model:       values.Model(model),
+		TrustedBoot: opts.Config.TrustedBoot,
+	}, nil
+}
+
+// logger returns the logger of the options
+func (o Options) logger() types.KairosLogger {
+	if o.Logger != nil {
+		return *o.Logger
+	}
+	return types.NewNullLogger()
+}
+
+// config returns the config of the options with the defaults for the model and variant of the system
+func (o Options) config(sis values.System) config.Config {
+	c := o.Config
+	c.Model = sis.Model.String()
+	c.Variant = sis.Variant
+	return c
+}
+
+// ResolvePackages returns the packages that the install stage installs on the system, with the templates rendered
+func ResolvePackages(s System, opts Options) ([]Package, error) {
+	sis, err := s.system(opts)
+	if err != nil {
+		return nil, err
+	}
+	c := opts.config(sis)
+	l := opts.logger()
+	provenance, err := values.GetPackageProvenance(sis, c, l)
+	if err != nil {
+		return nil, err
+	}
+	return values.RenderPackageProvenance(provenance, sis.TemplateParams(c), l)
+}
+
+// ResolveRepos returns the stages that enable the extra repos needed for the packages on the system
+func ResolveRepos(s System, opts Options) ([]schema.Stage, error) {
+	sis, err := s.system(opts)
+	if err != nil {
+		return nil, err
+	}
+	return stages.GetRepoStage(sis, opts.config(sis), opts.logger())
+}
+
+// ResolveStages returns the before-install, install and after-install stages for the system. The init stages depend on
+// what the install stages put on the system, like the installed kernel, so they can't be resolved beforehand
+// Nothing is read from or run on the host, so the result is the same on any machine: what depends on the system
+// being built, like the latest Ubuntu kernel for trusted boot or a local kernel package, is checked by the steps when
+// they run. The stage extensions on disk and the apt cache mount steps are left out, as they come from the build host
+func ResolveStages(s System, opts Options) (schema.YipConfig, error) {
+	sis, err := s.system(opts)
+	if err != nil {
+		return schema.YipConfig{}, err
+	}
+	return stages.GetInstallStages(sis, opts.config(sis), opts.logger())
+}
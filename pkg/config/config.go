@@ -2,28 +2,307 @@ package config
 
 import (
 	"fmt"
+	"os"
+
 	semver "github.com/hashicorp/go-version"
+	"gopkg.in/yaml.v3"
 )
 
 // Config is the struct to track the config of the init image
 // So we can access it from anywhere
 type Config struct {
-	Level              string
-	Stage              string
-	Model              string
-	FrameworkVersion   string
-	Variant            Variant
-	Registry           string
-	TrustedBoot        bool
-	Fips               bool
-	KubernetesProvider KubernetesProvider
-	KubernetesVersion  string
-	KairosVersion      semver.Version
-	Extensions         bool
+	Level              string             `yaml:"level,omitempty"`
+	Stage              string             `yaml:"stage,omitempty"`
+	Model              string             `yaml:"model,omitempty"`
+	FrameworkVersion   string             `yaml:"framework_version,omitempty"`
+	Variant            Variant            `yaml:"variant,omitempty"`
+	Registry           string             `yaml:"registry,omitempty"`
+	TrustedBoot        bool               `yaml:"trusted_boot,omitempty"`
+	Fips               bool               `yaml:"fips,omitempty"`
+	KubernetesProvider KubernetesProvider `yaml:"kubernetes_provider,omitempty"`
+	KubernetesVersion  string             `yaml:"kubernetes_version,omitempty"`
+	ProviderVersion    string             `yaml:"provider_version,omitempty"`
+	KairosVersion      semver.Version     `yaml:"-"`
+	Extensions         bool               `yaml:"stage_extensions,omitempty"`
+	Services           Services           `yaml:"services,omitempty"`
+	Sysctl             map[string]string  `yaml:"sysctl,omitempty"`
+	UdevRules          map[string]string  `yaml:"udev_rules,omitempty"`
+	User               User               `yaml:"user,omitempty"`
+	SSH                SSH                `yaml:"ssh,omitempty"`
+	Localization       Localization       `yaml:"localization,omitempty"`
+	Branding           Branding           `yaml:"branding,omitempty"`
+	Cleanup            Cleanup            `yaml:"cleanup,omitempty"`
+	KeepCloudInit      bool               `yaml:"keep_cloud_init,omitempty"`
+	NetworkStack       string             `yaml:"network_stack,omitempty"`
+	TimeSync           string             `yaml:"time_sync,omitempty"`
+	Swap               Swap               `yaml:"swap,omitempty"`
+	ContainerRuntime   string             `yaml:"container_runtime,omitempty"`
+	PackageOverlays    []string           `yaml:"package_overlays,omitempty"`
+	PackageGroups      PackageGroups      `yaml:"package_groups,omitempty"`
+	Features           []string           `yaml:"features,omitempty"`
+	Audit              Audit              `yaml:"audit,omitempty"`
+	KernelModules      KernelModules      `yaml:"kernel_modules,omitempty"`
+	Nvidia             bool               `yaml:"nvidia,omitempty"`
+	Zfs                bool               `yaml:"zfs,omitempty"`
+	Kernel             Kernel             `yaml:"kernel,omitempty"`
+	Firmware           string             `yaml:"firmware,omitempty"`
+	Microcode          bool               `yaml:"microcode,omitempty"`
+	Initrd             Initrd             `yaml:"initrd,omitempty"`
+	SecureBootVerify   string             `yaml:"secure_boot_verify,omitempty"`
+	SBOM               SBOM               `yaml:"sbom,omitempty"`
+	Manifest           Manifest           `yaml:"manifest,omitempty"`
+	Reproducible       bool               `yaml:"reproducible,omitempty"`
+	Licenses           Licenses           `yaml:"licenses,omitempty"`
+	SizeBudget         SizeBudget         `yaml:"size_budget,omitempty"`
+	Preflight          Preflight          `yaml:"preflight,omitempty"`
+	Offline            bool               `yaml:"offline,omitempty"`
+	Report             Report             `yaml:"report,omitempty"`
+	Sysext             Sysext             `yaml:"sysext,omitempty"`
+	Components         Components         `yaml:"components,omitempty"`
+	Check              bool               `yaml:"check,omitempty"`
+	NoRollback         bool               `yaml:"no_rollback,omitempty"`
+	NoLive             bool               `yaml:"no_live,omitempty"`
+	Profile            string             `yaml:"profile,omitempty"`
+	ShowPackageOutput  bool               `yaml:"show_package_output,omitempty"`
+	Mirrors            Mirrors            `yaml:"mirrors,omitempty"`
+}
+
+// Mirrors are the base urls of the package mirrors of each family, in order of preference. When a package manager
+// keeps failing on one, the repos are switched to the next
+type Mirrors map[string][]string
+
+// Services are extra services to handle on top of the default ones for the system
+// On openrc systems, enabled services are added to the default runlevel and masking is not supported
+type Services struct {
+	Enable  []string `yaml:"enable,omitempty"`
+	Disable []string `yaml:"disable,omitempty"`
+	Mask    []string `yaml:"mask,omitempty"`
+}
+
+// User is the default user to create at build time, for images that dont use cloud-config on boot to create it
+type User struct {
+	Create            bool     `yaml:"create,omitempty"`
+	Name              string   `yaml:"name,omitempty"`
+	UID               string   `yaml:"uid,omitempty"`
+	GID               string   `yaml:"gid,omitempty"`
+	Groups            []string `yaml:"groups,omitempty"`
+	Shell             string   `yaml:"shell,omitempty"`
+	PasswordHash      string   `yaml:"password_hash,omitempty"`
+	Sudo              bool     `yaml:"sudo,omitempty"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys,omitempty"`
+}
+
+// SSH is the sshd configuration written as a drop-in when Harden is set
+type SSH struct {
+	Harden                 bool     `yaml:"harden,omitempty"`
+	Port                   int      `yaml:"port,omitempty"`
+	PasswordAuthentication bool     `yaml:"password_authentication,omitempty"`
+	PermitRootLogin        string   `yaml:"permit_root_login,omitempty"`
+	Ciphers                []string `yaml:"ciphers,omitempty"`
+	MACs                   []string `yaml:"macs,omitempty"`
+	KexAlgorithms          []string `yaml:"kex_algorithms,omitempty"`
+}
+
+// Localization is the default locale, keymap and timezone for the system
+// Empty values leave the base image defaults untouched
+type Localization struct {
+	Locale      string `yaml:"locale,omitempty"`
+	Keymap      string `yaml:"keymap,omitempty"`
+	Timezone    string `yaml:"timezone,omitempty"`
+	TrimLocales bool   `yaml:"trim_locales,omitempty"`
+}
+
+// Branding are the motd and issue templates to install, empty values use the default templates
+// Templates are rendered with the kairos-release values, like {{.KAIROS_VERSION}}
+type Branding struct {
+	Motd  string `yaml:"motd,omitempty"`
+	Issue string `yaml:"issue,omitempty"`
+}
+
+// Cleanup are the optional things to remove from the image on the final cleanup stage
+// Package caches and logs are always cleaned, the machine-id is reset on the init stage
+type Cleanup struct {
+	Docs    bool `yaml:"docs,omitempty"`
+	Man     bool `yaml:"man,omitempty"`
+	Locales bool `yaml:"locales,omitempty"`
+}
+
+// Swap is the swap to set up for memory constrained devices, none by default. Both can be set, zram is used first
+type Swap struct {
+	// Zram is the size of a compressed swap in memory, as a percent of the RAM like "50%" or in MiB like "2048"
+	Zram string `yaml:"zram,omitempty"`
+	// File is the size in MiB of a swap file created on the persistent partition on first boot
+	File int `yaml:"file,omitempty"`
+}
+
+// Audit are the options of the audit feature, which installs and enables auditd
+type Audit struct {
+	// Forwarder sends the logs, with the audit events, to Target: rsyslog or journal-upload. Empty keeps them local
+	Forwarder string `yaml:"forwarder,omitempty"`
+	// Target is host or host:port for rsyslog, which forwards over tcp, or the url of the systemd-journal-remote server
+	Target string `yaml:"target,omitempty"`
+}
+
+// KernelModules are the extra modules to blacklist and to include in the initrd
+type KernelModules struct {
+	Blacklist []string `yaml:"blacklist,omitempty"`
+	Initrd    []string `yaml:"initrd,omitempty"`
+	// Build are the packages providing out-of-tree module sources (like wireguard-dkms or akmod-wl) to build against the installed kernel
+	Build []string `yaml:"build,omitempty"`
+}
+
+// Kernel are the options to select the kernel to install
+type Kernel struct {
+	Flavor string `yaml:"flavor,omitempty"`
+	// Version pins the kernel to an exact version, which is held after install so it is not upgraded
+	Version string `yaml:"version,omitempty"`
+	// Source is a local path or http(s) url to a kernel package (.deb, .rpm or .apk) to install instead of the distro kernel
+	Source string `yaml:"source,omitempty"`
+	// Checksum is the sha256 of the Source package, required when Source is an url
+	Checksum string `yaml:"checksum,omitempty"`
+	// Cmdline are extra kernel cmdline arguments, applied to grub, systemd-boot entries and UKI builds
+	Cmdline []string `yaml:"cmdline,omitempty"`
+	// Headers installs the headers matching the installed kernel and keeps them on the image
+	Headers bool `yaml:"headers,omitempty"`
+	// Fallback is the exact version of a secondary kernel to install, with its own initrd and boot entry
+	Fallback string `yaml:"fallback,omitempty"`
+}
+
+const (
+	// RealtimeKernelFlavor selects the PREEMPT_RT kernel packages of the distro
+	RealtimeKernelFlavor = "realtime"
+	// GAKernelFlavor selects the GA kernel on Ubuntu instead of the HWE one. Other distros have no HWE kernels so its the default one
+	GAKernelFlavor = "ga"
+	// Cloud kernel flavors select the kernel tuned for each cloud on Ubuntu
+	AWSKernelFlavor    = "aws"
+	AzureKernelFlavor  = "azure"
+	GCPKernelFlavor    = "gcp"
+	OracleKernelFlavor = "oracle"
+)
+
+// Initrd are the options to build the initrd with dracut. Empty values keep the distro defaults
+type Initrd struct {
+	// Mode is hostonly to only include what the build host needs or generic to include all the drivers
+	Mode string `yaml:"mode,omitempty"`
+	// Compression is the compression algorithm for the initrd, like zstd, xz, gzip or lz4
+	Compression string `yaml:"compression,omitempty"`
+}
+
+const (
+	HostonlyInitrdMode = "hostonly"
+	GenericInitrdMode  = "generic"
+)
+
+// SBOM are the options to generate the SBOM of the installed packages
+type SBOM struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Output is an extra dir to write the SBOM to, on top of the copy stored in the image
+	Output string `yaml:"output,omitempty"`
+	// Formats are the SBOM formats to generate, spdx and cyclonedx. Defaults to spdx
+	Formats []string `yaml:"formats,omitempty"`
+}
+
+// Licenses are the options for the license report of the installed packages
+type Licenses struct {
+	Report bool `yaml:"report,omitempty"`
+	// Output is an extra dir to write the report to, on top of the copy stored in the image
+	Output string `yaml:"output,omitempty"`
+	// Deny are the license ids that fail the build when an installed package uses them, matched by prefix so AGPL
+	// matches any AGPL version. Setting it enables the report
+	Deny []string `yaml:"deny,omitempty"`
+}
+
+// SizeBudget is the maximum size of the rootfs, and of what each stage can add to it, like 2GiB or 512M
+// The build fails as soon as a stage goes over its budget, the total is checked once the last stage has run
+type SizeBudget struct {
+	Total string `yaml:"total,omitempty"`
+	// Stages is the maximum growth for each stage, by stage name (install, init, after-init...)
+	Stages map[string]string `yaml:"stages,omitempty"`
+}
+
+// Preflight are the options of the disk space, memory and network checks run before the stages. The sizes override
+// the estimates for the family, like 4GiB
+type Preflight struct {
+	Skip bool `yaml:"skip,omitempty"`
+	// Disk is the free space needed on the rootfs for the install stage
+	Disk string `yaml:"disk,omitempty"`
+	// Tmp is the free space needed on the dir where the initrd is built, /var/tmp for dracut and /tmp for mkinitfs
+	Tmp string `yaml:"tmp,omitempty"`
+	// Memory is the available memory needed for the package installs and the initrd build
+	Memory string `yaml:"memory,omitempty"`
+}
+
+// Report are the options for the build report, which is always logged at the end of the build
+type Report struct {
+	// Output is a dir to write the report to, as text and json
+	Output string `yaml:"output,omitempty"`
+	// PackageBatch installs the base packages in batches of this many, to time them on their own
+	PackageBatch int `yaml:"package_batch,omitempty"`
+}
+
+// Sysext builds a systemd-sysext image with the files the stages add under /usr and /opt, to merge on top of the
+// unmodified base image instead of shipping the modified rootfs
+type Sysext struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Name of the extension, defaults to kairos
+	Name string `yaml:"name,omitempty"`
+	// Output is the path of the image, defaults to /<name>.raw
+	Output string `yaml:"output,omitempty"`
+}
+
+// PackageGroups selects the package groups to install on top of the default ones
+type PackageGroups struct {
+	Enable  []string `yaml:"enable,omitempty"`
+	Disable []string `yaml:"disable,omitempty"`
+}
+
+// Components are the options to install the kairos components from their pinned github releases instead of the
+// binaries shipped in the framework image
+type Components struct {
+	// Install replaces all the components with their pinned releases
+	Install        bool      `yaml:"install,omitempty"`
+	Immucore       Component `yaml:"immucore,omitempty"`
+	KairosAgent    Component `yaml:"kairos_agent,omitempty"`
+	ProviderKairos Component `yaml:"provider_kairos,omitempty"`
+}
+
+// Component overrides the pinned release of a component, setting any of its fields installs it even if
+// Components.Install is not set
+type Component struct {
+	// Version is the release tag to download instead of the pinned one
+	Version string `yaml:"version,omitempty"`
+	// Source is a local path or http(s) url to a binary or release tarball, for development builds
+	Source string `yaml:"source,omitempty"`
+	// Checksum is the sha256 of the Source, required when Source is an url
+	Checksum string `yaml:"checksum,omitempty"`
+}
+
+// Set returns true if the component has any override
+func (c Component) Set() bool {
+	return c.Version != "" || c.Source != ""
+}
+
+// Manifest are the options for the build manifest, which is always stored in the image
+type Manifest struct {
+	// Output is an extra dir to write the manifest to, to keep it as a build artifact
+	Output string `yaml:"output,omitempty"`
 }
 
 var DefaultConfig = Config{}
 
+// LoadFromFile loads the given yaml file on top of the current config values
+func (c *Config) LoadFromFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read config file %s: %w", path, err)
+	}
+	err = yaml.Unmarshal(data, c)
+	if err != nil {
+		return fmt.Errorf("could not parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
 type Variant string
 
 func (v Variant) Equal(s string) bool {
@@ -44,6 +323,9 @@ func (v *Variant) FromString(variant string) error {
 	}
 }
 
+// RecoveryProfile only installs what the recovery system needs to boot and reset the node, for recovery only images
+const RecoveryProfile = "recovery"
+
 const CoreVariant Variant = "core"
 const StandardVariant Variant = "standard"
 
@@ -54,7 +336,7 @@ type KubernetesProvider string
 func (v *KubernetesProvider) FromString(provider string) error {
 	*v = KubernetesProvider(provider)
 	switch *v {
-	case K3sProvider, K0sProvider:
+	case K3sProvider, K0sProvider, RKE2Provider:
 		return nil
 	default:
 		return fmt.Errorf("invalid Kubernetes provider: %s, possible values are %s", provider, ValidProviders)
@@ -63,5 +345,6 @@ func (v *KubernetesProvider) FromString(provider string) error {
 
 const K3sProvider KubernetesProvider = "k3s"
 const K0sProvider KubernetesProvider = "k0s"
+const RKE2Provider KubernetesProvider = "rke2"
 
-var ValidProviders = []KubernetesProvider{K3sProvider, K0sProvider}
+var ValidProviders = []KubernetesProvider{K3sProvider, K0sProvider, RKE2Provider}
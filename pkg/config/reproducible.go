@@ -0,0 +1,54 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// SourceDateEpochEnv is the env var used by build tools to get a fixed timestamp for reproducible builds
+const SourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// SetSourceDateEpoch makes sure SOURCE_DATE_EPOCH is set for reproducible builds, so the tools run by the stages
+// (dracut, package managers...) also use it. If not set, the mtime of the os-release file of the base image is used
+// so two builds on the same base get the same timestamp
+func SetSourceDateEpoch() error {
+	if value := os.Getenv(SourceDateEpochEnv); value != "" {
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("invalid %s value %s: %w", SourceDateEpochEnv, value, err)
+		}
+		return nil
+	}
+	var epoch int64
+	if info, err := os.Stat("/etc/os-release"); err == nil {
+		epoch = info.ModTime().Unix()
+	}
+	return os.Setenv(SourceDateEpochEnv, strconv.FormatInt(epoch, 10))
+}
+
+// BuildTime returns the timestamp to use on generated files, which is fixed to SOURCE_DATE_EPOCH on reproducible builds
+func (c Config) BuildTime() time.Time {
+	if !c.Reproducible {
+		return time.Now().UTC()
+	}
+	epoch, _ := strconv.ParseInt(os.Getenv(SourceDateEpochEnv), 10, 64)
+	return time.Unix(epoch, 0).UTC()
+}
+
+// WriteFile writes a generated file. On reproducible builds the timestamps of the file and its dir are set to the build
+// time, as files written after the cleanup stage are not normalized by it
+func (c Config) WriteFile(path string, data []byte, perm os.FileMode) error {
+	if err := os.WriteFile(path, data, perm); err != nil {
+		return err
+	}
+	if !c.Reproducible {
+		return nil
+	}
+	t := c.BuildTime()
+	if err := os.Chtimes(path, t, t); err != nil {
+		return err
+	}
+	return os.Chtimes(filepath.Dir(path), t, t)
+}
@@ -0,0 +1,110 @@
+package generate
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// DockerfileOptions are the options to generate a Containerfile that kairosifies a base image
+type DockerfileOptions struct {
+	Base              string
+	InitImage         string
+	Version           string
+	Variant           string
+	Model             string
+	TrustedBoot       bool
+	Provider          string
+	KubernetesVersion string
+	// ConfigFile is a kairos-init config file in the build context, copied into the image for the run
+	ConfigFile string
+}
+
+// cacheMounts are the package manager cache dirs to mount for each package manager, so rebuilds dont download everything again
+// kairos-init finds them mounted and keeps them out of the cleanup, and keeps the downloaded packages in the apt one
+var cacheMounts = map[string][]string{
+	"apt":    {"/var/cache/apt", "/var/lib/apt/lists"},
+	"dnf":    {"/var/cache/dnf", "/var/cache/yum"},
+	"zypper": {"/var/cache/zypp"},
+	"apk":    {"/var/cache/apk"},
+}
+
+// packageManagerForBase guesses the package manager from the base image name, as we cant detect the system from outside it
+func packageManagerForBase(base string) string {
+	name := strings.ToLower(base)
+	switch {
+	case strings.Contains(name, "ubuntu"), strings.Contains(name, "debian"):
+		return "apt"
+	case strings.Contains(name, "fedora"), strings.Contains(name, "rocky"), strings.Contains(name, "alma"),
+		strings.Contains(name, "ubi"), strings.Contains(name, "rhel"), strings.Contains(name, "centos"):
+		return "dnf"
+	case strings.Contains(name, "opensuse"), strings.Contains(name, "sles"), strings.Contains(name, "bci"):
+		return "zypper"
+	case strings.Contains(name, "alpine"):
+		return "apk"
+	}
+	return ""
+}
+
+const dockerfileTemplate = `# Generated by kairos-init generate dockerfile
+FROM {{.InitImage}} AS kairos-init
+
+FROM {{.Base}} AS base-kairos
+ARG VERSION={{.Version}}
+COPY --from=kairos-init /kairos-init /kairos-init
+{{- if .ConfigFile}}
+COPY {{.ConfigFile}} /kairos-init.yaml
+{{- end}}
+# Install stage, cached on its own layer as its usually the longest one
+RUN {{range .Mounts}}--mount=type=cache,target={{.}},sharing=locked {{end}}/kairos-init -l debug -s install --version "${VERSION}"{{.Args}}
+# Init stage
+RUN /kairos-init -l debug -s init --version "${VERSION}"{{.Args}}
+# Check the image is a valid Kairos image
+RUN /kairos-init -l debug --validate --version "${VERSION}"{{.Args}}
+RUN rm /kairos-init{{if .ConfigFile}} /kairos-init.yaml{{end}}
+`
+
+// Dockerfile returns a Containerfile that runs kairos-init over the base image with the given options
+func Dockerfile(opts DockerfileOptions) (string, error) {
+	if opts.Base == "" {
+		return "", fmt.Errorf("a base image is required")
+	}
+	if opts.Version == "" {
+		return "", fmt.Errorf("a version is required")
+	}
+
+	var args strings.Builder
+	for _, arg := range []struct{ flag, value string }{
+		{"-v", opts.Variant},
+		{"-m", opts.Model},
+		{"-k", opts.Provider},
+		{"--k8sversion", opts.KubernetesVersion},
+	} {
+		if arg.value != "" {
+			args.WriteString(fmt.Sprintf(" %s %s", arg.flag, arg.value))
+		}
+	}
+	if opts.TrustedBoot {
+		args.WriteString(" -t true")
+	}
+	if opts.ConfigFile != "" {
+		args.WriteString(" -c /kairos-init.yaml")
+	}
+
+	pm := packageManagerForBase(opts.Base)
+	tmpl, err := template.New("dockerfile").Parse(dockerfileTemplate)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, struct {
+		DockerfileOptions
+		Args   string
+		Mounts []string
+	}{opts, args.String(), cacheMounts[pm]})
+	if err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
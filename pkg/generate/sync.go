@@ -0,0 +1,186 @@
+package generate
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/api"
+	"github.com/kairos-io/kairos-init/pkg/values"
+)
+
+// SyncOptions are the options to compare the embedded package maps against an upstream package list
+type SyncOptions struct {
+	System  api.System
+	Options api.Options
+	// Map is the package map the missing packages are proposed for, see values.OverlayMaps
+	Map string
+}
+
+// SyncReport is the difference between the packages that kairos-init installs and the upstream ones
+type SyncReport struct {
+	// Missing are the upstream packages that the package maps dont install
+	Missing []string `json:"missing"`
+	// Extra are the packages that the package maps install and upstream doesnt, with where they come from, to review
+	Extra []api.Package `json:"extra"`
+	// Overlay is the proposed package overlay with the missing packages, to review and merge into the maps
+	Overlay values.PackageOverlay `json:"overlay"`
+}
+
+// installCommand matches the package install commands of the supported package managers, the packages are the
+// arguments after it
+var installCommand = regexp.MustCompile(`(?:apt-get|apt|dnf|yum|microdnf)\s+(?:-\S+\s+)*install\s|zypper\s+(?:-\S+\s+)*(?:in|install)\s|apk\s+(?:-\S+\s+)*add\s|pacman\s+(?:-\S+\s+)*-S\S*\s`)
+
+// commandSeparator splits the shell commands of a RUN instruction
+var commandSeparator = regexp.MustCompile(`&&|\|\||;|\|`)
+
+// ParseDockerfilePackages returns the packages installed by the RUN instructions of a Dockerfile, like the ones of the
+// official Kairos flavors. Arguments with variables are skipped as they cant be resolved outside the build
+func ParseDockerfilePackages(dockerfile string) []string {
+	var pkgs []string
+	// Join the continued lines, so each instruction is on a single line
+	dockerfile = strings.ReplaceAll(dockerfile, "\\\r\n", " ")
+	dockerfile = strings.ReplaceAll(dockerfile, "\\\n", " ")
+	for _, line := range strings.Split(dockerfile, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(strings.ToUpper(line), "RUN ") {
+			continue
+		}
+		for _, cmd := range commandSeparator.Split(line[4:], -1) {
+			loc := installCommand.FindStringIndex(cmd + " ")
+			if loc == nil {
+				continue
+			}
+			for _, arg := range strings.Fields(cmd[min(loc[1], len(cmd)):]) {
+				arg = strings.Trim(arg, `"'`)
+				if arg == "" || strings.HasPrefix(arg, "-") || strings.ContainsAny(arg, "$`{}()") {
+					continue
+				}
+				pkgs = append(pkgs, arg)
+			}
+		}
+	}
+	return pkgs
+}
+
+// UpstreamPackages reads the upstream packages from a Dockerfile, a kairos-init build manifest of a released image or
+// a plain list with a package per line
+func UpstreamPackages(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// A build manifest, the packages that the stages asked for are the upstream ones
+	var m struct {
+		Resolved []struct {
+			Name string `json:"name"`
+		} `json:"resolved"`
+	}
+	if json.Unmarshal(data, &m) == nil {
+		var pkgs []string
+		for _, pkg := range m.Resolved {
+			pkgs = append(pkgs, pkg.Name)
+		}
+		return pkgs, nil
+	}
+	if pkgs := ParseDockerfilePackages(string(data)); len(pkgs) > 0 {
+		return pkgs, nil
+	}
+	var pkgs []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			pkgs = append(pkgs, line)
+		}
+	}
+	if len(pkgs) == 0 {
+		return nil, fmt.Errorf("no packages found in %s", path)
+	}
+	return pkgs, nil
+}
+
+// Sync compares the packages that kairos-init installs on the system against the upstream ones, and proposes an
+// overlay with the missing ones scoped to the distro and version, so the maps dont silently drift from what the
+// released images use. Pinned versions are ignored on both sides
+func Sync(opts SyncOptions, upstream []string) (SyncReport, error) {
+	if _, ok := values.OverlayMaps[opts.Map]; !ok {
+		return SyncReport{}, fmt.Errorf("unknown map %q", opts.Map)
+	}
+	resolved, err := api.ResolvePackages(opts.System, opts.Options)
+	if err != nil {
+		return SyncReport{}, err
+	}
+
+	ours := map[string]bool{}
+	for _, pkg := range resolved {
+		ours[packageName(pkg.Name)] = true
+	}
+	theirs := map[string]bool{}
+	for _, pkg := range upstream {
+		theirs[packageName(pkg)] = true
+	}
+
+	report := SyncReport{Missing: []string{}, Extra: []api.Package{}}
+	for name := range theirs {
+		if !ours[name] {
+			report.Missing = append(report.Missing, name)
+		}
+	}
+	sort.Strings(report.Missing)
+	for _, pkg := range resolved {
+		if !theirs[packageName(pkg.Name)] {
+			report.Extra = append(report.Extra, pkg)
+		}
+	}
+
+	if len(report.Missing) > 0 {
+		version := opts.System.Version
+		if version == "" {
+			version = opts.System.Codename
+		}
+		report.Overlay.Packages = []values.OverlayEntry{{
+			Map:      opts.Map,
+			Distro:   opts.System.Distro,
+			Version:  version,
+			Packages: slices.Clone(report.Missing),
+		}}
+	}
+	return report, nil
+}
+
+// packageName returns the name of a package entry without the pinned version, both the one of the package maps and
+// the apt one are the same
+func packageName(pkg string) string {
+	name, _ := values.SplitPackageVersion(pkg)
+	return name
+}
+
+// String returns the report in a human readable format
+func (r SyncReport) String() string {
+	var out strings.Builder
+	if len(r.Missing) == 0 && len(r.Extra) == 0 {
+		return "The package maps are in sync with upstream\n"
+	}
+	if len(r.Missing) > 0 {
+		out.WriteString("Missing from the package maps:\n")
+		for _, pkg := range r.Missing {
+			out.WriteString(fmt.Sprintf("  + %s\n", pkg))
+		}
+	}
+	if len(r.Extra) > 0 {
+		out.WriteString("Not installed upstream:\n")
+		for _, pkg := range r.Extra {
+			where := []string{pkg.Map}
+			if pkg.Key != "" {
+				where = append(where, fmt.Sprintf("%s/%s", pkg.Key, pkg.Arch))
+			}
+			where = append(where, pkg.Constraint)
+			out.WriteString(fmt.Sprintf("  - %s (%s)\n", pkg.Name, strings.Join(where, " ")))
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,221 @@
+// Package golden snapshots the packages that kairos-init installs for every supported distro, version and arch, so
+// edits to the package maps show which systems they change in the PR diff instead of at image build time
+package golden
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+)
+
+var update = flag.Bool("update", false, "rewrite the snapshots with the current package maps")
+
+// dir is where the snapshots are kept, relative to this package
+const dir = "../../testdata/packages"
+
+// header is the first line of each snapshot, so they are not edited by hand
+const header = "# Generated with go test ./pkg/golden -update, do not edit"
+
+// combination is a system of the matrix
+type combination struct {
+	Distro  values.Distro
+	Version string
+	Arch    values.Architecture
+}
+
+// file is the name of the snapshot of the combination
+func (c combination) file() string {
+	if c.Version == "" {
+		return fmt.Sprintf("%s-%s.txt", c.Distro, c.Arch)
+	}
+	return fmt.Sprintf("%s-%s-%s.txt", c.Distro, c.Version, c.Arch)
+}
+
+// versions are the supported versions of each distro, covering the boundaries of the constraints in the package maps.
+// Rolling distros have a single entry, with a VERSION_ID like the one on their os-release
+var versions = map[values.Distro][]string{
+	values.Ubuntu:             {"20.04", "22.04", "24.04", "24.10", "25.04", "25.10"},
+	values.Debian:             {"11", "12", "13"},
+	values.Fedora:             {"40", "41", "42"},
+	values.RockyLinux:         {"8", "9"},
+	values.AlmaLinux:          {"8", "9"},
+	values.RedHat:             {"8", "9"},
+	values.Alpine:             {"3.19", "3.20", "3.21", "3.22"},
+	values.OpenSUSELeap:       {"15.5", "15.6"},
+	values.OpenSUSETumbleweed: {"20250101"},
+	values.SLES:               {"15.5", "15.6"},
+	// Arch has no VERSION_ID
+	values.Arch: {""},
+}
+
+// matrix returns all the supported combinations, sorted by distro, version and arch
+func matrix() []combination {
+	distros := make([]values.Distro, 0, len(versions))
+	for distro := range versions {
+		distros = append(distros, distro)
+	}
+	slices.Sort(distros)
+	var combinations []combination
+	for _, distro := range distros {
+		for _, version := range versions[distro] {
+			for _, arch := range []values.Architecture{values.ArchAMD64, values.ArchARM64} {
+				combinations = append(combinations, combination{Distro: distro, Version: version, Arch: arch})
+			}
+		}
+	}
+	return combinations
+}
+
+// snapshots returns the snapshot of the packages of each combination in the same order, with a section for the
+// default build and one for trusted boot. The packages are rendered like the install stage does, and a combination
+// that fails to resolve has the error in its section, so that is reviewed too
+func snapshots(combinations []combination) []string {
+	l := types.NewNullLogger()
+	results := map[bool][]values.MatrixResult{}
+	configs := map[bool]config.Config{}
+	for _, trustedBoot := range []bool{false, true} {
+		systems := make([]values.System, 0, len(combinations))
+		for _, c := range combinations {
+			systems = append(systems, values.System{
+				Name:        c.Distro.String(),
+				Distro:      c.Distro,
+				Family:      values.DistroFamilies[c.Distro],
+				Version:     c.Version,
+				Arch:        c.Arch,
+				Variant:     config.CoreVariant,
+				Model:       values.Generic,
+				TrustedBoot: trustedBoot,
+			})
+		}
+		configs[trustedBoot] = config.Config{Model: values.Generic.String(), Variant: config.CoreVariant, TrustedBoot: trustedBoot}
+		results[trustedBoot] = values.ResolveMatrix(systems, configs[trustedBoot], l)
+	}
+
+	snapshots := make([]string, 0, len(combinations))
+	for i, c := range combinations {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s\n# %s %s %s\n", header, c.Distro, c.Version, c.Arch)
+		for _, trustedBoot := range []bool{false, true} {
+			section := "default"
+			if trustedBoot {
+				section = "trusted boot"
+			}
+			fmt.Fprintf(&b, "\n[%s]\n", section)
+			result := results[trustedBoot][i]
+			pkgs, err := result.Packages, result.Err
+			if err == nil {
+				pkgs, err = values.PackageListToTemplate(pkgs, result.System.TemplateParams(configs[trustedBoot]), l)
+			}
+			if err != nil {
+				fmt.Fprintf(&b, "error: %s\n", err)
+				continue
+			}
+			for _, pkg := range pkgs {
+				fmt.Fprintf(&b, "%s\n", pkg)
+			}
+		}
+		snapshots = append(snapshots, b.String())
+	}
+	return snapshots
+}
+
+// TestPackageSnapshots compares the packages of every combination with the reviewed snapshots. After editing the
+// package maps, run it with -update and commit the snapshots with the change
+func TestPackageSnapshots(t *testing.T) {
+	combinations := matrix()
+	got := snapshots(combinations)
+	existing, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *update {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for i, c := range combinations {
+			path := filepath.Join(dir, c.file())
+			if err = os.WriteFile(path, []byte(got[i]), 0644); err != nil {
+				t.Fatal(err)
+			}
+			existing = slices.DeleteFunc(existing, func(s string) bool { return s == path })
+		}
+		// Whatever is left is of combinations no longer in the matrix
+		for _, path := range existing {
+			if err = os.Remove(path); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return
+	}
+
+	files := map[string]bool{}
+	for i, c := range combinations {
+		files[c.file()] = true
+		want, err := os.ReadFile(filepath.Join(dir, c.file()))
+		if os.IsNotExist(err) {
+			t.Errorf("%s: missing snapshot, run go test ./pkg/golden -update to write it", c.file())
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got[i] != string(want) {
+			t.Errorf("%s: the packages changed, review them and run go test ./pkg/golden -update to accept them:\n%s",
+				c.file(), diff(string(want), got[i]))
+		}
+	}
+	for _, path := range existing {
+		if !files[filepath.Base(path)] {
+			t.Errorf("%s: snapshot of a combination no longer in the matrix, run go test ./pkg/golden -update to remove it",
+				filepath.Base(path))
+		}
+	}
+}
+
+// diff returns the lines removed and added on each section, the packages are sorted so the order never changes
+func diff(want, got string) string {
+	wantSections, gotSections := sections(want), sections(got)
+	var lines []string
+	for _, name := range []string{"default", "trusted boot"} {
+		for _, line := range wantSections[name] {
+			if !slices.Contains(gotSections[name], line) {
+				lines = append(lines, fmt.Sprintf("  [%s] - %s", name, line))
+			}
+		}
+		for _, line := range gotSections[name] {
+			if !slices.Contains(wantSections[name], line) {
+				lines = append(lines, fmt.Sprintf("  [%s] + %s", name, line))
+			}
+		}
+	}
+	if len(lines) == 0 {
+		// Only the header or the layout changed
+		return "  the snapshot format changed"
+	}
+	return strings.Join(lines, "\n")
+}
+
+// sections returns the lines of each section of a snapshot
+func sections(snapshot string) map[string][]string {
+	result := map[string][]string{}
+	section := ""
+	for _, line := range strings.Split(snapshot, "\n") {
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.Trim(line, "[]")
+		default:
+			result[section] = append(result[section], line)
+		}
+	}
+	return result
+}
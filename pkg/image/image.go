@@ -0,0 +1,325 @@
+// Package image builds Kairos images straight from a base image reference: the base is pulled and unpacked, kairos-init
+// runs on it as a rootfs and the result is pushed or written as a tarball, so no Dockerfile or container build is needed
+package image
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/manifest"
+	"github.com/kairos-io/kairos-init/pkg/release"
+	"github.com/kairos-io/kairos-init/pkg/rootfs"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+)
+
+// Options are the options to build an image from a base image
+type Options struct {
+	// Base is the base image to kairosify, like ubuntu:24.04
+	Base string
+	// Tag is the reference of the resulting image
+	Tag string
+	// Output writes the image as a tarball to this file instead of pushing it
+	Output string
+	// Arch of the base image to pull. kairos-init runs natively on the base, so other arches need binfmt emulation
+	Arch string
+	// Rootfs are the options to run kairos-init on the unpacked base, the path is set by Build
+	Rootfs rootfs.Options
+}
+
+// Build pulls the base image, runs kairos-init on it and pushes the result, or writes it to the output file
+// The result is a single layer image with the config of the base, plus the Kairos OCI labels
+func Build(ctx context.Context, opts Options, l types.KairosLogger) error {
+	if opts.Base == "" || opts.Tag == "" {
+		return fmt.Errorf("a base image and a tag are required")
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("building an image needs root, to unpack the base with its owners")
+	}
+	baseRef, err := name.ParseReference(opts.Base)
+	if err != nil {
+		return err
+	}
+	tag, err := name.NewTag(opts.Tag)
+	if err != nil {
+		return err
+	}
+
+	l.Logger.Info().Str("base", opts.Base).Str("arch", opts.Arch).Msg("Pulling base image")
+	base, err := remote.Image(baseRef, remote.WithContext(ctx), remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithPlatform(v1.Platform{OS: "linux", Architecture: opts.Arch}))
+	if err != nil {
+		return fmt.Errorf("could not pull %s: %w", opts.Base, err)
+	}
+	baseConfig, err := base.ConfigFile()
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "kairos-init-image-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	l.Logger.Info().Str("dir", dir).Msg("Unpacking base image")
+	flattened := mutate.Extract(base)
+	err = untar(flattened, dir)
+	flattened.Close()
+	if err != nil {
+		return fmt.Errorf("could not unpack %s: %w", opts.Base, err)
+	}
+
+	opts.Rootfs.Path = dir
+	if err = rootfs.Run(ctx, opts.Rootfs, l); err != nil {
+		return err
+	}
+
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		r, w := io.Pipe()
+		go func() { w.CloseWithError(writeTar(dir, w)) }()
+		return r, nil
+	})
+	if err != nil {
+		return err
+	}
+	img, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer: layer,
+		History: v1.History{
+			Created:   v1.Time{Time: config.DefaultConfig.BuildTime()},
+			CreatedBy: fmt.Sprintf("kairos-init %s", values.GetVersion()),
+			Comment:   fmt.Sprintf("kairosified %s", opts.Base),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return err
+	}
+	cfg = cfg.DeepCopy()
+	cfg.Architecture, cfg.OS = baseConfig.Architecture, baseConfig.OS
+	cfg.Created = v1.Time{Time: config.DefaultConfig.BuildTime()}
+	cfg.Config = baseConfig.Config
+	cfg.Config.Labels = map[string]string{}
+	for label, value := range baseConfig.Config.Labels {
+		cfg.Config.Labels[label] = value
+	}
+	for label, value := range kairosLabels(dir, l) {
+		cfg.Config.Labels[label] = value
+	}
+	if img, err = mutate.ConfigFile(img, cfg); err != nil {
+		return err
+	}
+
+	if opts.Output != "" {
+		l.Logger.Info().Str("output", opts.Output).Str("tag", opts.Tag).Msg("Writing image")
+		return tarball.WriteToFile(opts.Output, tag, img)
+	}
+	l.Logger.Info().Str("tag", opts.Tag).Msg("Pushing image")
+	return remote.Write(tag, img, remote.WithContext(ctx), remote.WithAuthFromKeychain(authn.DefaultKeychain))
+}
+
+// kairosLabels returns the Kairos OCI labels from the manifest and kairos-release of the built rootfs, see
+// manifest.Labels. The image is still built without them if they can't be read
+func kairosLabels(dir string, l types.KairosLogger) map[string]string {
+	m, err := manifest.Load(filepath.Join(dir, manifest.Path))
+	if err != nil {
+		l.Logger.Warn().Err(err).Msg("Could not read the build manifest, not adding the Kairos labels")
+		return nil
+	}
+	r, err := release.Load(filepath.Join(dir, release.Path))
+	if err != nil {
+		l.Logger.Warn().Err(err).Msg("Could not read the kairos-release, not adding the Kairos labels")
+		return nil
+	}
+	return manifest.Labels(m, r)
+}
+
+// untar unpacks the flattened image into the dir, keeping the owners, modes and times
+// Device nodes and fifos are skipped, the container runtime or the booted system provide /dev
+func untar(r io.Reader, dir string) error {
+	// The checks for symlinks out of the dir compare resolved paths
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	dirTimes := map[string]time.Time{}
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, hdr.Name)
+		if err = inside(dir, path); err != nil {
+			return err
+		}
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+			dirTimes[path] = hdr.ModTime
+		case tar.TypeReg:
+			// Never write through a symlink that was there before
+			_ = os.Remove(path)
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			_ = os.Remove(path)
+			if err = os.Symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			target := filepath.Join(dir, hdr.Linkname)
+			if err = inside(dir, target); err != nil {
+				return err
+			}
+			_ = os.Remove(path)
+			if err = os.Link(target, path); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+
+		if err = os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+		// Hardlinks share the mode and times of their target
+		if hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink {
+			continue
+		}
+		// After the chown, as it clears the setuid bits
+		if err = os.Chmod(path, hdr.FileInfo().Mode()); err != nil {
+			return err
+		}
+		if err = os.Chtimes(path, hdr.ModTime, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+	// Creating the files changed the times of their dirs
+	for path, mtime := range dirTimes {
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inside checks that the path is inside the dir once the symlinks in the image are resolved, so an image can't write
+// out of it through an absolute symlink or ..
+func inside(dir, path string) error {
+	if path != dir && !strings.HasPrefix(path, dir+string(os.PathSeparator)) {
+		return fmt.Errorf("%s is out of the image", path)
+	}
+	// Resolve the deepest parent that is already there, the rest is created as plain dirs
+	parent := filepath.Dir(path)
+	for {
+		if _, err := os.Lstat(parent); err == nil {
+			break
+		}
+		parent = filepath.Dir(parent)
+	}
+	resolved, err := filepath.EvalSymlinks(parent)
+	if err != nil {
+		return err
+	}
+	if resolved != dir && !strings.HasPrefix(resolved, dir+string(os.PathSeparator)) {
+		return fmt.Errorf("%s is out of the image through a symlink", path)
+	}
+	return nil
+}
+
+// writeTar writes the dir as a tar, with the owners and hardlinks of the files. Sockets are skipped
+func writeTar(dir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	links := map[uint64]string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		// The names are looked up on the host, the ids are the ones that matter
+		hdr.Uname, hdr.Gname = "", ""
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && stat.Nlink > 1 {
+			if first, ok := links[stat.Ino]; ok {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+			} else {
+				links[stat.Ino] = hdr.Name
+			}
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
@@ -0,0 +1,94 @@
+package manifest
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/kairos-io/kairos-init/pkg/sbom"
+)
+
+// ProvenancePredicateType is the predicate type of the attestation, to be passed to cosign attest --type
+const ProvenancePredicateType = "https://slsa.dev/provenance/v1"
+
+// Provenance is a SLSA v1 provenance predicate describing how the image was built
+type Provenance struct {
+	BuildDefinition BuildDefinition `json:"buildDefinition"`
+	RunDetails      RunDetails      `json:"runDetails"`
+}
+
+type BuildDefinition struct {
+	BuildType            string                 `json:"buildType"`
+	ExternalParameters   map[string]interface{} `json:"externalParameters"`
+	InternalParameters   map[string]interface{} `json:"internalParameters"`
+	ResolvedDependencies []ResourceDescriptor   `json:"resolvedDependencies"`
+}
+
+type ResourceDescriptor struct {
+	URI         string            `json:"uri"`
+	Name        string            `json:"name,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type RunDetails struct {
+	Builder  Builder         `json:"builder"`
+	Metadata ProvenanceDates `json:"metadata"`
+}
+
+type Builder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version"`
+}
+
+type ProvenanceDates struct {
+	FinishedOn string `json:"finishedOn"`
+}
+
+// Attestation returns the provenance predicate for the image built with the given manifest, ready for
+// cosign attest --predicate file --type slsaprovenance1. The base image is not known from inside the image, so it's
+// only added to the dependencies if given
+func Attestation(m Manifest, base string) Provenance {
+	p := Provenance{
+		BuildDefinition: BuildDefinition{
+			BuildType:            "https://github.com/kairos-io/kairos-init/build/v1",
+			ExternalParameters:   map[string]interface{}{"config": m.Config},
+			InternalParameters:   map[string]interface{}{"system": m.System},
+			ResolvedDependencies: []ResourceDescriptor{},
+		},
+		RunDetails: RunDetails{
+			Builder: Builder{
+				ID:      "https://github.com/kairos-io/kairos-init",
+				Version: map[string]string{"kairos-init": m.KairosInit},
+			},
+			Metadata: ProvenanceDates{FinishedOn: m.Created},
+		},
+	}
+	if base != "" {
+		p.BuildDefinition.ExternalParameters["base"] = base
+		p.BuildDefinition.ResolvedDependencies = append(p.BuildDefinition.ResolvedDependencies, ResourceDescriptor{
+			URI:  fmt.Sprintf("oci://%s", base),
+			Name: "base",
+		})
+	}
+
+	// Kairos components first, then the packages
+	components := make([]string, 0, len(m.Components))
+	for name := range m.Components {
+		components = append(components, name)
+	}
+	sort.Strings(components)
+	for _, name := range components {
+		p.BuildDefinition.ResolvedDependencies = append(p.BuildDefinition.ResolvedDependencies, ResourceDescriptor{
+			URI:         fmt.Sprintf("pkg:generic/%s@%s", name, m.Components[name]),
+			Name:        name,
+			Annotations: map[string]string{"kind": "component"},
+		})
+	}
+	for _, pkg := range m.Installed {
+		p.BuildDefinition.ResolvedDependencies = append(p.BuildDefinition.ResolvedDependencies, ResourceDescriptor{
+			URI:         sbom.PURL(m.System, sbom.Package{Name: pkg.Name, Version: pkg.Version, Arch: pkg.Arch}),
+			Name:        pkg.Name,
+			Annotations: map[string]string{"kind": "package"},
+		})
+	}
+	return p
+}
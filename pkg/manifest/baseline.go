@@ -0,0 +1,103 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/sbom"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+)
+
+// StateDir is where kairos-init keeps its state between runs, like the baseline and the interrupted stages
+const StateDir = "/var/lib/kairos-init"
+
+// BaselinePath is where the state of the base image before the first run is kept, so the run can be undone
+const BaselinePath = StateDir + "/baseline.json"
+
+// Baseline are the packages and files of the base image before kairos-init changed it
+type Baseline struct {
+	Packages []InstalledPackage `json:"packages"`
+	Files    []string           `json:"files"`
+}
+
+// rootfsFiles returns all the paths of the root filesystem, skipping other filesystems mounted on top like /proc or
+// build cache mounts
+func rootfsFiles() ([]string, error) {
+	var root syscall.Stat_t
+	if err := syscall.Stat("/", &root); err != nil {
+		return nil, err
+	}
+	var files []string
+	err := filepath.WalkDir("/", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Dev != root.Dev {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if path != "/" {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// RecordBaseline stores the packages and files of the base image. An existing baseline from a previous layer is kept,
+// so undo goes back to the base image and not to the previous layer
+func RecordBaseline(s values.System, l types.KairosLogger) error {
+	if _, err := os.Stat(BaselinePath); err == nil {
+		l.Logger.Debug().Str("path", BaselinePath).Msg("Using the existing baseline")
+		return nil
+	}
+	var baseline Baseline
+	pkgs, err := sbom.ListPackages(s)
+	if err != nil {
+		return fmt.Errorf("could not list the base image packages: %w", err)
+	}
+	for _, pkg := range pkgs {
+		baseline.Packages = append(baseline.Packages, InstalledPackage{Name: pkg.Name, Version: pkg.Version, Arch: pkg.Arch})
+	}
+	baseline.Files, err = rootfsFiles()
+	if err != nil {
+		return fmt.Errorf("could not list the base image files: %w", err)
+	}
+	sort.Strings(baseline.Files)
+
+	data, err := json.Marshal(baseline)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(BaselinePath), 0755); err != nil {
+		return err
+	}
+	l.Logger.Debug().Int("packages", len(baseline.Packages)).Int("files", len(baseline.Files)).Msg("Recorded the baseline")
+	return config.DefaultConfig.WriteFile(BaselinePath, data, 0644)
+}
+
+// LoadBaseline reads the stored baseline
+func LoadBaseline() (Baseline, error) {
+	var baseline Baseline
+	data, err := os.ReadFile(BaselinePath)
+	if err != nil {
+		return baseline, err
+	}
+	if err = json.Unmarshal(data, &baseline); err != nil {
+		return baseline, fmt.Errorf("could not parse the baseline %s: %w", BaselinePath, err)
+	}
+	return baseline, nil
+}
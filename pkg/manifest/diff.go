@@ -0,0 +1,105 @@
+package manifest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Diff are the differences between two manifests
+type Diff struct {
+	Added   []InstalledPackage `json:"added"`
+	Removed []InstalledPackage `json:"removed"`
+	// Changed are the packages whose version changed, usually upgrades but distro versions cant be reliably compared
+	Changed    []Change `json:"changed"`
+	Components []Change `json:"components"`
+}
+
+// Change is a package or component whose version changed between two manifests, empty if it was not there
+type Change struct {
+	Name string `json:"name"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// DiffManifests returns what changed in the installed packages and components from a to b
+func DiffManifests(a, b Manifest) Diff {
+	d := Diff{Added: []InstalledPackage{}, Removed: []InstalledPackage{}, Changed: []Change{}, Components: []Change{}}
+
+	// Same package could be there for different archs, like multiarch libs on debian
+	key := func(p InstalledPackage) string { return p.Name + ":" + p.Arch }
+	before := map[string]InstalledPackage{}
+	for _, p := range a.Installed {
+		before[key(p)] = p
+	}
+	after := map[string]InstalledPackage{}
+	for _, p := range b.Installed {
+		after[key(p)] = p
+		old, ok := before[key(p)]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, p)
+		case old.Version != p.Version:
+			d.Changed = append(d.Changed, Change{Name: p.Name, From: old.Version, To: p.Version})
+		}
+	}
+	for _, p := range a.Installed {
+		if _, ok := after[key(p)]; !ok {
+			d.Removed = append(d.Removed, p)
+		}
+	}
+
+	for name, version := range b.Components {
+		if a.Components[name] != version {
+			d.Components = append(d.Components, Change{Name: name, From: a.Components[name], To: version})
+		}
+	}
+	for name, version := range a.Components {
+		if _, ok := b.Components[name]; !ok {
+			d.Components = append(d.Components, Change{Name: name, From: version})
+		}
+	}
+	sort.Slice(d.Components, func(i, j int) bool { return d.Components[i].Name < d.Components[j].Name })
+
+	return d
+}
+
+// String returns the diff in a human readable format
+func (d Diff) String() string {
+	var b strings.Builder
+	if len(d.Added)+len(d.Removed)+len(d.Changed)+len(d.Components) == 0 {
+		return "No changes\n"
+	}
+	if len(d.Components) > 0 {
+		b.WriteString("Components:\n")
+		for _, c := range d.Components {
+			b.WriteString(fmt.Sprintf("  %s: %s -> %s\n", c.Name, orNone(c.From), orNone(c.To)))
+		}
+	}
+	if len(d.Added) > 0 {
+		b.WriteString(fmt.Sprintf("Added packages (%d):\n", len(d.Added)))
+		for _, p := range d.Added {
+			b.WriteString(fmt.Sprintf("  + %s %s\n", p.Name, p.Version))
+		}
+	}
+	if len(d.Removed) > 0 {
+		b.WriteString(fmt.Sprintf("Removed packages (%d):\n", len(d.Removed)))
+		for _, p := range d.Removed {
+			b.WriteString(fmt.Sprintf("  - %s %s\n", p.Name, p.Version))
+		}
+	}
+	if len(d.Changed) > 0 {
+		b.WriteString(fmt.Sprintf("Changed packages (%d):\n", len(d.Changed)))
+		for _, c := range d.Changed {
+			b.WriteString(fmt.Sprintf("  ~ %s %s -> %s\n", c.Name, c.From, c.To))
+		}
+	}
+	return b.String()
+}
+
+func orNone(version string) string {
+	if version == "" {
+		return "(none)"
+	}
+	return version
+}
@@ -0,0 +1,58 @@
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/kairos-io/kairos-init/pkg/release"
+)
+
+// Labels returns the recommended OCI labels for the image, from its kairos-release values and its manifest
+// The packages digest only changes when the installed packages or their versions change, so pipelines can use it to
+// know if an image rebuild actually changed anything
+func Labels(m Manifest, r release.Release) map[string]string {
+	labels := map[string]string{}
+	for label, value := range map[string]string{
+		"org.kairos.flavor":         r.Flavor,
+		"org.kairos.flavor-release": r.FlavorRelease,
+		"org.kairos.family":         r.Family,
+		"org.kairos.version":        r.Version,
+		"org.kairos.variant":        r.Variant,
+		"org.kairos.model":          r.Model,
+		"org.kairos.arch":           r.Arch,
+		"org.kairos.fips":           strconv.FormatBool(r.Fips),
+	} {
+		if value != "" {
+			labels[label] = value
+		}
+	}
+	if r.SoftwareVersion != "" {
+		labels["org.kairos.software-version"] = fmt.Sprintf("%s-%s", r.SoftwareVersionPrefix, r.SoftwareVersion)
+	}
+	if r.Version != "" {
+		labels["org.opencontainers.image.version"] = r.Version
+	}
+
+	trusted, _ := m.Config["trusted_boot"].(bool)
+	labels["org.kairos.trusted-boot"] = strconv.FormatBool(trusted)
+	labels["org.kairos.packages-digest"] = PackagesDigest(m.Installed)
+
+	return labels
+}
+
+// PackagesDigest returns the sha256 of the sorted list of installed packages and versions
+func PackagesDigest(pkgs []InstalledPackage) string {
+	lines := make([]string, 0, len(pkgs))
+	for _, p := range pkgs {
+		lines = append(lines, fmt.Sprintf("%s:%s=%s\n", p.Name, p.Arch, p.Version))
+	}
+	sort.Strings(lines)
+	h := sha256.New()
+	for _, line := range lines {
+		h.Write([]byte(line))
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
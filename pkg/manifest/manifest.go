@@ -0,0 +1,174 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/release"
+	"github.com/kairos-io/kairos-init/pkg/sbom"
+	"github.com/kairos-io/kairos-init/pkg/stages"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+	"gopkg.in/yaml.v3"
+)
+
+// Path is where the manifest is stored in the image
+const Path = "/etc/kairos/kairos-init-manifest.json"
+
+// Manifest describes how an image was built: what was asked for, what was resolved and what ended up installed
+type Manifest struct {
+	KairosInit string                 `json:"kairos_init"`
+	Created    string                 `json:"created"`
+	System     values.System          `json:"system"`
+	Config     map[string]interface{} `json:"config"`
+	// Resolved are the packages that the stages asked to install, with the stage and step they came from
+	Resolved []ResolvedPackage `json:"resolved"`
+	// Provenance are the packages selected from the package maps for the install stage, with the map, key and
+	// constraint that selected them and why they are installed
+	Provenance []values.PackageProvenance `json:"provenance,omitempty"`
+	// Installed are the packages actually installed in the image, with their versions
+	Installed  []InstalledPackage   `json:"installed"`
+	Base       []InstalledPackage   `json:"base,omitempty"`
+	Timings    []stages.StageTiming `json:"timings"`
+	Sizes      []stages.StageSize   `json:"sizes,omitempty"`
+	Components map[string]string    `json:"components"`
+}
+
+// ResolvedPackage is a package that a stage asked to install
+type ResolvedPackage struct {
+	Name  string `json:"name"`
+	Stage string `json:"stage"`
+	Step  string `json:"step"`
+}
+
+// InstalledPackage is a package installed in the image
+type InstalledPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Arch    string `json:"arch,omitempty"`
+}
+
+// componentBinaries are the kairos components to report the version of, with the args to get it
+var componentBinaries = map[string][]string{
+	"kairos-agent": {"version"},
+	"immucore":     {"version"},
+}
+
+// Generate builds the manifest for the stages that were just run and writes it into the image, and also to the output
+// dir if set in the config. When building in layers the manifest from the previous run is extended, so running install
+// and init separately ends up with the same manifest as running all of them at once
+func Generate(s values.System, runStages schema.YipConfig, l types.KairosLogger) error {
+	m := Manifest{
+		KairosInit: values.GetVersion(),
+		Created:    config.DefaultConfig.BuildTime().Format(time.RFC3339),
+		System:     s,
+		Components: map[string]string{},
+	}
+	if previous, err := Load(Path); err == nil {
+		m.Resolved = previous.Resolved
+		m.Provenance = previous.Provenance
+		m.Timings = previous.Timings
+		m.Sizes = previous.Sizes
+	}
+
+	// Go through the config as yaml so the keys match the config file ones
+	out, err := yaml.Marshal(config.DefaultConfig)
+	if err != nil {
+		return err
+	}
+	if err = yaml.Unmarshal(out, &m.Config); err != nil {
+		return err
+	}
+
+	for _, name := range []string{"before-install", "install", "after-install", "before-init", "init", "after-init", "cleanup"} {
+		for _, step := range runStages.Stages[name] {
+			for _, pkg := range step.Packages.Install {
+				m.Resolved = append(m.Resolved, ResolvedPackage{Name: pkg, Stage: name, Step: step.Name})
+			}
+		}
+	}
+	if len(runStages.Stages["install"]) > 0 {
+		provenance, err := values.GetPackageProvenance(s, config.DefaultConfig, l)
+		if err == nil {
+			m.Provenance, err = values.RenderPackageProvenance(provenance, s.TemplateParams(config.DefaultConfig), l)
+		}
+		if err != nil {
+			l.Logger.Warn().Err(err).Msg("Could not get the package provenance for the manifest")
+		}
+	}
+	// Wall times change on every run, so they are left out of reproducible builds
+	if config.DefaultConfig.Reproducible {
+		m.Timings = nil
+	} else {
+		m.Timings = append(m.Timings, stages.Timings...)
+	}
+	m.Sizes = append(m.Sizes, stages.Sizes...)
+
+	pkgs, err := sbom.ListPackages(s)
+	if err != nil {
+		l.Logger.Warn().Err(err).Msg("Could not list the installed packages for the manifest")
+	}
+	for _, pkg := range pkgs {
+		m.Installed = append(m.Installed, InstalledPackage{Name: pkg.Name, Version: pkg.Version, Arch: pkg.Arch})
+	}
+
+	if baseline, err := LoadBaseline(); err == nil {
+		m.Base = baseline.Packages
+	}
+
+	m.Components["framework"] = config.DefaultConfig.FrameworkVersion
+	if r, err := release.Load(release.Path); err == nil {
+		if r.Version != "" {
+			m.Components["kairos"] = r.Version
+		}
+		if r.SoftwareVersion != "" {
+			m.Components[string(config.DefaultConfig.KubernetesProvider)] = r.SoftwareVersion
+		}
+	}
+	for binary, args := range componentBinaries {
+		out, err := exec.Command(binary, args...).Output()
+		if err != nil {
+			continue
+		}
+		m.Components[binary], _, _ = strings.Cut(strings.TrimSpace(string(out)), "\n")
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	paths := []string{Path}
+	if config.DefaultConfig.Manifest.Output != "" {
+		paths = append(paths, filepath.Join(config.DefaultConfig.Manifest.Output, filepath.Base(Path)))
+	}
+	for _, path := range paths {
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err = config.DefaultConfig.WriteFile(path, data, 0644); err != nil {
+			return fmt.Errorf("could not write the manifest to %s: %w", path, err)
+		}
+		l.Logger.Info().Str("path", path).Msg("Manifest written")
+	}
+	return nil
+}
+
+// Load reads a manifest from the given path
+func Load(path string) (Manifest, error) {
+	var m Manifest
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	if err = json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("could not parse the manifest %s: %w", path, err)
+	}
+	return m, nil
+}
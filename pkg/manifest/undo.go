@@ -0,0 +1,115 @@
+package manifest
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/sbom"
+	"github.com/kairos-io/kairos-init/pkg/system"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/console"
+	"github.com/mudler/yip/pkg/executor"
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/twpayne/go-vfs/v5"
+)
+
+// UndoPlan is what undo removes to take the image back to the base image
+type UndoPlan struct {
+	Packages []string `json:"packages"`
+	Files    []string `json:"files"`
+	// Upgraded are the base image packages that changed version, which are kept as they are
+	Upgraded []string `json:"upgraded,omitempty"`
+}
+
+// GetUndoPlan compares the system against the base image recorded in the manifest and the baseline
+func GetUndoPlan(s values.System) (UndoPlan, error) {
+	var plan UndoPlan
+	baseline, err := LoadBaseline()
+	if err != nil {
+		return plan, fmt.Errorf("no baseline found at %s, undo needs an image built with the install or all stages: %w", BaselinePath, err)
+	}
+	base := baseline.Packages
+	if m, err := Load(Path); err == nil && len(m.Base) > 0 {
+		base = m.Base
+	}
+	baseVersions := map[string]string{}
+	for _, pkg := range base {
+		baseVersions[pkg.Name] = pkg.Version
+	}
+
+	pkgs, err := sbom.ListPackages(s)
+	if err != nil {
+		return plan, fmt.Errorf("could not list the installed packages: %w", err)
+	}
+	for _, pkg := range pkgs {
+		version, ok := baseVersions[pkg.Name]
+		switch {
+		case !ok:
+			plan.Packages = append(plan.Packages, pkg.Name)
+		case version != pkg.Version:
+			plan.Upgraded = append(plan.Upgraded, fmt.Sprintf("%s %s -> %s", pkg.Name, version, pkg.Version))
+		}
+	}
+
+	files, err := rootfsFiles()
+	if err != nil {
+		return plan, fmt.Errorf("could not list the rootfs files: %w", err)
+	}
+	baseFiles := map[string]bool{}
+	for _, f := range baseline.Files {
+		baseFiles[f] = true
+	}
+	// Dont remove ourselves while running, nor our state and lock, so the baseline is there to undo again
+	self, _ := os.Executable()
+	for _, f := range files {
+		if baseFiles[f] || f == self || f == StateDir || strings.HasPrefix(f, StateDir+"/") || f == system.LockFile {
+			continue
+		}
+		plan.Files = append(plan.Files, f)
+	}
+	// Reverse order so the contents of a dir are removed before the dir
+	sort.Sort(sort.Reverse(sort.StringSlice(plan.Files)))
+
+	return plan, nil
+}
+
+// Undo removes the packages and files added since the baseline was recorded. Files of the base image that were
+// modified are not restored, so the result is only roughly the base image
+func Undo(plan UndoPlan, l types.KairosLogger) error {
+	if len(plan.Packages) > 0 {
+		l.Logger.Info().Strs("packages", plan.Packages).Msg("Removing packages")
+		data := schema.YipConfig{Stages: map[string][]schema.Stage{
+			"undo": {
+				{
+					Name:     "Remove added packages",
+					Packages: schema.Packages{Remove: plan.Packages},
+				},
+			},
+		}}
+		undoExecutor := executor.NewExecutor(executor.WithLogger(l))
+		yipConsole := console.NewStandardConsole(console.WithLogger(l))
+		if err := undoExecutor.Run("undo", vfs.OSFS, yipConsole, data.ToString()); err != nil {
+			return fmt.Errorf("could not remove the added packages: %w", err)
+		}
+	}
+
+	// Removing the packages already took some of the files with them
+	var failed int
+	for _, f := range plan.Files {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			l.Logger.Debug().Err(err).Str("path", f).Msg("Could not remove file")
+			failed++
+		}
+	}
+	if failed > 0 {
+		l.Logger.Warn().Int("files", failed).Msg("Some added files could not be removed")
+	}
+	for _, pkg := range plan.Upgraded {
+		l.Logger.Warn().Str("package", pkg).Msg("Package was upgraded from the base image and is kept at its current version")
+	}
+	l.Logger.Info().Int("packages", len(plan.Packages)).Int("files", len(plan.Files)-failed).Msg("Undo done, modified files from the base image were not restored")
+	return nil
+}
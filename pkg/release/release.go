@@ -0,0 +1,260 @@
+package release
+
+import (
+	"fmt"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/joho/godotenv"
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+)
+
+// Path is where the kairos-release file is stored in the image
+const Path = "/etc/kairos-release"
+
+// Release are the values of the kairos-release file, which the rest of the Kairos tooling uses to identify the system
+// The env tag is the key in the file, fields with the required tag must not be empty
+type Release struct {
+	ID                    string `env:"KAIROS_ID" required:"true"`
+	IDLike                string `env:"KAIROS_ID_LIKE" required:"true"`
+	Name                  string `env:"KAIROS_NAME" required:"true"`
+	Version               string `env:"KAIROS_VERSION" required:"true"`
+	Release               string `env:"KAIROS_RELEASE" required:"true"`
+	Arch                  string `env:"KAIROS_ARCH" required:"true"`
+	TargetArch            string `env:"KAIROS_TARGETARCH" required:"true"`
+	Flavor                string `env:"KAIROS_FLAVOR" required:"true"`
+	FlavorRelease         string `env:"KAIROS_FLAVOR_RELEASE" required:"true"`
+	Family                string `env:"KAIROS_FAMILY" required:"true"`
+	Model                 string `env:"KAIROS_MODEL" required:"true"` // NEEDED or it breaks boot!
+	Variant               string `env:"KAIROS_VARIANT" required:"true"`
+	RegistryAndOrg        string `env:"KAIROS_REGISTRY_AND_ORG" required:"true"` // Needed for upgrades to search for images
+	BugReportURL          string `env:"KAIROS_BUG_REPORT_URL" required:"true"`
+	HomeURL               string `env:"KAIROS_HOME_URL" required:"true"`
+	ImageLabel            string `env:"KAIROS_IMAGE_LABEL" required:"true"` // Used by raw image creation...very bad
+	FrameworkVersion      string `env:"KAIROS_FRAMEWORK_VERSION"`           // Just for info, could be dropped
+	Fips                  bool   `env:"KAIROS_FIPS"`                        // Was the image built with FIPS support?
+	SoftwareVersion       string `env:"KAIROS_SOFTWARE_VERSION"`
+	SoftwareVersionPrefix string `env:"KAIROS_SOFTWARE_VERSION_PREFIX"`
+}
+
+// New returns the kairos-release values for the system and the config
+func New(sis values.System, c config.Config, log types.KairosLogger) Release {
+	// TODO: Expand tis as this doesn't cover all the current fields
+	// Current missing fields
+	/*
+			KAIROS_VERSION_ID="v3.2.4-36-g24ca209-v1.32.0-k3s1"
+			KAIROS_GITHUB_REPO="kairos-io/kairos"
+			KAIROS_IMAGE_REPO="quay.io/kairos/ubuntu:24.04-standard-amd64-generic-v3.2.4-36-g24ca209-k3sv1.32.0-k3s1"
+			KAIROS_ARTIFACT="kairos-ubuntu-24.04-standard-amd64-generic-v3.2.4-36-g24ca209-k3sv1.32.0+k3s1"
+			KAIROS_PRETTY_NAME="kairos-standard-ubuntu-24.04 v3.2.4-36-g24ca209-v1.32.0-k3s1"
+
+		VERSION_ID and VERSION are the same, needed ?
+		RELEASE is the short version of VERSION and VERSION_ID, the version without the k3s version needed?
+		ARTIFACT is just the IMAGE_LABEL with the OS and OS VERSION in front, useless?
+		GITHUB_REPO is the repo where the image is stored, not really needed?
+		PRETTY_NAME is the same as the ID_LIKE but different? needed?
+
+	*/
+
+	idLike := fmt.Sprintf("kairos-%s-%s-%s", c.Variant, sis.Distro.String(), sis.Version)
+	flavor := sis.Distro.String()
+	flavorRelease := sis.Version
+
+	// TODO: Check if this affects sles versions? I don't think so as they are set like registry.suse.com/bci/bci-micro:15.6
+	if strings.Contains(flavor, "opensuse") {
+		// We store the suse version under the flavorRelease for some reason
+		// So opensuse-leap:15.5 will be stored as `leap-15.5` with flavor being plain `opensuse`
+		// Its a bit iffy IMHO but this is done so all opensuse stuff goes under the same repo instead of having
+		// a repo for opensuse-leap and a repo for opensuse-tumbleweed
+		flavorSplitted := strings.Split(flavor, "-")
+		if len(flavorSplitted) == 2 {
+			flavor = flavorSplitted[0]
+			flavorRelease = fmt.Sprintf("%s-%s", flavorSplitted[1], sis.Version)
+		} else {
+			log.Debugf("Failed to split the flavor %s", flavor)
+		}
+	}
+	// "24.04-standard-amd64-generic-v3.2.4-36-g24ca209-k3sv1.32.0-k3s1"
+	// We are not doing the k3s software version here
+	imageLabel := fmt.Sprintf("%s-%s-%s-%s-%s", flavorRelease, c.Variant, sis.Arch.String(), c.Model, c.KairosVersion.String())
+
+	r := Release{
+		ID:               "kairos", // What for?
+		IDLike:           idLike,   // What for?
+		Name:             idLike,   // What for? Same as ID_LIKE
+		Version:          c.KairosVersion.String(),
+		Release:          c.KairosVersion.String(),
+		Arch:             sis.Arch.String(),
+		TargetArch:       sis.Arch.String(), // What for? Same as ARCH
+		Flavor:           flavor,
+		FlavorRelease:    flavorRelease,
+		Family:           sis.Family.String(),
+		Model:            c.Model,
+		Variant:          c.Variant.String(),
+		RegistryAndOrg:   c.Registry,
+		BugReportURL:     "https://github.com/kairos-io/kairos/issues",
+		HomeURL:          "https://github.com/kairos-io/kairos",
+		ImageLabel:       imageLabel,
+		FrameworkVersion: c.FrameworkVersion,
+		Fips:             c.Fips,
+	}
+
+	// Get SOFTWARE_VERSION from the k3s/k0s/rke2 version
+	if c.Variant == config.StandardVariant {
+		log.Logger.Debug().Msg("Getting the k8s version for the kairos-release stage")
+		r.SoftwareVersion = softwareVersion(c, log)
+		r.SoftwareVersionPrefix = string(c.KubernetesProvider)
+		log.Logger.Debug().Str("k8sVersion", r.SoftwareVersion).Msg("Got the k8s version")
+	}
+
+	return r
+}
+
+// softwareVersion returns the version of the installed kubernetes provider
+func softwareVersion(c config.Config, log types.KairosLogger) string {
+	var k8sVersion string
+	switch c.KubernetesProvider {
+	case config.K3sProvider:
+		out, err := exec.Command("k3s", "--version").CombinedOutput()
+		if err != nil {
+			log.Logger.Error().Msgf("Failed to get the k3s version: %s", err)
+		}
+		// 2 lines in this format:
+		// k3s version v1.21.4+k3s1 (3781f4b7)
+		// go version go1.16.5
+		// We need the first line
+		re := regexp.MustCompile(`k3s version v(\d+\.\d+\.\d+\+k3s\d+)`)
+		if re.MatchString(string(out)) {
+			match := re.FindStringSubmatch(string(out))
+			k8sVersion = match[1]
+		} else {
+			log.Logger.Error().Msgf("Failed to parse the k3s version: %s", string(out))
+		}
+	case config.K0sProvider:
+		out, err := exec.Command("k0s", "version").CombinedOutput()
+		if err != nil {
+			log.Logger.Error().Msgf("Failed to get the k0s version: %s", err)
+		}
+		k8sVersion = strings.TrimSpace(string(out))
+	case config.RKE2Provider:
+		out, err := exec.Command("rke2", "--version").CombinedOutput()
+		if err != nil {
+			log.Logger.Error().Msgf("Failed to get the rke2 version: %s", err)
+		}
+		// Same format as k3s:
+		// rke2 version v1.30.1+rke2r1 (e7f87c6dd56fdd0de6e9b3fd0ff9e8fb7a79b5e3)
+		// go version go1.22.2 X:boringcrypto
+		re := regexp.MustCompile(`rke2 version v(\d+\.\d+\.\d+\+rke2r\d+)`)
+		if re.MatchString(string(out)) {
+			match := re.FindStringSubmatch(string(out))
+			k8sVersion = match[1]
+		} else {
+			log.Logger.Error().Msgf("Failed to parse the rke2 version: %s", string(out))
+		}
+	}
+	return k8sVersion
+}
+
+// Env returns the kairos-release values by key, leaving out the empty optional ones
+func (r Release) Env() map[string]string {
+	env := map[string]string{}
+	v := reflect.ValueOf(r)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		var value string
+		switch field := v.Field(i); field.Kind() {
+		case reflect.Bool:
+			value = strconv.FormatBool(field.Bool())
+		default:
+			value = field.String()
+		}
+		if value == "" && t.Field(i).Tag.Get("required") != "true" {
+			continue
+		}
+		env[t.Field(i).Tag.Get("env")] = value
+	}
+	return env
+}
+
+// String returns the kairos-release file contents, keys in the same order as the struct fields
+func (r Release) String() string {
+	env := r.Env()
+	var out strings.Builder
+	t := reflect.TypeOf(r)
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("env")
+		if value, ok := env[key]; ok {
+			out.WriteString(fmt.Sprintf("%s=%q\n", key, value))
+		}
+	}
+	return out.String()
+}
+
+// FromEnv returns the Release for the given kairos-release values, unknown keys are ignored
+func FromEnv(env map[string]string) Release {
+	var r Release
+	v := reflect.ValueOf(&r).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		value, ok := env[t.Field(i).Tag.Get("env")]
+		if !ok {
+			continue
+		}
+		switch field := v.Field(i); field.Kind() {
+		case reflect.Bool:
+			b, _ := strconv.ParseBool(value)
+			field.SetBool(b)
+		default:
+			field.SetString(value)
+		}
+	}
+	return r
+}
+
+// Load reads the kairos-release file from the given path
+func Load(path string) (Release, error) {
+	env, err := godotenv.Read(path)
+	if err != nil {
+		return Release{}, fmt.Errorf("could not open kairos-release file: %w", err)
+	}
+	return FromEnv(env), nil
+}
+
+// Validate checks that all the required values are set and that the known ones have valid values
+func (r Release) Validate() error {
+	var multi *multierror.Error
+	env := r.Env()
+	t := reflect.TypeOf(r)
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("env")
+		if t.Field(i).Tag.Get("required") == "true" && env[key] == "" {
+			multi = multierror.Append(multi, fmt.Errorf("key %s not found or empty in kairos-release", key))
+		}
+	}
+
+	if r.Variant != "" && !slices.Contains(config.ValidVariants, config.Variant(r.Variant)) {
+		multi = multierror.Append(multi, fmt.Errorf("invalid KAIROS_VARIANT %s, possible values are %v", r.Variant, config.ValidVariants))
+	}
+	if r.Arch != "" && r.Arch != values.ArchAMD64.String() && r.Arch != values.ArchARM64.String() {
+		multi = multierror.Append(multi, fmt.Errorf("invalid KAIROS_ARCH %s", r.Arch))
+	}
+	if r.TargetArch != r.Arch {
+		multi = multierror.Append(multi, fmt.Errorf("KAIROS_TARGETARCH %s does not match KAIROS_ARCH %s", r.TargetArch, r.Arch))
+	}
+	if r.Variant == config.StandardVariant.String() {
+		if r.SoftwareVersion == "" {
+			multi = multierror.Append(multi, fmt.Errorf("KAIROS_SOFTWARE_VERSION is empty"))
+		}
+		if r.SoftwareVersionPrefix == "" {
+			multi = multierror.Append(multi, fmt.Errorf("KAIROS_SOFTWARE_VERSION_PREFIX is empty"))
+		}
+	}
+	return multi.ErrorOrNil()
+}
@@ -0,0 +1,148 @@
+package release
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	semver "github.com/hashicorp/go-version"
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+)
+
+// testRelease returns a valid core release
+func testRelease() Release {
+	return Release{
+		ID:               "kairos",
+		IDLike:           "kairos-core-ubuntu-24.04",
+		Name:             "kairos-core-ubuntu-24.04",
+		Version:          "v3.4.0",
+		Release:          "v3.4.0",
+		Arch:             "amd64",
+		TargetArch:       "amd64",
+		Flavor:           "ubuntu",
+		FlavorRelease:    "24.04",
+		Family:           "debian",
+		Model:            "generic",
+		Variant:          "core",
+		RegistryAndOrg:   "quay.io/kairos",
+		BugReportURL:     "https://github.com/kairos-io/kairos/issues",
+		HomeURL:          "https://github.com/kairos-io/kairos",
+		ImageLabel:       "24.04-core-amd64-generic-v3.4.0",
+		FrameworkVersion: "v2.20.0",
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, r := range map[string]Release{
+		"core": testRelease(),
+		"standard fips": func() Release {
+			r := testRelease()
+			r.Variant = "standard"
+			r.Fips = true
+			r.SoftwareVersion = "v1.32.1+k3s1"
+			r.SoftwareVersionPrefix = "k3s"
+			return r
+		}(),
+	} {
+		if got := FromEnv(r.Env()); !reflect.DeepEqual(got, r) {
+			t.Errorf("%s: env round trip got %+v, expected %+v", name, got, r)
+		}
+
+		path := filepath.Join(t.TempDir(), "kairos-release")
+		if err := os.WriteFile(path, []byte(r.String()), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, r) {
+			t.Errorf("%s: file round trip got %+v, expected %+v", name, got, r)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	out := testRelease().String()
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if lines[0] != `KAIROS_ID="kairos"` || lines[len(lines)-1] != `KAIROS_FIPS="false"` {
+		t.Errorf("keys are not in the order of the struct fields:\n%s", out)
+	}
+	// Empty optional values are left out, required ones are kept
+	if strings.Contains(out, "KAIROS_SOFTWARE_VERSION") {
+		t.Errorf("empty optional values should be left out:\n%s", out)
+	}
+	r := testRelease()
+	r.HomeURL = ""
+	if !strings.Contains(r.String(), "KAIROS_HOME_URL=\"\"\n") {
+		t.Errorf("empty required values should be kept:\n%s", r.String())
+	}
+}
+
+func TestNewFlavor(t *testing.T) {
+	version, _ := semver.NewVersion("v3.4.0")
+	c := config.Config{Variant: config.CoreVariant, Model: "generic", Registry: "quay.io/kairos", KairosVersion: *version}
+	tests := []struct {
+		distro        values.Distro
+		version       string
+		flavor        string
+		flavorRelease string
+	}{
+		{values.OpenSUSELeap, "15.6", "opensuse", "leap-15.6"},
+		{values.OpenSUSETumbleweed, "20250101", "opensuse", "tumbleweed-20250101"},
+		{values.SLES, "15.6", "sles", "15.6"},
+		{values.Ubuntu, "24.04", "ubuntu", "24.04"},
+	}
+	for _, tt := range tests {
+		sis := values.System{Distro: tt.distro, Family: values.DistroFamilies[tt.distro], Version: tt.version, Arch: values.ArchAMD64}
+		r := New(sis, c, types.NewNullLogger())
+		if r.Flavor != tt.flavor || r.FlavorRelease != tt.flavorRelease {
+			t.Errorf("%s %s: got flavor %q and release %q, expected %q and %q", tt.distro, tt.version, r.Flavor, r.FlavorRelease, tt.flavor, tt.flavorRelease)
+		}
+		if want := tt.flavorRelease + "-core-amd64-generic-3.4.0"; r.ImageLabel != want {
+			t.Errorf("%s %s: got image label %q, expected %q", tt.distro, tt.version, r.ImageLabel, want)
+		}
+		if err := r.Validate(); err != nil {
+			t.Errorf("%s %s: %s", tt.distro, tt.version, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := testRelease().Validate(); err != nil {
+		t.Fatalf("valid release: %s", err)
+	}
+
+	// Every required field fails on its own when empty
+	typ := reflect.TypeOf(Release{})
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Tag.Get("required") != "true" {
+			continue
+		}
+		r := testRelease()
+		reflect.ValueOf(&r).Elem().Field(i).SetString("")
+		err := r.Validate()
+		if err == nil || !strings.Contains(err.Error(), field.Tag.Get("env")) {
+			t.Errorf("empty %s: expected an error naming it, got %v", field.Tag.Get("env"), err)
+		}
+	}
+
+	for name, edit := range map[string]func(*Release){
+		"unknown variant":             func(r *Release) { r.Variant = "minimal" },
+		"unknown arch":                func(r *Release) { r.Arch, r.TargetArch = "riscv64", "riscv64" },
+		"target arch mismatch":        func(r *Release) { r.TargetArch = "arm64" },
+		"standard without k8s":        func(r *Release) { r.Variant = "standard" },
+		"standard without k8s prefix": func(r *Release) { r.Variant, r.SoftwareVersion = "standard", "v1.32.1+k3s1" },
+	} {
+		r := testRelease()
+		edit(&r)
+		if err := r.Validate(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+// Package rootfs runs kairos-init against a rootfs directory instead of the running system, so an extracted image can
+// be initialized from the host without a container build. The kairos-init binary is copied into the rootfs and run
+// there with chroot or bwrap, so the package managers, the system detection and the stages all see the rootfs as /
+package rootfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/kairos-io/kairos-init/pkg/system"
+	"github.com/kairos-io/kairos-sdk/types"
+)
+
+// The runners that can be used to run kairos-init in the rootfs
+const (
+	ChrootRunner = "chroot"
+	BwrapRunner  = "bwrap"
+)
+
+// workDir is where the binary and the files passed as flags are copied to in the rootfs, removed afterwards
+const workDir = "/tmp/kairos-init-rootfs"
+
+// ownFlags are the flags that select the rootfs and how to run on it, they are dropped from the flags run in the rootfs
+var ownFlags = []string{"rootfs", "rootfs-runner", "rootfs-snapshots", "dry-run-stage"}
+
+// boolFlags are the own flags that take no value
+var boolFlags = []string{"rootfs-snapshots"}
+
+// stageFlag is the flag that selects the stages to run, replaced by each stage when they run on their own snapshot
+const stageFlag = "s"
+
+// fileFlags are the flags that take host files, which are copied into the rootfs. The package overlay one is a comma
+// separated list
+var fileFlags = []string{"c", "package-overlay"}
+
+// chrootMounts are the host dirs bind mounted into the rootfs for chroot, bwrap sets up its own
+var chrootMounts = []string{"/dev", "/proc", "/sys"}
+
+// Options are the options to run kairos-init in a rootfs
+type Options struct {
+	// Path is the rootfs directory
+	Path string
+	// Runner is chroot or bwrap, defaults to bwrap if available and chroot otherwise
+	Runner string
+	// Flags are the kairos-init flags to run in the rootfs, the rootfs flags are dropped from them
+	Flags []string
+	// Command is the subcommand and its args, passed as they are
+	Command []string
+	// Stage is the -s stage the flags select, to split it into the stages run on their own snapshot
+	Stage string
+	// Snapshots runs each stage on an overlay of the rootfs that is only applied once the stage succeeds, see
+	// runSnapshots
+	Snapshots bool
+	// DryRunStage runs the stage on an overlay that is thrown away and prints the files it would change
+	DryRunStage string
+}
+
+// Run runs kairos-init with the given flags and subcommand in the rootfs and returns its error, an *exec.ExitError if it failed
+// Cancelling the context stops the run in the rootfs, which stops its package managers in turn
+func Run(ctx context.Context, opts Options, l types.KairosLogger) error {
+	root, err := filepath.Abs(opts.Path)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(filepath.Join(root, "etc/os-release")); err != nil {
+		if _, err = os.Stat(filepath.Join(root, "usr/lib/os-release")); err != nil {
+			return fmt.Errorf("%s does not look like a rootfs, it has no os-release", root)
+		}
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("running on a rootfs needs root, to install the packages as root in it")
+	}
+	runner := opts.Runner
+	if runner == "" {
+		runner = ChrootRunner
+		if _, err = exec.LookPath(BwrapRunner); err == nil {
+			runner = BwrapRunner
+		}
+	}
+	if runner != ChrootRunner && runner != BwrapRunner {
+		return fmt.Errorf("invalid rootfs runner: %s, possible values are %s and %s", runner, ChrootRunner, BwrapRunner)
+	}
+	if _, err = exec.LookPath(runner); err != nil {
+		return fmt.Errorf("%s is needed to run on a rootfs: %w", runner, err)
+	}
+
+	// The runs in the rootfs share the work dir, and would interleave their package manager operations
+	unlock, err := system.Lock(root)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	switch {
+	case opts.DryRunStage != "":
+		if len(opts.Command) > 0 {
+			return fmt.Errorf("a stage dry run cant be combined with a subcommand")
+		}
+		return dryRunStage(ctx, root, runner, opts, l)
+	case opts.Snapshots:
+		if len(opts.Command) > 0 {
+			return fmt.Errorf("snapshots cant be combined with a subcommand, they are only taken between stages")
+		}
+		return runSnapshots(ctx, root, runner, opts, l)
+	}
+	return runIn(ctx, root, runner, opts.Flags, opts.Command, "", os.Stdout, l)
+}
+
+// runIn runs kairos-init in the rootfs with the flags and command, with its output to stdout and stderr. If stage is
+// set, it replaces the -s flag
+func runIn(ctx context.Context, root, runner string, flags, command []string, stage string, stdout io.Writer, l types.KairosLogger) error {
+	work := filepath.Join(root, workDir)
+	if err := os.MkdirAll(work, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(work)
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err = copyFile(self, filepath.Join(work, "kairos-init"), 0755); err != nil {
+		return fmt.Errorf("could not copy kairos-init into the rootfs: %w", err)
+	}
+	args, err := rootfsFlags(flags, work, stage)
+	if err != nil {
+		return err
+	}
+	args = append(args, command...)
+
+	// The package managers need name resolution, use the one of the host for the run and put back the one of the image
+	restore, err := replaceResolvConf(root)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	binary := filepath.Join(workDir, "kairos-init")
+	var cmd *exec.Cmd
+	switch runner {
+	case BwrapRunner:
+		bwrapArgs := []string{"--bind", root, "/", "--dev-bind", "/dev", "/dev", "--proc", "/proc", "--bind", "/sys", "/sys", "--cap-add", "ALL", binary}
+		cmd = exec.CommandContext(ctx, BwrapRunner, append(bwrapArgs, args...)...)
+	case ChrootRunner:
+		unmount, err := mountSystemDirs(root, l)
+		if err != nil {
+			return err
+		}
+		defer unmount()
+		cmd = exec.CommandContext(ctx, ChrootRunner, append([]string{root, binary}, args...)...)
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, stdout, os.Stderr
+	cmd.Env = append(os.Environ(), system.LockHeldEnv+"=1")
+	// On cancellation the kairos-init in the rootfs gets SIGTERM to stop its package managers and exit, instead of being
+	// killed and leaving them running. The whole group gets it as bwrap doesnt pass it on
+	system.OwnProcessGroup(cmd)
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM) }
+	cmd.WaitDelay = 2 * system.StopGrace
+	l.Logger.Info().Str("rootfs", root).Str("runner", runner).Strs("args", args).Msg("Running kairos-init on the rootfs")
+	return cmd.Run()
+}
+
+// rootfsFlags returns the flags to run in the rootfs: without the rootfs flags, and with the host files passed as flags
+// copied into the work dir and replaced by their path in the rootfs. If stage is set, it replaces the -s flag
+func rootfsFlags(args []string, work, stage string) ([]string, error) {
+	var result []string
+	copied := 0
+	for i := 0; i < len(args); i++ {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		isRootfs := slices.Contains(ownFlags, name) || stage != "" && name == stageFlag
+		isFile := slices.Contains(fileFlags, name)
+		if !strings.HasPrefix(args[i], "-") || !isRootfs && !isFile {
+			result = append(result, args[i])
+			continue
+		}
+		if !hasValue && !slices.Contains(boolFlags, name) {
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("flag -%s needs a value", name)
+			}
+			i++
+			value = args[i]
+		}
+		if isRootfs {
+			continue
+		}
+		var paths []string
+		for _, path := range strings.Split(value, ",") {
+			if path == "" {
+				continue
+			}
+			dest := filepath.Join(work, fmt.Sprintf("%d-%s", copied, filepath.Base(path)))
+			if err := copyFile(path, dest, 0644); err != nil {
+				return nil, fmt.Errorf("could not copy %s into the rootfs: %w", path, err)
+			}
+			copied++
+			paths = append(paths, filepath.Join(workDir, filepath.Base(dest)))
+		}
+		result = append(result, fmt.Sprintf("-%s=%s", name, strings.Join(paths, ",")))
+	}
+	if stage != "" {
+		result = append(result, fmt.Sprintf("-%s=%s", stageFlag, stage))
+	}
+	return result, nil
+}
+
+// replaceResolvConf puts the resolv.conf of the host in the rootfs, returning a func that puts back the original one
+// It is moved aside instead of bind mounted over, as images usually have it as a symlink to a file under /run
+func replaceResolvConf(root string) (func(), error) {
+	path := filepath.Join(root, "etc/resolv.conf")
+	backup := path + ".kairos-init"
+	_, err := os.Lstat(path)
+	existed := err == nil
+	if existed {
+		if err = os.Rename(path, backup); err != nil {
+			return nil, err
+		}
+	}
+	restore := func() {
+		_ = os.Remove(path)
+		if existed {
+			_ = os.Rename(backup, path)
+		}
+	}
+	if err = copyFile("/etc/resolv.conf", path, 0644); err != nil && !errors.Is(err, os.ErrNotExist) {
+		restore()
+		return nil, err
+	}
+	return restore, nil
+}
+
+// mountSystemDirs bind mounts the host system dirs into the rootfs for chroot, returning a func that unmounts them
+func mountSystemDirs(root string, l types.KairosLogger) (func(), error) {
+	var mounted []string
+	unmount := func() {
+		for i := len(mounted) - 1; i >= 0; i-- {
+			if out, err := exec.Command("umount", "-R", "-l", mounted[i]).CombinedOutput(); err != nil {
+				l.Logger.Warn().Err(err).Str("path", mounted[i]).Str("output", string(out)).Msg("Could not unmount from the rootfs")
+			}
+		}
+	}
+	for _, dir := range chrootMounts {
+		target := filepath.Join(root, dir)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			unmount()
+			return nil, err
+		}
+		if out, err := exec.Command("mount", "--rbind", dir, target).CombinedOutput(); err != nil {
+			unmount()
+			return nil, fmt.Errorf("could not mount %s into the rootfs: %s: %w", dir, string(out), err)
+		}
+		mounted = append(mounted, target)
+		// With shared propagation, the systemd default, the recursive unmount would propagate back and unmount the
+		// host submounts like the cgroups or /dev/pts, so the bind mounts only receive events from the host like
+		// arch-chroot does
+		if out, err := exec.Command("mount", "--make-rslave", target).CombinedOutput(); err != nil {
+			unmount()
+			return nil, fmt.Errorf("could not make the %s mount of the rootfs a slave: %s: %w", dir, string(out), err)
+		}
+	}
+	return unmount, nil
+}
+
+func copyFile(src, dest string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
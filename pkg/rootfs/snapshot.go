@@ -0,0 +1,332 @@
+package rootfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/kairos-io/kairos-sdk/types"
+)
+
+// opaqueXattr marks an overlayfs upper dir that hides the contents of the lower one
+const opaqueXattr = "trusted.overlay.opaque"
+
+// doneFile lists the stages already applied to the rootfs, so a run after a failed stage starts from it
+const doneFile = "done"
+
+// Change is a file that a stage adds, changes or removes in the rootfs
+type Change struct {
+	Path string `json:"path"`
+	// Change is added, changed, removed or replaced, the last for dirs whose previous contents are all gone
+	Change string `json:"change"`
+}
+
+// layer is an overlay of the rootfs that a stage runs on, the changes end up in the upper dir
+type layer struct {
+	dir    string
+	upper  string
+	merged string
+}
+
+// snapshotDir is where the layers of the stages are kept, next to the rootfs as overlayfs does not allow the upper dir
+// inside the lower one. It has to be on the same filesystem as the rootfs to move the changes into it
+func snapshotDir(root string) string {
+	return filepath.Join(filepath.Dir(root), fmt.Sprintf(".%s.kairos-init-snapshots", filepath.Base(root)))
+}
+
+// snapshotStages returns the stages to run each on its own snapshot for the -s stage
+func snapshotStages(stage string) []string {
+	switch stage {
+	case "", "all":
+		return []string{"install", "init"}
+	}
+	return []string{stage}
+}
+
+// runSnapshots runs each stage on an overlay of the rootfs and moves its changes into the rootfs once it succeeds. If
+// a stage fails its overlay is thrown away, so the rootfs is left as the previous stage left it, and running again
+// retries it without redoing the stages already applied
+func runSnapshots(ctx context.Context, root, runner string, opts Options, l types.KairosLogger) error {
+	dir := snapshotDir(root)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	done := readDone(dir)
+	for _, stage := range snapshotStages(opts.Stage) {
+		if slices.Contains(done, stage) {
+			l.Logger.Info().Str("stage", stage).Msg("Stage already applied to the rootfs, skipping it")
+			continue
+		}
+		lay, err := mountLayer(root, filepath.Join(dir, stage))
+		if err != nil {
+			return err
+		}
+		err = runIn(ctx, lay.merged, runner, opts.Flags, nil, stage, os.Stdout, l)
+		if unmountErr := lay.unmount(); err == nil {
+			err = unmountErr
+		}
+		if err != nil {
+			_ = os.RemoveAll(lay.dir)
+			l.Logger.Error().Str("stage", stage).Msg("Stage failed, rolled it back. Run again to retry it")
+			return err
+		}
+		l.Logger.Info().Str("stage", stage).Msg("Applying the stage to the rootfs")
+		if err = applyLayer(lay.upper, root); err != nil {
+			return fmt.Errorf("could not apply the %s stage to the rootfs, it is left half applied: %w", stage, err)
+		}
+		_ = os.RemoveAll(lay.dir)
+		done = append(done, stage)
+		if err = os.WriteFile(filepath.Join(dir, doneFile), []byte(strings.Join(done, "\n")+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+// dryRunStage runs the stage on an overlay of the rootfs that is thrown away afterwards, and prints the files it
+// changed as json
+func dryRunStage(ctx context.Context, root, runner string, opts Options, l types.KairosLogger) error {
+	dir := snapshotDir(root)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	lay, err := mountLayer(root, filepath.Join(dir, "dry-run-"+opts.DryRunStage))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(lay.dir)
+		// Only remove the snapshot dir if there is nothing else in it, like the stages of a failed run
+		_ = os.Remove(dir)
+	}()
+	// The output of the run goes to stderr, so stdout only has the changes
+	err = runIn(ctx, lay.merged, runner, opts.Flags, nil, opts.DryRunStage, os.Stderr, l)
+	if unmountErr := lay.unmount(); err == nil {
+		err = unmountErr
+	}
+	if err != nil {
+		return err
+	}
+	changes, err := layerChanges(lay.upper, root)
+	if err != nil {
+		return err
+	}
+	out, _ := json.MarshalIndent(changes, "", "  ")
+	fmt.Println(string(out))
+	return nil
+}
+
+// mountLayer mounts a fresh overlay of the rootfs in the dir, dropping any previous one there
+func mountLayer(root, dir string) (layer, error) {
+	lay := layer{dir: dir, upper: filepath.Join(dir, "upper"), merged: filepath.Join(dir, "merged")}
+	work := filepath.Join(dir, "work")
+	if err := os.RemoveAll(dir); err != nil {
+		return lay, err
+	}
+	for _, d := range []string{lay.upper, work, lay.merged} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return lay, err
+		}
+	}
+	// Without redirects or metacopy every change is a full copy in the upper dir, so it can be moved into the rootfs
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s,redirect_dir=off,metacopy=off", root, lay.upper, work)
+	if out, err := exec.Command("mount", "-t", "overlay", "overlay", "-o", options, lay.merged).CombinedOutput(); err != nil {
+		return lay, fmt.Errorf("could not mount the snapshot overlay: %s: %w", string(out), err)
+	}
+	return lay, nil
+}
+
+func (lay layer) unmount() error {
+	if out, err := exec.Command("umount", lay.merged).CombinedOutput(); err != nil {
+		return fmt.Errorf("could not unmount the snapshot overlay: %s: %w", string(out), err)
+	}
+	return nil
+}
+
+func readDone(dir string) []string {
+	data, err := os.ReadFile(filepath.Join(dir, doneFile))
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(data))
+}
+
+// isWhiteout returns true for the char devices that overlayfs leaves in the upper dir for removed files
+func isWhiteout(info fs.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.Mode()&os.ModeCharDevice != 0 && stat.Rdev == 0
+}
+
+func isOpaque(path string) bool {
+	value := make([]byte, 1)
+	n, err := syscall.Getxattr(path, opaqueXattr, value)
+	return err == nil && n == 1 && value[0] == 'y'
+}
+
+// applyLayer moves the changes of an upper dir into the rootfs: whiteouts remove the file, opaque dirs replace the
+// dir and everything else replaces the file. Dirs in both are merged and get the owner, mode and times of the upper
+func applyLayer(upper, root string) error {
+	entries, err := os.ReadDir(upper)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		src, dest := filepath.Join(upper, entry.Name()), filepath.Join(root, entry.Name())
+		info, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+		if isWhiteout(info) {
+			if err = os.RemoveAll(dest); err != nil {
+				return err
+			}
+			continue
+		}
+		destInfo, err := os.Lstat(dest)
+		if err == nil && info.IsDir() && destInfo.IsDir() && !isOpaque(src) {
+			if err = applyLayer(src, dest); err != nil {
+				return err
+			}
+			if err = copyAttributes(info, dest); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = os.RemoveAll(dest); err != nil {
+			return err
+		}
+		if err = os.Rename(src, dest); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// New dirs may be marked opaque too, the mark means nothing out of the overlay
+			_ = syscall.Removexattr(dest, opaqueXattr)
+		}
+	}
+	return nil
+}
+
+func copyAttributes(info fs.FileInfo, dest string) error {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(dest, int(stat.Uid), int(stat.Gid)); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(dest, info.Mode()); err != nil {
+		return err
+	}
+	return os.Chtimes(dest, info.ModTime(), info.ModTime())
+}
+
+// layerChanges returns the files that an upper dir adds, changes or removes in the rootfs, sorted by path. Files that
+// were only copied up, like the ones moved aside and back during the run, are not changes
+func layerChanges(upper, root string) ([]Change, error) {
+	changes := []Change{}
+	err := filepath.WalkDir(upper, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upper, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		change := Change{Path: "/" + filepath.ToSlash(rel)}
+		lower := filepath.Join(root, rel)
+		lowerInfo, lowerErr := os.Lstat(lower)
+		switch {
+		case isWhiteout(info):
+			change.Change = "removed"
+		case errors.Is(lowerErr, os.ErrNotExist):
+			change.Change = "added"
+		case lowerErr != nil:
+			return lowerErr
+		case d.IsDir() && lowerInfo.IsDir():
+			if !isOpaque(path) {
+				return nil
+			}
+			change.Change = "replaced"
+		default:
+			same, err := sameFile(path, info, lower, lowerInfo)
+			if err != nil || same {
+				return err
+			}
+			change.Change = "changed"
+		}
+		changes = append(changes, change)
+		return nil
+	})
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, err
+}
+
+// sameFile returns true if both files have the same type, mode, owner and contents
+func sameFile(a string, aInfo fs.FileInfo, b string, bInfo fs.FileInfo) (bool, error) {
+	if aInfo.Mode() != bInfo.Mode() || aInfo.Size() != bInfo.Size() {
+		return false, nil
+	}
+	aStat, aOk := aInfo.Sys().(*syscall.Stat_t)
+	bStat, bOk := bInfo.Sys().(*syscall.Stat_t)
+	if aOk && bOk && (aStat.Uid != bStat.Uid || aStat.Gid != bStat.Gid) {
+		return false, nil
+	}
+	switch {
+	case aInfo.Mode()&os.ModeSymlink != 0:
+		aLink, err := os.Readlink(a)
+		if err != nil {
+			return false, err
+		}
+		bLink, err := os.Readlink(b)
+		return aLink == bLink, err
+	case aInfo.Mode().IsRegular():
+		return sameContents(a, b)
+	}
+	return true, nil
+}
+
+func sameContents(a, b string) (bool, error) {
+	aFile, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer aFile.Close()
+	bFile, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer bFile.Close()
+	aBuf, bBuf := make([]byte, 64*1024), make([]byte, 64*1024)
+	for {
+		aN, aErr := io.ReadFull(aFile, aBuf)
+		bN, bErr := io.ReadFull(bFile, bBuf)
+		if !bytes.Equal(aBuf[:aN], bBuf[:bN]) {
+			return false, nil
+		}
+		aEnd := errors.Is(aErr, io.EOF) || errors.Is(aErr, io.ErrUnexpectedEOF)
+		bEnd := errors.Is(bErr, io.EOF) || errors.Is(bErr, io.ErrUnexpectedEOF)
+		switch {
+		case aEnd && bEnd:
+			return true, nil
+		case aErr != nil && !aEnd:
+			return false, aErr
+		case bErr != nil && !bEnd:
+			return false, bErr
+		case aEnd || bEnd:
+			return false, nil
+		}
+	}
+}
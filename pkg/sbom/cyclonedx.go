@@ -0,0 +1,105 @@
+package sbom
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+)
+
+// CycloneDXPath is where the CycloneDX SBOM is stored in the image
+const CycloneDXPath = "/etc/kairos/sbom.cdx.json"
+
+type cdxDocument struct {
+	BOMFormat    string         `json:"bomFormat"`
+	SpecVersion  string         `json:"specVersion"`
+	SerialNumber string         `json:"serialNumber"`
+	Version      int            `json:"version"`
+	Metadata     cdxMetadata    `json:"metadata"`
+	Components   []cdxComponent `json:"components"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     cdxTools     `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTools struct {
+	Components []cdxComponent `json:"components"`
+}
+
+type cdxComponent struct {
+	Type       string        `json:"type"`
+	BOMRef     string        `json:"bom-ref,omitempty"`
+	Name       string        `json:"name"`
+	Version    string        `json:"version,omitempty"`
+	PURL       string        `json:"purl,omitempty"`
+	Licenses   []cdxLicense  `json:"licenses,omitempty"`
+	Properties []cdxProperty `json:"properties,omitempty"`
+}
+
+// cdxLicense is either a SPDX expression or a free form license name
+type cdxLicense struct {
+	Expression string          `json:"expression,omitempty"`
+	License    *cdxLicenseName `json:"license,omitempty"`
+}
+
+type cdxLicenseName struct {
+	Name string `json:"name"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// CycloneDX returns the CycloneDX 1.5 json document for the given packages
+func CycloneDX(s values.System, name string, pkgs []Package) ([]byte, error) {
+	serial, err := documentID(name, pkgs)
+	if err != nil {
+		return nil, err
+	}
+	// Format it as an uuid v4
+	serial[6] = (serial[6] & 0x0f) | 0x40
+	serial[8] = (serial[8] & 0x3f) | 0x80
+
+	doc := cdxDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", serial[0:4], serial[4:6], serial[6:8], serial[8:10], serial[10:]),
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: config.DefaultConfig.BuildTime().Format(time.RFC3339),
+			Tools: cdxTools{
+				Components: []cdxComponent{{Type: "application", Name: "kairos-init", Version: values.GetVersion()}},
+			},
+			Component: cdxComponent{Type: "operating-system", Name: name},
+		},
+		Components: []cdxComponent{},
+	}
+
+	for _, pkg := range pkgs {
+		purl := PURL(s, pkg)
+		c := cdxComponent{
+			Type:    "library",
+			BOMRef:  purl,
+			Name:    pkg.Name,
+			Version: pkg.Version,
+			PURL:    purl,
+		}
+		if isSPDXLicense(pkg.License) {
+			c.Licenses = []cdxLicense{{Expression: pkg.License}}
+		} else if pkg.License != "" {
+			c.Licenses = []cdxLicense{{License: &cdxLicenseName{Name: pkg.License}}}
+		}
+		if pkg.Origin != "" {
+			c.Properties = []cdxProperty{{Name: "kairos:origin-repo", Value: pkg.Origin}}
+		}
+		doc.Components = append(doc.Components, c)
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
@@ -0,0 +1,104 @@
+package sbom
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+)
+
+// LicenseReportPath is where the license report is stored in the image
+const LicenseReportPath = "/etc/kairos/licenses.json"
+
+// LicenseReport groups the installed packages by their license
+type LicenseReport struct {
+	// Licenses are the packages for each license, as reported by the package metadata
+	Licenses map[string][]string `json:"licenses"`
+	// Unknown are the packages without license metadata
+	Unknown []string `json:"unknown"`
+	// Denied are the packages with a license matching the denylist, with the matching license
+	Denied map[string]string `json:"denied,omitempty"`
+}
+
+// Licenses returns the license report for the given packages, checking them against the denylist
+func Licenses(pkgs []Package, deny []string) LicenseReport {
+	report := LicenseReport{Licenses: map[string][]string{}, Unknown: []string{}}
+	for _, pkg := range pkgs {
+		if pkg.License == "" {
+			report.Unknown = append(report.Unknown, pkg.Name)
+			continue
+		}
+		// Multiarch packages are listed once per arch, but only reported once
+		if !slices.Contains(report.Licenses[pkg.License], pkg.Name) {
+			report.Licenses[pkg.License] = append(report.Licenses[pkg.License], pkg.Name)
+		}
+		if id := deniedLicense(pkg.License, deny); id != "" {
+			if report.Denied == nil {
+				report.Denied = map[string]string{}
+			}
+			report.Denied[pkg.Name] = id
+		}
+	}
+	return report
+}
+
+// licenseIDs returns the license ids of a license expression. Expressions are not always SPDX ones, as RPM uses
+// lowercase operators and commas, so this is lenient with the separators
+func licenseIDs(license string) []string {
+	var ids []string
+	for _, term := range strings.Fields(strings.NewReplacer("(", " ", ")", " ", ",", " ", "/", " ").Replace(license)) {
+		switch strings.ToLower(term) {
+		case "and", "or", "with":
+			continue
+		}
+		ids = append(ids, term)
+	}
+	return ids
+}
+
+// deniedLicense returns the first license id of the expression matching the denylist. Denylist entries match ids by
+// prefix ignoring case, so AGPL matches AGPL-3.0-only, AGPL-3+ or AGPLv3
+func deniedLicense(license string, deny []string) string {
+	for _, id := range licenseIDs(license) {
+		for _, d := range deny {
+			if d != "" && strings.HasPrefix(strings.ToLower(id), strings.ToLower(d)) {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// GenerateLicenseReport writes the license report of the installed packages into the image, and also to the output
+// dir if set in the config. It fails if any package has a denied license
+func GenerateLicenseReport(s values.System, l types.KairosLogger) error {
+	pkgs, err := ListPackages(s)
+	if err != nil {
+		return err
+	}
+	report := Licenses(pkgs, config.DefaultConfig.Licenses.Deny)
+	l.Logger.Debug().Int("licenses", len(report.Licenses)).Int("unknown", len(report.Unknown)).Msg("Generated license report")
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = writeReport(LicenseReportPath, config.DefaultConfig.Licenses.Output, data, l); err != nil {
+		return err
+	}
+
+	if len(report.Denied) > 0 {
+		var denied []string
+		for name, id := range report.Denied {
+			denied = append(denied, fmt.Sprintf("%s (%s)", name, id))
+		}
+		sort.Strings(denied)
+		return fmt.Errorf("packages with denied licenses installed: %s", strings.Join(denied, ", "))
+	}
+	return nil
+}
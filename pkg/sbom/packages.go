@@ -0,0 +1,200 @@
+package sbom
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/values"
+)
+
+// Package is an installed package in the image
+type Package struct {
+	Name    string
+	Version string
+	Arch    string
+	License string
+	// Origin is the repo the package was installed from, if the package manager keeps track of it
+	Origin string
+}
+
+// ListPackages returns the packages installed in the system, sorted by name
+func ListPackages(s values.System) ([]Package, error) {
+	var pkgs []Package
+	var err error
+	switch s.Family {
+	case values.DebianFamily:
+		pkgs, err = listDebPackages()
+	case values.RedHatFamily, values.SUSEFamily:
+		pkgs, err = listRpmPackages()
+	case values.AlpineFamily:
+		pkgs, err = listApkPackages()
+	default:
+		return nil, fmt.Errorf("listing packages is not supported on %s", s.Distro)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Multiarch systems can have the same package for several archs
+	sort.Slice(pkgs, func(i, j int) bool {
+		if pkgs[i].Name != pkgs[j].Name {
+			return pkgs[i].Name < pkgs[j].Name
+		}
+		return pkgs[i].Arch < pkgs[j].Arch
+	})
+	return pkgs, nil
+}
+
+// queryLines runs the given command and returns the tab separated fields of each line of the output
+func queryLines(name string, args ...string) ([][]string, error) {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not list the installed packages with %s: %w", name, err)
+	}
+	var lines [][]string
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		if scanner.Text() == "" {
+			continue
+		}
+		lines = append(lines, strings.Split(scanner.Text(), "\t"))
+	}
+	return lines, nil
+}
+
+func listDebPackages() ([]Package, error) {
+	lines, err := queryLines("dpkg-query", "-W", "-f=${db:Status-Abbrev}\t${Package}\t${Version}\t${Architecture}\n")
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []Package
+	for _, fields := range lines {
+		// Skip removed packages that still have their config around
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "ii") {
+			continue
+		}
+		pkgs = append(pkgs, Package{Name: fields[1], Version: fields[2], Arch: fields[3], License: debLicense(fields[1])})
+	}
+	return pkgs, nil
+}
+
+// debLicense returns the licenses of the machine readable copyright file of the package, dpkg doesnt keep them.
+// Each Files stanza has its own license, so all of them are joined
+func debLicense(name string) string {
+	file, err := os.Open(fmt.Sprintf("/usr/share/doc/%s/copyright", name))
+	if err != nil {
+		return ""
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+	var licenses []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if license, ok := strings.CutPrefix(scanner.Text(), "License:"); ok {
+			license = strings.TrimSpace(license)
+			if !isDebLicenseName(license) {
+				continue
+			}
+			if strings.Contains(license, " ") {
+				license = fmt.Sprintf("(%s)", license)
+			}
+			if license != "" && !slices.Contains(licenses, license) {
+				licenses = append(licenses, license)
+			}
+		}
+	}
+	return strings.Join(licenses, " AND ")
+}
+
+// isDebLicenseName returns false for License fields that have the license text in place of the license short name,
+// which happens on copyright files that are not fully machine readable
+func isDebLicenseName(license string) bool {
+	words := strings.Fields(license)
+	if len(words) < 2 {
+		return len(words) == 1
+	}
+	for _, word := range words {
+		switch strings.ToLower(strings.Trim(word, "(),")) {
+		case "and", "or", "with", "exception":
+			continue
+		}
+		// License names have versions, dashes or capitals, while plain text words are all lowercase letters
+		if strings.IndexFunc(word, func(r rune) bool { return r < 'a' || r > 'z' }) == -1 {
+			return false
+		}
+	}
+	return true
+}
+
+func listRpmPackages() ([]Package, error) {
+	lines, err := queryLines("rpm", "-qa", "--qf", "%{NAME}\t%{VERSION}-%{RELEASE}\t%{ARCH}\t%{LICENSE}\n")
+	if err != nil {
+		return nil, err
+	}
+	// The repo is only known by dnf, zypper doesnt keep it
+	origins := map[string]string{}
+	if _, err := exec.LookPath("dnf"); err == nil {
+		repoLines, err := queryLines("dnf", "repoquery", "--installed", "-q", "--qf", "%{name}\t%{from_repo}\n")
+		if err == nil {
+			for _, fields := range repoLines {
+				if len(fields) == 2 {
+					origins[fields[0]] = fields[1]
+				}
+			}
+		}
+	}
+	var pkgs []Package
+	for _, fields := range lines {
+		// gpg-pubkey entries are the imported keys, not packages
+		if len(fields) < 4 || fields[0] == "gpg-pubkey" {
+			continue
+		}
+		pkgs = append(pkgs, Package{Name: fields[0], Version: fields[1], Arch: fields[2], License: fields[3], Origin: origins[fields[0]]})
+	}
+	return pkgs, nil
+}
+
+func listApkPackages() ([]Package, error) {
+	// The installed db has one block per package, with a letter prefix for each field
+	file, err := os.Open("/lib/apk/db/installed")
+	if err != nil {
+		return nil, fmt.Errorf("could not list the installed packages: %w", err)
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	var pkgs []Package
+	var pkg Package
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if pkg.Name != "" {
+				pkgs = append(pkgs, pkg)
+			}
+			pkg = Package{}
+			continue
+		}
+		key, value, _ := strings.Cut(line, ":")
+		switch key {
+		case "P":
+			pkg.Name = value
+		case "V":
+			pkg.Version = value
+		case "A":
+			pkg.Arch = value
+		case "L":
+			pkg.License = value
+		}
+	}
+	if pkg.Name != "" {
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs, scanner.Err()
+}
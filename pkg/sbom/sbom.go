@@ -0,0 +1,94 @@
+package sbom
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/release"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+)
+
+const (
+	SPDXFormat      = "spdx"
+	CycloneDXFormat = "cyclonedx"
+)
+
+// Generate writes the SBOM of the installed packages into the image, and also to the output dir if set in the config
+func Generate(s values.System, l types.KairosLogger) error {
+	pkgs, err := ListPackages(s)
+	if err != nil {
+		return err
+	}
+	l.Logger.Debug().Int("packages", len(pkgs)).Msg("Generating SBOM")
+
+	// Name the document after the image, if kairos-release is already there
+	name := "kairos"
+	if r, err := release.Load(release.Path); err == nil && r.ImageLabel != "" {
+		name = r.ImageLabel
+	}
+
+	formats := config.DefaultConfig.SBOM.Formats
+	if len(formats) == 0 {
+		formats = []string{SPDXFormat}
+	}
+	for _, format := range formats {
+		var doc []byte
+		var path string
+		switch format {
+		case SPDXFormat:
+			doc, err = SPDX(s, name, pkgs)
+			path = SPDXPath
+		case CycloneDXFormat:
+			doc, err = CycloneDX(s, name, pkgs)
+			path = CycloneDXPath
+		default:
+			return fmt.Errorf("invalid SBOM format: %s, possible values are %s or %s", format, SPDXFormat, CycloneDXFormat)
+		}
+		if err != nil {
+			return fmt.Errorf("could not generate the %s SBOM: %w", format, err)
+		}
+		if err = writeReport(path, config.DefaultConfig.SBOM.Output, doc, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeReport writes a generated report into the image, and also to the output dir if set
+func writeReport(path, output string, doc []byte, l types.KairosLogger) error {
+	paths := []string{path}
+	if output != "" {
+		paths = append(paths, filepath.Join(output, filepath.Base(path)))
+	}
+	for _, p := range paths {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := config.DefaultConfig.WriteFile(p, doc, 0644); err != nil {
+			return fmt.Errorf("could not write %s: %w", p, err)
+		}
+		l.Logger.Info().Str("path", p).Msg("Report written")
+	}
+	return nil
+}
+
+// documentID returns the 16 bytes unique id of an SBOM document. On reproducible builds its derived from the document
+// contents instead of being random, so it does not change between runs
+func documentID(name string, pkgs []Package) ([]byte, error) {
+	if !config.DefaultConfig.Reproducible {
+		id := make([]byte, 16)
+		_, err := rand.Read(id)
+		return id, err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", name)
+	for _, pkg := range pkgs {
+		fmt.Fprintf(h, "%s %s %s\n", pkg.Name, pkg.Version, pkg.Arch)
+	}
+	return h.Sum(nil)[:16], nil
+}
@@ -0,0 +1,163 @@
+package sbom
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+)
+
+// SPDXPath is where the SPDX SBOM is stored in the image
+const SPDXPath = "/etc/kairos/sbom.spdx.json"
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	LicenseComments  string            `json:"licenseComments,omitempty"`
+	CopyrightText    string            `json:"copyrightText"`
+	SourceInfo       string            `json:"sourceInfo,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// spdxLicenses are the common SPDX license ids. Fedora and Alpine already use SPDX expressions for their licenses, while
+// the Debian and older RPM ones like "GPL-2+" or "GPLv2+" are not valid so they are kept as comments instead
+var spdxLicenses = map[string]bool{
+	"0BSD": true, "AGPL-3.0-only": true, "AGPL-3.0-or-later": true, "Apache-2.0": true, "Artistic-2.0": true,
+	"BSD-2-Clause": true, "BSD-3-Clause": true, "BSL-1.0": true, "CC0-1.0": true, "curl": true, "GPL-1.0-or-later": true,
+	"GPL-2.0-only": true, "GPL-2.0-or-later": true, "GPL-3.0-only": true, "GPL-3.0-or-later": true, "ISC": true,
+	"LGPL-2.0-or-later": true, "LGPL-2.1-only": true, "LGPL-2.1-or-later": true, "LGPL-3.0-only": true,
+	"LGPL-3.0-or-later": true, "MIT": true, "MPL-2.0": true, "OpenSSL": true, "PSF-2.0": true, "Unlicense": true,
+	"X11": true, "Zlib": true, "GCC-exception-3.1": true, "Linux-syscall-note": true, "Autoconf-exception-generic": true,
+}
+
+// isSPDXLicense returns true if all the license ids of the expression are known SPDX ones
+func isSPDXLicense(license string) bool {
+	if license == "" {
+		return false
+	}
+	for _, term := range strings.Fields(strings.NewReplacer("(", " ", ")", " ").Replace(license)) {
+		if term == "AND" || term == "OR" || term == "WITH" {
+			continue
+		}
+		if !spdxLicenses[term] {
+			return false
+		}
+	}
+	return true
+}
+
+// spdxIDChars are the chars not allowed on SPDX ids
+var spdxIDChars = regexp.MustCompile(`[^A-Za-z0-9.\-]`)
+
+const noAssertion = "NOASSERTION"
+
+// SPDX returns the SPDX 2.3 json document for the given packages
+func SPDX(s values.System, name string, pkgs []Package) ([]byte, error) {
+	ns, err := documentID(name, pkgs)
+	if err != nil {
+		return nil, err
+	}
+	doc := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              name,
+		DocumentNamespace: fmt.Sprintf("https://kairos.io/spdx/%s-%s", spdxIDChars.ReplaceAllString(name, "-"), hex.EncodeToString(ns)),
+		CreationInfo: spdxCreationInfo{
+			Created:  config.DefaultConfig.BuildTime().Format(time.RFC3339),
+			Creators: []string{fmt.Sprintf("Tool: kairos-init-%s", values.GetVersion())},
+		},
+		Packages:      []spdxPackage{},
+		Relationships: []spdxRelationship{},
+	}
+
+	for i, pkg := range pkgs {
+		id := fmt.Sprintf("SPDXRef-Package-%s-%d", spdxIDChars.ReplaceAllString(pkg.Name, "-"), i)
+		p := spdxPackage{
+			Name:             pkg.Name,
+			SPDXID:           id,
+			VersionInfo:      pkg.Version,
+			DownloadLocation: noAssertion,
+			LicenseConcluded: noAssertion,
+			LicenseDeclared:  noAssertion,
+			CopyrightText:    noAssertion,
+			ExternalRefs: []spdxExternalRef{
+				{
+					ReferenceCategory: "PACKAGE-MANAGER",
+					ReferenceType:     "purl",
+					ReferenceLocator:  PURL(s, pkg),
+				},
+			},
+		}
+		if isSPDXLicense(pkg.License) {
+			p.LicenseDeclared = pkg.License
+		} else if pkg.License != "" {
+			p.LicenseComments = pkg.License
+		}
+		if pkg.Origin != "" {
+			p.SourceInfo = fmt.Sprintf("installed from the %s repo", pkg.Origin)
+		}
+		doc.Packages = append(doc.Packages, p)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID:      "SPDXRef-DOCUMENT",
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: id,
+		})
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// PURL returns the package url for the given package
+func PURL(s values.System, pkg Package) string {
+	purlType := "rpm"
+	switch s.Family {
+	case values.DebianFamily:
+		purlType = "deb"
+	case values.AlpineFamily:
+		purlType = "apk"
+	}
+	purl := fmt.Sprintf("pkg:%s/%s/%s@%s", purlType, s.Distro, pkg.Name, pkg.Version)
+	if pkg.Arch != "" {
+		purl += "?arch=" + pkg.Arch
+	}
+	return purl
+}
@@ -0,0 +1,52 @@
+package stages
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// GetAuditStage returns the stages to set up the log forwarder of the audit feature
+// The packages are installed on the install stage and the services are handled by the services stage
+func GetAuditStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	forwarder, err := values.GetLogForwarder(sis, c)
+	if err != nil || forwarder == "" {
+		return []schema.Stage{}, err
+	}
+	content, err := values.LogForwarderFile(forwarder, c.Audit.Target)
+	if err != nil {
+		return []schema.Stage{}, err
+	}
+	logger.Logger.Debug().Str("forwarder", forwarder.String()).Str("target", c.Audit.Target).Msg("Setting up log forwarding")
+
+	stages := []schema.Stage{
+		{
+			Name: fmt.Sprintf("Forward logs with %s", forwarder),
+			Files: []schema.File{
+				{
+					Path:        values.LogForwarders[forwarder].File,
+					Permissions: 0644,
+					Owner:       0,
+					Group:       0,
+					Content:     content,
+				},
+			},
+		},
+	}
+	if forwarder == values.RsyslogForwarder {
+		// auditd only writes to its own log, send the events to syslog too so they are forwarded
+		var commands []string
+		for _, plugin := range values.AuditSyslogPlugins {
+			commands = append(commands, fmt.Sprintf("if [ -f %[1]s ]; then sed -i 's/^active *= *no/active = yes/' %[1]s; fi", plugin))
+		}
+		stages = append(stages, schema.Stage{
+			Name:     "Send the audit events to syslog",
+			Commands: []string{strings.Join(commands, "; ")},
+		})
+	}
+	return stages, nil
+}
@@ -0,0 +1,79 @@
+package stages
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/release"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// GetBrandingStage returns the stages to add the Kairos metadata to os-release and to install the motd and issue files
+func GetBrandingStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	env := release.New(sis, c, logger).Env()
+
+	motdTemplate := c.Branding.Motd
+	if motdTemplate == "" {
+		motdTemplate = values.DefaultMotd
+	}
+	motd, err := renderBrandingTemplate("motd", motdTemplate, env)
+	if err != nil {
+		return []schema.Stage{}, err
+	}
+
+	issueTemplate := c.Branding.Issue
+	if issueTemplate == "" {
+		issueTemplate = values.DefaultIssue
+	}
+	issue, err := renderBrandingTemplate("issue", issueTemplate, env)
+	if err != nil {
+		return []schema.Stage{}, err
+	}
+
+	return []schema.Stage{
+		{
+			// Other Kairos tooling reads the KAIROS_ keys from os-release on older systems
+			Name:            "Add Kairos metadata to os-release",
+			Environment:     env,
+			EnvironmentFile: "/etc/os-release",
+		},
+		{
+			Name: "Install motd and issue",
+			Files: []schema.File{
+				{
+					Path:        "/etc/motd",
+					Permissions: 0644,
+					Owner:       0,
+					Group:       0,
+					Content:     motd,
+				},
+				{
+					Path:        "/etc/issue",
+					Permissions: 0644,
+					Owner:       0,
+					Group:       0,
+					Content:     issue,
+				},
+			},
+		},
+	}, nil
+}
+
+// renderBrandingTemplate renders the given template with the kairos-release values
+// Unknown keys are an error so typos in user templates are caught at build time
+func renderBrandingTemplate(name string, tmpl string, env map[string]string) (string, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the %s template: %w", name, err)
+	}
+	var result bytes.Buffer
+	err = t.Execute(&result, env)
+	if err != nil {
+		return "", fmt.Errorf("failed to render the %s template: %w", name, err)
+	}
+	return result.String(), nil
+}
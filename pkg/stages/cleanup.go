@@ -0,0 +1,169 @@
+package stages
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/system"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// GetImageCleanupStage returns the final stage that cleans up the image to make it as small as possible
+// It runs after all the other stages, including the extensions, so nothing is left behind
+func GetImageCleanupStage(sis values.System, c config.Config, logger types.KairosLogger) []schema.Stage {
+	cleanup := c.Cleanup
+	logger.Logger.Debug().Interface("cleanup", cleanup).Msg("Image cleanup options")
+
+	stages := []schema.Stage{
+		{
+			Name:     "Clean package caches",
+			Commands: packageCacheCleanupCommands(sis, logger),
+		},
+		{
+			Name: "Truncate logs",
+			If:   "test -d /var/log",
+			Commands: []string{
+				"find /var/log -type f -exec truncate -s 0 {} +",
+			},
+		},
+		{
+			Name:     "Reset iSCSI initiator name",
+			If:       fmt.Sprintf("test -f %s", values.IscsiInitiatorName),
+			Commands: []string{iscsiInitiatorNameReset(sis)},
+		},
+	}
+
+	if cleanup.Docs {
+		stages = append(stages, schema.Stage{
+			Name: "Remove docs",
+			If:   "test -d /usr/share/doc",
+			Commands: []string{
+				// Keep the copyright files, as some licenses require them to be shipped
+				"find /usr/share/doc -mindepth 1 ! -name copyright ! -type d -delete",
+				"find /usr/share/doc -mindepth 1 -type d -empty -delete",
+			},
+		})
+	}
+
+	if cleanup.Man {
+		stages = append(stages, schema.Stage{
+			Name: "Remove man pages",
+			If:   "test -d /usr/share/man",
+			Commands: []string{
+				"rm -rf /usr/share/man/*",
+				"rm -rf /usr/share/info/*",
+			},
+		})
+	}
+
+	if cleanup.Locales {
+		// Keep the configured locale if any
+		keep := []string{"! -name 'C.*'"}
+		if locale := c.Localization.Locale; locale != "" {
+			territory, _, _ := strings.Cut(locale, ".")
+			keep = append(keep, fmt.Sprintf("! -name %s", values.LocaleLanguage(locale)), fmt.Sprintf("! -name %s", territory))
+		}
+		stages = append(stages, schema.Stage{
+			Name: "Remove locales",
+			If:   "test -d /usr/share/locale",
+			Commands: []string{
+				fmt.Sprintf("find /usr/share/locale -mindepth 1 -maxdepth 1 -type d %s -exec rm -rf {} +", strings.Join(keep, " ")),
+			},
+		})
+	}
+
+	if c.Reproducible {
+		stages = append(stages, GetReproducibleStage(sis, c, logger)...)
+	}
+
+	return stages
+}
+
+// iscsiInitiatorNameReset returns the command to reset the iSCSI initiator name, see values.IscsiInitiatorName
+func iscsiInitiatorNameReset(sis values.System) string {
+	if sis.Family == values.DebianFamily {
+		return fmt.Sprintf("echo GenerateName=yes > %s", values.IscsiInitiatorName)
+	}
+	return fmt.Sprintf("rm -f %s", values.IscsiInitiatorName)
+}
+
+// packageCacheCleanupCommands returns the commands to clean the package caches. The package manager clean commands
+// empty the build cache mounts too, so if any cache dir is mounted only the ones that are not get emptied, as the
+// mounted ones are not part of the image anyway
+func packageCacheCleanupCommands(sis values.System, logger types.KairosLogger) []string {
+	dirs := values.PackageCacheDirs[sis.Family]
+	mounted := system.MountedDirs(dirs)
+	if len(mounted) == 0 {
+		return values.PackageCacheCleanupCommands[sis.Family]
+	}
+	logger.Logger.Info().Strs("dirs", mounted).Msg("Keeping the package caches in the build cache mounts")
+	var commands []string
+	for _, dir := range dirs {
+		if !slices.Contains(mounted, dir) {
+			commands = append(commands, fmt.Sprintf("rm -rf %s/*", dir))
+		}
+	}
+	return commands
+}
+
+// GetAptCacheStages returns the before-install and after-install steps that keep the downloaded packages when the apt
+// cache is a build cache mount. The apt config of the Debian and Ubuntu images removes them after each install, so
+// it is moved aside during the install and put back after it
+func GetAptCacheStages(sis values.System, _ types.KairosLogger) (before []schema.Stage, after []schema.Stage) {
+	if sis.Family != values.DebianFamily || len(system.MountedDirs([]string{"/var/cache/apt"})) == 0 {
+		return nil, nil
+	}
+	aside := values.AptDockerClean + ".kairos-init"
+	// The after-install step won't run if the build is interrupted on the install
+	OnInterrupt("restore the apt docker-clean config", func() error {
+		if _, err := os.Stat(aside); err != nil {
+			return nil
+		}
+		return os.Rename(aside, values.AptDockerClean)
+	})
+	before = []schema.Stage{{
+		Name:     "Keep the downloaded packages in the apt cache mount",
+		If:       fmt.Sprintf("test -f %s", values.AptDockerClean),
+		Commands: []string{fmt.Sprintf("mv %s %s", values.AptDockerClean, aside)},
+	}}
+	after = []schema.Stage{{
+		Name:     "Restore the apt docker-clean config",
+		If:       fmt.Sprintf("test -f %s", aside),
+		Commands: []string{fmt.Sprintf("mv %s %s", aside, values.AptDockerClean)},
+	}}
+	return before, after
+}
+
+// GetReproducibleStage returns the steps that remove the per build state from the image and clamp the timestamps of
+// the files changed during the build to SOURCE_DATE_EPOCH, so two builds on the same base produce the same layer.
+// It has to be the last thing to run so no file is touched after it
+func GetReproducibleStage(_ values.System, c config.Config, logger types.KairosLogger) []schema.Stage {
+	epoch := c.BuildTime().Unix()
+	logger.Logger.Debug().Int64("epoch", epoch).Msg("Normalizing timestamps for a reproducible build")
+	// Reference file to compare against, busybox find does not support -newermt
+	ref := "/tmp/.kairos-init-epoch"
+
+	return []schema.Stage{
+		{
+			Name: "Remove random seeds",
+			Commands: []string{
+				"rm -f /var/lib/systemd/random-seed /var/lib/random-seed /var/lib/seedrng/seed.*",
+				"rm -f /var/cache/ldconfig/aux-cache",
+			},
+		},
+		{
+			Name: "Normalize timestamps",
+			Commands: []string{
+				fmt.Sprintf("touch -h -d @%d %s", epoch, ref),
+				fmt.Sprintf("find / -xdev -newer %s -exec touch -h -r %s {} +", ref, ref),
+				fmt.Sprintf("rm -f %s", ref),
+				fmt.Sprintf("touch -h -d @%d /tmp", epoch),
+			},
+		},
+	}
+}
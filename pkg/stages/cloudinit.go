@@ -0,0 +1,47 @@
+package stages
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// GetCloudInitStage returns the stages to remove cloud-init from the system so kairos-agent handles the cloud-config
+// Can be skipped with the keep_cloud_init option for hybrid setups that still want cloud-init around
+func GetCloudInitStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	var stages []schema.Stage
+	if c.KeepCloudInit {
+		logger.Logger.Debug().Msg("Keeping cloud-init as configured")
+		return stages, nil
+	}
+
+	vm := values.GetVersionMaps(sis, values.CloudInitPackages)
+	vm = append(vm, values.CloudInitPackages[values.Common][values.ArchCommon])
+	pkgs, err := values.FilterPackagesOnConstraint(sis, logger, vm)
+	if err != nil {
+		return stages, err
+	}
+	// Only remove the packages that are there, as not all package managers are happy removing missing packages
+	for _, pkg := range pkgs {
+		stages = append(stages, schema.Stage{
+			Name: fmt.Sprintf("Remove %s", pkg),
+			If:   values.PackageInstalledCheck(sis, pkg),
+			Packages: schema.Packages{
+				Remove: []string{pkg},
+			},
+		})
+	}
+
+	stages = append(stages, schema.Stage{
+		Name: "Remove cloud-init config and state",
+		Commands: []string{
+			fmt.Sprintf("rm -rf %s", strings.Join(values.CloudInitPaths, " ")),
+		},
+	})
+
+	return stages, nil
+}
@@ -0,0 +1,119 @@
+package stages
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// componentConfig returns the user overrides for the given component
+func componentConfig(c config.Config, name string) config.Component {
+	switch name {
+	case values.ImmucoreComponent:
+		return c.Components.Immucore
+	case values.KairosAgentComponent:
+		return c.Components.KairosAgent
+	case values.ProviderKairosComponent:
+		return c.Components.ProviderKairos
+	}
+	return config.Component{}
+}
+
+// GetInstallComponentsStage returns the stages that install the kairos components from their pinned releases, or from
+// the configured version or source, on top of the ones shipped in the framework image
+// Release tarballs are verified against the checksums file of the release before installing the binary
+func GetInstallComponentsStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	var stages []schema.Stage
+
+	for _, component := range values.Components {
+		override := componentConfig(c, component.Name)
+		if !c.Components.Install && !override.Set() {
+			continue
+		}
+		if component.Standard && sis.Variant == config.CoreVariant {
+			logger.Logger.Warn().Str("component", component.Name).Msg("Skipping component as it is only installed on standard images")
+			continue
+		}
+
+		var cmds []string
+		var err error
+		if override.Source != "" {
+			cmds, err = componentSourceCommands(component, override)
+		} else {
+			cmds = componentReleaseCommands(component, override.Version, sis.Arch)
+		}
+		if err != nil {
+			return []schema.Stage{}, err
+		}
+		logger.Logger.Debug().Str("component", component.Name).Strs("commands", cmds).Msg("Installing component")
+
+		stages = append(stages, schema.Stage{
+			Name:     fmt.Sprintf("Install %s component", component.Name),
+			Commands: cmds,
+		})
+	}
+
+	return stages, nil
+}
+
+// componentReleaseCommands returns the commands to download, verify and install a component from its github release
+func componentReleaseCommands(component values.Component, version string, arch values.Architecture) []string {
+	if version == "" {
+		version = component.Version
+	}
+	dir := filepath.Join("/tmp", fmt.Sprintf("kairos-component-%s", component.Name))
+	asset := component.Asset(version, arch)
+
+	return []string{
+		fmt.Sprintf("mkdir -p %s", dir),
+		fmt.Sprintf("curl -fsSL -o %s/%s '%s'", dir, asset, component.AssetURL(version, arch)),
+		fmt.Sprintf("curl -fsSL -o %s/checksums.txt '%s'", dir, component.ChecksumsURL(version)),
+		// Only check our asset, the checksums file lists all the archs
+		fmt.Sprintf("cd %s && grep ' %s$' checksums.txt | sha256sum -c -", dir, asset),
+		fmt.Sprintf("tar -xzf %s/%s -C %s %s", dir, asset, dir, component.Binary),
+		fmt.Sprintf("install -D -m 0755 %s/%s %s", dir, component.Binary, component.Destination),
+		fmt.Sprintf("rm -rf %s", dir),
+	}
+}
+
+// componentSourceCommands returns the commands to install a component from a local binary or tarball, or from an url
+func componentSourceCommands(component values.Component, override config.Component) ([]string, error) {
+	var cmds []string
+	dir := filepath.Join("/tmp", fmt.Sprintf("kairos-component-%s", component.Name))
+	cmds = append(cmds, fmt.Sprintf("mkdir -p %s", dir))
+
+	file := override.Source
+	if strings.HasPrefix(override.Source, "http://") || strings.HasPrefix(override.Source, "https://") {
+		if override.Checksum == "" {
+			return []string{}, fmt.Errorf("a checksum is required to install the %s component from an url", component.Name)
+		}
+		file = filepath.Join(dir, "source")
+		if strings.HasSuffix(override.Source, ".tar.gz") || strings.HasSuffix(override.Source, ".tgz") {
+			file = filepath.Join(dir, "source.tar.gz")
+		}
+		cmds = append(cmds, fmt.Sprintf("curl -fsSL -o %s '%s'", file, override.Source))
+	} else {
+		file = localPath(override.Source)
+		cmds = append(cmds, fmt.Sprintf("test -f %s", file))
+	}
+	if override.Checksum != "" {
+		cmds = append(cmds, fmt.Sprintf("echo '%s  %s' | sha256sum -c -", override.Checksum, file))
+	}
+
+	binary := file
+	if strings.HasSuffix(file, ".tar.gz") || strings.HasSuffix(file, ".tgz") {
+		cmds = append(cmds, fmt.Sprintf("tar -xzf %s -C %s %s", file, dir, component.Binary))
+		binary = filepath.Join(dir, component.Binary)
+	}
+	cmds = append(cmds,
+		fmt.Sprintf("install -D -m 0755 %s %s", binary, component.Destination),
+		fmt.Sprintf("rm -rf %s", dir),
+	)
+
+	return cmds, nil
+}
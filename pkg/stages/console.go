@@ -0,0 +1,164 @@
+package stages
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/system"
+	"github.com/kairos-io/kairos-init/pkg/tracing"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/plugins"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// packageManagers are the binaries whose invocations are marked as package manager ones on the traces
+var packageManagers = []string{"apt-get", "apt", "dpkg", "dnf", "yum", "rpm", "zypper", "apk", "pacman"}
+
+// stageConsole runs the commands of a yip stage, the package manager ones included, on their own span and keeps
+// track of the ones that fail for the error report
+type stageConsole struct {
+	plugins.Console
+	ctx    context.Context
+	logger types.KairosLogger
+	sis    values.System
+	stage  string
+	steps  []schema.Stage
+	span   *tracing.Span
+}
+
+func newStageConsole(ctx context.Context, logger types.KairosLogger, sis values.System, console plugins.Console, stage string, steps []schema.Stage, span *tracing.Span) plugins.Console {
+	return stageConsole{Console: console, ctx: ctx, logger: logger, sis: sis, stage: stage, steps: steps, span: span}
+}
+
+func (c stageConsole) Run(cmd string, opts ...func(*exec.Cmd)) (string, error) {
+	// Once cancelled, the rest of the commands of the stage are not run
+	if err := c.ctx.Err(); err != nil {
+		return "", fmt.Errorf("not running %q: %w", cmd, err)
+	}
+	// On cancellation, stop the command and what it spawned, so a package manager doesnt keep running and holding its
+	// locks after kairos-init exits
+	opts = append(opts, system.OwnProcessGroup)
+	stop := context.AfterFunc(c.ctx, func() { system.StopChildren(system.StopGrace) })
+	defer stop()
+
+	fields := strings.Fields(cmd)
+	name := "command"
+	if len(fields) > 0 {
+		name = filepath.Base(fields[0])
+	}
+	attributes := map[string]string{"process.command_line": cmd}
+	packageManager := slices.Contains(packageManagers, name)
+	if packageManager {
+		attributes["kairos.package_manager"] = name
+		// Name the span after the operation too, like apt-get install
+		if len(fields) > 1 {
+			name = name + " " + fields[1]
+		}
+	}
+	// yip runs the If conditions through the console too, those failing just means the step is skipped
+	condition := slices.ContainsFunc(c.steps, func(step schema.Stage) bool { return step.If != "" && step.If == cmd })
+	if condition {
+		attributes["kairos.condition"] = "true"
+	}
+	span := tracing.Start(name, c.span, attributes)
+	var out string
+	var err error
+	if packageManager && !condition {
+		start, received := time.Now(), system.ReceivedBytes()
+		out, err = c.stream(cmd, name, opts...)
+		out, err = c.retryMirrors(cmd, name, out, err, opts...)
+		if err == nil {
+			recordPackageTiming(c.stage, c.steps, cmd, start, received)
+		}
+	} else {
+		out, err = c.Console.Run(cmd, opts...)
+	}
+	if condition {
+		span.End(nil)
+		return out, err
+	}
+	span.End(err)
+	if err != nil {
+		recordFailure(c.stage, stepForCommand(c.steps, cmd), cmd, out, err)
+	}
+	return out, err
+}
+
+// stream runs a package manager command logging its output line by line, at debug level unless --show-package-output
+// is set, instead of all of it once it ends. The output is already logged, so only its tail is returned for the error
+// report when the command fails
+func (c stageConsole) stream(cmd, name string, opts ...func(*exec.Cmd)) (string, error) {
+	c.logger.Logger.Debug().Msgf("running command `%s`", cmd)
+	step := stepForCommand(c.steps, cmd)
+	pkgs := commandPackages(c.steps, cmd)
+	event := c.logger.Logger.Debug
+	if config.DefaultConfig.ShowPackageOutput {
+		event = c.logger.Logger.Info
+	}
+	output := newOutputLogger(func(line string) {
+		event().Str("stage", c.stage).Str("step", step).Str("command", name).Strs("packages", pkgs).Msg(line)
+	})
+
+	command := exec.Command("sh", "-c", cmd)
+	for _, opt := range opts {
+		opt(command)
+	}
+	command.Stdout, command.Stderr = output, output
+	err := command.Run()
+	// Also logs the last line if it had no newline
+	tail := output.Tail()
+	if err != nil {
+		// Same error as the yip console, the error report gets the exit status from it
+		return tail, fmt.Errorf("failed to run %s: %v", cmd, err)
+	}
+	return "", nil
+}
+
+// RunTemplate is the same as the embedded one, but running the commands through Run so they are tracked too
+func (c stageConsole) RunTemplate(items []string, template string) error {
+	var errs error
+	for _, item := range items {
+		if _, err := c.Run(fmt.Sprintf(template, item)); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// stepForCommand returns the name of the step that run the command. yip doesnt tell, so it looks for the step that has
+// the command, or for the package step with the packages in the command
+func stepForCommand(steps []schema.Stage, cmd string) string {
+	for _, step := range steps {
+		if slices.Contains(step.Commands, cmd) {
+			return step.Name
+		}
+	}
+	for _, step := range steps {
+		for _, pkgs := range [][]string{step.Packages.Install, step.Packages.Remove} {
+			if len(pkgs) > 0 && strings.Contains(cmd, pkgs[0]) {
+				return step.Name
+			}
+		}
+	}
+	return ""
+}
+
+// commandPackages returns the packages of the package step that run the command, if any
+func commandPackages(steps []schema.Stage, cmd string) []string {
+	for _, step := range steps {
+		for _, pkgs := range [][]string{step.Packages.Install, step.Packages.Remove} {
+			if len(pkgs) > 0 && strings.Contains(cmd, pkgs[0]) {
+				return pkgs
+			}
+		}
+	}
+	return nil
+}
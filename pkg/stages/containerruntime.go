@@ -0,0 +1,61 @@
+package stages
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// GetContainerRuntimeStage returns the stages to write the default config of the selected container runtime
+// The packages are installed on the install stage and the services are handled by the services stage
+func GetContainerRuntimeStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	if c.ContainerRuntime == "" {
+		return []schema.Stage{}, nil
+	}
+
+	runtime, err := values.GetContainerRuntime(sis, c.ContainerRuntime)
+	if err != nil {
+		return []schema.Stage{}, err
+	}
+	logger.Logger.Debug().Str("runtime", c.ContainerRuntime).Msg("Setting up container runtime")
+
+	contents := map[string]string{}
+	for path, content := range runtime.Files {
+		contents[path] = content
+	}
+	if sis.Family != values.AlpineFamily {
+		for path, content := range runtime.SystemdFiles {
+			contents[path] = content
+		}
+	}
+	if len(contents) == 0 {
+		return []schema.Stage{}, nil
+	}
+
+	paths := make([]string, 0, len(contents))
+	for path := range contents {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var files []schema.File
+	for _, path := range paths {
+		files = append(files, schema.File{
+			Path:        path,
+			Permissions: 0644,
+			Owner:       0,
+			Group:       0,
+			Content:     contents[path],
+		})
+	}
+
+	return []schema.Stage{
+		{
+			Name:  fmt.Sprintf("Write default %s config", c.ContainerRuntime),
+			Files: files,
+		},
+	}, nil
+}
@@ -0,0 +1,76 @@
+package stages
+
+import (
+	"os/exec"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// GetModuleBuildStage returns the stages that build the configured out-of-tree kernel modules against the installed kernel
+// It needs to run before the initrd is built so the modules can be added to it. The kernel headers are only
+// removed afterwards if they were not installed before or requested, so we dont break anything else that needs them
+func GetModuleBuildStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	modules := c.KernelModules.Build
+	if len(modules) == 0 {
+		return []schema.Stage{}, nil
+	}
+
+	builder, err := values.GetModuleBuilder(sis)
+	if err != nil {
+		return []schema.Stage{}, err
+	}
+
+	kernel, err := getLatestKernel(c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the latest kernel: %s", err)
+		return []schema.Stage{}, err
+	}
+
+	headers := values.KernelHeadersPackage(sis, kernel)
+	headersInstalled := exec.Command("sh", "-c", values.PackageInstalledCheck(sis, headers)).Run() == nil
+	logger.Logger.Debug().Str("kernel", kernel).Str("headers", headers).Bool("preinstalled", headersInstalled).Strs("modules", modules).Msg("Building out-of-tree modules")
+
+	var stages []schema.Stage
+	if builder == values.Akmods && sis.Distro != values.Fedora {
+		// akmods comes from epel on the RedHat derivatives
+		stages = append(stages, schema.Stage{
+			Name: "Enable epel repo",
+			Packages: schema.Packages{
+				Install: []string{"epel-release"},
+			},
+		})
+	}
+
+	pkgs := append(values.ModuleBuilderPackages(builder), headers)
+	pkgs = append(pkgs, modules...)
+	stages = append(stages, []schema.Stage{
+		{
+			Name: "Install out-of-tree module sources",
+			Packages: schema.Packages{
+				Install: pkgs,
+				Refresh: true,
+			},
+		},
+		{
+			// The package hooks only build the modules for the running kernel, which is the host one on a container build
+			Name: "Build out-of-tree modules",
+			Commands: []string{
+				values.ModuleBuildCommand(builder, kernel),
+			},
+		},
+	}...)
+
+	if !headersInstalled && !c.Kernel.Headers {
+		stages = append(stages, schema.Stage{
+			Name: "Remove kernel headers",
+			Packages: schema.Packages{
+				Remove: []string{headers},
+			},
+		})
+	}
+
+	return stages, nil
+}
@@ -0,0 +1,98 @@
+package stages
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+)
+
+// ErrorReportPath is where the error report is written when the build fails
+const ErrorReportPath = "/var/log/kairos-init-error.json"
+
+// errorReportLines is how many lines of the failed command output are kept on the report
+const errorReportLines = 50
+
+// ErrorReport describes why the build failed, so CI systems can show it without going through the logs
+type ErrorReport struct {
+	Stage    string   `json:"stage,omitempty"`
+	Step     string   `json:"step,omitempty"`
+	Command  string   `json:"command,omitempty"`
+	ExitCode int      `json:"exit_code,omitempty"`
+	Output   []string `json:"output,omitempty"`
+	Error    string   `json:"error"`
+	Hint     string   `json:"hint,omitempty"`
+	// Failures is how many commands failed in total, as yip keeps running the rest of the steps after a failure
+	Failures int `json:"failures"`
+}
+
+// failures are the commands that failed so far, in run order
+var failures []ErrorReport
+
+var exitStatus = regexp.MustCompile(`exit status (\d+)`)
+
+func recordFailure(stage, step, cmd, out string, err error) {
+	failure := ErrorReport{Stage: stage, Step: step, Command: cmd, Error: err.Error()}
+	if match := exitStatus.FindStringSubmatch(err.Error()); match != nil {
+		failure.ExitCode, _ = strconv.Atoi(match[1])
+	}
+	lines := strings.Split(strings.TrimRight(out, "\n"), "\n")
+	if len(lines) > errorReportLines {
+		lines = lines[len(lines)-errorReportLines:]
+	}
+	failure.Output = lines
+	failure.Hint = errorHint(out + "\n" + err.Error())
+	failures = append(failures, failure)
+}
+
+// errorHint returns the remediation hint for the first known error found in the output
+func errorHint(out string) string {
+	for _, hint := range values.ErrorHints {
+		if hint.Pattern.MatchString(out) {
+			return hint.Hint
+		}
+	}
+	return ""
+}
+
+// GetErrorReport returns the report for the build error. The first failed command is reported, as the ones after it
+// usually fail because of it. If no command failed, like when a stage could not be generated, only the error is there
+func GetErrorReport(err error) ErrorReport {
+	if len(failures) == 0 {
+		return ErrorReport{Error: err.Error(), Hint: errorHint(err.Error())}
+	}
+	report := failures[0]
+	report.Failures = len(failures)
+	return report
+}
+
+// WriteErrorReport prints the error report as json to stdout and writes it to ErrorReportPath, and to the report
+// output dir if set
+func WriteErrorReport(err error, l types.KairosLogger) {
+	data, jsonErr := json.Marshal(GetErrorReport(err))
+	if jsonErr != nil {
+		return
+	}
+	fmt.Println(string(data))
+
+	paths := []string{ErrorReportPath}
+	if config.DefaultConfig.Report.Output != "" {
+		paths = append(paths, filepath.Join(config.DefaultConfig.Report.Output, filepath.Base(ErrorReportPath)))
+	}
+	for _, path := range paths {
+		if mkdirErr := os.MkdirAll(filepath.Dir(path), 0755); mkdirErr != nil {
+			l.Logger.Warn().Err(mkdirErr).Msg("Could not write the error report")
+			continue
+		}
+		if writeErr := os.WriteFile(path, data, 0644); writeErr != nil {
+			l.Logger.Warn().Err(writeErr).Msg("Could not write the error report")
+		}
+	}
+}
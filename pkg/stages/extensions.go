@@ -13,10 +13,10 @@ import (
 
 // GetStageExtensions returns the expansions for a given stage
 // It loads the extensions from a dir in the filesystem, loads all files and only selects the proper stage to be returned
-func GetStageExtensions(stage string, logger types.KairosLogger) []schema.Stage {
+func GetStageExtensions(stage string, c config.Config, logger types.KairosLogger) []schema.Stage {
 	var data []schema.Stage
 	// If extensions are not enabled, return empty
-	if !config.DefaultConfig.Extensions {
+	if !c.Extensions {
 		return data
 	}
 
@@ -0,0 +1,89 @@
+package stages
+
+import (
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// GetImmutabilityStage returns the stages that prepare the rootfs for Kairos immutability
+// On a running Kairos system the rootfs is mounted read-only, /oem and /usr/local are bind mounted from persistent
+// partitions and /etc and /var get an overlay on top, so anything that expects otherwise needs to be fixed here
+func GetImmutabilityStage(sis values.System, c config.Config, _ types.KairosLogger) []schema.Stage {
+	stages := []schema.Stage{
+		{
+			// Anything under /usr/local is hidden by the persistent bind mount on boot, so move binaries installed
+			// there by the base image or installers into /usr. Existing files are not overwritten.
+			Name: "Relocate /usr/local binaries",
+			If:   "test -d /usr/local/bin -o -d /usr/local/sbin",
+			Commands: []string{
+				"if [ -d /usr/local/bin ]; then for f in /usr/local/bin/*; do [ -e \"$f\" ] && [ ! -e \"/usr/bin/$(basename $f)\" ] && mv \"$f\" /usr/bin/; done; fi; true",
+				"if [ -d /usr/local/sbin ]; then for f in /usr/local/sbin/*; do [ -e \"$f\" ] && [ ! -e \"/usr/sbin/$(basename $f)\" ] && mv \"$f\" /usr/sbin/; done; fi; true",
+			},
+		},
+		{
+			Name: "Create mountpoints",
+			Directories: []schema.Directory{
+				{Path: "/oem", Permissions: 0755, Owner: 0, Group: 0},
+				{Path: "/usr/local", Permissions: 0755, Owner: 0, Group: 0},
+			},
+		},
+		{
+			// Some distros link it to /run/lock, others dont have it at all
+			Name: "Create /var/lock",
+			If:   "test ! -e /var/lock",
+			Directories: []schema.Directory{
+				{Path: "/var/lock", Permissions: 0755, Owner: 0, Group: 0},
+			},
+		},
+		{
+			// mtab needs to follow the mounts as it cant be written
+			Name: "Link /etc/mtab",
+			If:   "test ! -L /etc/mtab",
+			Commands: []string{
+				"rm -f /etc/mtab",
+				"ln -s ../proc/self/mounts /etc/mtab",
+			},
+		},
+	}
+
+	// resolv.conf is bind mounted by the container runtime during the build, so we cant link it here.
+	// Instead we let systemd-tmpfiles link it on boot on the systems that use systemd-resolved.
+	// On Alpine connman writes the file directly on the /etc overlay, so nothing to do there, same as NetworkManager
+	// and connman when selected as the network stack on the other families
+	switch sis.Family {
+	case values.DebianFamily, values.RedHatFamily:
+		if !values.UsesResolved(c) {
+			break
+		}
+		stages = append(stages, schema.Stage{
+			Name: "Link resolv.conf to systemd-resolved on boot",
+			Files: []schema.File{
+				{
+					Path:        "/etc/tmpfiles.d/kairos-resolv.conf",
+					Permissions: 0644,
+					Owner:       0,
+					Group:       0,
+					Content:     "L+ /etc/resolv.conf - - - - ../run/systemd/resolve/stub-resolv.conf\n",
+				},
+			},
+		})
+	case values.SUSEFamily:
+		// SUSE uses netconfig to write resolv.conf under /run and expects /etc/resolv.conf to link there
+		stages = append(stages, schema.Stage{
+			Name: "Link resolv.conf to netconfig on boot",
+			Files: []schema.File{
+				{
+					Path:        "/etc/tmpfiles.d/kairos-resolv.conf",
+					Permissions: 0644,
+					Owner:       0,
+					Group:       0,
+					Content:     "L /etc/resolv.conf - - - - ../run/netconfig/resolv.conf\n",
+				},
+			},
+		})
+	}
+
+	return stages
+}
@@ -0,0 +1,62 @@
+package stages
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// initrdCompressions are the compression algorithms supported by dracut
+var initrdCompressions = []string{"zstd", "xz", "gzip", "lz4", "lzma", "bzip2", "cat"}
+
+// GetInitrdConfigStage returns the stage that sets the dracut mode and compression for the initrd
+// It needs to run before the initrd is built
+func GetInitrdConfigStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	opts := c.Initrd
+	if opts.Mode == "" && opts.Compression == "" {
+		return []schema.Stage{}, nil
+	}
+
+	var content string
+	switch opts.Mode {
+	case "":
+	case config.HostonlyInitrdMode:
+		content += "hostonly=\"yes\"\n"
+	case config.GenericInitrdMode:
+		// Inside a container hostonly picks the drivers of the build host, which are not the ones of the real hardware
+		content += "hostonly=\"no\"\n"
+	default:
+		return []schema.Stage{}, fmt.Errorf("invalid initrd mode: %s, possible values are %s or %s", opts.Mode, config.HostonlyInitrdMode, config.GenericInitrdMode)
+	}
+	if opts.Compression != "" {
+		if !slices.Contains(initrdCompressions, opts.Compression) {
+			return []schema.Stage{}, fmt.Errorf("invalid initrd compression: %s, possible values are %v", opts.Compression, initrdCompressions)
+		}
+		content += fmt.Sprintf("compress=\"%s\"\n", opts.Compression)
+	}
+
+	if sis.Family == values.AlpineFamily {
+		logger.Logger.Warn().Msg("The initrd mode and compression are only supported with dracut, ignoring them for mkinitfs")
+		return []schema.Stage{}, nil
+	}
+	logger.Logger.Debug().Str("mode", opts.Mode).Str("compression", opts.Compression).Msg("Setting initrd options")
+
+	return []schema.Stage{
+		{
+			Name: "Set initrd options",
+			Files: []schema.File{
+				{
+					Path:        "/etc/dracut.conf.d/kairos-initrd.conf",
+					Permissions: 0644,
+					Owner:       0,
+					Group:       0,
+					Content:     content,
+				},
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,165 @@
+package stages
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/system"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+)
+
+// ExitInterrupted is the exit code of an interrupted build, like the shells do for SIGINT, so CI can tell it apart from
+// a failed one and retry it
+const ExitInterrupted = 130
+
+// StatePath is where an interrupted build keeps how far it got, so running the same stage again resumes from there
+const StatePath = "/var/lib/kairos-init/state.json"
+
+// State is how far an interrupted build got
+type State struct {
+	// Stage is the kairos-init stage that was running, the state is only used to resume that same stage
+	Stage string `json:"stage"`
+	// Completed are the yip stages that finished before the interruption, which are skipped on resume
+	Completed []string `json:"completed"`
+	// Interrupted is the yip stage that was running, it runs again in full on resume
+	Interrupted string `json:"interrupted,omitempty"`
+	KairosInit  string `json:"kairos_init"`
+}
+
+// interruptCleanup is a cleanup registered with OnInterrupt
+type interruptCleanup struct {
+	name string
+	fn   func() error
+}
+
+var (
+	// cleanups run in reverse order when the build is interrupted
+	cleanups []interruptCleanup
+	// completed are the yip stages that finished on this run, and resumed the ones skipped from the previous one
+	completed []string
+	resumed   []string
+	// interrupted is the yip stage that was running when the build was interrupted
+	interrupted string
+)
+
+// Interrupted returns true if the error is from the build being interrupted by a signal
+func Interrupted(err error) bool {
+	return errors.Is(err, context.Canceled)
+}
+
+// OnInterrupt registers a cleanup to run if the build is interrupted, to undo what a stage does temporarily and then
+// undoes on a later step that won't run. Registering again with the same name replaces it
+func OnInterrupt(name string, fn func() error) {
+	cleanups = slices.DeleteFunc(cleanups, func(c interruptCleanup) bool { return c.name == name })
+	cleanups = append(cleanups, interruptCleanup{name: name, fn: fn})
+}
+
+// interruptedError returns the error of the yip stage being interrupted, keeping which one it was for the state
+func interruptedError(ctx context.Context, stage string) error {
+	interrupted = stage
+	return fmt.Errorf("interrupted: %w", ctx.Err())
+}
+
+// stageCompleted records that the yip stage finished, for the state of an interrupted build
+func stageCompleted(stage string) {
+	completed = append(completed, stage)
+}
+
+// skipResumed returns true if the yip stage finished on the interrupted build being resumed, so it doesn't run again
+func skipResumed(stage string, logger types.KairosLogger) bool {
+	if !slices.Contains(resumed, stage) {
+		return false
+	}
+	logger.Logger.Info().Msgf("Skipping the %s stage, it completed before the build was interrupted", stage)
+	completed = append(completed, stage)
+	return true
+}
+
+// CleanupInterrupted leaves the rootfs of an interrupted build ready to run the same stage again: it runs the
+// registered cleanups, releases the locks of the stopped package managers, removes the temp files of the stages and
+// writes the state to resume from. The running stage is already stopped by then, see newStageConsole
+func CleanupInterrupted(sis values.System, logger types.KairosLogger) {
+	logger.Logger.Warn().Msg("The build was interrupted, cleaning up so it can be resumed")
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		if err := cleanups[i].fn(); err != nil {
+			logger.Logger.Warn().Err(err).Msgf("Could not %s", cleanups[i].name)
+		}
+	}
+
+	// The locks are only stale if nothing is running that could hold them
+	if !system.ProcessRunning("zypper", "pacman") {
+		for _, lock := range values.PackageManagerLocks[sis.Family] {
+			if err := os.Remove(lock); err != nil && !os.IsNotExist(err) {
+				logger.Logger.Warn().Err(err).Msgf("Could not release the %s lock", lock)
+			}
+		}
+	}
+
+	for _, pattern := range values.InterruptTempFiles {
+		matches, _ := filepath.Glob(pattern)
+		for _, match := range matches {
+			if err := os.RemoveAll(match); err != nil {
+				logger.Logger.Warn().Err(err).Msgf("Could not remove %s", match)
+			}
+		}
+	}
+
+	state := State{Stage: config.DefaultConfig.Stage, Completed: completed, Interrupted: interrupted, KairosInit: values.GetVersion()}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(StatePath), 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(StatePath, data, 0644)
+	}
+	if err != nil {
+		logger.Logger.Warn().Err(err).Msg("Could not write the state, the next run will start over")
+		return
+	}
+	logger.Logger.Info().Strs("completed", completed).Msgf("Run the %s stage again to resume the build", state.Stage)
+}
+
+// Resume loads the state of an interrupted build of the same stage and version, so the yip stages it completed are
+// skipped, and repairs the package database that the stopped package manager left halfway
+func Resume(sis values.System, logger types.KairosLogger) error {
+	data, err := os.ReadFile(StatePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state State
+	if err = json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("invalid state on %s: %w", StatePath, err)
+	}
+	if state.Stage != config.DefaultConfig.Stage || state.KairosInit != values.GetVersion() {
+		logger.Logger.Warn().Msgf("Ignoring the state of the interrupted %s stage of kairos-init %s, starting over", state.Stage, state.KairosInit)
+		return ClearState()
+	}
+
+	logger.Logger.Info().Strs("completed", state.Completed).Msgf("Resuming the interrupted %s stage", state.Stage)
+	for _, cmd := range values.PackageManagerRepair[sis.Family] {
+		if out, err := exec.Command("sh", "-c", cmd).CombinedOutput(); err != nil {
+			return fmt.Errorf("repairing the package database with %q: %w: %s", cmd, err, out)
+		}
+	}
+	resumed = state.Completed
+	return nil
+}
+
+// ClearState removes the state of an interrupted build, once the stage completes so it doesn't end up in the image
+func ClearState() error {
+	if err := os.Remove(StatePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
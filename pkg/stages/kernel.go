@@ -0,0 +1,351 @@
+package stages
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// GetKernelRepoStage returns the stages that enable the repos needed for the selected kernel before installing it
+func GetKernelRepoStage(sis values.System, c config.Config, logger types.KairosLogger) []schema.Stage {
+	var stages []schema.Stage
+
+	if c.Kernel.Flavor == config.RealtimeKernelFlavor {
+		// Rocky and Alma ship the rt kernel on its own repo, disabled by default.
+		// On RedHat it needs to be enabled via subscription-manager with a valid subscription so we leave it to the user
+		if sis.Distro == values.RockyLinux || sis.Distro == values.AlmaLinux {
+			logger.Logger.Debug().Msg("Enabling the rt repo")
+			stages = append(stages, schema.Stage{
+				Name: "Enable realtime kernel repo",
+				Commands: []string{
+					"dnf install -y dnf-plugins-core",
+					"dnf config-manager --set-enabled rt",
+				},
+			})
+		}
+	}
+
+	return stages
+}
+
+// GetKernelHoldStage returns the stages that hold the pinned kernel packages so they are not upgraded afterwards
+// Alpine needs nothing as apk keeps the pinned version in the world file
+func GetKernelHoldStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	version := c.Kernel.Version
+	if version == "" {
+		return []schema.Stage{}, nil
+	}
+
+	pinned, err := values.FilterPackagesOnConstraint(sis, logger, values.GetVersionMaps(sis, values.KernelPackagesPinned))
+	if err != nil {
+		return []schema.Stage{}, fmt.Errorf("could not get the pinned kernel packages to hold: %w", err)
+	}
+	pkgs, err := values.PackageListToTemplate(pinned, sis.TemplateParams(c), logger)
+	if err != nil {
+		return []schema.Stage{}, fmt.Errorf("could not parse the pinned kernel packages to hold: %w", err)
+	}
+	// Only hold the versioned packages, not the firmware ones
+	var held []string
+	for _, pkg := range pkgs {
+		if strings.Contains(pkg, version) {
+			held = append(held, pkg)
+		}
+	}
+	logger.Logger.Debug().Strs("packages", held).Msg("Holding the kernel packages")
+
+	var cmds []string
+	switch sis.Family {
+	case values.DebianFamily:
+		cmds = []string{fmt.Sprintf("apt-mark hold %s", strings.Join(held, " "))}
+	case values.RedHatFamily:
+		cmds = []string{
+			"dnf install -y 'dnf-command(versionlock)'",
+			fmt.Sprintf("dnf versionlock add %s", strings.Join(held, " ")),
+		}
+	case values.SUSEFamily:
+		// zypper locks by name, the pinned version is already installed
+		var names []string
+		for _, pkg := range held {
+			name, _, _ := strings.Cut(pkg, "=")
+			names = append(names, name)
+		}
+		cmds = []string{fmt.Sprintf("zypper addlock %s", strings.Join(names, " "))}
+	default:
+		return []schema.Stage{}, nil
+	}
+
+	return []schema.Stage{
+		{
+			Name:     "Hold pinned kernel packages",
+			Commands: cmds,
+		},
+	}, nil
+}
+
+// localPath returns the path of a local file as the package managers need it to know that it is not a package name,
+// absolute or ./ prefixed. Relative paths stay relative to the dir kairos-init runs on
+func localPath(file string) string {
+	if filepath.IsAbs(file) {
+		return filepath.Clean(file)
+	}
+	return "./" + filepath.Clean(file)
+}
+
+// GetCustomKernelStage returns the stages that install the user provided kernel package instead of the distro kernel
+// Urls are downloaded first and the package is verified against the checksum before installing it
+func GetCustomKernelStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	source := c.Kernel.Source
+	checksum := c.Kernel.Checksum
+	if source == "" {
+		return []schema.Stage{}, nil
+	}
+
+	var cmds []string
+	file := source
+	downloaded := false
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		if checksum == "" {
+			return []schema.Stage{}, fmt.Errorf("a checksum is required to install a kernel from an url")
+		}
+		u, err := url.Parse(source)
+		if err != nil {
+			return []schema.Stage{}, fmt.Errorf("invalid kernel source url %s: %w", source, err)
+		}
+		// Keep the file name as the package managers need the extension to know that its a local file
+		file = filepath.Join("/tmp", path.Base(u.Path))
+		cmds = append(cmds, fmt.Sprintf("curl -fsSL -o %s '%s'", file, source))
+		downloaded = true
+	} else {
+		// apt needs an absolute or ./ prefixed path to know its a local file. The file is checked when the step runs,
+		// as the stages are resolved without touching the filesystem
+		file = localPath(source)
+		cmds = append(cmds, fmt.Sprintf("test -f %s", file))
+	}
+	if checksum != "" {
+		cmds = append(cmds, fmt.Sprintf("echo '%s  %s' | sha256sum -c -", checksum, file))
+	}
+	install, err := values.CustomKernelInstallCommand(sis, file)
+	if err != nil {
+		return []schema.Stage{}, err
+	}
+	cmds = append(cmds, install)
+	if downloaded {
+		cmds = append(cmds, fmt.Sprintf("rm -f %s", file))
+	}
+	logger.Logger.Debug().Str("source", source).Str("file", file).Msg("Installing custom kernel")
+
+	return []schema.Stage{
+		{
+			Name:     "Install custom kernel",
+			Commands: cmds,
+		},
+	}, nil
+}
+
+// GetKernelCmdlineStage returns the stages that set the extra kernel cmdline arguments
+// /etc/kernel/cmdline is read by kernel-install for the systemd-boot entries and by ukify when building UKIs, while
+// grub gets them from the kairos bootargs, so both boot paths end up with the same arguments
+func GetKernelCmdlineStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	if err := values.ValidateKernelCmdline(c); err != nil {
+		return []schema.Stage{}, err
+	}
+	args := strings.Join(c.Kernel.Cmdline, " ")
+	if args == "" {
+		return []schema.Stage{}, nil
+	}
+	logger.Logger.Debug().Str("cmdline", args).Msg("Setting extra kernel cmdline")
+
+	stages := []schema.Stage{
+		{
+			Name: "Set kernel cmdline",
+			Files: []schema.File{
+				{
+					Path:        "/etc/kernel/cmdline",
+					Permissions: 0644,
+					Owner:       0,
+					Group:       0,
+					Content:     args + "\n",
+				},
+			},
+		},
+	}
+	if !c.TrustedBoot {
+		// The grubenv is loaded before the bootargs so extra_cmdline set on install is kept after ours. The line is
+		// written as a file and put on top of the bootargs, so the args don't go through the shell or sed
+		line := "/etc/cos/bootargs.cfg.kairos-init"
+		stages = append(stages, schema.Stage{
+			Name: "Write kernel cmdline grub line",
+			If:   "test -f /etc/cos/bootargs.cfg",
+			Files: []schema.File{
+				{
+					Path:        line,
+					Permissions: 0644,
+					Owner:       0,
+					Group:       0,
+					Content:     fmt.Sprintf("set extra_cmdline=\"%s ${extra_cmdline}\" # kairos-init cmdline\n", args),
+				},
+			},
+		}, schema.Stage{
+			Name: "Add kernel cmdline to grub bootargs",
+			If:   "test -f /etc/cos/bootargs.cfg",
+			Commands: []string{
+				"sed -i '/# kairos-init cmdline$/d' /etc/cos/bootargs.cfg",
+				// On top, so its set before the cmdline is built
+				fmt.Sprintf("cat %s /etc/cos/bootargs.cfg > /etc/cos/bootargs.cfg.new", line),
+				"cat /etc/cos/bootargs.cfg.new > /etc/cos/bootargs.cfg",
+				fmt.Sprintf("rm -f /etc/cos/bootargs.cfg.new %s", line),
+			},
+		})
+	}
+	return stages, nil
+}
+
+// GetKernelHeadersStage returns the stage that installs the headers matching the installed kernel
+// They are resolved from the kernel under /lib/modules instead of the package maps so they always match it
+func GetKernelHeadersStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	if !c.Kernel.Headers {
+		return []schema.Stage{}, nil
+	}
+
+	kernel, err := getLatestKernel(c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the latest kernel: %s", err)
+		return []schema.Stage{}, err
+	}
+	headers := values.KernelHeadersPackage(sis, kernel)
+	logger.Logger.Debug().Str("kernel", kernel).Str("headers", headers).Msg("Installing kernel headers")
+
+	return []schema.Stage{
+		{
+			Name: "Install kernel headers",
+			Packages: schema.Packages{
+				Install: []string{headers},
+				Refresh: true,
+			},
+		},
+	}, nil
+}
+
+// isFallbackKernel returns true if the kernel dir under /lib/modules belongs to the fallback kernel
+// The dir name is the kernel version plus the flavor or arch, like 6.8.0-40-generic or 5.14.0-427.el9.x86_64
+func isFallbackKernel(c config.Config, dir string) bool {
+	fallback := c.Kernel.Fallback
+	if fallback == "" {
+		return false
+	}
+	return dir == fallback || strings.HasPrefix(dir, fallback+"-") || strings.HasPrefix(dir, fallback+".")
+}
+
+// getFallbackKernel returns the kernel dir under /lib/modules for the fallback kernel
+func getFallbackKernel(c config.Config) (string, error) {
+	dirs, err := os.ReadDir("/lib/modules")
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range dirs {
+		if dir.IsDir() && isFallbackKernel(c, dir.Name()) {
+			return dir.Name(), nil
+		}
+	}
+	return "", fmt.Errorf("fallback kernel %s not found", c.Kernel.Fallback)
+}
+
+// GetFallbackKernelInstallStage returns the stage that installs the fallback kernel next to the default one
+// The packages are the same ones used to pin the kernel version, see values.KernelPackagesPinned
+func GetFallbackKernelInstallStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	fallback := c.Kernel.Fallback
+	if fallback == "" {
+		return []schema.Stage{}, nil
+	}
+	if c.TrustedBoot {
+		return []schema.Stage{}, fmt.Errorf("a fallback kernel is not supported for trusted boot")
+	}
+	// Alpine and SUSE kernel package versions dont match the kernel dir name, so we cant find it afterwards
+	if sis.Family != values.DebianFamily && sis.Family != values.RedHatFamily {
+		return []schema.Stage{}, fmt.Errorf("a fallback kernel is not supported on %s", sis.Distro)
+	}
+
+	params := sis.TemplateParams(c)
+	params["kernelVersion"] = fallback
+	pinned, err := values.FilterPackagesOnConstraint(sis, logger, values.GetVersionMaps(sis, values.KernelPackagesPinned))
+	if err != nil {
+		return []schema.Stage{}, err
+	}
+	pkgs, err := values.PackageListToTemplate(pinned, params, logger)
+	if err != nil {
+		return []schema.Stage{}, err
+	}
+	logger.Logger.Debug().Strs("packages", pkgs).Msg("Installing fallback kernel")
+
+	return []schema.Stage{
+		{
+			Name: "Install fallback kernel",
+			Packages: schema.Packages{
+				Install: pkgs,
+			},
+		},
+	}, nil
+}
+
+// GetFallbackKernelStage returns the stages that link the fallback kernel, build its initrd and add a grub entry for it
+// It needs to run after the default initrd is built, as that removes all the initrds
+func GetFallbackKernelStage(_ values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	if c.Kernel.Fallback == "" {
+		return []schema.Stage{}, nil
+	}
+	kernel, err := getFallbackKernel(c)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the fallback kernel: %s", err)
+		return []schema.Stage{}, err
+	}
+	logger.Logger.Debug().Str("kernel", kernel).Msg("Setting up fallback kernel")
+
+	return []schema.Stage{
+		{
+			Name: "Link fallback kernel",
+			Commands: []string{
+				fmt.Sprintf("ln -sf /boot/vmlinuz-%s /boot/vmlinuz-fallback", kernel),
+			},
+		},
+		{
+			Name: "Create fallback initrd",
+			Commands: []string{
+				fmt.Sprintf("depmod -a %s", kernel),
+				fmt.Sprintf("dracut -v -f /boot/initrd-fallback %s", kernel),
+			},
+		},
+		{
+			// Same as the default entry, but booting the fallback kernel and initrd from the active image
+			// Appended, as the branding may already ship extra entries. The entry of a previous run is removed first,
+			// so running again on the same rootfs does not add it twice
+			Name: "Add fallback kernel boot entry",
+			Commands: []string{
+				"mkdir -p /etc/kairos/branding",
+				"touch /etc/kairos/branding/grubmenu.cfg",
+				"sed -i '/^# kairos-init fallback kernel start$/,/^# kairos-init fallback kernel end$/d' /etc/kairos/branding/grubmenu.cfg",
+				fmt.Sprintf(`cat >> /etc/kairos/branding/grubmenu.cfg <<'EOF'
+# kairos-init fallback kernel start
+menuentry "Kairos (fallback kernel %s)" --id fallback-kernel {
+  search --no-floppy --label --set=root $state_label
+  set img=/cOS/active.img
+  set label=$active_label
+  loopback loop0 /$img
+  set root=($root)
+  source (loop0)/etc/cos/bootargs.cfg
+  linux (loop0)/boot/vmlinuz-fallback ${kernelcmd} ${extra_cmdline} ${extra_active_cmdline}
+  initrd (loop0)/boot/initrd-fallback
+}
+# kairos-init fallback kernel end
+EOF`, kernel),
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,193 @@
+package stages
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// GetLocalizationStage returns the stages to set the default locale, keymap and timezone of the system
+// The packages needed for each of them are added on the install stage, see values.LocalePackages
+func GetLocalizationStage(sis values.System, c config.Config, logger types.KairosLogger) []schema.Stage {
+	var stages []schema.Stage
+	loc := c.Localization
+	logger.Logger.Debug().Interface("localization", loc).Msg("Localization options")
+
+	if loc.Locale != "" {
+		stages = append(stages, getLocaleStages(sis, loc.Locale)...)
+		if loc.TrimLocales {
+			lang := values.LocaleLanguage(loc.Locale)
+			territory, _, _ := strings.Cut(loc.Locale, ".")
+			stages = append(stages, schema.Stage{
+				Name: "Trim unused locales",
+				If:   "test -d /usr/share/locale",
+				Commands: []string{
+					fmt.Sprintf("find /usr/share/locale -mindepth 1 -maxdepth 1 -type d ! -name %s ! -name %s ! -name 'C.*' -exec rm -rf {} +", lang, territory),
+				},
+			})
+			if sis.Family == values.RedHatFamily {
+				// glibc-all-langpacks may be there on the base image, which brings all the compiled locales
+				stages = append(stages, schema.Stage{
+					Name: "Trim unused compiled locales",
+					If:   "test -f /usr/lib/locale/locale-archive && command -v localedef",
+					Commands: []string{
+						fmt.Sprintf("localedef --list-archive | grep -v '^%s' | xargs -r localedef --delete-from-archive", territory),
+					},
+				})
+			}
+		}
+	}
+
+	if loc.Keymap != "" {
+		stages = append(stages, getKeymapStages(sis, loc.Keymap)...)
+	}
+
+	if loc.Timezone != "" {
+		stages = append(stages, schema.Stage{
+			Name: "Set timezone",
+			Commands: []string{
+				// Fail if the timezone does not exist instead of leaving a broken link
+				fmt.Sprintf("test -f /usr/share/zoneinfo/%[1]s && ln -sf /usr/share/zoneinfo/%[1]s /etc/localtime", loc.Timezone),
+			},
+		})
+		if sis.Family == values.DebianFamily || sis.Family == values.AlpineFamily {
+			stages = append(stages, schema.Stage{
+				Name: "Write timezone file",
+				Files: []schema.File{
+					{
+						Path:        "/etc/timezone",
+						Permissions: 0644,
+						Owner:       0,
+						Group:       0,
+						Content:     loc.Timezone + "\n",
+					},
+				},
+			})
+		}
+	}
+
+	return stages
+}
+
+func getLocaleStages(sis values.System, locale string) []schema.Stage {
+	switch sis.Family {
+	case values.DebianFamily:
+		entry := fmt.Sprintf("%s %s", locale, values.LocaleCharset(locale))
+		return []schema.Stage{
+			{
+				Name: "Generate locale",
+				Commands: []string{
+					fmt.Sprintf("grep -q '^# *%[1]s' /etc/locale.gen && sed -i 's/^# *\\(%[1]s\\)/\\1/' /etc/locale.gen || echo '%[1]s' >> /etc/locale.gen", entry),
+					"locale-gen",
+				},
+			},
+			{
+				Name: "Set default locale",
+				Files: []schema.File{
+					{
+						Path:        "/etc/default/locale",
+						Permissions: 0644,
+						Owner:       0,
+						Group:       0,
+						Content:     fmt.Sprintf("LANG=%s\n", locale),
+					},
+					{
+						Path:        "/etc/locale.conf",
+						Permissions: 0644,
+						Owner:       0,
+						Group:       0,
+						Content:     fmt.Sprintf("LANG=%s\n", locale),
+					},
+				},
+			},
+		}
+	case values.AlpineFamily:
+		// No locale.conf on openrc, musl-locales reads the LANG from the environment
+		return []schema.Stage{
+			{
+				Name: "Set default locale",
+				Files: []schema.File{
+					{
+						Path:        "/etc/profile.d/10-kairos-locale.sh",
+						Permissions: 0644,
+						Owner:       0,
+						Group:       0,
+						Content:     fmt.Sprintf("export LANG=%s\n", locale),
+					},
+				},
+			},
+		}
+	default:
+		// RedHat and SUSE ship the compiled locales with the langpacks so we only need to set it
+		return []schema.Stage{
+			{
+				Name: "Set default locale",
+				Files: []schema.File{
+					{
+						Path:        "/etc/locale.conf",
+						Permissions: 0644,
+						Owner:       0,
+						Group:       0,
+						Content:     fmt.Sprintf("LANG=%s\n", locale),
+					},
+				},
+			},
+		}
+	}
+}
+
+func getKeymapStages(sis values.System, keymap string) []schema.Stage {
+	if sis.Family == values.AlpineFamily {
+		// Alpine keymaps are stored as layout/variant, so de-latin1 is under de/de-latin1.bmap.gz
+		layout, _, _ := strings.Cut(keymap, "-")
+		return []schema.Stage{
+			{
+				Name: "Set keymap",
+				Commands: []string{
+					"mkdir -p /etc/keymap",
+					fmt.Sprintf("cp /usr/share/bkeymaps/%s/%s.bmap.gz /etc/keymap/%s.bmap.gz", layout, keymap, keymap),
+				},
+				Files: []schema.File{
+					{
+						Path:        "/etc/conf.d/keymaps",
+						Permissions: 0644,
+						Owner:       0,
+						Group:       0,
+						Content:     fmt.Sprintf("keymap=\"/etc/keymap/%s.bmap.gz\"\n", keymap),
+					},
+				},
+			},
+		}
+	}
+
+	// vconsole.conf is read by systemd and dracut on all the systemd based families
+	files := []schema.File{
+		{
+			Path:        "/etc/vconsole.conf",
+			Permissions: 0644,
+			Owner:       0,
+			Group:       0,
+			Content:     fmt.Sprintf("KEYMAP=%s\n", keymap),
+		},
+	}
+	if sis.Family == values.DebianFamily {
+		layout, _, _ := strings.Cut(keymap, "-")
+		files = append(files, schema.File{
+			Path:        "/etc/default/keyboard",
+			Permissions: 0644,
+			Owner:       0,
+			Group:       0,
+			Content:     fmt.Sprintf("XKBMODEL=\"pc105\"\nXKBLAYOUT=\"%s\"\nXKBVARIANT=\"\"\nXKBOPTIONS=\"\"\nBACKSPACE=\"guess\"\n", layout),
+		})
+	}
+	return []schema.Stage{
+		{
+			Name:  "Set keymap",
+			Files: files,
+		},
+	}
+}
@@ -0,0 +1,41 @@
+package stages
+
+import (
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// GetMicrocodeStage returns the stages that set up the early loading of the cpu microcode
+// dracut prepends the microcode to the initrd, so it works the same for grub and for the UKI built from it.
+// It needs to run before the initrd is built
+func GetMicrocodeStage(sis values.System, c config.Config, logger types.KairosLogger) []schema.Stage {
+	if !c.Microcode {
+		return []schema.Stage{}
+	}
+	if sis.Arch != values.ArchAMD64 {
+		logger.Logger.Warn().Str("arch", sis.Arch.String()).Msg("Microcode is only available on amd64, skipping")
+		return []schema.Stage{}
+	}
+	if sis.Family == values.AlpineFamily {
+		// mkinitfs has no early microcode support, the bootloader needs to load the ucode images from /boot before the initrd
+		logger.Logger.Warn().Msg("Early microcode loading is not supported by mkinitfs, the microcode images are left under /boot")
+		return []schema.Stage{}
+	}
+
+	return []schema.Stage{
+		{
+			Name: "Enable early microcode loading",
+			Files: []schema.File{
+				{
+					Path:        "/etc/dracut.conf.d/kairos-microcode.conf",
+					Permissions: 0644,
+					Owner:       0,
+					Group:       0,
+					Content:     "early_microcode=\"yes\"\n",
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,57 @@
+package stages
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/system"
+	"github.com/kairos-io/kairos-init/pkg/values"
+)
+
+// validateMirrors checks that the mirrors are set for known families, so a typo doesn't silently disable the failover
+func validateMirrors() error {
+	for family, mirrors := range config.DefaultConfig.Mirrors {
+		if _, ok := values.RepoRefreshCommands[values.Family(family)]; !ok {
+			return fmt.Errorf("mirrors set for unknown family %q", family)
+		}
+		for _, mirror := range mirrors {
+			if !strings.Contains(mirror, "://") {
+				return fmt.Errorf("mirror %q of the %s family is not an url", mirror, family)
+			}
+		}
+	}
+	return nil
+}
+
+// retryMirrors retries a package manager command that failed because of the mirror, as the arm64 ports mirrors often
+// fail under load. It is retried values.MirrorRetries times on the same mirror, and then the repos are switched to the
+// next mirror in the config, refreshing the repo metadata before retrying there, until there are no mirrors left.
+// The switched repos stay in the image
+func (c stageConsole) retryMirrors(cmd, name, out string, err error, opts ...func(*exec.Cmd)) (string, error) {
+	mirrors := config.DefaultConfig.Mirrors[string(c.sis.Family)]
+	if len(mirrors) == 0 {
+		return out, err
+	}
+	retry, failures := cmd, 0
+	for err != nil && c.ctx.Err() == nil && values.MirrorFailure(out+"\n"+err.Error()) {
+		failures++
+		if failures > values.MirrorRetries {
+			current := system.CurrentMirror(c.sis.Family, mirrors)
+			if current < 0 || current == len(mirrors)-1 {
+				c.logger.Logger.Warn().Strs("mirrors", mirrors).Msg("No mirror left to fail over to")
+				return out, err
+			}
+			files, replaceErr := system.ReplaceMirror(c.sis.Family, mirrors[current], mirrors[current+1])
+			if replaceErr != nil {
+				return out, fmt.Errorf("%w, and switching to the %s mirror failed: %s", err, mirrors[current+1], replaceErr)
+			}
+			c.logger.Logger.Warn().Strs("files", files).Msgf("The %s mirror keeps failing, switching to %s", mirrors[current], mirrors[current+1])
+			retry, failures = values.RepoRefreshCommands[c.sis.Family]+" && "+cmd, 0
+		}
+		c.logger.Logger.Warn().Msgf("The %s command failed on the mirror, retrying", name)
+		out, err = c.stream(retry, name, opts...)
+	}
+	return out, err
+}
@@ -0,0 +1,79 @@
+package stages
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// GetKernelModulesStage returns the stages that blacklist kernel modules and add modules to the initrd
+// It needs to run before the initrd is built so the changes end up in it
+func GetKernelModulesStage(sis values.System, c config.Config, logger types.KairosLogger) []schema.Stage {
+	var stages []schema.Stage
+	blacklist := append([]string{}, values.BlacklistedModules...)
+	blacklist = append(blacklist, c.KernelModules.Blacklist...)
+	if c.Nvidia {
+		// nouveau grabs the card before the proprietary driver can
+		blacklist = append(blacklist, "nouveau")
+	}
+	initrd := c.KernelModules.Initrd
+	logger.Logger.Debug().Strs("blacklist", blacklist).Strs("initrd", initrd).Msg("Kernel modules")
+
+	var content strings.Builder
+	content.WriteString("# Generated by kairos-init\n")
+	for _, module := range blacklist {
+		content.WriteString(fmt.Sprintf("blacklist %s\n", module))
+	}
+	stages = append(stages, schema.Stage{
+		Name: "Blacklist kernel modules",
+		Files: []schema.File{
+			{
+				Path:        "/etc/modprobe.d/kairos-blacklist.conf",
+				Permissions: 0644,
+				Owner:       0,
+				Group:       0,
+				Content:     content.String(),
+			},
+		},
+	})
+
+	if sis.Family == values.AlpineFamily {
+		if len(initrd) > 0 {
+			// mkinitfs takes the module paths relative to the modules dir from the features files
+			var commands []string
+			for _, module := range initrd {
+				commands = append(commands, fmt.Sprintf("find /lib/modules/*/ -name '%s.ko*' | sed 's|^/lib/modules/[^/]*/||' >> /etc/mkinitfs/features.d/kairos.modules", module))
+			}
+			commands = append(commands, "grep -q '^features=.*kairos' /etc/mkinitfs/mkinitfs.conf || sed -i 's/^features=\"\\(.*\\)\"/features=\"\\1 kairos\"/' /etc/mkinitfs/mkinitfs.conf")
+			stages = append(stages, schema.Stage{
+				Name:     "Add kernel modules to the initrd",
+				Commands: append([]string{"mkdir -p /etc/mkinitfs/features.d", "truncate -s 0 /etc/mkinitfs/features.d/kairos.modules"}, commands...),
+			})
+		}
+		return stages
+	}
+
+	// dracut copies the modprobe.d files into the initrd but would still add the modules if something requires them
+	dracutConf := fmt.Sprintf("omit_drivers+=\" %s \"\n", strings.Join(blacklist, " "))
+	if len(initrd) > 0 {
+		dracutConf += fmt.Sprintf("add_drivers+=\" %s \"\n", strings.Join(initrd, " "))
+	}
+	stages = append(stages, schema.Stage{
+		Name: "Set kernel modules for the initrd",
+		Files: []schema.File{
+			{
+				Path:        "/etc/dracut.conf.d/kairos-modules.conf",
+				Permissions: 0644,
+				Owner:       0,
+				Group:       0,
+				Content:     dracutConf,
+			},
+		},
+	})
+
+	return stages
+}
@@ -0,0 +1,90 @@
+package stages
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// GetNetworkStage returns the stages to set up the selected network stack
+// It removes the packages from the other stacks and writes the default DHCP config for the selected one.
+// The packages are installed on the install stage and the services are handled by the services stage
+func GetNetworkStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	var stages []schema.Stage
+	if c.NetworkStack == "" {
+		return stages, nil
+	}
+
+	stack, err := values.GetNetworkStack(sis, c.NetworkStack)
+	if err != nil {
+		return stages, err
+	}
+	logger.Logger.Debug().Str("stack", c.NetworkStack).Msg("Setting up network stack")
+
+	selected, err := values.FilterPackagesOnConstraint(sis, logger, values.GetVersionMaps(sis, stack.Packages))
+	if err != nil {
+		return stages, err
+	}
+	keep := map[string]bool{}
+	for _, pkg := range selected {
+		keep[pkg] = true
+	}
+	for name, other := range values.NetworkStacks {
+		if name.String() == c.NetworkStack {
+			continue
+		}
+		pkgs, err := values.FilterPackagesOnConstraint(sis, logger, values.GetVersionMaps(sis, other.Packages))
+		if err != nil {
+			return stages, err
+		}
+		for _, pkg := range pkgs {
+			if keep[pkg] {
+				continue
+			}
+			stages = append(stages, schema.Stage{
+				Name: fmt.Sprintf("Remove %s", pkg),
+				If:   values.PackageInstalledCheck(sis, pkg),
+				Packages: schema.Packages{
+					Remove: []string{pkg},
+				},
+			})
+		}
+	}
+	// Keep the order stable between runs
+	sort.SliceStable(stages, func(i, j int) bool {
+		return stages[i].Name < stages[j].Name
+	})
+
+	paths := make([]string, 0, len(stack.Files))
+	for path := range stack.Files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var files []schema.File
+	for _, path := range paths {
+		// NetworkManager ignores connection files readable by others, the rest need to be readable by the
+		// unprivileged users the daemons run as
+		var perms uint32 = 0644
+		if strings.HasSuffix(path, ".nmconnection") {
+			perms = 0600
+		}
+		files = append(files, schema.File{
+			Path:        path,
+			Permissions: perms,
+			Owner:       0,
+			Group:       0,
+			Content:     stack.Files[path],
+		})
+	}
+	stages = append(stages, schema.Stage{
+		Name:  fmt.Sprintf("Write default %s config", c.NetworkStack),
+		Files: files,
+	})
+
+	return stages, nil
+}
@@ -0,0 +1,72 @@
+package stages
+
+import (
+	"slices"
+	"sort"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// GetNvidiaRepoStage returns the stage that adds the NVIDIA driver and container toolkit repos
+// The packages are installed on the install stage and nouveau is blacklisted on the kernel modules stage
+func GetNvidiaRepoStage(sis values.System, logger types.KairosLogger) ([]schema.Stage, error) {
+	logger.Logger.Debug().Str("distro", sis.Distro.String()).Msg("Adding the NVIDIA repos")
+	commands, err := values.NvidiaRepoCommands(sis)
+	if err != nil {
+		return []schema.Stage{}, err
+	}
+	return []schema.Stage{
+		{
+			Name:     "Add NVIDIA repos",
+			Commands: commands,
+		},
+	}, nil
+}
+
+// GetNvidiaContainerStage returns the stage that sets the nvidia runtime as the default of the container runtime and the
+// kubernetes provider, so GPU workloads work on first boot. It runs after the container runtime config is written, as
+// nvidia-ctk edits it. The toolkit is installed on the install stage with the nvidia-container feature
+func GetNvidiaContainerStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	features, err := values.EnabledFeatures(sis, c)
+	if err != nil {
+		return []schema.Stage{}, err
+	}
+	if !slices.Contains(features, values.NvidiaContainerFeature) {
+		return []schema.Stage{}, nil
+	}
+
+	commands := values.NvidiaRuntimeCommands(c)
+	contents := values.NvidiaRuntimeFiles(c)
+	if len(commands) == 0 && len(contents) == 0 {
+		logger.Logger.Warn().Msg("No container runtime or kubernetes provider to set the nvidia runtime on, only the toolkit is installed")
+		return []schema.Stage{}, nil
+	}
+	logger.Logger.Debug().Strs("commands", commands).Msg("Setting the nvidia runtime as the default")
+
+	paths := make([]string, 0, len(contents))
+	for path := range contents {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var files []schema.File
+	for _, path := range paths {
+		files = append(files, schema.File{
+			Path:        path,
+			Permissions: 0644,
+			Owner:       0,
+			Group:       0,
+			Content:     contents[path],
+		})
+	}
+
+	return []schema.Stage{
+		{
+			Name:     "Set the nvidia container runtime as the default",
+			Commands: commands,
+			Files:    files,
+		},
+	}, nil
+}
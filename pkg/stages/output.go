@@ -0,0 +1,67 @@
+package stages
+
+import (
+	"strings"
+	"sync"
+)
+
+// outputLineMax is the longest line of command output that is logged, the rest of the line is dropped
+const outputLineMax = 4096
+
+// outputLogger is the stdout and stderr of a command, logging each line as it comes and keeping only the last ones for
+// the error report, so a long package manager run doesnt pile up in memory
+type outputLogger struct {
+	mu   sync.Mutex
+	log  func(line string)
+	line []byte
+	// cr is set after a \r, which the package managers use to redraw their progress on the same line
+	cr   bool
+	tail []string
+}
+
+func newOutputLogger(log func(line string)) *outputLogger {
+	return &outputLogger{log: log}
+}
+
+func (o *outputLogger) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, b := range p {
+		switch {
+		case b == '\n':
+			o.flush()
+		case b == '\r':
+			o.cr = true
+		default:
+			// Only the last redraw of a progress line is kept
+			if o.cr {
+				o.line, o.cr = o.line[:0], false
+			}
+			if len(o.line) < outputLineMax {
+				o.line = append(o.line, b)
+			}
+		}
+	}
+	return len(p), nil
+}
+
+func (o *outputLogger) flush() {
+	line := string(o.line)
+	o.line, o.cr = o.line[:0], false
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	o.log(line)
+	o.tail = append(o.tail, line)
+	if len(o.tail) > errorReportLines {
+		o.tail = o.tail[1:]
+	}
+}
+
+// Tail returns the last lines of the output, up to errorReportLines
+func (o *outputLogger) Tail() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.flush()
+	return strings.Join(o.tail, "\n")
+}
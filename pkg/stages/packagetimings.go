@@ -0,0 +1,87 @@
+package stages
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/kairos-init/pkg/system"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// slowestInstalls is how many of the slowest package installs the build report text shows
+const slowestInstalls = 10
+
+// PackageTiming is the wall time of a package install command, with the packages its step asked for. With the base
+// packages installed in batches, see batchInstall, it tells which ones dominate the build time
+type PackageTiming struct {
+	Stage    string   `json:"stage"`
+	Step     string   `json:"step"`
+	Packages []string `json:"packages"`
+	Seconds  float64  `json:"seconds"`
+	// Downloaded are the bytes received over the network while the command run
+	Downloaded int64 `json:"downloaded_bytes"`
+}
+
+// PackageTimings are the timings of the package installs run so far, in run order
+var PackageTimings []PackageTiming
+
+// batchInstall returns the steps that install the packages, refreshing the repos and upgrading the system first. With
+// a batch size they are installed that many at a time, each batch on its own step so it is timed on its own, which
+// makes the whole install slower as the package manager runs once per batch
+func batchInstall(name string, pkgs []string, batch int) []schema.Stage {
+	if batch <= 0 || batch >= len(pkgs) {
+		return []schema.Stage{{Name: name, Packages: schema.Packages{Install: pkgs, Refresh: true, Upgrade: true}}}
+	}
+	var steps []schema.Stage
+	total := (len(pkgs) + batch - 1) / batch
+	for i := 0; i < len(pkgs); i += batch {
+		steps = append(steps, schema.Stage{
+			Name:     fmt.Sprintf("%s (batch %d/%d)", name, len(steps)+1, total),
+			Packages: schema.Packages{Install: pkgs[i:min(i+batch, len(pkgs))], Refresh: i == 0, Upgrade: i == 0},
+		})
+	}
+	return steps
+}
+
+// installStep returns the step that installs the packages of the command and its packages, if the command is the
+// install of a package step
+func installStep(steps []schema.Stage, cmd string) (string, []string) {
+	for _, step := range steps {
+		if len(step.Packages.Install) > 0 && strings.Contains(cmd, " "+step.Packages.Install[0]) {
+			return step.Name, step.Packages.Install
+		}
+	}
+	return "", nil
+}
+
+// recordPackageTiming records how long the package install of the command took, if it is one
+func recordPackageTiming(stage string, steps []schema.Stage, cmd string, start time.Time, received int64) {
+	step, pkgs := installStep(steps, cmd)
+	if pkgs == nil {
+		return
+	}
+	PackageTimings = append(PackageTimings, PackageTiming{
+		Stage:      stage,
+		Step:       step,
+		Packages:   pkgs,
+		Seconds:    time.Since(start).Seconds(),
+		Downloaded: system.ReceivedBytes() - received,
+	})
+}
+
+// slowestPackageTimings returns the package installs, the slowest first
+func slowestPackageTimings() []PackageTiming {
+	timings := slices.Clone(PackageTimings)
+	slices.SortStableFunc(timings, func(a, b PackageTiming) int {
+		switch {
+		case a.Seconds > b.Seconds:
+			return -1
+		case a.Seconds < b.Seconds:
+			return 1
+		}
+		return 0
+	})
+	return timings
+}
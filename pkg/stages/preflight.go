@@ -0,0 +1,96 @@
+package stages
+
+import (
+	"fmt"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/system"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+)
+
+// preflightCheck is a resource that a stage needs before it runs
+type preflightCheck struct {
+	what      string
+	available int64
+	needed    int64
+	option    string
+}
+
+// ValidatePreflight checks the preflight size values, so a wrong value fails before the build
+func ValidatePreflight() error {
+	preflight := config.DefaultConfig.Preflight
+	for option, size := range map[string]string{"disk": preflight.Disk, "tmp": preflight.Tmp, "memory": preflight.Memory} {
+		if size == "" {
+			continue
+		}
+		if _, err := system.ParseSize(size); err != nil {
+			return fmt.Errorf("invalid preflight %s size: %w", option, err)
+		}
+	}
+	return nil
+}
+
+// preflightSize returns the configured size for a preflight check, or the estimate if not set
+func preflightSize(size string, estimate int64) int64 {
+	if size == "" {
+		return estimate
+	}
+	bytes, _ := system.ParseSize(size)
+	return bytes
+}
+
+// Preflight checks that the builder has the free disk space and memory that the install or init stage needs, so the
+// build fails right away with a clear message instead of halfway through the packages or the initrd with ENOSPC
+func Preflight(sis values.System, stage string, logger types.KairosLogger) error {
+	preflight := config.DefaultConfig.Preflight
+	if preflight.Skip {
+		logger.Logger.Debug().Msg("Skipping the preflight checks")
+		return nil
+	}
+
+	var checks []preflightCheck
+	disk := preflightSize(preflight.Disk, values.PreflightDisk[sis.Family])
+	if stage != "install" {
+		disk = values.PreflightInitDisk
+	}
+	free, err := system.FreeSpace("/")
+	if err != nil {
+		logger.Logger.Warn().Err(err).Msg("Could not check the free space of the rootfs")
+	} else {
+		checks = append(checks, preflightCheck{what: "free space on /", available: free, needed: disk, option: "disk"})
+	}
+	if stage != "install" {
+		tmpDir := values.InitrdTmpDir(sis.Family)
+		free, err = system.FreeSpace(tmpDir)
+		if err != nil {
+			logger.Logger.Warn().Err(err).Str("dir", tmpDir).Msg("Could not check the free space to build the initrd")
+		} else {
+			checks = append(checks, preflightCheck{
+				what:      fmt.Sprintf("free space on %s to build the initrd", tmpDir),
+				available: free,
+				needed:    preflightSize(preflight.Tmp, values.PreflightTmp),
+				option:    "tmp",
+			})
+		}
+	}
+	if memory := system.AvailableMemory(); memory > 0 {
+		checks = append(checks, preflightCheck{
+			what:      "available memory",
+			available: memory,
+			needed:    preflightSize(preflight.Memory, values.PreflightMemory),
+			option:    "memory",
+		})
+	}
+
+	for _, check := range checks {
+		logger.Logger.Debug().Str("check", check.what).Str("available", system.HumanSize(check.available)).
+			Str("needed", system.HumanSize(check.needed)).Msg("Preflight check")
+		if check.available < check.needed {
+			return fmt.Errorf("not enough %s for the %s stage: %s available, about %s needed. Increase the resources of the builder, "+
+				"or set preflight.%s in the config to change the estimate", check.what, stage, system.HumanSize(check.available),
+				system.HumanSize(check.needed), check.option)
+		}
+	}
+	return nil
+}
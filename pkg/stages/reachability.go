@@ -0,0 +1,245 @@
+package stages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/system"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// reachabilityTimeout is how long to wait for each DNS lookup and connection
+const reachabilityTimeout = 5 * time.Second
+
+// commandURL matches the urls that the commands of a stage download from, like the curl ones
+var commandURL = regexp.MustCompile(`https?://[^\s'"]+`)
+
+// endpoint is an url that a stage needs to reach, with what needs it
+type endpoint struct {
+	url    string
+	source string
+}
+
+// reachability is the result of checking a host, with the endpoints that need it
+type reachability struct {
+	host     string
+	sources  []string
+	resolved bool
+	// notFound is set when the DNS answered that the host does not exist, as opposed to the DNS not answering
+	notFound bool
+	err      error
+}
+
+// stageEndpoints returns the urls that the stages need: the package repos if any step installs packages, the
+// registries of the images to unpack, the downloads and the urls in the commands
+func stageEndpoints(sis values.System, data schema.YipConfig) []endpoint {
+	var endpoints []endpoint
+	needsRepos := false
+	names := make([]string, 0, len(data.Stages))
+	for name := range data.Stages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, step := range data.Stages[name] {
+			source := fmt.Sprintf("the %q step", step.Name)
+			if len(step.Packages.Install) > 0 || step.Packages.Refresh || step.Packages.Upgrade {
+				needsRepos = true
+			}
+			for _, image := range step.UnpackImages {
+				endpoints = append(endpoints, endpoint{url: registryURL(image.Source), source: source})
+			}
+			for _, download := range step.Downloads {
+				endpoints = append(endpoints, endpoint{url: download.URL, source: source})
+			}
+			for _, cmd := range step.Commands {
+				for _, u := range commandURL.FindAllString(cmd, -1) {
+					endpoints = append(endpoints, endpoint{url: u, source: source})
+				}
+			}
+		}
+	}
+	if needsRepos {
+		for _, repo := range system.Repos(sis.Family) {
+			// The stages fail over to the next mirror if this one is down
+			if system.HasFallbackMirror(repo.URL, config.DefaultConfig.Mirrors[string(sis.Family)]) {
+				continue
+			}
+			endpoints = append(endpoints, endpoint{url: repo.URL, source: repo.File})
+		}
+	}
+	return endpoints
+}
+
+// registryURL returns the url of the registry of an image reference, docker hub if it has no registry
+func registryURL(image string) string {
+	host, _, found := strings.Cut(image, "/")
+	if !found || (!strings.ContainsAny(host, ".:") && host != "localhost") {
+		host = "registry-1.docker.io"
+	}
+	return "https://" + host
+}
+
+// isLocal returns true for the urls that dont need the network, like file:// repos or a mirror on localhost
+func isLocal(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" || u.Scheme == "file" || u.Scheme == "cdrom" {
+		return err == nil
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// NetworkPreflight checks that the hosts the stages need are reachable before running them, telling apart a build
+// environment without network or DNS from a repo with a wrong host. With offline set it checks instead that nothing in
+// the stages needs the network, listing what does
+func NetworkPreflight(sis values.System, data schema.YipConfig, logger types.KairosLogger) error {
+	if err := validateMirrors(); err != nil {
+		return err
+	}
+	endpoints := stageEndpoints(sis, data)
+	if config.DefaultConfig.Offline {
+		var remote []string
+		for _, e := range endpoints {
+			if line := fmt.Sprintf("%s, from %s", e.url, e.source); !isLocal(e.url) && !slices.Contains(remote, line) {
+				remote = append(remote, line)
+			}
+		}
+		if len(remote) > 0 {
+			return fmt.Errorf("the build is set as offline, but it needs the network for:\n  %s", strings.Join(remote, "\n  "))
+		}
+		logger.Logger.Info().Msg("Nothing in the stages needs the network")
+		return nil
+	}
+	if config.DefaultConfig.Preflight.Skip {
+		return nil
+	}
+
+	// Check each host once, or the proxy instead if the url goes through one
+	hosts := map[string]*reachability{}
+	for _, e := range endpoints {
+		u, err := url.Parse(e.url)
+		if err != nil || isLocal(e.url) || u.Host == "" || strings.Contains(u.Host, "$") {
+			continue
+		}
+		if proxy, err := http.ProxyFromEnvironment(&http.Request{URL: u}); err == nil && proxy != nil {
+			u = proxy
+		}
+		host := u.Host
+		if u.Port() == "" {
+			port := "443"
+			if u.Scheme == "http" {
+				port = "80"
+			} else if u.Scheme == "ftp" {
+				port = "21"
+			}
+			host = net.JoinHostPort(u.Hostname(), port)
+		}
+		if hosts[host] == nil {
+			hosts[host] = &reachability{host: host}
+		}
+		if !slices.Contains(hosts[host].sources, e.source) {
+			hosts[host].sources = append(hosts[host].sources, e.source)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for _, r := range hosts {
+		wg.Add(1)
+		go func(r *reachability) {
+			defer wg.Done()
+			checkReachability(r)
+		}(r)
+	}
+	wg.Wait()
+
+	results := make([]*reachability, 0, len(hosts))
+	resolved, reached := 0, 0
+	for _, r := range hosts {
+		results = append(results, r)
+		if r.resolved {
+			resolved++
+		}
+		if r.err == nil {
+			reached++
+		}
+		logger.Logger.Debug().Str("host", r.host).Bool("resolved", r.resolved).Err(r.err).Msg("Network preflight")
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].host < results[j].host })
+	if reached == len(results) {
+		return nil
+	}
+
+	offlineHint := "If the build is meant to run without network, pass --offline to check that nothing needs it instead"
+	switch {
+	case resolved == 0:
+		return fmt.Errorf("none of the %d hosts the build needs could be resolved, DNS is not working or the build "+
+			"environment has no network. Check the network and DNS of the builder. %s:\n  %s", len(results), offlineHint, unreachableList(results))
+	case reached == 0:
+		return fmt.Errorf("none of the %d hosts the build needs could be reached, the build environment has no network "+
+			"access. Check the network of the builder or set HTTPS_PROXY if it needs a proxy. %s:\n  %s", len(results), offlineHint, unreachableList(results))
+	}
+	return fmt.Errorf("some of the hosts the build needs are not reachable while others are, check for a typo or a "+
+		"down mirror in where they are set:\n  %s", unreachableList(results))
+}
+
+// checkReachability resolves the host and connects to it
+func checkReachability(r *reachability) {
+	ctx, cancel := context.WithTimeout(context.Background(), reachabilityTimeout)
+	defer cancel()
+	hostname, _, _ := net.SplitHostPort(r.host)
+	if net.ParseIP(hostname) == nil {
+		if _, err := net.DefaultResolver.LookupHost(ctx, hostname); err != nil {
+			var dnsErr *net.DNSError
+			r.notFound = errors.As(err, &dnsErr) && dnsErr.IsNotFound
+			r.err = err
+			return
+		}
+	}
+	r.resolved = true
+	conn, err := (&net.Dialer{Timeout: reachabilityTimeout}).DialContext(ctx, "tcp", r.host)
+	if err != nil {
+		r.err = err
+		return
+	}
+	_ = conn.Close()
+}
+
+// unreachableList returns a line for each host that failed, with why and what needs it
+func unreachableList(results []*reachability) string {
+	var lines []string
+	for _, r := range results {
+		if r.err == nil {
+			continue
+		}
+		reason := "is not reachable"
+		switch {
+		case r.notFound:
+			reason = "does not exist in DNS"
+		case !r.resolved:
+			reason = "could not be resolved"
+		}
+		lines = append(lines, fmt.Sprintf("%s %s (%s), needed by %s", r.host, reason, r.err, strings.Join(r.sources, ", ")))
+	}
+	return strings.Join(lines, "\n  ")
+}
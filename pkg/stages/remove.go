@@ -0,0 +1,46 @@
+package stages
+
+import (
+	"fmt"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// GetRemovePackagesStage returns the stages that remove the packages of values.RemovePackages from the base image
+// Packages that the install stage installs are kept, so a map entry can't undo what the image needs
+func GetRemovePackagesStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	var stages []schema.Stage
+
+	installed, err := values.GetPackages(sis, c, logger)
+	if err != nil {
+		return stages, err
+	}
+	keep := map[string]bool{}
+	for _, pkg := range installed {
+		keep[pkg] = true
+	}
+
+	remove, err := values.FilterPackagesOnConstraint(sis, logger, values.GetVersionMaps(sis, values.RemovePackages))
+	if err != nil {
+		return stages, err
+	}
+	// Already sorted, so the stages keep the same order between runs
+	for _, pkg := range remove {
+		if keep[pkg] {
+			logger.Logger.Debug().Str("package", pkg).Msg("Keeping package as the install stage installs it")
+			continue
+		}
+		// Only remove the packages that are there, as not all package managers are happy removing missing packages
+		stages = append(stages, schema.Stage{
+			Name: fmt.Sprintf("Remove %s", pkg),
+			If:   values.PackageInstalledCheck(sis, pkg),
+			Packages: schema.Packages{
+				Remove: []string{pkg},
+			},
+		})
+	}
+	return stages, nil
+}
@@ -0,0 +1,94 @@
+package stages
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/system"
+	"github.com/kairos-io/kairos-sdk/types"
+)
+
+// BuildReport shows where the build time went, per stage and per package install
+type BuildReport struct {
+	Stages     []StageTiming `json:"stages"`
+	Sizes      []StageSize   `json:"sizes,omitempty"`
+	Seconds    float64       `json:"seconds"`
+	Packages   int           `json:"packages"`
+	Downloaded int64         `json:"downloaded_bytes"`
+	// PackageInstalls are the package install commands, the slowest first
+	PackageInstalls []PackageTiming `json:"package_installs,omitempty"`
+}
+
+// GetBuildReport returns the report for the stages run so far
+func GetBuildReport() BuildReport {
+	report := BuildReport{Stages: Timings, Sizes: Sizes, PackageInstalls: slowestPackageTimings()}
+	for _, timing := range Timings {
+		report.Seconds += timing.Seconds
+		report.Packages += len(timing.Packages)
+		report.Downloaded += timing.Downloaded
+	}
+	return report
+}
+
+// String returns the report as a table, with the rootfs growth if it was tracked
+func (r BuildReport) String() string {
+	growth := map[string]int64{}
+	for _, size := range r.Sizes {
+		growth[size.Stage] = size.Bytes
+	}
+	var out strings.Builder
+	out.WriteString(fmt.Sprintf("%-16s %10s %10s %12s %12s\n", "STAGE", "TIME", "PACKAGES", "DOWNLOADED", "GROWTH"))
+	for _, timing := range r.Stages {
+		stageGrowth := "-"
+		if size, ok := growth[timing.Stage]; ok {
+			stageGrowth = system.HumanSize(size)
+		}
+		out.WriteString(fmt.Sprintf("%-16s %9.1fs %10d %12s %12s\n", timing.Stage, timing.Seconds, len(timing.Packages), system.HumanSize(timing.Downloaded), stageGrowth))
+	}
+	out.WriteString(fmt.Sprintf("%-16s %9.1fs %10d %12s %12s\n", "TOTAL", r.Seconds, r.Packages, system.HumanSize(r.Downloaded), ""))
+	if len(r.PackageInstalls) > 0 {
+		out.WriteString(fmt.Sprintf("\n%-16s %10s %12s  %s\n", "SLOWEST INSTALLS", "TIME", "DOWNLOADED", "PACKAGES"))
+		for _, timing := range r.PackageInstalls[:min(slowestInstalls, len(r.PackageInstalls))] {
+			out.WriteString(fmt.Sprintf("%-16s %9.1fs %12s  %s\n", timing.Stage, timing.Seconds, system.HumanSize(timing.Downloaded), packageList(timing.Packages)))
+		}
+	}
+	return out.String()
+}
+
+// WriteBuildReport logs the build report and writes it as text and json to the report output dir, if set
+func WriteBuildReport(l types.KairosLogger) error {
+	report := GetBuildReport()
+	l.Infof("Build report:\n%s", report.String())
+
+	output := config.DefaultConfig.Report.Output
+	if output == "" {
+		return nil
+	}
+	if err := os.MkdirAll(output, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	for name, content := range map[string][]byte{"build-report.json": data, "build-report.txt": []byte(report.String())} {
+		if err = os.WriteFile(filepath.Join(output, name), content, 0644); err != nil {
+			return fmt.Errorf("could not write the build report: %w", err)
+		}
+	}
+	l.Logger.Info().Str("path", output).Msg("Build report written")
+	return nil
+}
+
+// packageList returns the first packages of a batch, as a batch of the whole install would not fit on a line
+func packageList(pkgs []string) string {
+	const shown = 6
+	if len(pkgs) <= shown {
+		return strings.Join(pkgs, " ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(pkgs[:shown], " "), len(pkgs)-shown)
+}
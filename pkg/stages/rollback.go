@@ -0,0 +1,52 @@
+package stages
+
+import (
+	"context"
+	"slices"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/console"
+	"github.com/mudler/yip/pkg/executor"
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/twpayne/go-vfs/v5"
+)
+
+// rollbackPackages removes the packages that the given stages installed, from their timings, so a failed kairos-init
+// stage doesn't leave a half installed layer behind that could be cached or shipped. Packages that were upgraded are
+// kept at their new version, as the package managers cant reliably go back to the previous one
+// An interrupted stage is not rolled back, as the package manager was stopped halfway and would need to be repaired
+// first, and it would hold up the exit that was asked for
+func rollbackPackages(ctx context.Context, timings []StageTiming, logger types.KairosLogger) {
+	if config.DefaultConfig.NoRollback || ctx.Err() != nil {
+		logger.Logger.Warn().Msg("Keeping the packages installed by the failed stage, the rootfs is not fit to be shipped")
+		return
+	}
+	var pkgs []string
+	for _, timing := range timings {
+		for _, pkg := range timing.Packages {
+			if !slices.Contains(pkgs, pkg) {
+				pkgs = append(pkgs, pkg)
+			}
+		}
+	}
+	if len(pkgs) == 0 {
+		return
+	}
+
+	logger.Logger.Info().Strs("packages", pkgs).Msg("Removing the packages installed by the failed stage")
+	data := schema.YipConfig{Stages: map[string][]schema.Stage{
+		"rollback": {
+			{
+				Name:     "Remove the packages installed by the failed stage",
+				Packages: schema.Packages{Remove: pkgs},
+			},
+		},
+	}}
+	rollbackExecutor := executor.NewExecutor(executor.WithLogger(logger))
+	yipConsole := console.NewStandardConsole(console.WithLogger(logger))
+	if err := rollbackExecutor.Run("rollback", vfs.OSFS, yipConsole, data.ToString()); err != nil {
+		// The stage already failed, so this is only logged and the rootfs is left as it is
+		logger.Logger.Error().Msgf("Failed to remove the packages installed by the failed stage, the rootfs is not fit to be shipped: %s", err)
+	}
+}
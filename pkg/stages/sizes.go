@@ -0,0 +1,82 @@
+package stages
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/system"
+	"github.com/kairos-io/kairos-sdk/types"
+)
+
+// StageSize is how much a yip stage grew the rootfs, negative if it freed space
+type StageSize struct {
+	Stage string `json:"stage"`
+	Bytes int64  `json:"bytes"`
+	Total int64  `json:"total"`
+}
+
+// Sizes are the rootfs growth of the stages run so far, in run order. Only tracked when a size budget is set, as
+// measuring the rootfs takes a while
+var Sizes []StageSize
+
+// budgetStages are the stages that can have their own budget
+var budgetStages = []string{"before-install", "install", "after-install", "before-init", "init", "after-init", "cleanup"}
+
+func sizeBudgetEnabled() bool {
+	return config.DefaultConfig.SizeBudget.Total != "" || len(config.DefaultConfig.SizeBudget.Stages) > 0
+}
+
+// ValidateSizeBudget checks the size budget values, so a wrong value fails before the build and not after a long stage
+func ValidateSizeBudget() error {
+	budget := config.DefaultConfig.SizeBudget
+	if budget.Total != "" {
+		if _, err := system.ParseSize(budget.Total); err != nil {
+			return fmt.Errorf("invalid total size budget: %w", err)
+		}
+	}
+	for stage, size := range budget.Stages {
+		if !slices.Contains(budgetStages, stage) {
+			return fmt.Errorf("invalid size budget stage %s, possible values are %v", stage, budgetStages)
+		}
+		if _, err := system.ParseSize(size); err != nil {
+			return fmt.Errorf("invalid size budget for the %s stage: %w", stage, err)
+		}
+	}
+	return nil
+}
+
+// rootfsSize returns the current rootfs size if a budget is set, to pass to recordSize after the stage runs
+func rootfsSize() int64 {
+	if !sizeBudgetEnabled() {
+		return 0
+	}
+	return system.RootfsSize()
+}
+
+// recordSize records the rootfs growth of a stage and fails if it goes over the budget for the stage. The total budget
+// is only checked after the last stage, as the package caches are still around until the cleanup
+func recordSize(stage string, before int64, logger types.KairosLogger) error {
+	if !sizeBudgetEnabled() {
+		return nil
+	}
+	after := system.RootfsSize()
+	Sizes = append(Sizes, StageSize{Stage: stage, Bytes: after - before, Total: after})
+	logger.Logger.Info().Str("stage", stage).Str("growth", system.HumanSize(after-before)).Str("total", system.HumanSize(after)).Msg("Rootfs size")
+
+	budget := config.DefaultConfig.SizeBudget
+	if limit, ok := budget.Stages[stage]; ok {
+		limitBytes, _ := system.ParseSize(limit)
+		if after-before > limitBytes {
+			return fmt.Errorf("the %s stage grew the rootfs by %s, over its %s budget", stage, system.HumanSize(after-before), limit)
+		}
+	}
+	last := stage == "cleanup" || (stage == "after-install" && config.DefaultConfig.Stage == "install")
+	if budget.Total != "" && last {
+		totalBytes, _ := system.ParseSize(budget.Total)
+		if after > totalBytes {
+			return fmt.Errorf("the rootfs is %s, over the %s budget", system.HumanSize(after), budget.Total)
+		}
+	}
+	return nil
+}
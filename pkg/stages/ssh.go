@@ -0,0 +1,88 @@
+package stages
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+const sshdDropInDir = "/etc/ssh/sshd_config.d"
+
+// GetSSHStage returns the stages to write the sshd hardening drop-in
+// Only done if enabled in the config, and the drop-in dir is used so we dont need to modify the distro sshd_config
+func GetSSHStage(_ values.System, c config.Config, logger types.KairosLogger) []schema.Stage {
+	var stages []schema.Stage
+	sshConfig := c.SSH
+	if !sshConfig.Harden {
+		return stages
+	}
+
+	// sshd uses the first value found for each option, so the include needs to go at the top of the file
+	// Older distros (like Rocky 8) dont have the include on their default config.
+	// SUSE ships the default config under /usr/etc/ssh/sshd_config on newer versions which already includes the
+	// drop-in dir, so we only patch the file if its under /etc
+	stages = append(stages, schema.Stage{
+		Name: "Include sshd drop-in dir",
+		If:   fmt.Sprintf("test -f /etc/ssh/sshd_config && ! grep -q '^Include %s' /etc/ssh/sshd_config", sshdDropInDir),
+		Commands: []string{
+			fmt.Sprintf("sed -i '1i Include %s/*.conf' /etc/ssh/sshd_config", sshdDropInDir),
+		},
+	})
+
+	permitRootLogin := sshConfig.PermitRootLogin
+	if permitRootLogin == "" {
+		permitRootLogin = "no"
+	}
+	passwordAuth := "no"
+	if sshConfig.PasswordAuthentication {
+		passwordAuth = "yes"
+	}
+
+	var content strings.Builder
+	content.WriteString("# Generated by kairos-init\n")
+	if sshConfig.Port != 0 {
+		content.WriteString(fmt.Sprintf("Port %d\n", sshConfig.Port))
+	}
+	content.WriteString(fmt.Sprintf("PasswordAuthentication %s\n", passwordAuth))
+	// ChallengeResponseAuthentication is deprecated on newer versions but still accepted, while
+	// KbdInteractiveAuthentication is not known by older versions (Ubuntu 20.04, Rocky 8)
+	content.WriteString(fmt.Sprintf("ChallengeResponseAuthentication %s\n", passwordAuth))
+	content.WriteString(fmt.Sprintf("PermitRootLogin %s\n", permitRootLogin))
+	if len(sshConfig.Ciphers) > 0 {
+		content.WriteString(fmt.Sprintf("Ciphers %s\n", strings.Join(sshConfig.Ciphers, ",")))
+	}
+	if len(sshConfig.MACs) > 0 {
+		content.WriteString(fmt.Sprintf("MACs %s\n", strings.Join(sshConfig.MACs, ",")))
+	}
+	if len(sshConfig.KexAlgorithms) > 0 {
+		content.WriteString(fmt.Sprintf("KexAlgorithms %s\n", strings.Join(sshConfig.KexAlgorithms, ",")))
+	}
+	logger.Logger.Debug().Str("content", content.String()).Msg("sshd drop-in")
+
+	stages = append(stages, schema.Stage{
+		Name: "Write sshd hardening drop-in",
+		Directories: []schema.Directory{
+			{
+				Path:        sshdDropInDir,
+				Permissions: 0755,
+				Owner:       0,
+				Group:       0,
+			},
+		},
+		Files: []schema.File{
+			{
+				Path:        fmt.Sprintf("%s/10-kairos.conf", sshdDropInDir),
+				Permissions: 0600,
+				Owner:       0,
+				Group:       0,
+				Content:     content.String(),
+			},
+		},
+	})
+
+	return stages
+}
@@ -1,15 +1,20 @@
+// Package stages builds and runs the yip stages of kairos-init. The Get* functions build the stages from the system and
+// the config they are passed, never from config.DefaultConfig, so any config can be resolved. The Run* functions read
+// config.DefaultConfig once, as set from the flags and the config file, and pass it down. The runtime checks around a
+// run (preflight, reports, rollback and the size budgets) read config.DefaultConfig directly
 package stages
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
-	"regexp"
+	"slices"
 	"sort"
 	"strings"
 
 	semver "github.com/hashicorp/go-version"
 	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/release"
 	"github.com/kairos-io/kairos-init/pkg/system"
 	"github.com/kairos-io/kairos-init/pkg/values"
 	"github.com/kairos-io/kairos-sdk/types"
@@ -19,7 +24,7 @@ import (
 	"github.com/twpayne/go-vfs/v5"
 )
 
-func getLatestKernel(l types.KairosLogger) (string, error) {
+func getLatestKernel(c config.Config, l types.KairosLogger) (string, error) {
 	var kernelVersion string
 	modulesPath := "/lib/modules"
 	// Read the directories under /lib/modules
@@ -28,6 +33,10 @@ func getLatestKernel(l types.KairosLogger) (string, error) {
 		l.Logger.Error().Msgf("Failed to read the directory %s: %s", modulesPath, err)
 		return kernelVersion, err
 	}
+	// The fallback kernel is handled on its own, see GetFallbackKernelStage
+	dirs = slices.DeleteFunc(dirs, func(dir os.DirEntry) bool {
+		return isFallbackKernel(c, dir.Name())
+	})
 
 	var versions []*semver.Version
 	var version *semver.Version
@@ -63,183 +72,76 @@ func getLatestKernel(l types.KairosLogger) (string, error) {
 	return kernelVersion, nil
 }
 
-func GetKairosReleaseStage(sis values.System, log types.KairosLogger) []schema.Stage {
-	// TODO: Expand tis as this doesn't cover all the current fields
-	// Current missing fields
-	/*
-			KAIROS_VERSION_ID="v3.2.4-36-g24ca209-v1.32.0-k3s1"
-			KAIROS_GITHUB_REPO="kairos-io/kairos"
-			KAIROS_IMAGE_REPO="quay.io/kairos/ubuntu:24.04-standard-amd64-generic-v3.2.4-36-g24ca209-k3sv1.32.0-k3s1"
-			KAIROS_ARTIFACT="kairos-ubuntu-24.04-standard-amd64-generic-v3.2.4-36-g24ca209-k3sv1.32.0+k3s1"
-			KAIROS_PRETTY_NAME="kairos-standard-ubuntu-24.04 v3.2.4-36-g24ca209-v1.32.0-k3s1"
-
-		VERSION_ID and VERSION are the same, needed ?
-		RELEASE is the short version of VERSION and VERSION_ID, the version without the k3s version needed?
-		ARTIFACT is just the IMAGE_LABEL with the OS and OS VERSION in front, useless?
-		GITHUB_REPO is the repo where the image is stored, not really needed?
-		PRETTY_NAME is the same as the ID_LIKE but different? needed?
-
-	*/
-
-	idLike := fmt.Sprintf("kairos-%s-%s-%s", config.DefaultConfig.Variant, sis.Distro.String(), sis.Version)
-	flavor := sis.Distro.String()
-	flavorRelease := sis.Version
-
-	// TODO: Check if this affects sles versions? I don't think so as they are set like registry.suse.com/bci/bci-micro:15.6
-	if strings.Contains(flavor, "opensuse") {
-		// We store the suse version under the flavorRelease for some reason
-		// So opensuse-leap:15.5 will be stored as `leap-15.5` with flavor being plain `opensuse`
-		// Its a bit iffy IMHO but this is done so all opensuse stuff goes under the same repo instead of having
-		// a repo for opensuse-leap and a repo for opensuse-tumbleweed
-		flavorSplitted := strings.Split(flavor, "-")
-		if len(flavorSplitted) == 2 {
-			flavor = flavorSplitted[0]
-			flavorRelease = fmt.Sprintf("%s-%s", flavorSplitted[1], sis.Version)
-		} else {
-			log.Debugf("Failed to split the flavor %s", flavor)
-		}
-	}
-	// "24.04-standard-amd64-generic-v3.2.4-36-g24ca209-k3sv1.32.0-k3s1"
-	// We are not doing the k3s software version here
-	imageLabel := fmt.Sprintf("%s-%s-%s-%s-%s", flavorRelease, config.DefaultConfig.Variant, sis.Arch.String(), config.DefaultConfig.Model, config.DefaultConfig.KairosVersion.String())
-
-	env := map[string]string{
-		"KAIROS_ID":                "kairos", // What for?
-		"KAIROS_ID_LIKE":           idLike,   // What for?
-		"KAIROS_NAME":              idLike,   // What for? Same as ID_LIKE
-		"KAIROS_VERSION":           config.DefaultConfig.KairosVersion.String(),
-		"KAIROS_ARCH":              sis.Arch.String(),
-		"KAIROS_TARGETARCH":        sis.Arch.String(), // What for? Same as ARCH
-		"KAIROS_FLAVOR":            flavor,
-		"KAIROS_FLAVOR_RELEASE":    flavorRelease,
-		"KAIROS_FAMILY":            sis.Family.String(),
-		"KAIROS_MODEL":             config.DefaultConfig.Model, // NEEDED or it breaks boot!
-		"KAIROS_VARIANT":           config.DefaultConfig.Variant.String(),
-		"KAIROS_REGISTRY_AND_ORG":  config.DefaultConfig.Registry, // Needed for upgrades to search for images
-		"KAIROS_BUG_REPORT_URL":    "https://github.com/kairos-io/kairos/issues",
-		"KAIROS_HOME_URL":          "https://github.com/kairos-io/kairos",
-		"KAIROS_RELEASE":           config.DefaultConfig.KairosVersion.String(),
-		"KAIROS_IMAGE_LABEL":       imageLabel,                                   // Used by raw image creation...very bad
-		"KAIROS_FRAMEWORK_VERSION": config.DefaultConfig.FrameworkVersion,        // Just for info, could be dropped
-		"KAIROS_FIPS":              fmt.Sprintf("%t", config.DefaultConfig.Fips), // Was the image built with FIPS support?
-	}
-
-	// Get SOFTWARE_VERSION from the k3s/k0s version
-	if config.DefaultConfig.Variant == config.StandardVariant {
-		log.Logger.Debug().Msg("Getting the k8s version for the kairos-release stage")
-		var k8sVersion string
-
-		switch config.DefaultConfig.KubernetesProvider {
-		case config.K3sProvider:
-			out, err := exec.Command("k3s", "--version").CombinedOutput()
-			if err != nil {
-				log.Logger.Error().Msgf("Failed to get the k3s version: %s", err)
-			}
-			// 2 lines in this format:
-			// k3s version v1.21.4+k3s1 (3781f4b7)
-			// go version go1.16.5
-			// We need the first line
-			re := regexp.MustCompile(`k3s version v(\d+\.\d+\.\d+\+k3s\d+)`)
-			if re.MatchString(string(out)) {
-				match := re.FindStringSubmatch(string(out))
-				k8sVersion = match[1]
-			} else {
-				log.Logger.Error().Msgf("Failed to parse the k3s version: %s", string(out))
-			}
-		case config.K0sProvider:
-			out, err := exec.Command("k0s", "version").CombinedOutput()
-			if err != nil {
-				log.Logger.Error().Msgf("Failed to get the k0s version: %s", err)
-			}
-			k8sVersion = strings.TrimSpace(string(out))
-		}
-
-		log.Logger.Debug().Str("k8sVersion", k8sVersion).Msg("Got the k8s version")
-		env["KAIROS_SOFTWARE_VERSION"] = k8sVersion
-		env["KAIROS_SOFTWARE_VERSION_PREFIX"] = string(config.DefaultConfig.KubernetesProvider)
+// GetKairosReleaseStage returns the stage that writes the kairos-release file, failing if any needed value is missing
+func GetKairosReleaseStage(sis values.System, c config.Config, log types.KairosLogger) ([]schema.Stage, error) {
+	r := release.New(sis, c, log)
+	if err := r.Validate(); err != nil {
+		return []schema.Stage{}, err
 	}
-
+	env := r.Env()
 	log.Logger.Debug().Interface("env", env).Msg("Kairos release stage")
 
 	return []schema.Stage{
 		{
 			Name:            "Write kairos-release",
 			Environment:     env,
-			EnvironmentFile: "/etc/kairos-release",
+			EnvironmentFile: release.Path,
 		},
-	}
+	}, nil
 }
 
-func GetInstallStage(sis values.System, logger types.KairosLogger) ([]schema.Stage, error) {
+func GetInstallStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
 	// Fips + ubuntu fails early and redirect to our Example
-	if sis.Distro == values.Ubuntu && config.DefaultConfig.Fips {
+	if sis.Distro == values.Ubuntu && c.Fips {
 		return nil, fmt.Errorf("FIPS is not supported on Ubuntu without a PRO account and extra packages.\n" +
 			"See https://github.com/kairos-io/kairos/blob/master/examples/builds/ubuntu-fips/Dockerfile for an example on how to build it")
 	}
 
 	// Get the packages
-	packages, err := values.GetPackages(sis, logger)
+	packages, err := values.GetPackages(sis, c, logger)
 	if err != nil {
 		logger.Logger.Error().Msgf("Failed to get the packages: %s", err)
 		return []schema.Stage{}, err
 	}
 	// Now parse the packages with the templating engine
-	finalMergedPkgs, err := values.PackageListToTemplate(packages, values.GetTemplateParams(sis), logger)
+	finalMergedPkgs, err := values.PackageListToTemplate(packages, sis.TemplateParams(c), logger)
 	if err != nil {
 		logger.Logger.Error().Msgf("Failed to parse the packages: %s", err)
 		return []schema.Stage{}, err
 	}
+	// And translate the pinned ones to the package manager syntax
+	for i, pkg := range finalMergedPkgs {
+		if finalMergedPkgs[i], err = values.PackageInstallName(sis, pkg); err != nil {
+			logger.Logger.Error().Msgf("Failed to parse the packages: %s", err)
+			return []schema.Stage{}, err
+		}
+	}
+
+	stages := batchInstall("Install base packages", finalMergedPkgs, c.Report.PackageBatch)
 
 	// For trusted boot we need to select the correct kernel packages manually
 	// TODO: Have a flag in the config to add the full linux-firmware package?
-	if config.DefaultConfig.TrustedBoot {
+	if c.TrustedBoot {
 		// TODO: Check for other distros/families
-		if sis.Distro == values.Ubuntu {
-			// First update the package list so we can search for the kernel packages properly
-			err = exec.Command("apt-get", "update").Run()
-			if err != nil {
-				logger.Logger.Error().Msgf("Failed to update the package list: %s", err)
-				return []schema.Stage{}, err
-			}
-
-			out, err := exec.Command("apt-cache", "search", "linux-image").CombinedOutput()
-			if err != nil {
-				logger.Logger.Error().Msgf("Failed to get the kernel packages: %s", err)
-				return []schema.Stage{}, err
-			}
-			// Get the latest kernel image and modules version
-			// package is in format linux-image-5.4.0-104-generic
-			// modules are in format linux-modules-5.4.0-104-generic
-			// we need to extract the number only
-			re, _ := regexp.Compile(`linux-image-(\d+\.\d+\.\d+-\d+)-generic`)
-			if re.Match(out) {
-				match := re.FindStringSubmatch(string(out))
-				logger.Logger.Debug().Str("kernel", match[1]).Msg("Found the kernel package")
-				finalMergedPkgs = append(finalMergedPkgs, fmt.Sprintf("linux-image-%s-generic", match[1]))
-				finalMergedPkgs = append(finalMergedPkgs, fmt.Sprintf("linux-modules-%s-generic", match[1]))
-			} else {
-				logger.Logger.Error().Err(err).Msgf("Failed to get the kernel packages")
-				logger.Logger.Debug().Str("output", string(out)).Msgf("Failed to get the kernel packages")
-				return []schema.Stage{}, err
-			}
+		// A pinned kernel already comes with the versioned packages from values.KernelPackagesPinned, the flavors
+		// with their own package maps and a custom one is installed on its own stage
+		if sis.Distro == values.Ubuntu && c.Kernel.Version == "" && c.Kernel.Source == "" &&
+			c.Kernel.Flavor == "" {
+			// The kernel is looked up on the system being built when the step runs, after the base packages refreshed
+			// the package list, so resolving the stages does not depend on the apt cache of the host
+			stages = append(stages, schema.Stage{
+				Name:     "Install latest generic kernel for trusted boot",
+				Commands: []string{values.UbuntuTrustedBootKernelCommand},
+			})
 		}
 	}
 
 	// TODO(rhel): Add zfs packages? Currently we add the repos to alma+rocky but we don't install the packages so?
-	return []schema.Stage{
-		{
-			Name: "Install base packages",
-			Packages: schema.Packages{
-				Install: finalMergedPkgs,
-				Refresh: true,
-				Upgrade: true,
-			},
-		},
-	}, nil
+	return stages, nil
 }
 
-func GetKernelStage(_ values.System, logger types.KairosLogger) ([]schema.Stage, error) {
-	kernel, err := getLatestKernel(logger)
+func GetKernelStage(_ values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	kernel, err := getLatestKernel(c, logger)
 	if err != nil {
 		logger.Logger.Error().Msgf("Failed to get the latest kernel: %s", err)
 		return []schema.Stage{}, err
@@ -311,6 +213,13 @@ func GetKernelStage(_ values.System, logger types.KairosLogger) ([]schema.Stage,
 				"ln -s /boot/vmlinuz-lts /boot/vmlinuz",
 			},
 		},
+		{
+			Name: "Link kernel for Alpine RT",
+			If:   "test -f /boot/vmlinuz-rt",
+			Commands: []string{
+				"ln -s /boot/vmlinuz-rt /boot/vmlinuz",
+			},
+		},
 		{
 			Name: "Link kernel for Alpine RPI",
 			If:   "test -f /boot/vmlinuz-rpi",
@@ -321,7 +230,7 @@ func GetKernelStage(_ values.System, logger types.KairosLogger) ([]schema.Stage,
 	}, nil
 }
 
-func GetInitrdStage(sys values.System, logger types.KairosLogger) ([]schema.Stage, error) {
+func GetInitrdStage(sys values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
 	stage := []schema.Stage{
 		{
 			Name: "Remove all initrds",
@@ -333,14 +242,14 @@ func GetInitrdStage(sys values.System, logger types.KairosLogger) ([]schema.Stag
 	}
 
 	// If we are not using trusted boot we need to create a new initrd
-	if !config.DefaultConfig.TrustedBoot {
-		kernel, err := getLatestKernel(logger)
+	if !c.TrustedBoot {
+		kernel, err := getLatestKernel(c, logger)
 		if err != nil {
 			logger.Logger.Error().Msgf("Failed to get the latest kernel: %s", err)
 			return []schema.Stage{}, err
 		}
 
-		if config.DefaultConfig.Fips {
+		if c.Fips {
 			// Add dracut fips support
 			stage = append(stage, []schema.Stage{
 				{
@@ -359,6 +268,51 @@ func GetInitrdStage(sys values.System, logger types.KairosLogger) ([]schema.Stag
 			}...)
 		}
 
+		// dracut modules of the enabled features
+		features, err := values.EnabledFeatures(sys, c)
+		if err != nil {
+			return []schema.Stage{}, err
+		}
+		var modules []string
+		for _, feature := range features {
+			modules = append(modules, values.Features[feature].DracutModules...)
+			paths := make([]string, 0, len(values.Features[feature].Files))
+			for path := range values.Features[feature].Files {
+				paths = append(paths, path)
+			}
+			sort.Strings(paths)
+			for _, path := range paths {
+				stage = append(stage, schema.Stage{
+					Name: fmt.Sprintf("Write default %s config %s", feature, path),
+					If:   fmt.Sprintf("test ! -f %s", path),
+					Files: []schema.File{
+						{
+							Path:        path,
+							Owner:       0,
+							Group:       0,
+							Permissions: 0644,
+							Content:     values.Features[feature].Files[path],
+						},
+					},
+				})
+			}
+		}
+		if len(modules) > 0 {
+			stage = append(stage, schema.Stage{
+				Name:     "Add feature modules to initramfs",
+				OnlyIfOs: "Ubuntu.*|Debian.*|Fedora.*|CentOS.*|RedHat.*|Rocky.*|AlmaLinux.*|SLES.*|[O-o]penSUSE.*",
+				Files: []schema.File{
+					{
+						Path:        "/etc/dracut.conf.d/kairos-features.conf",
+						Owner:       0,
+						Group:       0,
+						Permissions: 0644,
+						Content:     fmt.Sprintf("add_dracutmodules+=\" %s \"\n", strings.Join(modules, " ")),
+					},
+				},
+			})
+		}
+
 		stage = append(stage, []schema.Stage{
 			{
 				Name:     "Create new initrd",
@@ -407,7 +361,7 @@ func GetWorkaroundsStage(_ values.System, _ types.KairosLogger) []schema.Stage {
 	return stages
 }
 
-func GetCleanupStage(sis values.System, l types.KairosLogger) []schema.Stage {
+func GetCleanupStage(sis values.System, c config.Config, l types.KairosLogger) ([]schema.Stage, error) {
 	stages := []schema.Stage{
 		{
 			Name: "Remove dbus machine-id",
@@ -434,7 +388,7 @@ func GetCleanupStage(sis values.System, l types.KairosLogger) []schema.Stage {
 
 	var pkgs []values.VersionMap
 
-	if config.DefaultConfig.TrustedBoot {
+	if c.TrustedBoot {
 		// Try to remove as many packages as possible that are not needed
 		pkgs = append(pkgs, values.ImmucorePackages[sis.Distro][values.ArchCommon])
 		pkgs = append(pkgs, values.ImmucorePackages[sis.Family][values.ArchCommon])
@@ -450,9 +404,13 @@ func GetCleanupStage(sis values.System, l types.KairosLogger) []schema.Stage {
 		pkgs = append(pkgs, values.ImmucorePackages[sis.Family][values.ArchCommon])
 		pkgs = append(pkgs, values.ImmucorePackages[sis.Distro][sis.Arch])
 		pkgs = append(pkgs, values.ImmucorePackages[sis.Family][sis.Arch])
+		pkgs = append(pkgs, values.GetVersionMaps(sis, values.LivePackages)...)
 	}
 
-	filteredPkgs := values.FilterPackagesOnConstraint(sis, l, pkgs)
+	filteredPkgs, err := values.FilterPackagesOnConstraint(sis, l, pkgs)
+	if err != nil {
+		return stages, err
+	}
 	stages = append(stages, []schema.Stage{
 		{
 			Name: "Remove unneeded packages",
@@ -468,12 +426,12 @@ func GetCleanupStage(sis values.System, l types.KairosLogger) []schema.Stage {
 			},
 		},
 	}...)
-	return stages
+	return stages, nil
 }
 
-func GetInstallFrameworkStage(_ values.System, _ types.KairosLogger) []schema.Stage {
-	framework := config.DefaultConfig.FrameworkVersion
-	if config.DefaultConfig.Fips {
+func GetInstallFrameworkStage(_ values.System, c config.Config, _ types.KairosLogger) []schema.Stage {
+	framework := c.FrameworkVersion
+	if c.Fips {
 		framework = fmt.Sprintf("%s-fips", framework)
 	}
 	return []schema.Stage{
@@ -500,20 +458,20 @@ func GetInstallFrameworkStage(_ values.System, _ types.KairosLogger) []schema.St
 }
 
 // GetInstallProviderAndKubernetes will install the provider and kubernetes packages
-func GetInstallProviderAndKubernetes(sis values.System, _ types.KairosLogger) []schema.Stage {
+func GetInstallProviderAndKubernetes(sis values.System, c config.Config, _ types.KairosLogger) []schema.Stage {
 	var data []schema.Stage
 
 	// If its core we dont do anything here
-	if config.DefaultConfig.Variant.String() == "core" {
+	if sis.Variant == config.CoreVariant {
 		return data
 	}
 
-	switch config.DefaultConfig.KubernetesProvider {
+	switch c.KubernetesProvider {
 	case config.K3sProvider:
 		cmd := "INSTALL_K3S_BIN_DIR=/usr/bin INSTALL_K3S_SKIP_ENABLE=true INSTALL_K3S_SKIP_SELINUX_RPM=true"
 		// Append version if any, otherwise default to latest
-		if config.DefaultConfig.KubernetesVersion != "" {
-			cmd = fmt.Sprintf("INSTALL_K3S_VERSION=%s %s", config.DefaultConfig.KubernetesVersion, cmd)
+		if version := values.KubernetesVersion(c); version != "" {
+			cmd = fmt.Sprintf("INSTALL_K3S_VERSION=%s %s", version, cmd)
 		}
 		data = append(data, []schema.Stage{
 			{
@@ -529,8 +487,8 @@ func GetInstallProviderAndKubernetes(sis values.System, _ types.KairosLogger) []
 	case config.K0sProvider:
 		cmd := "sh installer.sh"
 		// Append version if any, otherwise default to latest
-		if config.DefaultConfig.KubernetesVersion != "" {
-			cmd = fmt.Sprintf("K0S_VERSION=%s %s", config.DefaultConfig.KubernetesVersion, cmd)
+		if version := values.KubernetesVersion(c); version != "" {
+			cmd = fmt.Sprintf("K0S_VERSION=%s %s", version, cmd)
 		}
 		data = append(data, []schema.Stage{
 			{
@@ -658,6 +616,25 @@ depend() {
 				},
 			},
 		}...)
+	case config.RKE2Provider:
+		// The tarball comes with the binaries under /usr, as /usr/local is not part of the image, and both the
+		// rke2-server and rke2-agent systemd units
+		cmd := fmt.Sprintf("INSTALL_RKE2_METHOD=tar INSTALL_RKE2_TAR_PREFIX=%s sh installer.sh", values.RKE2Prefix)
+		// Append version if any, otherwise default to latest
+		if version := values.KubernetesVersion(c); version != "" {
+			cmd = fmt.Sprintf("INSTALL_RKE2_VERSION=%s %s", version, cmd)
+		}
+		data = append(data, []schema.Stage{
+			{
+				Name: "Install Kubernetes packages",
+				Commands: []string{
+					"curl -sfL https://get.rke2.io > installer.sh",
+					"chmod +x installer.sh",
+					cmd,
+					"rm installer.sh",
+				},
+			},
+		}...)
 	}
 
 	// Install provider + k8s utils
@@ -666,7 +643,7 @@ depend() {
 			Name: "Install Provider packages",
 			UnpackImages: []schema.UnpackImageConf{
 				{
-					Source: values.GetProviderPackage(sis.Arch.String()),
+					Source: values.GetProviderPackage(sis.Arch.String(), c.ProviderVersion),
 					Target: "/",
 				},
 			},
@@ -712,64 +689,108 @@ depend() {
 	return data
 }
 
-func GetServicesStage(_ values.System, _ types.KairosLogger) []schema.Stage {
-	return []schema.Stage{
-		{
-			Name:     "Enable services for Modern systems",
-			OnlyIfOs: "Ubuntu.*|Debian.*|Fedora.*",
-			Systemctl: schema.Systemctl{
-				Enable: []string{
-					"systemd-networkd", // Separate this and use ifOS to trigger it only on systemd systems? i.e. do a reverse regex match somehow
-				},
-			},
-		},
-		{
-			Name:     "Enable services for Debian family",
-			OnlyIfOs: "Ubuntu.*|Debian.*",
-			Systemctl: schema.Systemctl{
-				Enable: []string{
-					"ssh",
-				},
-			},
-		},
-		{
-			Name:     "Enable services for RHEL family",
-			OnlyIfOs: "Fedora.*|CentOS.*|RedHat.*|Rocky.*|AlmaLinux.*",
+// GetServicesStage returns the stages to enable, disable and mask the services for the system
+// Default services from the values maps are only handled if they exist on the system, while
+// the user provided services from the config are always handled so a typo fails the build
+func GetServicesStage(sis values.System, c config.Config, logger types.KairosLogger) []schema.Stage {
+	var stages []schema.Stage
+
+	if sis.Family == values.AlpineFamily {
+		services := values.GetOpenRCServices(sis, c)
+		runlevels := make([]string, 0, len(services.Enable))
+		for runlevel := range services.Enable {
+			runlevels = append(runlevels, runlevel)
+		}
+		sort.Strings(runlevels)
+		for _, runlevel := range runlevels {
+			for _, service := range services.Enable[runlevel] {
+				stages = append(stages, schema.Stage{
+					Name:     fmt.Sprintf("Enable service %s", service),
+					If:       fmt.Sprintf("test -f /etc/init.d/%s", service),
+					Commands: []string{fmt.Sprintf("rc-update add %s %s", service, runlevel)},
+				})
+			}
+		}
+		for _, service := range services.Disable {
+			stages = append(stages, schema.Stage{
+				Name:     fmt.Sprintf("Disable service %s", service),
+				If:       fmt.Sprintf("test -f /etc/init.d/%s", service),
+				Commands: []string{fmt.Sprintf("rc-update -a del %s", service)},
+			})
+		}
+
+		// User provided services
+		var commands []string
+		for _, service := range c.Services.Enable {
+			commands = append(commands, fmt.Sprintf("rc-update add %s default", service))
+		}
+		for _, service := range c.Services.Disable {
+			commands = append(commands, fmt.Sprintf("rc-update -a del %s", service))
+		}
+		if len(c.Services.Mask) > 0 {
+			logger.Logger.Warn().Strs("services", c.Services.Mask).Msg("Masking services is not supported on openrc, ignoring")
+		}
+		if len(commands) > 0 {
+			stages = append(stages, schema.Stage{
+				Name:     "Handle user services",
+				Commands: commands,
+			})
+		}
+		return stages
+	}
+
+	services := values.GetServices(sis, c)
+	for _, service := range services.Enable {
+		stages = append(stages, schema.Stage{
+			Name:      fmt.Sprintf("Enable service %s", service),
+			If:        systemdUnitExists(service),
+			Systemctl: schema.Systemctl{Enable: []string{service}},
+		})
+	}
+	for _, service := range services.Disable {
+		stages = append(stages, schema.Stage{
+			Name:      fmt.Sprintf("Disable service %s", service),
+			If:        systemdUnitExists(service),
+			Systemctl: schema.Systemctl{Disable: []string{service}},
+		})
+	}
+	for _, service := range services.Mask {
+		stages = append(stages, schema.Stage{
+			Name:      fmt.Sprintf("Mask service %s", service),
+			If:        systemdUnitExists(service),
+			Systemctl: schema.Systemctl{Mask: []string{service}},
+		})
+	}
+
+	// User provided services
+	userServices := c.Services
+	if len(userServices.Enable) > 0 || len(userServices.Disable) > 0 || len(userServices.Mask) > 0 {
+		stages = append(stages, schema.Stage{
+			Name: "Handle user services",
 			Systemctl: schema.Systemctl{
-				Enable: []string{
-					"sshd",
-					"systemd-resolved",
-				},
-				Disable: []string{
-					"dnf-makecache",
-					"dnf-makecache.timer",
-				},
+				Enable:  userServices.Enable,
+				Disable: userServices.Disable,
+				Mask:    userServices.Mask,
 			},
-		},
-		{
-			Name:     "Enable services for Alpine family",
-			OnlyIfOs: "Alpine.*",
-			Commands: []string{
-				"rc-update add sshd boot",
-				"rc-update add connman boot ",
-				"rc-update add acpid boot",
-				"rc-update add hwclock boot",
-				"rc-update add syslog boot",
-				"rc-update add udev sysinit",
-				"rc-update add udev-trigger sysinit",
-				"rc-update add cgroups sysinit",
-				"rc-update add ntpd boot",
-				"rc-update add crond",
-				"rc-update add fail2ban",
-			},
-		},
+		})
 	}
+
+	return stages
+}
+
+// systemdUnitExists returns a check for the If field of a stage to see if the given unit exists in the system
+// Units without a suffix are treated as services
+func systemdUnitExists(unit string) string {
+	if !strings.Contains(unit, ".") {
+		unit = fmt.Sprintf("%s.service", unit)
+	}
+	return fmt.Sprintf("test -f /etc/systemd/system/%[1]s || test -f /usr/lib/systemd/system/%[1]s || test -f /lib/systemd/system/%[1]s", unit)
 }
 
 // RunAllStages Runs all the stages in the correct order
-func RunAllStages(logger types.KairosLogger) (schema.YipConfig, error) {
+func RunAllStages(ctx context.Context, logger types.KairosLogger) (schema.YipConfig, error) {
 	fullYipConfig := schema.YipConfig{Stages: map[string][]schema.Stage{}}
-	installStage, err := RunInstallStage(logger)
+	installStage, err := RunInstallStage(ctx, logger)
 	if err != nil {
 		logger.Logger.Error().Msgf("Failed to run the install stage: %s", err)
 		return installStage, err
@@ -780,7 +801,7 @@ func RunAllStages(logger types.KairosLogger) (schema.YipConfig, error) {
 		fullYipConfig.Stages[stageName] = append(fullYipConfig.Stages[stageName], stages...)
 	}
 
-	initStage, err := RunInitStage(logger)
+	initStage, err := RunInitStage(ctx, logger)
 	if err != nil {
 		logger.Logger.Error().Msgf("Failed to run the init stage: %s", err)
 		return fullYipConfig, err
@@ -797,18 +818,70 @@ func RunAllStages(logger types.KairosLogger) (schema.YipConfig, error) {
 // RunInstallStage Runs the install stage
 // This is good if we are doing the init in layers as this will allow us to run the install stage and cache that then run
 // the init stage later so we can cache the install stage which is usually the longest
-func RunInstallStage(logger types.KairosLogger) (schema.YipConfig, error) {
+func RunInstallStage(ctx context.Context, logger types.KairosLogger) (schema.YipConfig, error) {
 	sis := system.DetectSystem(logger)
+	c := config.DefaultConfig
 	initExecutor := executor.NewExecutor(executor.WithLogger(logger))
 	yipConsole := console.NewStandardConsole(console.WithLogger(logger))
 
-	data := schema.YipConfig{Stages: map[string][]schema.Stage{}}
-	// Run things before we install packages and framework
-	data.Stages["before-install"] = []schema.Stage{}
+	if err := Preflight(sis, "install", logger); err != nil {
+		logger.Logger.Error().Msgf("Failed the preflight checks: %s", err)
+		return schema.YipConfig{}, err
+	}
+
+	data, err := GetInstallStages(sis, c, logger)
+	if err != nil {
+		return data, err
+	}
+	// Keep the downloaded packages if the apt cache is a build cache mount, before anything is installed
+	keepAptCache, restoreAptClean := GetAptCacheStages(sis, logger)
+	data.Stages["before-install"] = append(keepAptCache, data.Stages["before-install"]...)
+	data.Stages["after-install"] = append(data.Stages["after-install"], restoreAptClean...)
+	// Add extensions from disk
+	for _, st := range []string{"before-install", "install", "after-install"} {
+		data.Stages[st] = append(data.Stages[st], GetStageExtensions(st, c, logger)...)
+	}
 
-	// On Rpi3 and Rpi4 we need to enable the non-free repository for Debian to get the firmware
-	if config.DefaultConfig.Model == values.Rpi3.String() || config.DefaultConfig.Model == values.Rpi4.String() {
-		data.Stages["before-install"] = append(data.Stages["before-install"], []schema.Stage{
+	if err = NetworkPreflight(sis, data, logger); err != nil {
+		logger.Logger.Error().Msgf("Failed the network preflight checks: %s", err)
+		return data, err
+	}
+
+	// Run install first, as kernel and initrd resolution depend on the installed packages
+	// Roll back the packages of the whole kairos-init stage if any of its yip stages fails
+	first := len(Timings)
+	for _, st := range []string{"before-install", "install", "after-install"} {
+		if skipResumed(st, logger) {
+			continue
+		}
+		size := rootfsSize()
+		start := startStage(sis, st)
+		err = initExecutor.Run(st, vfs.OSFS, newStageConsole(ctx, logger, sis, yipConsole, st, data.Stages[st], start.span), data.ToString())
+		if ctx.Err() != nil {
+			err = interruptedError(ctx, st)
+		}
+		recordTiming(sis, st, start, err)
+		if err == nil {
+			err = recordSize(st, size, logger)
+		}
+		if err != nil {
+			logger.Logger.Error().Msgf("Failed to run the %s stage: %s", st, err)
+			rollbackPackages(ctx, Timings[first:], logger)
+			return data, err
+		}
+		stageCompleted(st)
+	}
+	return data, nil
+}
+
+// GetRepoStage returns the before-install stages that enable the extra repos needed for the configured packages
+func GetRepoStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	var stages []schema.Stage
+
+	// On Rpi3 and Rpi4, for the full firmware and for the microcode we need to enable the non-free repository for Debian
+	if c.Model == values.Rpi3.String() || c.Model == values.Rpi4.String() ||
+		c.Firmware == string(values.FirmwareFull) || c.Microcode {
+		stages = append(stages, []schema.Stage{
 			{
 				Name:     "Enable non-free repository",
 				OnlyIfOs: "Debian.*",
@@ -818,90 +891,289 @@ func RunInstallStage(logger types.KairosLogger) (schema.YipConfig, error) {
 			},
 		}...)
 	}
-	// Add extensions from disk
-	data.Stages["before-install"] = append(data.Stages["before-install"], GetStageExtensions("before-install", logger)...)
+	stages = append(stages, GetKernelRepoStage(sis, c, logger)...)
+	// Add the NVIDIA repos so the driver can be installed with the rest of the packages
+	if c.Nvidia {
+		nvidiaStage, err := GetNvidiaRepoStage(sis, logger)
+		if err != nil {
+			logger.Logger.Error().Msgf("Failed to get the NVIDIA repo stage: %s", err)
+			return stages, err
+		}
+		stages = append(stages, nvidiaStage...)
+	}
+	// Add the zfs repos for the families that dont ship it
+	if c.Zfs {
+		zfsStage, err := GetZfsRepoStage(sis, logger)
+		if err != nil {
+			logger.Logger.Error().Msgf("Failed to get the zfs repo stage: %s", err)
+			return stages, err
+		}
+		stages = append(stages, zfsStage...)
+	}
+	return stages, nil
+}
+
+// GetInstallStages returns the before-install, install and after-install stages for the system without running them
+// They only depend on the system and config, nothing is read from or run on the host, so they can be resolved for
+// other systems. The steps that depend on the host, like the stage extensions on disk, are added by RunInstallStage
+func GetInstallStages(sis values.System, c config.Config, logger types.KairosLogger) (schema.YipConfig, error) {
+	data := schema.YipConfig{Stages: map[string][]schema.Stage{}}
+	// Run things before we install packages and framework
+	repoStage, err := GetRepoStage(sis, c, logger)
+	if err != nil {
+		return data, err
+	}
+	data.Stages["before-install"] = repoStage
 
 	// Add packages install
-	installStage, err := GetInstallStage(sis, logger)
+	installStage, err := GetInstallStage(sis, c, logger)
 	if err != nil {
 		logger.Logger.Error().Msgf("Failed to get the install stage: %s", err)
 		return data, err
 	}
 	data.Stages["install"] = installStage
+	customKernelStage, err := GetCustomKernelStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the custom kernel stage: %s", err)
+		return data, err
+	}
+	data.Stages["install"] = append(data.Stages["install"], customKernelStage...)
+	fallbackInstallStage, err := GetFallbackKernelInstallStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the fallback kernel install stage: %s", err)
+		return data, err
+	}
+	data.Stages["install"] = append(data.Stages["install"], fallbackInstallStage...)
 	// Add the framework stage
-	data.Stages["install"] = append(data.Stages["install"], GetInstallFrameworkStage(sis, logger)...)
-	data.Stages["install"] = append(data.Stages["install"], GetInstallProviderAndKubernetes(sis, logger)...)
-
-	// Add extensions from disk
-	data.Stages["install"] = append(data.Stages["install"], GetStageExtensions("install", logger)...)
+	data.Stages["install"] = append(data.Stages["install"], GetInstallFrameworkStage(sis, c, logger)...)
+	data.Stages["install"] = append(data.Stages["install"], GetInstallProviderAndKubernetes(sis, c, logger)...)
+	componentsStage, err := GetInstallComponentsStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the components stage: %s", err)
+		return data, err
+	}
+	data.Stages["install"] = append(data.Stages["install"], componentsStage...)
 
 	// Run things after we install packages and framework
 	data.Stages["after-install"] = []schema.Stage{}
-
-	// Add extensions from disk
-	data.Stages["after-install"] = append(data.Stages["after-install"], GetStageExtensions("after-install", logger)...)
-
-	// Run install first, as kernel and initrd resolution depend on the installed packages
-	for _, st := range []string{"before-install", "install", "after-install"} {
-		err = initExecutor.Run(st, vfs.OSFS, yipConsole, data.ToString())
-		if err != nil {
-			logger.Logger.Error().Msgf("Failed to run the %s stage: %s", st, err)
-			return data, err
-		}
+	kernelHoldStage, err := GetKernelHoldStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the kernel hold stage: %s", err)
+		return data, err
 	}
+	data.Stages["after-install"] = append(data.Stages["after-install"], kernelHoldStage...)
+
 	return data, nil
 }
 
 // RunInitStage Runs the init stage
 // This is good if we are doing the init in layers as this will allow us to run the install stage and cache that then run
 // the init stage later so we can cache the install stage which is usually the longest
-func RunInitStage(logger types.KairosLogger) (schema.YipConfig, error) {
+func RunInitStage(ctx context.Context, logger types.KairosLogger) (schema.YipConfig, error) {
 	sis := system.DetectSystem(logger)
+	c := config.DefaultConfig
 	initExecutor := executor.NewExecutor(executor.WithLogger(logger))
 	yipConsole := console.NewStandardConsole(console.WithLogger(logger))
 
 	data := schema.YipConfig{Stages: map[string][]schema.Stage{}}
 
+	if err := Preflight(sis, "init", logger); err != nil {
+		logger.Logger.Error().Msgf("Failed the preflight checks: %s", err)
+		return data, err
+	}
+
 	// Run things before we init the system
 	data.Stages["before-init"] = []schema.Stage{}
 
 	// Add extensions from disk
-	data.Stages["before-init"] = append(data.Stages["before-init"], GetStageExtensions("before-init", logger)...)
+	data.Stages["before-init"] = append(data.Stages["before-init"], GetStageExtensions("before-init", c, logger)...)
 
 	data.Stages["init"] = []schema.Stage{}
-	data.Stages["init"] = append(data.Stages["init"], GetKairosReleaseStage(sis, logger)...)
-	kernelStage, err := GetKernelStage(sis, logger)
+	releaseStage, err := GetKairosReleaseStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the kairos-release stage: %s", err)
+		return data, err
+	}
+	data.Stages["init"] = append(data.Stages["init"], releaseStage...)
+	brandingStage, err := GetBrandingStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the branding stage: %s", err)
+		return data, err
+	}
+	data.Stages["init"] = append(data.Stages["init"], brandingStage...)
+	kernelStage, err := GetKernelStage(sis, c, logger)
 	if err != nil {
 		logger.Logger.Error().Msgf("Failed to get the kernel stage: %s", err)
 		return data, err
 	}
 	data.Stages["init"] = append(data.Stages["init"], kernelStage...)
-	initrdStage, err := GetInitrdStage(sis, logger)
+	kernelCmdlineStage, err := GetKernelCmdlineStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the kernel cmdline stage: %s", err)
+		return data, err
+	}
+	data.Stages["init"] = append(data.Stages["init"], kernelCmdlineStage...)
+	data.Stages["init"] = append(data.Stages["init"], GetKernelModulesStage(sis, c, logger)...)
+	zfsStage, err := GetZfsStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the zfs stage: %s", err)
+		return data, err
+	}
+	data.Stages["init"] = append(data.Stages["init"], zfsStage...)
+	headersStage, err := GetKernelHeadersStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the kernel headers stage: %s", err)
+		return data, err
+	}
+	data.Stages["init"] = append(data.Stages["init"], headersStage...)
+	moduleBuildStage, err := GetModuleBuildStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the module build stage: %s", err)
+		return data, err
+	}
+	data.Stages["init"] = append(data.Stages["init"], moduleBuildStage...)
+	data.Stages["init"] = append(data.Stages["init"], GetMicrocodeStage(sis, c, logger)...)
+	initrdConfigStage, err := GetInitrdConfigStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the initrd config stage: %s", err)
+		return data, err
+	}
+	data.Stages["init"] = append(data.Stages["init"], initrdConfigStage...)
+	initrdStage, err := GetInitrdStage(sis, c, logger)
 	if err != nil {
 		logger.Logger.Error().Msgf("Failed to get the initrd stage: %s", err)
 		return data, err
 	}
 	data.Stages["init"] = append(data.Stages["init"], initrdStage...)
-	data.Stages["init"] = append(data.Stages["init"], GetServicesStage(sis, logger)...)
+	fallbackStage, err := GetFallbackKernelStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the fallback kernel stage: %s", err)
+		return data, err
+	}
+	data.Stages["init"] = append(data.Stages["init"], fallbackStage...)
+	cloudInitStage, err := GetCloudInitStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the cloud-init stage: %s", err)
+		return data, err
+	}
+	data.Stages["init"] = append(data.Stages["init"], cloudInitStage...)
+	removeStage, err := GetRemovePackagesStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the package removal stage: %s", err)
+		return data, err
+	}
+	data.Stages["init"] = append(data.Stages["init"], removeStage...)
+	networkStage, err := GetNetworkStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the network stage: %s", err)
+		return data, err
+	}
+	data.Stages["init"] = append(data.Stages["init"], networkStage...)
+	timeSyncStage, err := GetTimeSyncStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the time sync stage: %s", err)
+		return data, err
+	}
+	data.Stages["init"] = append(data.Stages["init"], timeSyncStage...)
+	containerRuntimeStage, err := GetContainerRuntimeStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the container runtime stage: %s", err)
+		return data, err
+	}
+	data.Stages["init"] = append(data.Stages["init"], containerRuntimeStage...)
+	nvidiaContainerStage, err := GetNvidiaContainerStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the nvidia container stage: %s", err)
+		return data, err
+	}
+	data.Stages["init"] = append(data.Stages["init"], nvidiaContainerStage...)
+	auditStage, err := GetAuditStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the audit stage: %s", err)
+		return data, err
+	}
+	data.Stages["init"] = append(data.Stages["init"], auditStage...)
+	data.Stages["init"] = append(data.Stages["init"], GetServicesStage(sis, c, logger)...)
+	data.Stages["init"] = append(data.Stages["init"], GetSysctlStage(sis, c, logger)...)
+	swapStage, err := GetSwapStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the swap stage: %s", err)
+		return data, err
+	}
+	data.Stages["init"] = append(data.Stages["init"], swapStage...)
+	data.Stages["init"] = append(data.Stages["init"], GetUdevStage(sis, c, logger)...)
+	data.Stages["init"] = append(data.Stages["init"], GetUserStage(sis, c, logger)...)
+	data.Stages["init"] = append(data.Stages["init"], GetSSHStage(sis, c, logger)...)
+	data.Stages["init"] = append(data.Stages["init"], GetLocalizationStage(sis, c, logger)...)
 	data.Stages["init"] = append(data.Stages["init"], GetWorkaroundsStage(sis, logger)...)
-	data.Stages["init"] = append(data.Stages["init"], GetCleanupStage(sis, logger)...)
+	data.Stages["init"] = append(data.Stages["init"], GetImmutabilityStage(sis, c, logger)...)
+	cleanupStage, err := GetCleanupStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the cleanup stage: %s", err)
+		return data, err
+	}
+	data.Stages["init"] = append(data.Stages["init"], cleanupStage...)
 
 	// Add extensions from disk
-	data.Stages["init"] = append(data.Stages["init"], GetStageExtensions("init", logger)...)
+	data.Stages["init"] = append(data.Stages["init"], GetStageExtensions("init", c, logger)...)
 
 	// Run things after we init the system
 	data.Stages["after-init"] = []schema.Stage{}
 
 	// Add extensions from disk
-	data.Stages["after-init"] = append(data.Stages["after-init"], GetStageExtensions("after-init", logger)...)
+	data.Stages["after-init"] = append(data.Stages["after-init"], GetStageExtensions("after-init", c, logger)...)
+
+	// Final cleanup of the image, after everything else has run
+	data.Stages["cleanup"] = GetImageCleanupStage(sis, c, logger)
+
+	if err = NetworkPreflight(sis, data, logger); err != nil {
+		logger.Logger.Error().Msgf("Failed the network preflight checks: %s", err)
+		return data, err
+	}
 
+	// Roll back the packages of the whole kairos-init stage if any of its yip stages fails
+	first := len(Timings)
 	for _, st := range []string{"before-init", "init", "after-init"} {
-		err = initExecutor.Run(st, vfs.OSFS, yipConsole, data.ToString())
+		if skipResumed(st, logger) {
+			continue
+		}
+		size := rootfsSize()
+		start := startStage(sis, st)
+		err = initExecutor.Run(st, vfs.OSFS, newStageConsole(ctx, logger, sis, yipConsole, st, data.Stages[st], start.span), data.ToString())
+		if ctx.Err() != nil {
+			err = interruptedError(ctx, st)
+		}
+		recordTiming(sis, st, start, err)
+		if err == nil {
+			err = recordSize(st, size, logger)
+		}
 		if err != nil {
 			logger.Logger.Error().Msgf("Failed to run the %s stage: %s", st, err)
+			rollbackPackages(ctx, Timings[first:], logger)
 			return data, err
 		}
+		stageCompleted(st)
+	}
+
+	// Run the cleanup on its own so we can report how much space was freed
+	before := system.DirSizes(values.SizeReportDirs)
+	size := rootfsSize()
+	start := startStage(sis, "cleanup")
+	err = initExecutor.Run("cleanup", vfs.OSFS, newStageConsole(ctx, logger, sis, yipConsole, "cleanup", data.Stages["cleanup"], start.span), data.ToString())
+	if ctx.Err() != nil {
+		err = interruptedError(ctx, "cleanup")
+	}
+	recordTiming(sis, "cleanup", start, err)
+	if err == nil {
+		err = recordSize("cleanup", size, logger)
+	}
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to run the cleanup stage: %s", err)
+		rollbackPackages(ctx, Timings[first:], logger)
+		return data, err
 	}
+	after := system.DirSizes(values.SizeReportDirs)
+	logger.Infof("Image size report:\n%s", system.SizeReport(values.SizeReportDirs, before, after))
 
 	return data, nil
 }
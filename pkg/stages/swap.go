@@ -0,0 +1,84 @@
+package stages
+
+import (
+	"fmt"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// GetSwapStage returns the stages to set up the zram swap and the swapfile, enabling their services
+// The zram packages are installed on the install stage
+func GetSwapStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	var stages []schema.Stage
+	swap := c.Swap
+	if swap.File < 0 {
+		return stages, fmt.Errorf("invalid swap file size %d, it has to be a size in MiB", swap.File)
+	}
+	logger.Logger.Debug().Interface("swap", swap).Msg("Swap config")
+
+	if swap.Zram != "" {
+		path, content, err := values.ZramConfig(sis, swap.Zram)
+		if err != nil {
+			return stages, err
+		}
+		stage := schema.Stage{
+			Name: "Set up zram swap",
+			Files: []schema.File{
+				{
+					Path:        path,
+					Permissions: 0644,
+					Owner:       0,
+					Group:       0,
+					Content:     content,
+				},
+			},
+		}
+		// zram-generator creates the swap units on boot, zram-init needs its service enabled
+		if sis.Family == values.AlpineFamily {
+			stage.Commands = []string{fmt.Sprintf("rc-update add %s boot", values.ZramInitService)}
+		}
+		stages = append(stages, stage)
+	}
+
+	if swap.File > 0 {
+		if sis.Family == values.AlpineFamily {
+			stages = append(stages, schema.Stage{
+				Name: "Set up swap file",
+				Files: []schema.File{
+					{
+						Path:        fmt.Sprintf("/etc/init.d/%s", values.SwapFileService),
+						Permissions: 0755,
+						Owner:       0,
+						Group:       0,
+						Content: fmt.Sprintf("#!/sbin/openrc-run\n\ndescription=\"Create and enable the swap file\"\n\n"+
+							"depend() {\n\tafter localmount\n}\n\n"+
+							"start() {\n\t[ -e %s ] && return 0\n\tebegin \"Enabling swap file\"\n\t%s\n\teend $?\n}\n\n"+
+							"stop() {\n\tswapoff %s\n}\n", values.LiveModeFile, values.SwapFileScript(swap.File), values.SwapFile),
+					},
+				},
+				Commands: []string{fmt.Sprintf("rc-update add %s default", values.SwapFileService)},
+			})
+		} else {
+			stages = append(stages, schema.Stage{
+				Name: "Set up swap file",
+				Files: []schema.File{
+					{
+						Path:        fmt.Sprintf("/etc/systemd/system/%s.service", values.SwapFileService),
+						Permissions: 0644,
+						Owner:       0,
+						Group:       0,
+						Content: fmt.Sprintf("[Unit]\nDescription=Create and enable the swap file\n"+
+							"After=local-fs.target\nConditionPathExists=!%s\n\n"+
+							"[Service]\nType=oneshot\nRemainAfterExit=yes\nExecStart=/bin/sh -c '%s'\nExecStop=/sbin/swapoff %s\n\n"+
+							"[Install]\nWantedBy=multi-user.target\n", values.LiveModeFile, values.SwapFileScript(swap.File), values.SwapFile),
+					},
+				},
+				Systemctl: schema.Systemctl{Enable: []string{values.SwapFileService}},
+			})
+		}
+	}
+	return stages, nil
+}
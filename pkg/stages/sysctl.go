@@ -0,0 +1,60 @@
+package stages
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// GetSysctlStage returns the stage that writes the sysctl drop-in for the system
+// User values from the config are merged on top of the default ones, so they can also override them
+func GetSysctlStage(_ values.System, c config.Config, logger types.KairosLogger) []schema.Stage {
+	sysctl := map[string]string{}
+	for k, v := range values.DefaultSysctl {
+		sysctl[k] = v
+	}
+	for k, v := range c.Sysctl {
+		sysctl[k] = v
+	}
+
+	// Sort the keys so the file is always the same for the same values
+	keys := make([]string, 0, len(sysctl))
+	for k := range sysctl {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var content strings.Builder
+	content.WriteString("# Generated by kairos-init\n")
+	for _, k := range keys {
+		content.WriteString(fmt.Sprintf("%s = %s\n", k, sysctl[k]))
+	}
+	logger.Logger.Debug().Interface("sysctl", sysctl).Msg("Sysctl values")
+
+	return []schema.Stage{
+		{
+			Name: "Write sysctl configuration",
+			Files: []schema.File{
+				{
+					Path:        "/etc/sysctl.d/60-kairos.conf",
+					Permissions: 0644,
+					Owner:       0,
+					Group:       0,
+					Content:     content.String(),
+				},
+				{
+					Path:        "/etc/modules-load.d/kairos.conf",
+					Permissions: 0644,
+					Owner:       0,
+					Group:       0,
+					Content:     strings.Join(values.DefaultKernelModules, "\n") + "\n",
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,39 @@
+package stages
+
+import (
+	"fmt"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// GetTimeSyncStage returns the stages to remove the time sync daemons other than the selected one, like the chrony
+// that some base images ship. The packages are installed on the install stage and the services are handled by the
+// services stage
+func GetTimeSyncStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	var stages []schema.Stage
+	if c.TimeSync == "" {
+		return stages, nil
+	}
+	if _, err := values.GetTimeSync(sis, c.TimeSync); err != nil {
+		return stages, err
+	}
+	logger.Logger.Debug().Str("time_sync", c.TimeSync).Msg("Setting up time sync")
+
+	others, err := values.OtherTimeSyncPackages(sis, c.TimeSync, logger)
+	if err != nil {
+		return stages, err
+	}
+	for _, pkg := range others {
+		stages = append(stages, schema.Stage{
+			Name: fmt.Sprintf("Remove %s", pkg),
+			If:   values.PackageInstalledCheck(sis, pkg),
+			Packages: schema.Packages{
+				Remove: []string{pkg},
+			},
+		})
+	}
+	return stages, nil
+}
@@ -0,0 +1,93 @@
+package stages
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/kairos-io/kairos-init/pkg/sbom"
+	"github.com/kairos-io/kairos-init/pkg/system"
+	"github.com/kairos-io/kairos-init/pkg/tracing"
+	"github.com/kairos-io/kairos-init/pkg/values"
+)
+
+// StageTiming is the wall time that a yip stage took to run, with the packages it installed and what it downloaded
+type StageTiming struct {
+	Stage   string  `json:"stage"`
+	Seconds float64 `json:"seconds"`
+	// Packages are the packages that were not there before the stage run
+	Packages []string `json:"packages,omitempty"`
+	// Downloaded are the bytes received over the network while the stage run
+	Downloaded int64 `json:"downloaded_bytes"`
+}
+
+// Timings are the timings of the stages run so far, in run order
+var Timings []StageTiming
+
+// stageStart is the state of the system before a stage runs, to compare with after it
+type stageStart struct {
+	time     time.Time
+	received int64
+	packages []string
+	span     *tracing.Span
+}
+
+func startStage(sis values.System, stage string) stageStart {
+	if system.UnderBuildKit() {
+		fmt.Fprintf(os.Stdout, "[kairos-init] stage %s started\n", stage)
+	}
+	return stageStart{
+		time:     time.Now(),
+		received: system.ReceivedBytes(),
+		packages: installedPackages(sis),
+		span:     tracing.Start(stage, nil, map[string]string{"kairos.stage": stage}),
+	}
+}
+
+func recordTiming(sis values.System, stage string, start stageStart, err error) {
+	timing := StageTiming{
+		Stage:      stage,
+		Seconds:    time.Since(start.time).Seconds(),
+		Downloaded: system.ReceivedBytes() - start.received,
+	}
+	for _, pkg := range installedPackages(sis) {
+		if !slices.Contains(start.packages, pkg) {
+			timing.Packages = append(timing.Packages, pkg)
+		}
+	}
+	Timings = append(Timings, timing)
+	if system.UnderBuildKit() {
+		printProgress(timing, err)
+	}
+
+	start.span.SetAttribute("kairos.packages_installed", strconv.Itoa(len(timing.Packages)))
+	start.span.SetAttribute("kairos.downloaded_bytes", strconv.FormatInt(timing.Downloaded, 10))
+	start.span.End(err)
+}
+
+// printProgress prints a line with how the stage went, as BuildKit only shows the last lines of the output of each
+// step while it runs and the logs of the stage can be long
+func printProgress(timing StageTiming, err error) {
+	result := "done"
+	if err != nil {
+		result = "failed"
+	}
+	fmt.Fprintf(os.Stdout, "[kairos-init] stage %s %s in %.1fs, %d packages installed, %s downloaded\n",
+		timing.Stage, result, timing.Seconds, len(timing.Packages), system.HumanSize(timing.Downloaded))
+}
+
+// installedPackages returns the names of the installed packages, empty if they cant be listed as this is only for
+// reporting
+func installedPackages(sis values.System) []string {
+	pkgs, err := sbom.ListPackages(sis)
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		names = append(names, pkg.Name)
+	}
+	return slices.Compact(names)
+}
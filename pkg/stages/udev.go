@@ -0,0 +1,56 @@
+package stages
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// GetUdevStage returns the stage that installs the udev rules for the system
+// User rules from the config are installed after the default ones, so they can override them by using the same name
+// Both udev and eudev (Alpine) read the rules from /etc/udev/rules.d
+func GetUdevStage(sis values.System, c config.Config, logger types.KairosLogger) []schema.Stage {
+	rules := values.GetUdevRules(sis, c.Model)
+	for name, content := range c.UdevRules {
+		rules[name] = content
+	}
+
+	if len(rules) == 0 {
+		return []schema.Stage{}
+	}
+
+	names := make([]string, 0, len(rules))
+	for name := range rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var files []schema.File
+	for _, name := range names {
+		fileName := filepath.Base(name)
+		// udev ignores files without the proper extension
+		if !strings.HasSuffix(fileName, ".rules") {
+			fileName = fileName + ".rules"
+		}
+		files = append(files, schema.File{
+			Path:        filepath.Join("/etc/udev/rules.d", fileName),
+			Permissions: 0644,
+			Owner:       0,
+			Group:       0,
+			Content:     rules[name],
+		})
+	}
+	logger.Logger.Debug().Strs("rules", names).Msg("Udev rules")
+
+	return []schema.Stage{
+		{
+			Name:  "Install udev rules",
+			Files: files,
+		},
+	}
+}
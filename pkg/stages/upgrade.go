@@ -0,0 +1,173 @@
+package stages
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/release"
+	"github.com/kairos-io/kairos-init/pkg/sbom"
+	"github.com/kairos-io/kairos-init/pkg/system"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/console"
+	"github.com/mudler/yip/pkg/executor"
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/twpayne/go-vfs/v5"
+)
+
+// IsInitialized returns true if the rootfs was already initialized by kairos-init, which is the case if it has a
+// kairos-release file that identifies it as a kairos system
+func IsInitialized() bool {
+	r, err := release.Load(release.Path)
+	return err == nil && r.ID != "" && r.Version != ""
+}
+
+// GetUpgradePackagesStage returns the stage that installs the packages that the package maps of this kairos-init
+// version add on top of the ones already installed, without upgrading the rest of the system
+func GetUpgradePackagesStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	installStage, err := GetInstallStage(sis, c, logger)
+	if err != nil {
+		return []schema.Stage{}, err
+	}
+	installed, err := sbom.ListPackages(sis)
+	if err != nil {
+		return []schema.Stage{}, fmt.Errorf("listing the installed packages: %w", err)
+	}
+	names := map[string]bool{}
+	for _, pkg := range installed {
+		names[pkg.Name] = true
+	}
+
+	var missing []string
+	for _, st := range installStage {
+		for _, pkg := range st.Packages.Install {
+			if !names[pkg] {
+				missing = append(missing, pkg)
+			}
+		}
+	}
+	if len(missing) == 0 {
+		logger.Logger.Info().Msg("No new packages to install")
+		return []schema.Stage{}, nil
+	}
+	logger.Logger.Info().Strs("packages", missing).Msg("Installing the new packages")
+
+	return []schema.Stage{
+		{
+			Name: "Install new packages",
+			Packages: schema.Packages{
+				Install: missing,
+				Refresh: true,
+			},
+		},
+	}, nil
+}
+
+// GetUpgradeComponentsStage returns the stages that replace the kairos components with the ones for this kairos-init
+// version. The kubernetes distro is left alone, as its version is chosen by the user and not by kairos-init
+func GetUpgradeComponentsStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	stages := GetInstallFrameworkStage(sis, c, logger)
+	for _, st := range GetInstallProviderAndKubernetes(sis, c, logger) {
+		if len(st.UnpackImages) > 0 {
+			stages = append(stages, st)
+		}
+	}
+	componentsStage, err := GetInstallComponentsStage(sis, c, logger)
+	if err != nil {
+		return []schema.Stage{}, err
+	}
+	return append(stages, componentsStage...), nil
+}
+
+// RunUpgradeStage upgrades an already initialized rootfs to this kairos-init version
+// Only the kairos components and the packages added to the package maps are installed, then the kairos-release file and
+// the initrd are regenerated so they pick up the new version and components
+func RunUpgradeStage(ctx context.Context, logger types.KairosLogger) (schema.YipConfig, error) {
+	sis := system.DetectSystem(logger)
+	c := config.DefaultConfig
+	initExecutor := executor.NewExecutor(executor.WithLogger(logger))
+	yipConsole := console.NewStandardConsole(console.WithLogger(logger))
+
+	data := schema.YipConfig{Stages: map[string][]schema.Stage{}}
+	if !IsInitialized() {
+		return data, fmt.Errorf("no kairos installation found on the rootfs, %s is missing or invalid. Run the all stage instead", release.Path)
+	}
+	if r, err := release.Load(release.Path); err == nil {
+		logger.Logger.Info().Str("from", r.Version).Str("to", c.KairosVersion.String()).
+			Str("framework", c.FrameworkVersion).Msg("Upgrading kairos rootfs")
+	}
+	// The upgrade installs few packages, but rebuilds the initrd like the init stage
+	if err := Preflight(sis, "upgrade", logger); err != nil {
+		logger.Logger.Error().Msgf("Failed the preflight checks: %s", err)
+		return data, err
+	}
+
+	packagesStage, err := GetUpgradePackagesStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the upgrade packages stage: %s", err)
+		return data, err
+	}
+	data.Stages["install"] = packagesStage
+	componentsStage, err := GetUpgradeComponentsStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the upgrade components stage: %s", err)
+		return data, err
+	}
+	data.Stages["install"] = append(data.Stages["install"], componentsStage...)
+	data.Stages["install"] = append(data.Stages["install"], GetStageExtensions("install", c, logger)...)
+
+	data.Stages["init"] = []schema.Stage{}
+	releaseStage, err := GetKairosReleaseStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the kairos-release stage: %s", err)
+		return data, err
+	}
+	data.Stages["init"] = append(data.Stages["init"], releaseStage...)
+	initrdStage, err := GetInitrdStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the initrd stage: %s", err)
+		return data, err
+	}
+	data.Stages["init"] = append(data.Stages["init"], initrdStage...)
+	cleanupStage, err := GetCleanupStage(sis, c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the cleanup stage: %s", err)
+		return data, err
+	}
+	data.Stages["init"] = append(data.Stages["init"], cleanupStage...)
+	data.Stages["init"] = append(data.Stages["init"], GetStageExtensions("init", c, logger)...)
+
+	data.Stages["cleanup"] = GetImageCleanupStage(sis, c, logger)
+
+	if err = NetworkPreflight(sis, data, logger); err != nil {
+		logger.Logger.Error().Msgf("Failed the network preflight checks: %s", err)
+		return data, err
+	}
+
+	// Roll back the packages of the whole kairos-init stage if any of its yip stages fails
+	first := len(Timings)
+	for _, st := range []string{"install", "init", "cleanup"} {
+		if skipResumed(st, logger) {
+			continue
+		}
+		size := rootfsSize()
+		start := startStage(sis, st)
+		err = initExecutor.Run(st, vfs.OSFS, newStageConsole(ctx, logger, sis, yipConsole, st, data.Stages[st], start.span), data.ToString())
+		if ctx.Err() != nil {
+			err = interruptedError(ctx, st)
+		}
+		recordTiming(sis, st, start, err)
+		if err == nil {
+			err = recordSize(st, size, logger)
+		}
+		if err != nil {
+			logger.Logger.Error().Msgf("Failed to run the %s stage: %s", st, err)
+			rollbackPackages(ctx, Timings[first:], logger)
+			return data, err
+		}
+		stageCompleted(st)
+	}
+
+	return data, nil
+}
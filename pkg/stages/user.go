@@ -0,0 +1,80 @@
+package stages
+
+import (
+	"fmt"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// GetUserStage returns the stages to create the default user at build time
+// This is optional and only done if enabled in the config, as usually the user is created via cloud-config on boot
+func GetUserStage(sis values.System, c config.Config, logger types.KairosLogger) []schema.Stage {
+	var stages []schema.Stage
+	userConfig := c.User
+	if !userConfig.Create {
+		return stages
+	}
+
+	name := userConfig.Name
+	if name == "" {
+		name = values.DefaultUserName
+	}
+
+	groups := userConfig.Groups
+	if userConfig.Sudo {
+		groups = append(groups, values.AdminGroups[sis.Family]...)
+	}
+
+	// Create the primary group with the given gid, as yip can only set the uid
+	primaryGroup := ""
+	if userConfig.GID != "" {
+		primaryGroup = name
+		cmd := fmt.Sprintf("groupadd -g %s %s", userConfig.GID, name)
+		if sis.Family == values.AlpineFamily {
+			cmd = fmt.Sprintf("addgroup -g %s %s", userConfig.GID, name)
+		}
+		stages = append(stages, schema.Stage{
+			Name:     fmt.Sprintf("Create group %s", name),
+			If:       fmt.Sprintf("! grep -q '^%s:' /etc/group", name),
+			Commands: []string{cmd},
+		})
+	}
+
+	logger.Logger.Debug().Str("user", name).Strs("groups", groups).Msg("Creating user")
+	stages = append(stages, schema.Stage{
+		Name: fmt.Sprintf("Create user %s", name),
+		Users: map[string]schema.User{
+			name: {
+				Name:              name,
+				UID:               userConfig.UID,
+				PrimaryGroup:      primaryGroup,
+				Groups:            groups,
+				Shell:             userConfig.Shell,
+				PasswordHash:      userConfig.PasswordHash,
+				LockPasswd:        userConfig.PasswordHash == "",
+				SSHAuthorizedKeys: userConfig.SSHAuthorizedKeys,
+				Homedir:           fmt.Sprintf("/home/%s", name),
+			},
+		},
+	})
+
+	if userConfig.Sudo {
+		stages = append(stages, schema.Stage{
+			Name: fmt.Sprintf("Add sudoers drop-in for %s", name),
+			Files: []schema.File{
+				{
+					Path:        fmt.Sprintf("/etc/sudoers.d/%s", name),
+					Permissions: 0440,
+					Owner:       0,
+					Group:       0,
+					Content:     fmt.Sprintf("%s ALL=(ALL) NOPASSWD: ALL\n", name),
+				},
+			},
+		})
+	}
+
+	return stages
+}
@@ -0,0 +1,77 @@
+package stages
+
+import (
+	"fmt"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/schema"
+)
+
+// GetZfsRepoStage returns the stage that adds the zfs repos, so the packages can be installed with the rest
+func GetZfsRepoStage(sis values.System, logger types.KairosLogger) ([]schema.Stage, error) {
+	commands, err := values.ZfsRepoCommands(sis)
+	if err != nil {
+		return []schema.Stage{}, err
+	}
+	if len(commands) == 0 {
+		logger.Logger.Debug().Str("distro", sis.Distro.String()).Msg("zfs is available on the default repos")
+		return []schema.Stage{}, nil
+	}
+	return []schema.Stage{
+		{
+			Name:     "Add zfs repos",
+			Commands: commands,
+		},
+	}, nil
+}
+
+// GetZfsStage returns the stages that build the zfs module against the installed kernel and add it to the initrd
+// It needs to run before the initrd is built
+func GetZfsStage(sis values.System, c config.Config, logger types.KairosLogger) ([]schema.Stage, error) {
+	if !c.Zfs {
+		return []schema.Stage{}, nil
+	}
+
+	if sis.Family == values.AlpineFamily {
+		return []schema.Stage{
+			{
+				Name: "Add zfs to the initrd",
+				Commands: []string{
+					"grep -q '^features=.*zfs' /etc/mkinitfs/mkinitfs.conf || sed -i 's/^features=\"\\(.*\\)\"/features=\"\\1 zfs\"/' /etc/mkinitfs/mkinitfs.conf",
+				},
+			},
+		}, nil
+	}
+
+	kernel, err := getLatestKernel(c, logger)
+	if err != nil {
+		logger.Logger.Error().Msgf("Failed to get the latest kernel: %s", err)
+		return []schema.Stage{}, err
+	}
+
+	return []schema.Stage{
+		{
+			// dkms only builds the module for the running kernel on install, which is the host one on a container build
+			Name: "Build zfs module",
+			If:   "command -v dkms",
+			Commands: []string{
+				fmt.Sprintf("dkms autoinstall -k %s", kernel),
+				fmt.Sprintf("test -n \"$(find /lib/modules/%s -name 'zfs.ko*')\"", kernel),
+			},
+		},
+		{
+			Name: "Add zfs to the initrd",
+			Files: []schema.File{
+				{
+					Path:        "/etc/dracut.conf.d/kairos-zfs.conf",
+					Permissions: 0644,
+					Owner:       0,
+					Group:       0,
+					Content:     "add_dracutmodules+=\" zfs \"\n",
+				},
+			},
+		},
+	}, nil
+}
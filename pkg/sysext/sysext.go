@@ -0,0 +1,248 @@
+package sysext
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/joho/godotenv"
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+)
+
+// Dirs are the dirs that systemd-sysext merges, anything else changed by the stages cant go in the extension
+var Dirs = []string{"/usr", "/opt"}
+
+// SnapshotPath is where the state of the rootfs before the stages run is kept, so layered builds running install and
+// init separately produce an extension with the changes of both
+const SnapshotPath = "/var/lib/kairos-init/sysext-snapshot.json"
+
+// fileState is what is compared to know if a file changed, packages replace files with new inodes and keep the mtime
+// of the package build, so the mtime alone is not enough
+type fileState struct {
+	Size  int64  `json:"s"`
+	Mtime int64  `json:"m"`
+	Inode uint64 `json:"i"`
+}
+
+func walk(dirs []string, fn func(path string, d fs.DirEntry, info fs.FileInfo) error) error {
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// Dirs not there on the base image are fine
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			return fn(path, d, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stateOf(info fs.FileInfo) fileState {
+	state := fileState{Size: info.Size(), Mtime: info.ModTime().UnixNano()}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		state.Inode = stat.Ino
+	}
+	return state
+}
+
+// Snapshot records the state of the sysext dirs before the stages run. An existing snapshot from a previous layer is
+// kept, so the extension carries all the changes since the base image
+func Snapshot(l types.KairosLogger) error {
+	if _, err := os.Stat(SnapshotPath); err == nil {
+		l.Logger.Debug().Str("path", SnapshotPath).Msg("Using the existing sysext snapshot")
+		return nil
+	}
+	snapshot := map[string]fileState{}
+	err := walk(Dirs, func(path string, _ fs.DirEntry, info fs.FileInfo) error {
+		snapshot[path] = stateOf(info)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not snapshot the rootfs for the sysext: %w", err)
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(SnapshotPath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(SnapshotPath, data, 0644)
+}
+
+// Build creates the systemd-sysext image with the files added or changed under /usr and /opt since the snapshot.
+// The image is a squashfs with the extension-release file matching the base image, so it only merges on top of it
+func Build(s values.System, l types.KairosLogger) error {
+	opts := config.DefaultConfig.Sysext
+	name := opts.Name
+	if name == "" {
+		name = "kairos"
+	}
+	if _, err := exec.LookPath("mksquashfs"); err != nil {
+		return fmt.Errorf("mksquashfs is needed to build the sysext image, install squashfs-tools")
+	}
+
+	data, err := os.ReadFile(SnapshotPath)
+	if err != nil {
+		return fmt.Errorf("no sysext snapshot found, it is taken when running the stages in sysext mode: %w", err)
+	}
+	snapshot := map[string]fileState{}
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("could not parse the sysext snapshot: %w", err)
+	}
+
+	staging, err := os.MkdirTemp("", "kairos-sysext")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(staging)
+	}()
+	// The staging dir is the root of the image
+	if err = os.Chmod(staging, 0755); err != nil {
+		return err
+	}
+
+	var changed int
+	seen := map[string]bool{}
+	err = walk(Dirs, func(path string, d fs.DirEntry, info fs.FileInfo) error {
+		seen[path] = true
+		previous, existed := snapshot[path]
+		// Dirs are created as needed when copying the files inside them
+		if d.IsDir() || (existed && previous == stateOf(info)) {
+			return nil
+		}
+		changed++
+		return copyEntry(path, filepath.Join(staging, path), info)
+	})
+	if err != nil {
+		return fmt.Errorf("could not copy the changed files for the sysext: %w", err)
+	}
+
+	var removed int
+	for path := range snapshot {
+		if !seen[path] {
+			removed++
+		}
+	}
+	if removed > 0 {
+		// Extensions can only add files on top of the base image
+		l.Logger.Warn().Int("files", removed).Msg("Files removed from the base image are not removed by the sysext")
+	}
+
+	if err = writeExtensionRelease(staging, name, s); err != nil {
+		return err
+	}
+
+	output := opts.Output
+	if output == "" {
+		output = filepath.Join("/", name+".raw")
+	}
+	if err = os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return err
+	}
+	out, err := exec.Command("mksquashfs", staging, output, "-noappend", "-all-root", "-comp", "zstd").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("could not build the sysext image: %s: %w", string(out), err)
+	}
+	l.Logger.Info().Str("path", output).Int("files", changed).Msg("Sysext image written")
+	return nil
+}
+
+// copyEntry copies a file or symlink keeping its mode, creating the parent dirs with the same mode as the source ones
+func copyEntry(src, dst string, info fs.FileInfo) error {
+	if err := mkdirLike(filepath.Dir(src), filepath.Dir(dst)); err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	case info.Mode().IsRegular():
+		in, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = in.Close()
+		}()
+		out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(out, in); err != nil {
+			_ = out.Close()
+			return err
+		}
+		if err = out.Close(); err != nil {
+			return err
+		}
+		// Perm() drops setuid and friends, which some binaries need
+		return os.Chmod(dst, info.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky))
+	}
+	// Devices, sockets and fifos dont belong in /usr
+	return nil
+}
+
+func mkdirLike(src, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	if err := mkdirLike(filepath.Dir(src), filepath.Dir(dst)); err != nil {
+		return err
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(dst, info.Mode().Perm())
+}
+
+// writeExtensionRelease writes the file that systemd-sysext checks to decide if the extension matches the host
+func writeExtensionRelease(staging, name string, s values.System) error {
+	osRelease, err := godotenv.Read("/etc/os-release")
+	if err != nil {
+		return fmt.Errorf("could not read os-release for the extension-release file: %w", err)
+	}
+	// systemd uses its own names for the archs
+	arch := map[values.Architecture]string{values.ArchAMD64: "x86-64", values.ArchARM64: "arm64"}[s.Arch]
+
+	var release strings.Builder
+	release.WriteString(fmt.Sprintf("ID=%s\n", osRelease["ID"]))
+	if osRelease["VERSION_ID"] != "" {
+		release.WriteString(fmt.Sprintf("VERSION_ID=%s\n", osRelease["VERSION_ID"]))
+	}
+	if arch != "" {
+		release.WriteString(fmt.Sprintf("ARCHITECTURE=%s\n", arch))
+	}
+	if config.DefaultConfig.KairosVersion.String() != "" {
+		release.WriteString(fmt.Sprintf("SYSEXT_VERSION_ID=%s\n", config.DefaultConfig.KairosVersion.String()))
+	}
+
+	dir := filepath.Join(staging, "usr/lib/extension-release.d")
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "extension-release."+name), []byte(release.String()), 0644)
+}
@@ -0,0 +1,213 @@
+package system
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+)
+
+// Artifact is a boot artifact found in the image, with the path relative to the image root
+type Artifact struct {
+	Path    string `json:"path"`
+	Version string `json:"version,omitempty"`
+}
+
+// ArtifactsPath is where the artifacts description is stored in the image, for AuroraBoot to build the media from
+const ArtifactsPath = "/etc/kairos/artifacts.json"
+
+// Artifacts are the boot artifacts installed in the image, as left by the init stage
+type Artifacts struct {
+	Arch           string       `json:"arch,omitempty"`
+	Kernel         *Artifact    `json:"kernel,omitempty"`
+	Initrd         *Artifact    `json:"initrd,omitempty"`
+	FallbackKernel *Artifact    `json:"fallback_kernel,omitempty"`
+	FallbackInitrd *Artifact    `json:"fallback_initrd,omitempty"`
+	UKI            []Artifact   `json:"uki,omitempty"`
+	Shim           *Artifact    `json:"shim,omitempty"`
+	Grub           *Artifact    `json:"grub,omitempty"`
+	GrubModules    *GrubModules `json:"grub_modules,omitempty"`
+	SystemdBoot    *Artifact    `json:"systemd_boot,omitempty"`
+	// ESP is where each of the boot files goes on the EFI system partition
+	ESP []ESPEntry `json:"esp,omitempty"`
+}
+
+// GrubModules are the grub modules available in the image, to build grub images or copy them to the ESP
+type GrubModules struct {
+	Platform string   `json:"platform"`
+	Dir      string   `json:"dir"`
+	Modules  []string `json:"modules"`
+}
+
+// ESPEntry is a file of the image to copy to the EFI system partition, with its path on the partition
+type ESPEntry struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+// GetArtifacts returns the kernel, initrd and UKIs installed under the given root
+// The kernel and initrd are the /boot/vmlinuz and /boot/initrd links that kairos boots from, and their version is
+// the kernel version under /lib/modules, so tooling doesnt need to know the distro specific names
+func GetArtifacts(root string) (Artifacts, error) {
+	var artifacts Artifacts
+
+	kernel, err := getKernelArtifact(root, "/boot/vmlinuz")
+	if err != nil {
+		return artifacts, err
+	}
+	if kernel == nil {
+		return artifacts, fmt.Errorf("no kernel found under %s", filepath.Join(root, "boot"))
+	}
+	artifacts.Kernel = kernel
+	if exists(root, "/boot/initrd") {
+		artifacts.Initrd = &Artifact{Path: "/boot/initrd", Version: kernel.Version}
+	}
+
+	artifacts.FallbackKernel, err = getKernelArtifact(root, "/boot/vmlinuz-fallback")
+	if err != nil {
+		return artifacts, err
+	}
+	if artifacts.FallbackKernel != nil && exists(root, "/boot/initrd-fallback") {
+		artifacts.FallbackInitrd = &Artifact{Path: "/boot/initrd-fallback", Version: artifacts.FallbackKernel.Version}
+	}
+
+	for _, dir := range []string{"/boot/EFI/Linux", "/efi/EFI/Linux"} {
+		ukis, _ := filepath.Glob(filepath.Join(root, dir, "*.efi"))
+		for _, uki := range ukis {
+			artifacts.UKI = append(artifacts.UKI, Artifact{Path: filepath.Join(dir, filepath.Base(uki))})
+		}
+	}
+
+	getBootloaderArtifacts(root, &artifacts)
+
+	return artifacts, nil
+}
+
+// getBootloaderArtifacts fills the shim, grub and systemd-boot binaries and the ESP layout. The family and arch are
+// the ones whose shim is found in the image, so this works on a root of another arch too
+func getBootloaderArtifacts(root string, artifacts *Artifacts) {
+	for family, arches := range values.BootChainFiles {
+		for arch, files := range arches {
+			if shim := glob(root, files[0]); shim != "" {
+				artifacts.Arch = arch.String()
+				artifacts.Shim = &Artifact{Path: shim}
+				if grub := glob(root, files[1]); grub != "" {
+					artifacts.Grub = &Artifact{Path: grub}
+				}
+				if mok := glob(root, values.MokManagerFiles[family][arch]); mok != "" {
+					artifacts.ESP = append(artifacts.ESP, ESPEntry{Source: mok, Destination: fmt.Sprintf("/EFI/BOOT/mm%s.efi", values.EFIArchSuffix[arch])})
+				}
+			}
+		}
+	}
+	for arch, files := range values.SystemdBootFiles {
+		for _, file := range files {
+			if exists(root, file) {
+				artifacts.Arch = arch.String()
+				artifacts.SystemdBoot = &Artifact{Path: file}
+				break
+			}
+		}
+		if artifacts.SystemdBoot != nil {
+			break
+		}
+	}
+	arch := values.Architecture(artifacts.Arch)
+	if arch == "" {
+		return
+	}
+	suffix := values.EFIArchSuffix[arch]
+
+	for _, dir := range values.GrubModulesDirs {
+		dir = fmt.Sprintf(dir, values.GrubPlatform[arch])
+		mods, _ := filepath.Glob(filepath.Join(root, dir, "*.mod"))
+		if len(mods) == 0 {
+			continue
+		}
+		artifacts.GrubModules = &GrubModules{Platform: values.GrubPlatform[arch], Dir: dir}
+		for _, mod := range mods {
+			artifacts.GrubModules.Modules = append(artifacts.GrubModules.Modules, strings.TrimSuffix(filepath.Base(mod), ".mod"))
+		}
+		break
+	}
+
+	// Trusted boot images boot the UKIs with systemd-boot, the rest go through shim and grub
+	if len(artifacts.UKI) > 0 && artifacts.SystemdBoot != nil {
+		artifacts.ESP = []ESPEntry{{Source: artifacts.SystemdBoot.Path, Destination: fmt.Sprintf("/EFI/BOOT/BOOT%s.EFI", strings.ToUpper(suffix))}}
+		for _, uki := range artifacts.UKI {
+			artifacts.ESP = append(artifacts.ESP, ESPEntry{Source: uki.Path, Destination: filepath.Join("/EFI/Linux", filepath.Base(uki.Path))})
+		}
+		return
+	}
+	if artifacts.Shim != nil && artifacts.Grub != nil {
+		artifacts.ESP = append([]ESPEntry{
+			{Source: artifacts.Shim.Path, Destination: fmt.Sprintf("/EFI/BOOT/BOOT%s.EFI", strings.ToUpper(suffix))},
+			{Source: artifacts.Grub.Path, Destination: fmt.Sprintf("/EFI/BOOT/grub%s.efi", suffix)},
+		}, artifacts.ESP...)
+	}
+}
+
+// glob returns the first match of the pattern inside the root, relative to it
+func glob(root, pattern string) string {
+	matches, _ := filepath.Glob(filepath.Join(root, pattern))
+	if len(matches) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(matches[0], strings.TrimSuffix(root, "/"))
+}
+
+// WriteArtifacts stores the artifacts of the image at ArtifactsPath
+func WriteArtifacts() error {
+	artifacts, err := GetArtifacts("/")
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(artifacts, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(ArtifactsPath), 0755); err != nil {
+		return err
+	}
+	return config.DefaultConfig.WriteFile(ArtifactsPath, data, 0644)
+}
+
+// getKernelArtifact returns the kernel for the given link, or nil if the link doesnt exist
+func getKernelArtifact(root, link string) (*Artifact, error) {
+	if !exists(root, link) {
+		return nil, nil
+	}
+	// The links are absolute, so resolve them inside the root instead of following them
+	path := link
+	if target, err := os.Readlink(filepath.Join(root, link)); err == nil {
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(link), target)
+		}
+		path = target
+	}
+
+	modules, err := os.ReadDir(filepath.Join(root, "/lib/modules"))
+	if err != nil {
+		return nil, fmt.Errorf("could not read the kernel modules dir: %w", err)
+	}
+	// vmlinuz-6.8.0-45-generic or Image-6.4.0-150600.23.22-default carry the version, vmlinuz-lts on Alpine doesnt
+	_, version, _ := strings.Cut(filepath.Base(path), "-")
+	for _, dir := range modules {
+		if dir.IsDir() && dir.Name() == version {
+			return &Artifact{Path: path, Version: version}, nil
+		}
+	}
+	if len(modules) == 1 {
+		return &Artifact{Path: path, Version: modules[0].Name()}, nil
+	}
+	return &Artifact{Path: path}, nil
+}
+
+func exists(root, path string) bool {
+	_, err := os.Lstat(filepath.Join(root, path))
+	return err == nil
+}
@@ -0,0 +1,69 @@
+package system
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// buildKitHostname is the hostname that BuildKit gives to the RUN containers, unless overridden with the
+// BUILDKIT_SANDBOX_HOSTNAME build arg
+const buildKitHostname = "buildkitsandbox"
+
+// UnderBuildKit returns true if kairos-init runs in a RUN instruction of a BuildKit build
+func UnderBuildKit() bool {
+	hostname, err := os.Hostname()
+	return err == nil && hostname == buildKitHostname
+}
+
+// MountedDirs returns the dirs from the given ones that are mount points, like the cache mounts of a BuildKit build,
+// from /proc/self/mountinfo
+func MountedDirs(dirs []string) []string {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	mounts := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Lines are like "36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw", the mount point is the fifth
+		// field, with spaces and other special chars octal escaped
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mounts[unescapeMountPath(fields[4])] = true
+	}
+
+	var mounted []string
+	for _, dir := range dirs {
+		if mounts[dir] {
+			mounted = append(mounted, dir)
+		}
+	}
+	return mounted
+}
+
+// unescapeMountPath undoes the octal escaping of the mountinfo paths, like \040 for a space
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var out strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			code := path[i+1 : i+4]
+			if code[0] >= '0' && code[0] <= '3' && code[1] >= '0' && code[1] <= '7' && code[2] >= '0' && code[2] <= '7' {
+				out.WriteByte((code[0]-'0')<<6 | (code[1]-'0')<<3 | (code[2] - '0'))
+				i += 3
+				continue
+			}
+		}
+		out.WriteByte(path[i])
+	}
+	return out.String()
+}
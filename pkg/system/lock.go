@@ -0,0 +1,57 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// LockFile is the lock of the kairos-init runs, relative to the root they run on. It is on /run so a leftover one
+// never ends up on the booted system
+const LockFile = "/run/kairos-init.lock"
+
+// LockHeldEnv is set for the kairos-init run in a rootfs, which runs under the lock of the one that started it
+const LockHeldEnv = "KAIROS_INIT_LOCK_HELD"
+
+// ErrLocked is returned when another run holds the lock
+var ErrLocked = errors.New("another kairos-init run is in progress")
+
+// Lock takes the lock of the runs on the root, so two runs dont interleave their package manager operations on it.
+// It fails right away if another run holds it, instead of waiting for it. The returned func releases the lock and
+// removes the file, so it isn't left in the image
+func Lock(root string) (func(), error) {
+	if os.Getenv(LockHeldEnv) != "" {
+		return func() {}, nil
+	}
+	path := filepath.Join(root, LockFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			_ = file.Close()
+			if errors.Is(err, syscall.EWOULDBLOCK) {
+				// The lock goes away with the process that holds it, so it is never stale
+				return nil, fmt.Errorf("%w on %s, wait for it to finish", ErrLocked, root)
+			}
+			return nil, err
+		}
+		// The run that held it could have removed the file before we got the lock, then the lock is on a file that
+		// is no longer there and another run could take a new one
+		opened, statErr := file.Stat()
+		current, err := os.Stat(path)
+		if statErr == nil && err == nil && os.SameFile(opened, current) {
+			return func() {
+				_ = os.Remove(path)
+				_ = file.Close()
+			}, nil
+		}
+		_ = file.Close()
+	}
+}
@@ -0,0 +1,62 @@
+package system
+
+import (
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/values"
+)
+
+// mirrorUses returns true if the repo url is served by the mirror, which is the base url of the repos on it
+func mirrorUses(mirror, url string) bool {
+	return strings.HasPrefix(strings.TrimSuffix(url, "/")+"/", strings.TrimSuffix(mirror, "/")+"/")
+}
+
+// CurrentMirror returns the index of the first of the mirrors that the enabled repos of the family use, or -1 if they
+// use none of them
+func CurrentMirror(family values.Family, mirrors []string) int {
+	repos := Repos(family)
+	return slices.IndexFunc(mirrors, func(mirror string) bool {
+		return slices.ContainsFunc(repos, func(repo Repo) bool { return mirrorUses(mirror, repo.URL) })
+	})
+}
+
+// HasFallbackMirror returns true if the repo url is served by one of the mirrors, other than the last one
+func HasFallbackMirror(url string, mirrors []string) bool {
+	for _, mirror := range mirrors[:max(len(mirrors)-1, 0)] {
+		if mirrorUses(mirror, url) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReplaceMirror rewrites the repo configs of the family that use the from mirror to use the to one instead, and returns
+// the files that changed
+func ReplaceMirror(family values.Family, from, to string) ([]string, error) {
+	from, to = strings.TrimSuffix(from, "/"), strings.TrimSuffix(to, "/")
+	// Only the whole base url, so a mirror of /ubuntu doesn't replace the start of /ubuntu-ports
+	pattern := regexp.MustCompile(regexp.QuoteMeta(from) + `(/|\s|$|["'])`)
+	var changed []string
+	for _, repo := range Repos(family) {
+		if !mirrorUses(from, repo.URL) || slices.Contains(changed, repo.File) {
+			continue
+		}
+		data, err := os.ReadFile(repo.File)
+		if err != nil {
+			return changed, err
+		}
+		info, err := os.Stat(repo.File)
+		if err != nil {
+			return changed, err
+		}
+		replaced := pattern.ReplaceAllString(string(data), strings.ReplaceAll(to, "$", "$$")+"${1}")
+		if err = os.WriteFile(repo.File, []byte(replaced), info.Mode().Perm()); err != nil {
+			return changed, err
+		}
+		changed = append(changed, repo.File)
+	}
+	return changed, nil
+}
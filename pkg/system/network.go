@@ -0,0 +1,38 @@
+package system
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ReceivedBytes returns the bytes received by all the network interfaces except loopback, from /proc/net/dev
+// Inside a build container this is the traffic of the build, mostly package downloads
+func ReceivedBytes() int64 {
+	file, err := os.Open("/proc/net/dev")
+	if err != nil {
+		return 0
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	var total int64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Lines are like "  eth0: 1234 12 0 0 0 0 0 0 5678 ...", the first field after the colon is the received bytes
+		iface, counters, found := strings.Cut(scanner.Text(), ":")
+		if !found || strings.TrimSpace(iface) == "lo" {
+			continue
+		}
+		fields := strings.Fields(counters)
+		if len(fields) == 0 {
+			continue
+		}
+		if rx, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+			total += rx
+		}
+	}
+	return total
+}
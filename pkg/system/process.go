@@ -0,0 +1,98 @@
+package system
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// StopGrace is how long the children get after SIGTERM to exit on their own, before they are killed
+const StopGrace = 10 * time.Second
+
+// OwnProcessGroup makes the command run on its own process group, so it and whatever it spawns, like dpkg under
+// apt-get, can be signaled together with StopChildren
+func OwnProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// StopChildren stops the running children of this process and what they spawned. They get SIGTERM first so the package
+// managers can release their locks and leave their databases consistent, and SIGKILL if they are still running after
+// the grace period
+func StopChildren(grace time.Duration) {
+	targets := childTargets()
+	if len(targets) == 0 {
+		return
+	}
+	for _, target := range targets {
+		_ = syscall.Kill(target, syscall.SIGTERM)
+	}
+	deadline := time.Now().Add(grace)
+	for time.Now().Before(deadline) {
+		running := false
+		for _, target := range targets {
+			if syscall.Kill(target, 0) == nil {
+				running = true
+			}
+		}
+		if !running {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	for _, target := range targets {
+		_ = syscall.Kill(target, syscall.SIGKILL)
+	}
+}
+
+// childTargets returns what to signal to stop the children: the process group of the ones that lead their own, see
+// OwnProcessGroup, and the process itself for the ones in ours, as signaling our group would stop us too
+func childTargets() []int {
+	self := os.Getpid()
+	ownGroup := syscall.Getpgrp()
+	stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+	var targets []int
+	for _, stat := range stats {
+		data, err := os.ReadFile(stat)
+		if err != nil {
+			continue
+		}
+		// The fields after the command, which is in parens and can have spaces and parens, are like "S 1234 1234 ..."
+		end := strings.LastIndex(string(data), ")")
+		fields := strings.Fields(string(data)[end+1:])
+		if end < 0 || len(fields) < 3 {
+			continue
+		}
+		ppid, _ := strconv.Atoi(fields[1])
+		pgrp, _ := strconv.Atoi(fields[2])
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(stat)))
+		if err != nil || ppid != self {
+			continue
+		}
+		if pgrp == pid && pgrp != ownGroup {
+			targets = append(targets, -pgrp)
+		} else {
+			targets = append(targets, pid)
+		}
+	}
+	return targets
+}
+
+// ProcessRunning returns true if a process with any of the names is running
+func ProcessRunning(names ...string) bool {
+	comms, _ := filepath.Glob("/proc/[0-9]*/comm")
+	for _, comm := range comms {
+		data, err := os.ReadFile(comm)
+		if err == nil && slices.Contains(names, strings.TrimSpace(string(data))) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package system
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/values"
+)
+
+// Repo is a package repository or mirror configured on the system
+type Repo struct {
+	URL string `json:"url"`
+	// File is the config file where the repo is set, to point at it when the repo is wrong
+	File string `json:"file"`
+}
+
+// Repos returns the enabled package repositories of the system for the family, from the package manager configs
+func Repos(family values.Family) []Repo {
+	switch family {
+	case values.DebianFamily:
+		return aptRepos()
+	case values.RedHatFamily:
+		return iniRepos(globFiles("/etc/yum.repos.d/*.repo"))
+	case values.SUSEFamily:
+		return iniRepos(globFiles("/etc/zypp/repos.d/*.repo"))
+	case values.AlpineFamily:
+		return lineRepos([]string{"/etc/apk/repositories"}, func(line string) string {
+			// Tagged repos are like "@edge https://..."
+			fields := strings.Fields(line)
+			return fields[len(fields)-1]
+		})
+	case values.ArchFamily:
+		return lineRepos([]string{"/etc/pacman.conf", "/etc/pacman.d/mirrorlist"}, func(line string) string {
+			key, value, found := strings.Cut(line, "=")
+			if !found || strings.TrimSpace(key) != "Server" {
+				return ""
+			}
+			return strings.TrimSpace(value)
+		})
+	}
+	return nil
+}
+
+func globFiles(pattern string) []string {
+	files, _ := filepath.Glob(pattern)
+	return files
+}
+
+// readLines calls fn with each line of the file that is not a comment, with empty lines as ""
+func readLines(path string, fn func(line string)) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch trimmed := strings.TrimSpace(line); {
+		case trimmed == "":
+			fn("")
+		case !strings.HasPrefix(trimmed, "#"):
+			fn(line)
+		}
+	}
+}
+
+// aptRepos reads the one line style sources.list files and the deb822 style .sources ones
+func aptRepos() []Repo {
+	var repos []Repo
+	for _, file := range append([]string{"/etc/apt/sources.list"}, globFiles("/etc/apt/sources.list.d/*.list")...) {
+		readLines(file, func(line string) {
+			// Lines are like "deb [arch=amd64 signed-by=...] http://archive.ubuntu.com/ubuntu noble main"
+			fields := strings.Fields(line)
+			if len(fields) < 2 || fields[0] != "deb" {
+				return
+			}
+			fields = fields[1:]
+			if strings.HasPrefix(fields[0], "[") {
+				for len(fields) > 0 && !strings.HasSuffix(fields[0], "]") {
+					fields = fields[1:]
+				}
+				if len(fields) < 2 {
+					return
+				}
+				fields = fields[1:]
+			}
+			repos = append(repos, Repo{URL: fields[0], File: file})
+		})
+	}
+	for _, file := range globFiles("/etc/apt/sources.list.d/*.sources") {
+		// Stanzas are separated by empty lines, and can be disabled with "Enabled: no"
+		var uris []string
+		enabled, binary := true, false
+		flush := func() {
+			if enabled && binary {
+				for _, uri := range uris {
+					repos = append(repos, Repo{URL: uri, File: file})
+				}
+			}
+			uris, enabled, binary = nil, true, false
+		}
+		readLines(file, func(line string) {
+			if line == "" {
+				flush()
+				return
+			}
+			key, value, _ := strings.Cut(line, ":")
+			switch strings.ToLower(strings.TrimSpace(key)) {
+			case "uris":
+				uris = append(uris, strings.Fields(value)...)
+			case "enabled":
+				enabled = strings.TrimSpace(value) != "no"
+			case "types":
+				binary = slices.Contains(strings.Fields(value), "deb")
+			}
+		})
+		flush()
+	}
+	return repos
+}
+
+// iniRepos reads the dnf and zypper .repo files, with a section for each repo
+func iniRepos(files []string) []Repo {
+	var repos []Repo
+	for _, file := range files {
+		var urls []string
+		enabled := true
+		continued := false
+		flush := func() {
+			if enabled {
+				for _, url := range urls {
+					repos = append(repos, Repo{URL: url, File: file})
+				}
+			}
+			urls, enabled, continued = nil, true, false
+		}
+		readLines(file, func(line string) {
+			trimmed := strings.TrimSpace(line)
+			switch {
+			case trimmed == "":
+				continued = false
+			case strings.HasPrefix(trimmed, "["):
+				flush()
+			case continued && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")):
+				// baseurl can list more urls on the next lines
+				urls = append(urls, strings.Fields(trimmed)...)
+			default:
+				key, value, _ := strings.Cut(trimmed, "=")
+				key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+				continued = key == "baseurl"
+				switch key {
+				case "baseurl", "mirrorlist", "metalink":
+					urls = append(urls, strings.Fields(value)...)
+				case "enabled":
+					enabled = value != "0" && value != "false" && value != "no"
+				}
+			}
+		})
+		flush()
+	}
+	return repos
+}
+
+// lineRepos reads the files with a repo per line, parse returns the url of the line or empty to skip it
+func lineRepos(files []string, parse func(line string) string) []Repo {
+	var repos []Repo
+	for _, file := range files {
+		readLines(file, func(line string) {
+			if line == "" {
+				return
+			}
+			if url := parse(strings.TrimSpace(line)); url != "" {
+				repos = append(repos, Repo{URL: url, File: file})
+			}
+		})
+	}
+	return repos
+}
@@ -0,0 +1,69 @@
+package system
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// FreeSpace returns the bytes available to root on the filesystem of the path. A path that is not there yet, like
+// /var/tmp on some base images, is measured on the closest parent that is
+func FreeSpace(path string) (int64, error) {
+	for {
+		if _, err := os.Stat(path); err == nil || path == "/" {
+			break
+		}
+		path = filepath.Dir(path)
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	// Bfree and not Bavail, kairos-init runs as root and can use the reserved blocks
+	return int64(stat.Bfree) * stat.Bsize, nil
+}
+
+// AvailableMemory returns the bytes of memory available for the build, 0 if it cant be known. Inside a container
+// /proc/meminfo is the one of the host, so the cgroup limit is checked too
+func AvailableMemory() int64 {
+	available := meminfoAvailable()
+	if limit, err := os.ReadFile("/sys/fs/cgroup/memory.max"); err == nil {
+		maxBytes, maxErr := strconv.ParseInt(strings.TrimSpace(string(limit)), 10, 64)
+		usage, usageErr := os.ReadFile("/sys/fs/cgroup/memory.current")
+		if maxErr == nil && usageErr == nil {
+			current, err := strconv.ParseInt(strings.TrimSpace(string(usage)), 10, 64)
+			if err == nil && (available == 0 || maxBytes-current < available) {
+				available = max(maxBytes-current, 0)
+			}
+		}
+	}
+	return available
+}
+
+// meminfoAvailable returns the MemAvailable of /proc/meminfo in bytes, 0 if it cant be read
+func meminfoAvailable() int64 {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// The line is like "MemAvailable:    1234 kB"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb * 1024
+		}
+	}
+	return 0
+}
@@ -0,0 +1,124 @@
+package system
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// DirSize returns the size in bytes of all the files under the given dir
+// Symlinks are not followed and errors are ignored, as this is only used for reporting
+func DirSize(path string) int64 {
+	var size int64
+	_ = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// RootfsSize returns the size in bytes of all the files of the root filesystem
+// Other filesystems mounted on top, like /proc or build cache mounts, are not counted
+func RootfsSize() int64 {
+	var root syscall.Stat_t
+	if err := syscall.Stat("/", &root); err != nil {
+		return 0
+	}
+	var size int64
+	_ = filepath.WalkDir("/", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Dev != root.Dev {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// DirSizes returns the size of each of the given dirs
+func DirSizes(dirs []string) map[string]int64 {
+	sizes := map[string]int64{}
+	for _, dir := range dirs {
+		sizes[dir] = DirSize(dir)
+	}
+	return sizes
+}
+
+// SizeReport returns a table with the before and after sizes of each dir and the difference between them
+func SizeReport(dirs []string, before, after map[string]int64) string {
+	var report strings.Builder
+	var totalBefore, totalAfter int64
+	report.WriteString(fmt.Sprintf("%-25s %12s %12s %12s\n", "DIRECTORY", "BEFORE", "AFTER", "FREED"))
+	for _, dir := range dirs {
+		report.WriteString(fmt.Sprintf("%-25s %12s %12s %12s\n", dir, HumanSize(before[dir]), HumanSize(after[dir]), HumanSize(before[dir]-after[dir])))
+		// Only count top level dirs for the total, as the rest are contained in them
+		if strings.Count(dir, "/") == 1 {
+			totalBefore += before[dir]
+			totalAfter += after[dir]
+		}
+	}
+	report.WriteString(fmt.Sprintf("%-25s %12s %12s %12s\n", "TOTAL", HumanSize(totalBefore), HumanSize(totalAfter), HumanSize(totalBefore-totalAfter)))
+	return report.String()
+}
+
+// HumanSize returns the size in a human readable format, like 1.5MiB
+func HumanSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	i := 0
+	for (value >= 1024 || value <= -1024) && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", size, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", value, units[i])
+}
+
+// ParseSize parses a size like 512MiB, 2G or 1048576 into bytes. Units are powers of 1024 with or without the i
+func ParseSize(size string) (int64, error) {
+	value := strings.TrimSpace(size)
+	multiplier := int64(1)
+	for i, unit := range []string{"K", "M", "G", "T"} {
+		for _, suffix := range []string{unit + "iB", unit + "B", unit} {
+			if strings.HasSuffix(value, suffix) {
+				value = strings.TrimSuffix(value, suffix)
+				multiplier = int64(1) << (10 * (i + 1))
+				break
+			}
+		}
+		if multiplier != 1 {
+			break
+		}
+	}
+	value = strings.TrimSuffix(value, "B")
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %s, expected a number with an optional unit like 512MiB or 2G", size)
+	}
+	return int64(number * float64(multiplier)), nil
+}
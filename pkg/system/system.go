@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/joho/godotenv"
+	"github.com/kairos-io/kairos-init/pkg/config"
 	"github.com/kairos-io/kairos-init/pkg/values"
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
 )
@@ -35,40 +36,9 @@ func DetectSystem(l sdkTypes.KairosLogger) values.System {
 	}
 	l.Logger.Trace().Interface("values", val).Msg("Read values from os-release")
 	// Match values to distros
-	switch values.Distro(val["ID"]) {
-	case values.Debian:
-		s.Distro = values.Debian
-		s.Family = values.DebianFamily
-	case values.Ubuntu:
-		s.Distro = values.Ubuntu
-		s.Family = values.DebianFamily
-	case values.Fedora:
-		s.Distro = values.Fedora
-		s.Family = values.RedHatFamily
-	case values.RockyLinux:
-		s.Distro = values.RockyLinux
-		s.Family = values.RedHatFamily
-	case values.AlmaLinux:
-		s.Distro = values.AlmaLinux
-		s.Family = values.RedHatFamily
-	case values.RedHat:
-		s.Distro = values.RedHat
-		s.Family = values.RedHatFamily
-	case values.Arch:
-		s.Distro = values.Arch
-		s.Family = values.ArchFamily
-	case values.Alpine:
-		s.Distro = values.Alpine
-		s.Family = values.AlpineFamily
-	case values.OpenSUSELeap:
-		s.Distro = values.OpenSUSELeap
-		s.Family = values.SUSEFamily
-	case values.OpenSUSETumbleweed:
-		s.Distro = values.OpenSUSETumbleweed
-		s.Family = values.SUSEFamily
-	case values.SLES:
-		s.Distro = values.SLES
-		s.Family = values.SUSEFamily
+	if family, ok := values.DistroFamilies[values.Distro(val["ID"])]; ok {
+		s.Distro = values.Distro(val["ID"])
+		s.Family = family
 	}
 
 	// Match architecture
@@ -102,6 +72,7 @@ func DetectSystem(l sdkTypes.KairosLogger) values.System {
 
 	// Store the version
 	s.Version = val["VERSION_ID"]
+	s.Codename = val["VERSION_CODENAME"]
 	if s.Distro == values.Alpine {
 		// We currently only do major.minor for alpine, even if os-release reports also the patch
 		// So for backwards compatibility we will only store the major.minor
@@ -113,6 +84,10 @@ func DetectSystem(l sdkTypes.KairosLogger) values.System {
 		}
 	}
 
+	s.Variant = config.DefaultConfig.Variant
+	s.Model = values.Model(config.DefaultConfig.Model)
+	s.TrustedBoot = config.DefaultConfig.TrustedBoot
+
 	// Store the name
 	s.Name = val["PRETTY_NAME"]
 	// Fallback to normal name
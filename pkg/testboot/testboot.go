@@ -0,0 +1,362 @@
+// Package testboot boots a built image in QEMU to check that it reaches the Kairos agent, as a smoke test for CI. The
+// bootable ISO is assembled with AuroraBoot, with a cloud config whose boot stage, run by the agent, prints a marker
+// on the serial console
+package testboot
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/kairos-init/pkg/values"
+	"github.com/kairos-io/kairos-sdk/types"
+)
+
+// The firmwares to boot with
+const (
+	BIOS = "bios"
+	EFI  = "efi"
+)
+
+// DefaultAuroraBoot is the AuroraBoot image used to build the ISO
+const DefaultAuroraBoot = "quay.io/kairos/auroraboot:latest"
+
+// Marker is printed on the serial console by the boot stage of the test cloud config
+const Marker = "KAIROS-INIT-TEST-BOOT-OK"
+
+// cloudConfig runs on the boot stage, so the marker is only printed once the agent runs the stages
+var cloudConfig = fmt.Sprintf(`#cloud-config
+stages:
+  boot:
+    - name: "kairos-init test-boot marker"
+      commands:
+        - echo "%s $(kairos-agent version 2>/dev/null | head -n1)" > /dev/ttyS0
+`, Marker)
+
+// firmwarePair is the UEFI code and the template for the vars of a firmware package
+type firmwarePair struct {
+	code string
+	vars string
+}
+
+// uefiFirmwares are the places where the distros ship the UEFI firmware for QEMU, by arch
+var uefiFirmwares = map[values.Architecture][]firmwarePair{
+	values.ArchAMD64: {
+		{"/usr/share/OVMF/OVMF_CODE_4M.fd", "/usr/share/OVMF/OVMF_VARS_4M.fd"},
+		{"/usr/share/OVMF/OVMF_CODE.fd", "/usr/share/OVMF/OVMF_VARS.fd"},
+		{"/usr/share/edk2/ovmf/OVMF_CODE.fd", "/usr/share/edk2/ovmf/OVMF_VARS.fd"},
+		{"/usr/share/qemu/ovmf-x86_64-code.bin", "/usr/share/qemu/ovmf-x86_64-vars.bin"},
+		{"/usr/share/edk2/x64/OVMF_CODE.fd", "/usr/share/edk2/x64/OVMF_VARS.fd"},
+	},
+	values.ArchARM64: {
+		{"/usr/share/AAVMF/AAVMF_CODE.fd", "/usr/share/AAVMF/AAVMF_VARS.fd"},
+		{"/usr/share/edk2/aarch64/QEMU_EFI-pflash.raw", "/usr/share/edk2/aarch64/vars-template-pflash.raw"},
+		{"/usr/share/qemu/edk2-aarch64-code.fd", "/usr/share/qemu/edk2-arm-vars.fd"},
+	},
+}
+
+// Options are the options to boot test an image
+type Options struct {
+	// Image is the image built with kairos-init, from the local docker daemon or a registry
+	Image string
+	// Rootfs is a rootfs dir to boot instead of an image
+	Rootfs string
+	// Firmwares are the firmwares to boot with, each on its own VM
+	Firmwares []string
+	// TrustedBoot builds a UKI ISO signed with the keys in Keys instead, it always boots with EFI
+	TrustedBoot bool
+	Keys        string
+	AuroraBoot  string
+	Arch        values.Architecture
+	// Memory is the memory of the VM in MiB
+	Memory  int
+	CPUs    int
+	Timeout time.Duration
+	// Expect is the regex that the serial console has to match, the marker by default. For media that cant carry the
+	// test cloud config
+	Expect string
+	// Output is the dir for the ISO and the serial logs, a temp dir by default that is only kept if a boot fails
+	Output string
+}
+
+// Result is the result of booting with a firmware
+type Result struct {
+	Firmware    string  `json:"firmware"`
+	TrustedBoot bool    `json:"trusted_boot"`
+	Booted      bool    `json:"booted"`
+	Seconds     float64 `json:"seconds"`
+	// Log is the serial console log of the boot
+	Log   string `json:"log"`
+	Error string `json:"error,omitempty"`
+}
+
+// Run builds the ISO and boots it with each firmware, returning the result of each boot. The error is only for the
+// failures to get to boot, a boot that doesnt reach the agent is a result with Booted false
+func Run(opts Options, l types.KairosLogger) ([]Result, error) {
+	if (opts.Image == "") == (opts.Rootfs == "") {
+		return nil, fmt.Errorf("either an image or a rootfs is required")
+	}
+	if opts.TrustedBoot {
+		if opts.Keys == "" {
+			return nil, fmt.Errorf("trusted boot needs the dir with the secure boot keys to sign the UKI")
+		}
+		opts.Firmwares = []string{EFI}
+	}
+	for _, firmware := range opts.Firmwares {
+		if firmware != BIOS && firmware != EFI {
+			return nil, fmt.Errorf("invalid firmware %s, possible values are %s and %s", firmware, BIOS, EFI)
+		}
+		if firmware == BIOS && opts.Arch != values.ArchAMD64 {
+			return nil, fmt.Errorf("%s can only boot with %s", opts.Arch, EFI)
+		}
+	}
+	expect := regexp.MustCompile(regexp.QuoteMeta(Marker))
+	if opts.Expect != "" {
+		var err error
+		if expect, err = regexp.Compile(opts.Expect); err != nil {
+			return nil, fmt.Errorf("invalid expect regex: %w", err)
+		}
+	}
+
+	var results []Result
+	dir := opts.Output
+	if dir == "" {
+		tmp, err := os.MkdirTemp("", "kairos-init-test-boot-")
+		if err != nil {
+			return nil, err
+		}
+		// Keep the serial logs around when a boot fails
+		defer func() {
+			if len(results) > 0 && Failed(results) == nil {
+				_ = os.RemoveAll(tmp)
+			}
+		}()
+		dir = tmp
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	iso, err := buildISO(opts, dir, l)
+	if err != nil {
+		return nil, err
+	}
+	for _, firmware := range opts.Firmwares {
+		result := Result{Firmware: firmware, TrustedBoot: opts.TrustedBoot, Log: filepath.Join(dir, fmt.Sprintf("serial-%s.log", firmware))}
+		l.Logger.Info().Str("firmware", firmware).Bool("trusted_boot", opts.TrustedBoot).Str("iso", iso).Msg("Booting the image")
+		start := time.Now()
+		err = boot(opts, firmware, iso, dir, result.Log, expect)
+		result.Seconds = time.Since(start).Seconds()
+		result.Booted = err == nil
+		if err != nil {
+			result.Error = err.Error()
+			l.Logger.Error().Err(err).Str("firmware", firmware).Str("log", result.Log).Msg("The image did not reach the Kairos agent")
+		} else {
+			l.Logger.Info().Str("firmware", firmware).Float64("seconds", result.Seconds).Msg("The image reached the Kairos agent")
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// buildISO builds the ISO with AuroraBoot in docker and returns its path
+func buildISO(opts Options, dir string, l types.KairosLogger) (string, error) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		return "", fmt.Errorf("docker is needed to run AuroraBoot: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cloud-config.yaml"), []byte(cloudConfig), 0644); err != nil {
+		return "", err
+	}
+	auroraboot := opts.AuroraBoot
+	if auroraboot == "" {
+		auroraboot = DefaultAuroraBoot
+	}
+
+	args := []string{"run", "--rm", "--privileged", "-v", "/var/run/docker.sock:/var/run/docker.sock", "-v", dir + ":/output"}
+	source := "docker:" + opts.Image
+	if opts.Rootfs != "" {
+		rootfs, err := filepath.Abs(opts.Rootfs)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, "-v", rootfs+":/rootfs:ro")
+		source = "dir:/rootfs"
+	}
+	if opts.TrustedBoot {
+		keys, err := filepath.Abs(opts.Keys)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, "-v", keys+":/keys:ro", auroraboot, "build-uki", "--output-dir", "/output", "--output-type", "iso",
+			"--public-keys", "/keys", "--tpm-pcr-private-key", "/keys/tpm2-pcr-private.pem", "--sb-key", "/keys/db.key",
+			"--sb-cert", "/keys/db.pem", "--overlay-iso", "/output/overlay", source)
+		// The UKI cant be changed after it is signed, so the cloud config goes in the ISO next to it
+		if err = os.MkdirAll(filepath.Join(dir, "overlay"), 0755); err != nil {
+			return "", err
+		}
+		if err = os.WriteFile(filepath.Join(dir, "overlay", "config.yaml"), []byte(cloudConfig), 0644); err != nil {
+			return "", err
+		}
+	} else {
+		args = append(args, auroraboot, "build-iso", "--output", "/output", "--cloud-config", "/output/cloud-config.yaml", source)
+	}
+
+	l.Logger.Info().Str("source", source).Str("auroraboot", auroraboot).Msg("Building the ISO with AuroraBoot")
+	cmd := exec.Command("docker", args...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("AuroraBoot could not build the ISO: %w", err)
+	}
+	isos, _ := filepath.Glob(filepath.Join(dir, "*.iso"))
+	if len(isos) == 0 {
+		return "", fmt.Errorf("AuroraBoot did not leave an ISO in %s", dir)
+	}
+	return isos[0], nil
+}
+
+// qemuArgs returns the qemu binary and the args to boot the ISO with the firmware
+func qemuArgs(opts Options, firmware, iso, dir string) (string, []string, error) {
+	binary := "qemu-system-x86_64"
+	args := []string{"-m", fmt.Sprintf("%d", opts.Memory), "-smp", fmt.Sprintf("%d", opts.CPUs), "-display", "none",
+		"-serial", "stdio", "-monitor", "none", "-no-reboot", "-cdrom", iso, "-boot", "d"}
+	cpu := ""
+	if opts.Arch == values.ArchARM64 {
+		binary = "qemu-system-aarch64"
+		args = append(args, "-M", "virt")
+		cpu = "max"
+	}
+	// Only use kvm when booting the arch of the host, with access to it
+	if _, err := os.Stat("/dev/kvm"); err == nil && values.Architecture(runtime.GOARCH) == opts.Arch {
+		args = append(args, "-enable-kvm")
+		cpu = "host"
+	}
+	if cpu != "" {
+		args = append(args, "-cpu", cpu)
+	}
+	if firmware == EFI {
+		pair, err := findUEFI(opts.Arch)
+		if err != nil {
+			return "", nil, err
+		}
+		// The vars are written by the firmware, so each boot gets its own copy
+		vars := filepath.Join(dir, "efivars.fd")
+		if err = copyFile(pair.vars, vars); err != nil {
+			return "", nil, err
+		}
+		args = append(args,
+			"-drive", fmt.Sprintf("if=pflash,format=raw,readonly=on,file=%s", pair.code),
+			"-drive", fmt.Sprintf("if=pflash,format=raw,file=%s", vars))
+	}
+	if _, err := exec.LookPath(binary); err != nil {
+		return "", nil, fmt.Errorf("%s is needed to boot the image: %w", binary, err)
+	}
+	return binary, args, nil
+}
+
+// boot boots the ISO and waits until the serial console matches expect, writing the console to the log
+func boot(opts Options, firmware, iso, dir, log string, expect *regexp.Regexp) error {
+	binary, args, err := qemuArgs(opts, firmware, iso, dir)
+	if err != nil {
+		return err
+	}
+	logFile, err := os.Create(log)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, binary, args...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = logFile
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("could not start %s: %w", binary, err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	// The marker can come in the middle of other output, so match line by line on the console as it comes
+	found := make(chan bool, 1)
+	go func() {
+		scanner := bufio.NewScanner(io.TeeReader(out, logFile))
+		for scanner.Scan() {
+			if expect.MatchString(scanner.Text()) {
+				found <- true
+				return
+			}
+		}
+		found <- false
+	}()
+	select {
+	case ok := <-found:
+		if ok {
+			return nil
+		}
+		return fmt.Errorf("the VM stopped before reaching the Kairos agent, see %s", log)
+	case <-ctx.Done():
+		return fmt.Errorf("the VM did not reach the Kairos agent in %s, see %s", opts.Timeout, log)
+	}
+}
+
+func findUEFI(arch values.Architecture) (firmwarePair, error) {
+	var searched []string
+	for _, pair := range uefiFirmwares[arch] {
+		_, codeErr := os.Stat(pair.code)
+		_, varsErr := os.Stat(pair.vars)
+		if codeErr == nil && varsErr == nil {
+			return pair, nil
+		}
+		searched = append(searched, pair.code)
+	}
+	return firmwarePair{}, fmt.Errorf("no UEFI firmware found for %s, install OVMF/AAVMF. Searched %s", arch, strings.Join(searched, ", "))
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Failed returns an error if any of the boots didnt reach the agent
+func Failed(results []Result) error {
+	var failed []string
+	for _, result := range results {
+		if !result.Booted {
+			failed = append(failed, result.Firmware)
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New("the image did not boot with " + strings.Join(failed, ", "))
+	}
+	return nil
+}
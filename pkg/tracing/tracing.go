@@ -0,0 +1,236 @@
+package tracing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kairos-io/kairos-init/pkg/values"
+)
+
+// Tracing exports the spans with OTLP over http with the json encoding, configured with the standard OTEL_ env vars.
+// It's only enabled when an endpoint is set. Spans are kept in memory and sent at the end of the run, as a build only
+// generates a few hundred of them
+
+// Span is a timed operation of the build
+type Span struct {
+	traceID    string
+	spanID     string
+	parentID   string
+	name       string
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        error
+}
+
+var (
+	mu       sync.Mutex
+	enabled  bool
+	endpoint string
+	headers  map[string]string
+	traceID  string
+	parentID string
+	root     *Span
+	spans    []*Span
+)
+
+// Init enables tracing if OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or OTEL_EXPORTER_OTLP_ENDPOINT are set and starts the
+// root span. If TRACEPARENT is set, like in CI systems that propagate the trace context, the spans join that trace
+func Init(name string) error {
+	endpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
+		endpoint = strings.TrimSuffix(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "/") + "/v1/traces"
+	}
+	if endpoint == "" {
+		return nil
+	}
+	if protocol := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"); protocol != "" && protocol != "http/json" {
+		return fmt.Errorf("unsupported OTEL_EXPORTER_OTLP_PROTOCOL %s, only http/json is supported", protocol)
+	}
+
+	headers = map[string]string{}
+	for _, header := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if key, value, ok := strings.Cut(header, "="); ok {
+			headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+
+	// traceparent is version-traceid-parentid-flags
+	if parts := strings.Split(os.Getenv("TRACEPARENT"), "-"); len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		traceID = parts[1]
+		parentID = parts[2]
+	} else {
+		traceID = randomID(16)
+	}
+	enabled = true
+	root = Start(name, nil, nil)
+	return nil
+}
+
+func randomID(size int) string {
+	id := make([]byte, size)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Start starts a span under the given parent, or under the root span if no parent is given. Returns nil when tracing
+// is disabled, which is safe to use on all the Span methods
+func Start(name string, parent *Span, attributes map[string]string) *Span {
+	if !enabled {
+		return nil
+	}
+	span := &Span{traceID: traceID, spanID: randomID(8), parentID: parentID, name: name, start: time.Now(), attributes: map[string]string{}}
+	if parent == nil {
+		parent = root
+	}
+	if parent != nil {
+		span.parentID = parent.spanID
+	}
+	for key, value := range attributes {
+		span.attributes[key] = value
+	}
+	mu.Lock()
+	spans = append(spans, span)
+	mu.Unlock()
+	return span
+}
+
+// SetAttribute adds an attribute to the span
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.attributes[key] = value
+}
+
+// End finishes the span, marking it as failed if there is an error
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+}
+
+// otlp json encoding, see https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func attributes(values map[string]string) []otlpAttribute {
+	var attrs []otlpAttribute
+	for key, value := range values {
+		attr := otlpAttribute{Key: key}
+		attr.Value.StringValue = value
+		attrs = append(attrs, attr)
+	}
+	return attrs
+}
+
+// Flush ends the root span and sends all the spans to the collector
+func Flush(err error) error {
+	if !enabled {
+		return nil
+	}
+	root.End(err)
+
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = "kairos-init"
+	}
+
+	mu.Lock()
+	otlpSpans := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		// Spans that never ended, like when a stage panics, end with the root span
+		end := span.end
+		if end.IsZero() {
+			end = root.end
+		}
+		s := otlpSpan{
+			TraceID:           span.traceID,
+			SpanID:            span.spanID,
+			ParentSpanID:      span.parentID,
+			Name:              span.name,
+			Kind:              1, // internal
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+			Attributes:        attributes(span.attributes),
+			Status:            otlpStatus{Code: 1},
+		}
+		if span.err != nil {
+			s.Status = otlpStatus{Code: 2, Message: span.err.Error()}
+		}
+		otlpSpans = append(otlpSpans, s)
+	}
+	mu.Unlock()
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": attributes(map[string]string{"service.name": serviceName, "service.version": values.GetVersion()}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "kairos-init", "version": values.GetVersion()},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not export the traces to %s: %w", endpoint, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("could not export the traces to %s: %s", endpoint, resp.Status)
+	}
+	return nil
+}
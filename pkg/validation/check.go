@@ -0,0 +1,85 @@
+package validation
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// CheckResult is the result of a single conformance check
+type CheckResult struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	// Skipped checks could not run on this system, like the initrd contents without lsinitrd, and count as passed
+	Skipped bool   `json:"skipped,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// CheckReport are the results of all the conformance checks of the rootfs
+type CheckReport struct {
+	Passed bool          `json:"passed"`
+	Checks []CheckResult `json:"checks"`
+}
+
+func passed(name string) CheckResult {
+	return CheckResult{Name: name, Passed: true}
+}
+
+func failed(name string, format string, args ...interface{}) CheckResult {
+	return CheckResult{Name: name, Message: fmt.Sprintf(format, args...)}
+}
+
+// Failed returns the names of the failed checks
+func (r CheckReport) Failed() []string {
+	var names []string
+	for _, c := range r.Checks {
+		if !c.Passed {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+// Error returns an error listing the failed checks, or nil if all passed
+func (r CheckReport) Error() error {
+	if r.Passed {
+		return nil
+	}
+	return fmt.Errorf("conformance checks failed: %s", strings.Join(r.Failed(), ", "))
+}
+
+// Check verifies that the rootfs meets the kairos requirements: kernel and initrd in place with the kairos binaries in
+// the initrd, required binaries and services installed and enabled, bootloader files in place and the kairos-release
+// fields populated
+func (v *Validator) Check() CheckReport {
+	var checks []CheckResult
+	checks = append(checks, v.checkBinaries()...)
+	checks = append(checks, v.checkKernel()...)
+	checks = append(checks, v.checkServices()...)
+	checks = append(checks, v.checkBootloader()...)
+	checks = append(checks, v.checkRelease()...)
+
+	for _, dir := range []string{"/var/lock"} {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			checks = append(checks, failed("dir "+dir, "directory %s does not exist", dir))
+		} else {
+			checks = append(checks, passed("dir "+dir))
+		}
+	}
+
+	if err := v.CheckBootChain(); err != nil {
+		checks = append(checks, failed("secure boot chain", "%s", err))
+	}
+
+	// Do it at the ends as its the slowest check
+	checks = append(checks, v.checkInitrd()...)
+
+	report := CheckReport{Passed: true, Checks: checks}
+	for _, c := range checks {
+		if !c.Passed {
+			v.Log.Logger.Error().Str("check", c.Name).Msg(c.Message)
+			report.Passed = false
+		}
+	}
+	return report
+}
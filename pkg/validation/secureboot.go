@@ -0,0 +1,101 @@
+package validation
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/values"
+)
+
+const (
+	// SecureBootVerifyWarn logs the broken secure boot chain files
+	SecureBootVerifyWarn = "warn"
+	// SecureBootVerifyFail fails the build if the secure boot chain is broken
+	SecureBootVerifyFail = "fail"
+)
+
+// CheckBootChain runs ValidateBootChain if enabled in the config, only logging the errors on warn mode
+func (v *Validator) CheckBootChain() error {
+	switch config.DefaultConfig.SecureBootVerify {
+	case "":
+		return nil
+	case SecureBootVerifyWarn:
+		if err := v.ValidateBootChain(); err != nil {
+			v.Log.Logger.Warn().Err(err).Msg("Secure boot chain is broken, the image may not boot with secure boot enabled")
+		}
+		return nil
+	case SecureBootVerifyFail:
+		return v.ValidateBootChain()
+	default:
+		return fmt.Errorf("invalid secure boot verify mode: %s, possible values are %s or %s", config.DefaultConfig.SecureBootVerify, SecureBootVerifyWarn, SecureBootVerifyFail)
+	}
+}
+
+// ValidateBootChain checks that the shim, grub and kernel of the image are signed, so the image boots with secure boot enabled
+// It uses sbverify or pesign, whatever is available, and returns an error for each file that is missing or not signed
+func (v *Validator) ValidateBootChain() error {
+	var multi *multierror.Error
+
+	if config.DefaultConfig.TrustedBoot {
+		v.Log.Logger.Info().Msg("Trusted boot images are signed when building the UKI, skipping the boot chain check")
+		return nil
+	}
+	globs, ok := values.BootChainFiles[v.System.Family][v.System.Arch]
+	if !ok {
+		v.Log.Logger.Warn().Str("distro", v.System.Distro.String()).Msg("No signed boot chain for this system, skipping the boot chain check")
+		return nil
+	}
+
+	verify, err := signatureChecker()
+	if err != nil {
+		return err
+	}
+
+	for _, glob := range globs {
+		files, _ := filepath.Glob(glob)
+		if len(files) == 0 {
+			multi = multierror.Append(multi, fmt.Errorf("boot chain file %s not found", glob))
+			continue
+		}
+		// The symlinks, like /boot/vmlinuz, are checked against the file they point to
+		file, err := filepath.EvalSymlinks(files[0])
+		if err != nil {
+			multi = multierror.Append(multi, fmt.Errorf("could not resolve %s: %w", files[0], err))
+			continue
+		}
+		if err = verify(file); err != nil {
+			multi = multierror.Append(multi, err)
+			continue
+		}
+		v.Log.Logger.Info().Str("file", file).Msg("File is signed")
+	}
+
+	return multi.ErrorOrNil()
+}
+
+// signatureChecker returns a function that checks if the given PE file has any signature
+func signatureChecker() (func(string) error, error) {
+	if _, err := exec.LookPath("sbverify"); err == nil {
+		return func(file string) error {
+			out, err := exec.Command("sbverify", "--list", file).CombinedOutput()
+			if err != nil || strings.Contains(string(out), "No signature table present") {
+				return fmt.Errorf("%s is not signed: %s", file, strings.TrimSpace(string(out)))
+			}
+			return nil
+		}, nil
+	}
+	if _, err := exec.LookPath("pesign"); err == nil {
+		return func(file string) error {
+			out, err := exec.Command("pesign", "-S", "-i", file).CombinedOutput()
+			if err != nil || strings.Contains(string(out), "No signatures found") {
+				return fmt.Errorf("%s is not signed: %s", file, strings.TrimSpace(string(out)))
+			}
+			return nil
+		}, nil
+	}
+	return nil, fmt.Errorf("sbverify or pesign are needed to verify the boot chain")
+}
@@ -1,15 +1,17 @@
 package validation
 
 import (
+	"errors"
 	"fmt"
 	"github.com/hashicorp/go-multierror"
-	"github.com/joho/godotenv"
 	"github.com/kairos-io/kairos-init/pkg/config"
+	"github.com/kairos-io/kairos-init/pkg/release"
 	"github.com/kairos-io/kairos-init/pkg/system"
 	"github.com/kairos-io/kairos-init/pkg/values"
 	"github.com/kairos-io/kairos-sdk/types"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 )
 
@@ -23,8 +25,20 @@ func NewValidator(logger types.KairosLogger) *Validator {
 	return &Validator{Log: logger, System: sis}
 }
 
+// Validate runs the conformance checks and returns an error for each failed one
 func (v *Validator) Validate() error {
 	var multi *multierror.Error
+	for _, result := range v.Check().Checks {
+		if !result.Passed {
+			multi = multierror.Append(multi, errors.New(result.Message))
+		}
+	}
+	return multi.ErrorOrNil()
+}
+
+// checkBinaries checks that the kairos binaries and the ones of the selected variant are in the PATH
+func (v *Validator) checkBinaries() []CheckResult {
+	var results []CheckResult
 
 	binaries := []string{
 		"immucore",
@@ -43,6 +57,9 @@ func (v *Validator) Validate() error {
 		if config.DefaultConfig.KubernetesProvider == config.K0sProvider {
 			binaries = append(binaries, "k0s")
 		}
+		if config.DefaultConfig.KubernetesProvider == config.RKE2Provider {
+			binaries = append(binaries, "rke2")
+		}
 	}
 
 	// Alter path to include our providers path
@@ -52,13 +69,21 @@ func (v *Validator) Validate() error {
 	for _, binary := range binaries {
 		path, err := exec.LookPath(binary)
 		if err != nil {
-			multi = multierror.Append(multi, fmt.Errorf("could not find binary %s", binary))
+			results = append(results, failed("binary "+binary, "could not find binary %s", binary))
+			continue
 		}
 		v.Log.Logger.Info().Str("path", path).Str("binary", binary).Msg("Found binary")
+		results = append(results, passed("binary "+binary))
 	}
 
 	// Restore the path
 	_ = os.Setenv("PATH", originalPath)
+	return results
+}
+
+// checkKernel checks that the kernel and initrd that kairos boots from are in place
+func (v *Validator) checkKernel() []CheckResult {
+	var results []CheckResult
 
 	checkfiles := []string{"/boot/vmlinuz"}
 	if !config.DefaultConfig.TrustedBoot {
@@ -67,127 +92,164 @@ func (v *Validator) Validate() error {
 	for _, f := range checkfiles {
 		s, err := os.Lstat(f)
 		if err != nil {
-			multi = multierror.Append(multi, fmt.Errorf("file missing %s", f))
+			results = append(results, failed("file "+f, "file missing %s", f))
 			continue
 		}
 		v.Log.Logger.Info().Str("file", f).Msg("Found file")
 		// Check if its a symlink in the vmlinuz case
 		if s != nil && s.Mode()&os.ModeSymlink != 0 && f == "/boot/vmlinuz" {
 			// check if it resolves correctly
-			_, err = os.Readlink(f)
-			if err != nil {
-				multi = multierror.Append(multi, fmt.Errorf("%s symlink is not a valid symlink", f))
+			if _, err = os.Stat(f); err != nil {
+				results = append(results, failed("file "+f, "%s symlink is not a valid symlink", f))
 				continue
-			} else {
-				v.Log.Logger.Info().Str("file", f).Msg("File is a symlink and resolves as expected")
 			}
+			v.Log.Logger.Info().Str("file", f).Msg("File is a symlink and resolves as expected")
 		} else {
 			v.Log.Logger.Info().Str("file", f).Msg("File is not a symlink")
 		}
+		results = append(results, passed("file "+f))
 	}
+	return results
+}
 
-	// Check services are there
-	if v.System.Family != values.AlpineFamily {
-		services := []string{
-			"kairos-agent",
-			"kairos-interactive",
-			"kairos-recovery",
-			"kairos-reset",
-			"kairos-webui",
-			"kairos",
-		}
+// checkServices checks that the kairos services are installed and that the services that should be enabled are
+func (v *Validator) checkServices() []CheckResult {
+	var results []CheckResult
 
-		if config.DefaultConfig.Variant == "standard" {
-			switch config.DefaultConfig.KubernetesProvider {
-			case config.K3sProvider:
-				services = append(services, "k3s", "k3s-agent")
-			case config.K0sProvider:
-				services = append(services, "k0scontroller", "k0sworker")
-			}
-		}
-		for _, service := range services {
-			_, err := os.Stat(fmt.Sprintf("/etc/systemd/system/%s.service", service))
-			if err != nil {
-				multi = multierror.Append(multi, fmt.Errorf("service %s not found", service))
+	if v.System.Family == values.AlpineFamily {
+		for _, service := range config.DefaultConfig.Services.Enable {
+			if _, err := os.Stat(fmt.Sprintf("/etc/runlevels/default/%s", service)); err != nil {
+				results = append(results, failed("enabled "+service, "service %s is not enabled", service))
 			} else {
-				v.Log.Logger.Info().Str("service", service).Msg("Found service")
+				results = append(results, passed("enabled "+service))
 			}
-
 		}
+		return results
 	}
 
-	// Validate all needed keys are stored in kairos-release
-	keys := []string{
-		"KAIROS_ID",
-		"KAIROS_ID_LIKE", // Maybe not critical? Same as name below
-		"KAIROS_NAME",
-		"KAIROS_VERSION",
-		"KAIROS_ARCH",
-		"KAIROS_TARGETARCH", // Not critical, same as ARCH above
-		"KAIROS_FLAVOR",
-		"KAIROS_FLAVOR_RELEASE",
-		"KAIROS_FAMILY",
-		"KAIROS_MODEL",
-		"KAIROS_VARIANT",
-		"KAIROS_REGISTRY_AND_ORG",
-		"KAIROS_BUG_REPORT_URL", // Not critical
-		"KAIROS_HOME_URL",       // Not critical
-		"KAIROS_RELEASE",
-		"KAIROS_IMAGE_LABEL",
-	}
-
-	vals, err := godotenv.Read("/etc/kairos-release")
-	if err != nil {
-		multi = multierror.Append(multi, fmt.Errorf("could not open kairos-release file"))
-	} else {
-		for _, key := range keys {
-			if vals[key] == "" {
-				multi = multierror.Append(multi, fmt.Errorf("key %s not found or empty in kairos-release", key))
-			}
-		}
+	services := []string{
+		"kairos-agent",
+		"kairos-interactive",
+		"kairos-recovery",
+		"kairos-reset",
+		"kairos-webui",
+		"kairos",
 	}
 
 	if config.DefaultConfig.Variant == "standard" {
-		if vals["KAIROS_VARIANT"] != "standard" {
-			multi = multierror.Append(multi, fmt.Errorf("KAIROS_VARIANT is not standard"))
+		services = append(services, values.KubernetesServices[config.DefaultConfig.KubernetesProvider]...)
+	}
+	for _, service := range services {
+		// The rke2 units are installed under /usr/lib/systemd/system
+		if !systemdUnitExists(service) {
+			results = append(results, failed("service "+service, "service %s not found", service))
+		} else {
+			v.Log.Logger.Info().Str("service", service).Msg("Found service")
+			results = append(results, passed("service "+service))
 		}
-		if vals["KAIROS_SOFTWARE_VERSION"] == "" {
-			multi = multierror.Append(multi, fmt.Errorf("KAIROS_SOFTWARE_VERSION is empty"))
+	}
+
+	// The default services are only enabled if the system ships them, the user ones must always be there
+	var enabled []string
+	for _, service := range values.GetServices(v.System, config.DefaultConfig).Enable {
+		if systemdUnitExists(service) {
+			enabled = append(enabled, service)
 		}
-		if vals["KAIROS_SOFTWARE_VERSION_PREFIX"] == "" {
-			multi = multierror.Append(multi, fmt.Errorf("KAIROS_SOFTWARE_VERSION_PREFIX is empty"))
+	}
+	enabled = append(enabled, config.DefaultConfig.Services.Enable...)
+	for _, service := range enabled {
+		out, err := exec.Command("systemctl", "is-enabled", service).CombinedOutput()
+		state := strings.TrimSpace(string(out))
+		if err != nil || (state != "enabled" && state != "static" && state != "alias") {
+			results = append(results, failed("enabled "+service, "service %s is not enabled: %s", service, state))
+			continue
 		}
+		results = append(results, passed("enabled "+service))
 	}
+	return results
+}
 
-	ExpectedDirs := []string{"/var/lock"}
+// systemdUnitExists returns true if the given unit is installed, units without a suffix are treated as services
+func systemdUnitExists(unit string) bool {
+	if !strings.Contains(unit, ".") {
+		unit = fmt.Sprintf("%s.service", unit)
+	}
+	for _, dir := range []string{"/etc/systemd/system", "/usr/lib/systemd/system", "/lib/systemd/system"} {
+		if _, err := os.Stat(filepath.Join(dir, unit)); err == nil {
+			return true
+		}
+	}
+	return false
+}
 
-	for _, dir := range ExpectedDirs {
-		if _, err := os.Stat(dir); os.IsNotExist(err) {
-			multi = multierror.Append(multi, fmt.Errorf("directory %s does not exist", dir))
+// checkBootloader checks that the bootloader files needed to build the boot media are in the image
+func (v *Validator) checkBootloader() []CheckResult {
+	artifacts, err := system.GetArtifacts("/")
+	if err != nil {
+		return []CheckResult{failed("bootloader", "could not get the boot artifacts: %s", err)}
+	}
+	if config.DefaultConfig.TrustedBoot {
+		if artifacts.SystemdBoot == nil {
+			return []CheckResult{failed("bootloader systemd-boot", "systemd-boot efi binary not found")}
 		}
+		return []CheckResult{passed("bootloader systemd-boot")}
+	}
+	// Some models boot with their own firmware, like the raspberry pi, so only generic images need grub
+	if config.DefaultConfig.Model != values.Generic.String() {
+		return []CheckResult{}
 	}
+	var results []CheckResult
+	if artifacts.Grub == nil {
+		results = append(results, failed("bootloader grub", "grub efi binary not found"))
+	} else {
+		results = append(results, passed("bootloader grub"))
+	}
+	if artifacts.GrubModules == nil || len(artifacts.GrubModules.Modules) == 0 {
+		results = append(results, failed("bootloader grub modules", "grub modules not found"))
+	} else {
+		results = append(results, passed("bootloader grub modules"))
+	}
+	return results
+}
 
-	// Check if initrd contains the necessary binaries
-	// Do it at the ends as its the slowest check
-	if !config.DefaultConfig.TrustedBoot {
-		// check dracut
-		if _, err := exec.LookPath("lsinitrd"); err != nil {
-			v.Log.Logger.Warn().Msg("lsinitrd not found, cannot check initrd contents")
+// checkRelease checks that all the needed keys are stored in kairos-release
+func (v *Validator) checkRelease() []CheckResult {
+	r, err := release.Load(release.Path)
+	if err != nil {
+		return []CheckResult{failed("kairos-release", "%s", err)}
+	}
+	if err = r.Validate(); err != nil {
+		return []CheckResult{failed("kairos-release", "%s", err)}
+	}
+	if config.DefaultConfig.Variant == config.StandardVariant && r.Variant != config.StandardVariant.String() {
+		return []CheckResult{failed("kairos-release", "KAIROS_VARIANT is not standard")}
+	}
+	return []CheckResult{passed("kairos-release")}
+}
+
+// checkInitrd checks that the initrd contains the kairos binaries needed to boot
+func (v *Validator) checkInitrd() []CheckResult {
+	if config.DefaultConfig.TrustedBoot {
+		return []CheckResult{}
+	}
+	// check dracut
+	if _, err := exec.LookPath("lsinitrd"); err != nil {
+		v.Log.Logger.Warn().Msg("lsinitrd not found, cannot check initrd contents")
+		return []CheckResult{{Name: "initrd", Passed: true, Skipped: true, Message: "lsinitrd not found, cannot check initrd contents"}}
+	}
+	v.Log.Logger.Info().Msg("Checking initrd contents")
+	out, err := exec.Command("lsinitrd", "/boot/initrd").CombinedOutput()
+	if err != nil {
+		return []CheckResult{failed("initrd", "could not list the initrd contents: %s", err)}
+	}
+	var results []CheckResult
+	for _, binary := range []string{"immucore", "kairos-agent"} {
+		if !strings.Contains(string(out), binary) {
+			results = append(results, failed("initrd "+binary, "did not found %s in the initrd", binary))
 		} else {
-			v.Log.Logger.Info().Msg("Checking initrd contents")
-			out, err := exec.Command("lsinitrd", "/boot/initrd").CombinedOutput()
-			if err != nil {
-				return err
-			}
-			for _, binary := range []string{"immucore", "kairos-agent"} {
-				if !strings.Contains(string(out), binary) {
-					multi = multierror.Append(multi, fmt.Errorf("did not found %s in the initrd", binary))
-				} else {
-					v.Log.Logger.Info().Str("binary", binary).Msg("Found binary in the initrd")
-				}
-			}
+			v.Log.Logger.Info().Str("binary", binary).Msg("Found binary in the initrd")
+			results = append(results, passed("initrd "+binary))
 		}
 	}
-
-	return multi.ErrorOrNil()
+	return results
 }
@@ -0,0 +1,42 @@
+package values
+
+// EFIArchSuffix is the suffix of the removable media EFI binaries for each arch, like BOOTX64.EFI
+var EFIArchSuffix = map[Architecture]string{
+	ArchAMD64: "x64",
+	ArchARM64: "aa64",
+}
+
+// GrubPlatform is the grub platform dir for each arch
+var GrubPlatform = map[Architecture]string{
+	ArchAMD64: "x86_64-efi",
+	ArchARM64: "arm64-efi",
+}
+
+// GrubModulesDirs are the dirs where the distros keep the grub modules, with the platform as parameter
+var GrubModulesDirs = []string{
+	"/usr/lib/grub/%s",
+	"/usr/lib/grub2/%s",
+	"/usr/share/grub2/%s",
+}
+
+// MokManagerFiles are the globs for the MokManager binary shipped with shim, for each family and arch
+var MokManagerFiles = map[Family]map[Architecture]string{
+	DebianFamily: {
+		ArchAMD64: "/usr/lib/shim/mmx64.efi.signed*",
+		ArchARM64: "/usr/lib/shim/mmaa64.efi.signed*",
+	},
+	RedHatFamily: {
+		ArchAMD64: "/boot/efi/EFI/*/mmx64.efi",
+		ArchARM64: "/boot/efi/EFI/*/mmaa64.efi",
+	},
+	SUSEFamily: {
+		ArchAMD64: "/usr/share/efi/x86_64/MokManager.efi",
+		ArchARM64: "/usr/share/efi/aarch64/MokManager.efi",
+	},
+}
+
+// SystemdBootFiles are the globs for the systemd-boot binary used on trusted boot images, the signed one first
+var SystemdBootFiles = map[Architecture][]string{
+	ArchAMD64: {"/usr/lib/systemd/boot/efi/systemd-bootx64.efi.signed", "/usr/lib/systemd/boot/efi/systemd-bootx64.efi"},
+	ArchARM64: {"/usr/lib/systemd/boot/efi/systemd-bootaa64.efi.signed", "/usr/lib/systemd/boot/efi/systemd-bootaa64.efi"},
+}
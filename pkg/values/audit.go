@@ -0,0 +1,156 @@
+package values
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+)
+
+// LogForwarder sends the system logs, with the audit events, to a remote server
+type LogForwarder string
+
+func (f LogForwarder) String() string {
+	return string(f)
+}
+
+const (
+	RsyslogForwarder       LogForwarder = "rsyslog"
+	JournalUploadForwarder LogForwarder = "journal-upload"
+)
+
+// LogForwarderConfig is everything needed to set up a log forwarder on the system
+type LogForwarderConfig struct {
+	Packages       PackageMap // Packages to install
+	Services       []string   // Services to enable on systemd systems
+	OpenRCServices []string   // Services to add to the default runlevel on openrc systems
+	OpenRCReplaces []string   // Services removed from the runlevels on openrc systems, as they would conflict
+	File           string     // Drop-in with the target
+}
+
+// LogForwarders are the supported log forwarders
+// journal-upload needs systemd so it is not available on Alpine, and rsyslog is not in the Arch repos
+var LogForwarders = map[LogForwarder]LogForwarderConfig{
+	RsyslogForwarder: {
+		Packages: PackageMap{
+			DebianFamily: {
+				ArchCommon: {
+					Common: {"rsyslog"},
+				},
+			},
+			RedHatFamily: {
+				ArchCommon: {
+					Common: {"rsyslog"},
+				},
+			},
+			SUSEFamily: {
+				ArchCommon: {
+					Common: {"rsyslog"},
+				},
+			},
+			AlpineFamily: {
+				ArchCommon: {
+					Common: {"rsyslog", "rsyslog-openrc"},
+				},
+			},
+		},
+		Services:       []string{"rsyslog"},
+		OpenRCServices: []string{"rsyslog"},
+		// Both listen on /dev/log
+		OpenRCReplaces: []string{"syslog"},
+		File:           "/etc/rsyslog.d/90-kairos-forward.conf",
+	},
+	JournalUploadForwarder: {
+		Packages: PackageMap{
+			DebianFamily: {
+				ArchCommon: {
+					Common: {"systemd-journal-remote"},
+				},
+			},
+			RedHatFamily: {
+				ArchCommon: {
+					Common: {"systemd-journal-remote"},
+				},
+			},
+			SUSEFamily: {
+				ArchCommon: {
+					Common: {"systemd-journal-remote"},
+				},
+			},
+			ArchFamily: {
+				ArchCommon: {
+					// systemd-journal-upload comes with systemd
+					Common: {"systemd"},
+				},
+			},
+		},
+		Services: []string{"systemd-journal-upload"},
+		File:     "/etc/systemd/journal-upload.conf.d/90-kairos.conf",
+	},
+}
+
+// AuditSyslogPlugins are the auditd syslog plugin configs, for audit 3 and for audit 2, which are enabled when
+// forwarding with rsyslog so the audit events get forwarded too. With journal-upload they already are, as journald
+// reads them from the kernel
+var AuditSyslogPlugins = []string{"/etc/audit/plugins.d/syslog.conf", "/etc/audisp/plugins.d/syslog.conf"}
+
+// rsyslogDefaultPort is the port to forward to when the rsyslog target has none
+const rsyslogDefaultPort = "514"
+
+// GetLogForwarder returns the log forwarder set in the audit config, empty if none, checking that the audit feature
+// is enabled, that it has a target and that it is available on the system
+func GetLogForwarder(s System, c config.Config) (LogForwarder, error) {
+	if c.Audit.Forwarder == "" {
+		if c.Audit.Target != "" {
+			return "", fmt.Errorf("audit target %s is set without a forwarder, possible values are %s and %s", c.Audit.Target, RsyslogForwarder, JournalUploadForwarder)
+		}
+		return "", nil
+	}
+	forwarder := LogForwarder(c.Audit.Forwarder)
+	forwarderConfig, ok := LogForwarders[forwarder]
+	if !ok {
+		return "", fmt.Errorf("invalid audit forwarder: %s, possible values are %s and %s", c.Audit.Forwarder, RsyslogForwarder, JournalUploadForwarder)
+	}
+	features, err := EnabledFeatures(s, c)
+	if err != nil {
+		return "", err
+	}
+	if !slices.Contains(features, AuditFeature) {
+		return "", fmt.Errorf("audit forwarder %s is set but the %s feature is not enabled", forwarder, AuditFeature)
+	}
+	if c.Audit.Target == "" {
+		return "", fmt.Errorf("audit forwarder %s needs a target to forward the logs to", forwarder)
+	}
+	if !hasPackages(GetVersionMaps(s, forwarderConfig.Packages)) {
+		return "", fmt.Errorf("audit forwarder %s is not available on %s", forwarder, s.Distro)
+	}
+	return forwarder, nil
+}
+
+// LogForwarderFile returns the drop-in of the forwarder that sends the logs to the target
+// rsyslog forwards over tcp with a disk assisted queue, so the logs are kept while the target is down. Its target is
+// host or host:port, with 514 as the default port. journal-upload takes an url or a host, see journal-upload.conf(5)
+func LogForwarderFile(forwarder LogForwarder, target string) (string, error) {
+	switch forwarder {
+	case RsyslogForwarder:
+		host, port, err := net.SplitHostPort(target)
+		if err != nil {
+			host, port = target, rsyslogDefaultPort
+		}
+		if host == "" || strings.ContainsAny(host, "/ \"") {
+			return "", fmt.Errorf("invalid rsyslog target %q, it has to be host or host:port", target)
+		}
+		return fmt.Sprintf("# Generated by kairos-init\n"+
+			"*.* action(type=\"omfwd\" target=\"%s\" port=\"%s\" protocol=\"tcp\"\n"+
+			"  queue.type=\"LinkedList\" queue.filename=\"kairos-forward\" queue.saveOnShutdown=\"on\"\n"+
+			"  action.resumeRetryCount=\"-1\")\n", host, port), nil
+	case JournalUploadForwarder:
+		if strings.ContainsAny(target, " \n") {
+			return "", fmt.Errorf("invalid journal-upload target %q", target)
+		}
+		return fmt.Sprintf("# Generated by kairos-init\n[Upload]\nURL=%s\n", target), nil
+	}
+	return "", fmt.Errorf("invalid audit forwarder: %s", forwarder)
+}
@@ -0,0 +1,15 @@
+package values
+
+// DefaultMotd is the default template for /etc/motd, rendered with the kairos-release values
+const DefaultMotd = `Welcome to Kairos {{.KAIROS_VERSION}}
+{{.KAIROS_FLAVOR}} {{.KAIROS_FLAVOR_RELEASE}} {{.KAIROS_VARIANT}} ({{.KAIROS_ARCH}}, {{.KAIROS_MODEL}})
+
+Documentation: https://kairos.io/docs/
+Issues: {{.KAIROS_BUG_REPORT_URL}}
+`
+
+// DefaultIssue is the default template for /etc/issue, rendered with the kairos-release values
+// The \n and \l escapes are expanded by getty to the hostname and tty
+const DefaultIssue = `Kairos {{.KAIROS_VERSION}} ({{.KAIROS_FLAVOR}} {{.KAIROS_FLAVOR_RELEASE}}) \n \l
+
+`
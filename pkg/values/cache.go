@@ -0,0 +1,122 @@
+package values
+
+import (
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+	semver "github.com/hashicorp/go-version"
+)
+
+// The package maps are resolved for each system and config, and resolving a whole matrix parses the same templates,
+// constraints and versions over and over. They only depend on their text, and on the distro for the codenames, so
+// they are parsed once and kept for the life of the process. The caches are safe to use from several goroutines
+
+var (
+	templateCache   sync.Map // package template -> cachedTemplate
+	constraintCache sync.Map // constraintKey -> cachedConstraint
+	versionCache    sync.Map // version -> cachedVersion
+	semverCache     sync.Map // semver constraint -> cachedSemver
+	systemCache     sync.Map // systemVersionKey -> systemVersionEntry
+)
+
+type cachedTemplate struct {
+	tmpl *template.Template
+	err  error
+}
+
+// packageTemplate returns the parsed package template. A typo in a param would render as "<no value>" instead of
+// failing, so they fail on missing keys
+func packageTemplate(pkg string) (*template.Template, error) {
+	if cached, ok := templateCache.Load(pkg); ok {
+		return cached.(cachedTemplate).tmpl, cached.(cachedTemplate).err
+	}
+	tmpl, err := template.New("versionTemplate").Funcs(sprig.TxtFuncMap()).Option("missingkey=error").Parse(pkg)
+	templateCache.Store(pkg, cachedTemplate{tmpl: tmpl, err: err})
+	return tmpl, err
+}
+
+// isTemplate returns true if the package has template actions, the rest render to themselves
+func isTemplate(pkg string) bool {
+	return strings.Contains(pkg, "{{")
+}
+
+type constraintKey struct {
+	distro     Distro
+	constraint string
+}
+
+type cachedConstraint struct {
+	parsed parsedConstraint
+	err    error
+}
+
+// cachedParseConstraint is parseConstraint, parsing each constraint once for each distro
+func cachedParseConstraint(distro Distro, constraint string) (parsedConstraint, error) {
+	key := constraintKey{distro: distro, constraint: constraint}
+	if cached, ok := constraintCache.Load(key); ok {
+		return cached.(cachedConstraint).parsed, cached.(cachedConstraint).err
+	}
+	parsed, err := parseConstraint(distro, constraint)
+	constraintCache.Store(key, cachedConstraint{parsed: parsed, err: err})
+	return parsed, err
+}
+
+type cachedVersion struct {
+	version *semver.Version
+	err     error
+}
+
+// parseVersion is semver.NewVersion, parsing each version once
+func parseVersion(version string) (*semver.Version, error) {
+	if cached, ok := versionCache.Load(version); ok {
+		return cached.(cachedVersion).version, cached.(cachedVersion).err
+	}
+	v, err := semver.NewVersion(version)
+	versionCache.Store(version, cachedVersion{version: v, err: err})
+	return v, err
+}
+
+type cachedSemver struct {
+	constraint semver.Constraints
+	err        error
+}
+
+// parseSemverConstraint is semver.NewConstraint, parsing each constraint once
+func parseSemverConstraint(constraint string) (semver.Constraints, error) {
+	if cached, ok := semverCache.Load(constraint); ok {
+		return cached.(cachedSemver).constraint, cached.(cachedSemver).err
+	}
+	c, err := semver.NewConstraint(constraint)
+	semverCache.Store(constraint, cachedSemver{constraint: c, err: err})
+	return c, err
+}
+
+// systemVersionKey is what ParseSystemVersion depends on
+type systemVersionKey struct {
+	distro  Distro
+	family  Family
+	version string
+}
+
+type systemVersionEntry struct {
+	version, core *semver.Version
+	err           error
+}
+
+// cachedSystemVersion is ParseSystemVersion, with the version without its pre-release that the constraints check
+func cachedSystemVersion(s System) (*semver.Version, *semver.Version, error) {
+	key := systemVersionKey{distro: s.Distro, family: s.Family, version: SystemVersion(s)}
+	if cached, ok := systemCache.Load(key); ok {
+		c := cached.(systemVersionEntry)
+		return c.version, c.core, c.err
+	}
+	c := systemVersionEntry{}
+	c.version, c.err = parseSystemVersion(s)
+	if c.err == nil {
+		c.core = c.version.Core()
+	}
+	systemCache.Store(key, c)
+	return c.version, c.core, c.err
+}
@@ -0,0 +1,78 @@
+package values
+
+// SizeReportDirs are the dirs reported on the image cleanup stage
+// Top level dirs are used for the total, the rest are there to show where the space goes
+var SizeReportDirs = []string{
+	"/boot",
+	"/etc",
+	"/opt",
+	"/root",
+	"/usr",
+	"/var",
+	"/usr/share/doc",
+	"/usr/share/man",
+	"/usr/share/locale",
+	"/var/cache",
+	"/var/lib/apt/lists",
+	"/var/log",
+}
+
+// PackageCacheCleanupCommands are the commands to clean the package manager caches for each family
+var PackageCacheCleanupCommands = map[Family][]string{
+	DebianFamily: {
+		"apt-get clean",
+		"rm -rf /var/lib/apt/lists/*",
+	},
+	RedHatFamily: {
+		"dnf clean all",
+		"rm -rf /var/cache/dnf/*",
+	},
+	SUSEFamily: {
+		"zypper clean -a",
+	},
+	AlpineFamily: {
+		"rm -rf /var/cache/apk/*",
+	},
+	ArchFamily: {
+		"pacman -Scc --noconfirm",
+	},
+}
+
+// IscsiInitiatorName is the iSCSI initiator name that open-iscsi generates when installed, which has to be unique for
+// each node. It is reset so each node generates its own on boot, which the Debian family only does with GenerateName
+const IscsiInitiatorName = "/etc/iscsi/initiatorname.iscsi"
+
+// PackageCacheDirs are the package manager cache dirs for each family. When any of them is a build cache mount it is
+// kept as it is, so the next build can use the cache
+var PackageCacheDirs = map[Family][]string{
+	DebianFamily: {"/var/cache/apt", "/var/lib/apt/lists"},
+	RedHatFamily: {"/var/cache/dnf", "/var/cache/yum", "/var/cache/libdnf5"},
+	SUSEFamily:   {"/var/cache/zypp"},
+	AlpineFamily: {"/var/cache/apk"},
+	ArchFamily:   {"/var/cache/pacman/pkg"},
+}
+
+// AptDockerClean is the apt config of the Debian and Ubuntu container images that removes the downloaded packages
+// after each install, which leaves nothing in an apt cache mount
+const AptDockerClean = "/etc/apt/apt.conf.d/docker-clean"
+
+// PackageManagerLocks are the lock files of the package managers that are left behind when they are killed. apt, dnf
+// and apk use fcntl or flock locks that go away with the process, so they have none
+var PackageManagerLocks = map[Family][]string{
+	SUSEFamily: {"/run/zypp.pid"},
+	ArchFamily: {"/var/lib/pacman/db.lck"},
+}
+
+// PackageManagerRepair are the commands that finish what a package manager stopped halfway left undone, run before
+// resuming an interrupted build
+var PackageManagerRepair = map[Family][]string{
+	DebianFamily: {"dpkg --configure -a"},
+}
+
+// InterruptTempFiles are the temp files the stages create and remove on their own, which are left behind when the
+// build is interrupted
+var InterruptTempFiles = []string{
+	"/var/tmp/dracut.*",
+	"/tmp/.kairos-init-epoch",
+	"/tmp/cuda-keyring.deb",
+}
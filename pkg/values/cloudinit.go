@@ -0,0 +1,44 @@
+package values
+
+// CloudInitPackages are the cloud-init packages that base images may ship.
+// They conflict with the kairos-agent cloud-config handling so they are removed unless configured otherwise
+var CloudInitPackages = PackageMap{
+	Common: {
+		ArchCommon: {
+			Common: {
+				"cloud-init",
+			},
+		},
+	},
+	Ubuntu: {
+		ArchCommon: {
+			Common: {
+				"cloud-initramfs-copymods",    // Shipped on the cloud images, hooks into the initramfs
+				"cloud-initramfs-dyn-netconf", // Same as above
+			},
+		},
+	},
+}
+
+// CloudInitPaths are the cloud-init config, datasource and state paths to remove with it
+var CloudInitPaths = []string{
+	"/etc/cloud",
+	"/var/lib/cloud",
+	"/var/log/cloud-init.log",
+	"/var/log/cloud-init-output.log",
+	"/etc/netplan/50-cloud-init.yaml", // Network config written by cloud-init on Ubuntu
+}
+
+// PackageInstalledCheck returns a shell check that succeeds if the package is installed on the system
+func PackageInstalledCheck(s System, pkg string) string {
+	switch s.Family {
+	case DebianFamily:
+		return "dpkg -s " + pkg + " >/dev/null 2>&1"
+	case AlpineFamily:
+		return "apk info -e " + pkg + " >/dev/null 2>&1"
+	case ArchFamily:
+		return "pacman -Q " + pkg + " >/dev/null 2>&1"
+	default:
+		return "rpm -q " + pkg + " >/dev/null 2>&1"
+	}
+}
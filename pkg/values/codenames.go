@@ -0,0 +1,237 @@
+package values
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	semver "github.com/hashicorp/go-version"
+)
+
+// Codenames map the release codenames of each distro to their version, so the package map constraints can use them
+// Debian testing has no VERSION_ID on its os-release, so its version comes from here
+var Codenames = map[Distro]map[string]string{
+	Ubuntu: {
+		"focal":    "20.04",
+		"jammy":    "22.04",
+		"kinetic":  "22.10",
+		"lunar":    "23.04",
+		"mantic":   "23.10",
+		"noble":    "24.04",
+		"oracular": "24.10",
+		"plucky":   "25.04",
+		"questing": "25.10",
+	},
+	Debian: {
+		"buster":   "10",
+		"bullseye": "11",
+		"bookworm": "12",
+		"trixie":   "13",
+		"forky":    "14",
+	},
+}
+
+// codenameRegex matches a constraint value that is a codename and not a version
+var codenameRegex = regexp.MustCompile(`^[a-z]+$`)
+
+// SystemVersion returns the version of the system, falling back to the one of its codename if the os-release has none
+func SystemVersion(s System) string {
+	if s.Version == "" && s.Codename != "" {
+		return Codenames[s.Distro][s.Codename]
+	}
+	return s.Version
+}
+
+// versionSegments are the segments of the version that select the packages of each distro or family, the rest are
+// point releases that ship the same packages, like Ubuntu 24.04.1, Debian 12.5 or Alpine 3.19.1. Distro entries take
+// precedence over the family ones
+var versionSegments = map[DistroFamilyInterface]int{
+	Debian:       1,
+	Fedora:       1,
+	DebianFamily: 2,
+	RedHatFamily: 2,
+	SUSEFamily:   2,
+	AlpineFamily: 2,
+}
+
+// servicePackRegex matches the SUSE service pack versions, like 15-SP5, which are the same as 15.5
+var servicePackRegex = regexp.MustCompile(`^(\d+)-SP(\d+)$`)
+
+// preReleaseRegex matches the Alpine pre-release suffixes, like 3.21.0_rc1 or 3.21.0_alpha20240807 on edge
+var preReleaseRegex = regexp.MustCompile(`_(alpha|beta|pre|rc)(\d*)$`)
+
+// ParseSystemVersion returns the version of the system normalized for the VersionMap constraints: service packs are
+// turned into minor versions, pre-release suffixes into semver pre-releases and point releases are dropped, see
+// versionSegments. It fails on versions that can't be parsed instead of silently selecting no packages
+func ParseSystemVersion(s System) (*semver.Version, error) {
+	v, _, err := cachedSystemVersion(s)
+	return v, err
+}
+
+func parseSystemVersion(s System) (*semver.Version, error) {
+	raw := SystemVersion(s)
+	if raw == "" {
+		return nil, fmt.Errorf("%s has no version or known codename", s.Distro)
+	}
+	version := servicePackRegex.ReplaceAllString(raw, "$1.$2")
+	version = preReleaseRegex.ReplaceAllString(version, "-$1$2")
+	version, preRelease, found := strings.Cut(version, "-")
+	segments, ok := versionSegments[s.Distro]
+	if !ok {
+		segments, ok = versionSegments[s.Family]
+	}
+	if parts := strings.Split(version, "."); ok && len(parts) > segments {
+		version = strings.Join(parts[:segments], ".")
+	}
+	if found {
+		version = fmt.Sprintf("%s-%s", version, preRelease)
+	}
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the %s version %q: %w", s.Distro, raw, err)
+	}
+	return v, nil
+}
+
+// parsedConstraint is a VersionMap constraint split in its parts, with the codenames resolved to versions
+type parsedConstraint struct {
+	names, versions, models, arches []string
+}
+
+// parseConstraint splits a VersionMap constraint of the distro in its parts, see constraintMatches
+func parseConstraint(distro Distro, constraint string) (parsedConstraint, error) {
+	var parsed parsedConstraint
+	for _, part := range strings.Split(constraint, ",") {
+		part = strings.TrimSpace(part)
+		// A typo in a model or arch would never match, silently dropping the packages
+		switch {
+		case part == "":
+			return parsedConstraint{}, fmt.Errorf("empty part")
+		case strings.HasPrefix(part, ModelConstraintPrefix):
+			model := strings.TrimPrefix(part, ModelConstraintPrefix)
+			if !slices.Contains(Models, Model(model)) {
+				return parsedConstraint{}, fmt.Errorf("unknown model %q", model)
+			}
+			parsed.models = append(parsed.models, model)
+			continue
+		case strings.HasPrefix(part, ArchConstraintPrefix):
+			arch := strings.TrimPrefix(part, ArchConstraintPrefix)
+			if arch != ArchAMD64.String() && arch != ArchARM64.String() {
+				return parsedConstraint{}, fmt.Errorf("unknown arch %q", arch)
+			}
+			parsed.arches = append(parsed.arches, arch)
+			continue
+		}
+		value := strings.TrimLeft(part, "<>=!~ ")
+		operator := strings.TrimSpace(strings.TrimSuffix(part, value))
+		if !codenameRegex.MatchString(value) {
+			parsed.versions = append(parsed.versions, part)
+			continue
+		}
+		version, ok := Codenames[distro][value]
+		if !ok {
+			return parsedConstraint{}, fmt.Errorf("unknown codename %s for %s", value, distro)
+		}
+		if operator == "" {
+			parsed.names = append(parsed.names, value)
+			continue
+		}
+		parsed.versions = append(parsed.versions, fmt.Sprintf("%s %s", operator, version))
+	}
+	return parsed, nil
+}
+
+// constraintMatches checks the system against a VersionMap constraint
+// Constraints are semver constraints like ">=22.04, <24.10" or "~> 24.10", where the versions can also be codenames of
+// the distro like ">=bookworm". Bare codenames are a set instead, so "jammy,noble" matches any of them
+// Each version part is checked on its own, see versionMatches for how pre-releases are handled
+// Model and arch parts like "model=rpi4" or "arch=arm64" are sets of the models and arches the entry applies to, see
+// ModelConstraintPrefix and ArchConstraintPrefix
+func constraintMatches(s System, constraint string) (bool, error) {
+	parsed, err := cachedParseConstraint(s.Distro, constraint)
+	if err != nil {
+		return false, err
+	}
+	names, versions, models, arches := parsed.names, parsed.versions, parsed.models, parsed.arches
+
+	if len(models) > 0 && !slices.Contains(models, s.Model.String()) {
+		return false, nil
+	}
+	if len(arches) > 0 && !slices.Contains(arches, s.Arch.String()) {
+		return false, nil
+	}
+	// Model or arch only constraints dont need a version
+	if len(names) == 0 && len(versions) == 0 {
+		return true, nil
+	}
+
+	systemVersion, core, err := cachedSystemVersion(s)
+	if err != nil {
+		return false, err
+	}
+	if len(names) > 0 {
+		match := slices.Contains(names, s.Codename)
+		for _, name := range names {
+			if v, err := parseVersion(Codenames[s.Distro][name]); err == nil && v.Equal(core) {
+				match = true
+			}
+		}
+		if !match {
+			return false, nil
+		}
+	}
+	for _, part := range versions {
+		match, err := versionMatches(systemVersion, core, part)
+		if err != nil || !match {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// versionMatches checks the system version against a single version part of a constraint, like ">=3.21" or
+// "~> 24.10". A pre-release of the system, like Alpine 3.21.0_rc1, is the release it precedes for the parts without a
+// pre-release so it gets the packages of that release, and only the parts with one, like ">=3.21-rc1", tell them apart.
+// go-version instead never matches a pre-release against a constraint without one
+// core is the system version without its pre-release, passed in as it is the same for all the parts
+func versionMatches(system, core *semver.Version, part string) (bool, error) {
+	value := strings.TrimLeft(part, "<>=!~ ")
+	operator := strings.TrimSpace(strings.TrimSuffix(part, value))
+	version, err := parseVersion(value)
+	if err != nil {
+		return false, err
+	}
+	if version.Prerelease() == "" {
+		constraint, err := parseSemverConstraint(part)
+		if err != nil {
+			return false, err
+		}
+		return constraint.Check(core), nil
+	}
+
+	cmp := system.Compare(version)
+	switch operator {
+	case "", "=":
+		return cmp == 0, nil
+	case "!=":
+		return cmp != 0, nil
+	case ">":
+		return cmp > 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case "~>":
+		// From the pre-release on, up to the same bound as without it
+		release, _, _ := strings.Cut(value, "-")
+		constraint, err := parseSemverConstraint(fmt.Sprintf("~> %s", release))
+		if err != nil {
+			return false, err
+		}
+		return cmp >= 0 && constraint.Check(core), nil
+	}
+	return false, fmt.Errorf("unknown operator %q", operator)
+}
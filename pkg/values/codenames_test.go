@@ -0,0 +1,106 @@
+package values
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+)
+
+func TestConstraintMatches(t *testing.T) {
+	alpine := func(version string) System {
+		return System{Distro: Alpine, Family: AlpineFamily, Version: version, Arch: ArchAMD64, Model: Generic}
+	}
+	ubuntu := func(version, codename string) System {
+		return System{Distro: Ubuntu, Family: DebianFamily, Version: version, Codename: codename, Arch: ArchAMD64, Model: Generic}
+	}
+	tests := []struct {
+		system     System
+		constraint string
+		want       bool
+	}{
+		// Pre-releases get the packages of the release they precede
+		{alpine("3.22.0_rc1"), ">=3.22", true},
+		{alpine("3.22.0_rc1"), "<3.22", false},
+		{alpine("3.22.0_rc1"), "3.22", true},
+		{alpine("3.22.0_rc1"), "~> 3.22", true},
+		// Unless the constraint has a pre-release too
+		{alpine("3.22.0_rc1"), ">=3.22-rc1", true},
+		{alpine("3.22.0_rc1"), ">=3.22-rc2", false},
+		{alpine("3.22.0_rc1"), "<3.22-rc2", true},
+		{alpine("3.22.0_rc1"), "~> 3.22-rc1", true},
+		{alpine("3.22.0_rc1"), "~> 3.22-rc2", false},
+		{alpine("3.22.0_alpha20250108"), ">=3.22-rc1", false},
+		{alpine("3.22.0"), ">=3.22-rc1", true},
+		{alpine("3.22.0"), "~> 3.22-rc1", true},
+		{alpine("3.21.3"), ">=3.22-rc1", false},
+		{alpine("3.21.3"), "~> 3.22-rc1", false},
+		// Point releases are dropped
+		{alpine("3.22.1"), "3.22", true},
+		// Interim releases
+		{ubuntu("24.10", "oracular"), ">=20.04, <24.10", false},
+		{ubuntu("24.10", "oracular"), ">=24.10, <25.04", true},
+		{ubuntu("25.04", "plucky"), ">=24.10, <25.04", false},
+		{ubuntu("25.04", "plucky"), ">=25.04", true},
+		{ubuntu("25.10", "questing"), "~> 25.04", true},
+		{ubuntu("26.10", ""), ">=26.04, <26.10", false},
+		{ubuntu("24.04.1", "noble"), "noble", true},
+		{ubuntu("24.04", "noble"), ">=jammy, <oracular", true},
+		{ubuntu("24.04", "noble"), "arch=arm64, >=24.04", false},
+	}
+	for _, tt := range tests {
+		got, err := constraintMatches(tt.system, tt.constraint)
+		if err != nil {
+			t.Errorf("%s %s %q: %s", tt.system.Distro, tt.system.Version, tt.constraint, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s %s %q: got %t, expected %t", tt.system.Distro, tt.system.Version, tt.constraint, got, tt.want)
+		}
+	}
+}
+
+func TestConstraintMatchesErrors(t *testing.T) {
+	s := System{Distro: Ubuntu, Family: DebianFamily, Version: "24.04", Codename: "noble", Arch: ArchAMD64, Model: Generic}
+	for _, constraint := range []string{">=24.04,", "model=rpi5", "arch=riscv64", ">=unknown", ">=not.a.version"} {
+		if _, err := constraintMatches(s, constraint); err == nil {
+			t.Errorf("%q: expected an error", constraint)
+		}
+	}
+	s.Version = "not.a.version"
+	if _, err := constraintMatches(s, ">=24.04"); err == nil {
+		t.Errorf("expected an error for an unparseable system version")
+	}
+}
+
+// TestUbuntuKernelPackages checks the hwe kernel that each Ubuntu release gets, as the interim releases don't follow
+// the version of the release
+func TestUbuntuKernelPackages(t *testing.T) {
+	tests := []struct {
+		version, codename string
+		want              []string
+	}{
+		{"22.04", "jammy", []string{"linux-image-generic-hwe-22.04"}},
+		{"24.04", "noble", []string{"linux-image-generic-hwe-24.04"}},
+		{"24.10", "oracular", []string{"linux-image-generic-hwe-24.04"}},
+		{"25.04", "plucky", []string{"linux-image-generic-hwe-25.04"}},
+		{"25.10", "questing", []string{"linux-image-generic-hwe-25.10"}},
+		{"26.10", "", []string{"linux-image-generic-hwe-26.10"}},
+	}
+	l := sdkTypes.NewNullLogger()
+	for _, tt := range tests {
+		s := System{Distro: Ubuntu, Family: DebianFamily, Version: tt.version, Codename: tt.codename, Arch: ArchAMD64, Model: Generic}
+		pkgs, err := FilterPackagesOnConstraint(s, l, GetVersionMaps(s, KernelPackages))
+		if err == nil {
+			pkgs, err = PackageListToTemplate(pkgs, s.TemplateParams(config.Config{}), l)
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.version, err)
+			continue
+		}
+		if !reflect.DeepEqual(pkgs, tt.want) {
+			t.Errorf("%s: got %v, expected %v", tt.version, pkgs, tt.want)
+		}
+	}
+}
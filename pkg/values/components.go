@@ -0,0 +1,86 @@
+package values
+
+import "fmt"
+
+// Component is a kairos component released as a binary on its github repo
+type Component struct {
+	// Name of the component, which is also the prefix of its release assets
+	Name string
+	// Repo is the github repo that releases the component
+	Repo string
+	// Binary is the name of the binary inside the release tarball
+	Binary string
+	// Destination is where the binary is installed
+	Destination string
+	// Version is the pinned release
+	Version string
+	// Standard is set for the components that are only installed on the standard variant
+	Standard bool
+}
+
+// The versions below get auto updated by renovate on github
+// They should match the ones shipped in the framework image
+var (
+	// renovate: datasource=github-releases depName=kairos-io/immucore
+	immucoreVersion = "v0.9.6"
+	// renovate: datasource=github-releases depName=kairos-io/kairos-agent
+	kairosAgentVersion = "v2.20.7"
+	// renovate: datasource=github-releases depName=kairos-io/provider-kairos
+	providerKairosVersion = "v2.10.0"
+)
+
+const (
+	ImmucoreComponent       = "immucore"
+	KairosAgentComponent    = "kairos-agent"
+	ProviderKairosComponent = "provider-kairos"
+)
+
+// Components are the kairos components that can be installed from their releases, in install order
+// Their units and dracut modules come from the framework image, so only the binaries are replaced
+var Components = []Component{
+	{
+		Name:        ImmucoreComponent,
+		Repo:        "kairos-io/immucore",
+		Binary:      "immucore",
+		Destination: "/usr/bin/immucore",
+		Version:     immucoreVersion,
+	},
+	{
+		Name:        KairosAgentComponent,
+		Repo:        "kairos-io/kairos-agent",
+		Binary:      "kairos-agent",
+		Destination: "/usr/bin/kairos-agent",
+		Version:     kairosAgentVersion,
+	},
+	{
+		Name:        ProviderKairosComponent,
+		Repo:        "kairos-io/provider-kairos",
+		Binary:      "agent-provider-kairos",
+		Destination: "/system/providers/agent-provider-kairos",
+		Version:     providerKairosVersion,
+		Standard:    true,
+	},
+}
+
+// componentArch returns the arch name used on the release assets
+func componentArch(arch Architecture) string {
+	if arch == ArchARM64 {
+		return "arm64"
+	}
+	return "x86_64"
+}
+
+// Asset returns the release tarball name of the component for the given version and arch
+func (c Component) Asset(version string, arch Architecture) string {
+	return fmt.Sprintf("%s-%s-Linux-%s.tar.gz", c.Name, version, componentArch(arch))
+}
+
+// AssetURL returns the download url of the release tarball
+func (c Component) AssetURL(version string, arch Architecture) string {
+	return fmt.Sprintf("https://github.com/%s/releases/download/%s/%s", c.Repo, version, c.Asset(version, arch))
+}
+
+// ChecksumsURL returns the download url of the release checksums file, which lists the sha256 of every asset
+func (c Component) ChecksumsURL(version string) string {
+	return fmt.Sprintf("https://github.com/%s/releases/download/%s/%s-%s-checksums.txt", c.Repo, version, c.Name, version)
+}
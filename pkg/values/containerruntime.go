@@ -0,0 +1,150 @@
+package values
+
+import "fmt"
+
+// ContainerRuntime is the container runtime installed in the image
+type ContainerRuntime string
+
+func (c ContainerRuntime) String() string {
+	return string(c)
+}
+
+const (
+	ContainerdRuntime ContainerRuntime = "containerd"
+	DockerRuntime     ContainerRuntime = "docker"
+	CrioRuntime       ContainerRuntime = "crio"
+)
+
+// ContainerRuntimeConfig is everything needed to set up a container runtime on the system
+type ContainerRuntimeConfig struct {
+	Packages       PackageMap        // Packages to install
+	Services       []string          // Services to enable on systemd systems
+	OpenRCServices []string          // Services to add to the default runlevel on openrc systems
+	Files          map[string]string // Default config files
+	SystemdFiles   map[string]string // Default config files only written on systemd systems, as they set the systemd cgroup driver
+}
+
+// ContainerRuntimes are the supported container runtimes
+// RedHat and its clones only ship podman so they have none, and cri-o is not in the Debian family repos
+var ContainerRuntimes = map[ContainerRuntime]ContainerRuntimeConfig{
+	ContainerdRuntime: {
+		Packages: PackageMap{
+			DebianFamily: {
+				ArchCommon: {
+					Common: {"containerd", "runc"},
+				},
+			},
+			Fedora: {
+				ArchCommon: {
+					Common: {"containerd", "runc"},
+				},
+			},
+			SUSEFamily: {
+				ArchCommon: {
+					Common: {"containerd", "runc"},
+				},
+			},
+			ArchFamily: {
+				ArchCommon: {
+					Common: {"containerd", "runc"},
+				},
+			},
+			AlpineFamily: {
+				ArchCommon: {
+					Common: {"containerd", "containerd-openrc", "runc"},
+				},
+			},
+		},
+		Services:       []string{"containerd"},
+		OpenRCServices: []string{"containerd"},
+		SystemdFiles: map[string]string{
+			"/etc/containerd/config.toml": "version = 2\n\n[plugins.\"io.containerd.grpc.v1.cri\".containerd.runtimes.runc.options]\n  SystemdCgroup = true\n",
+		},
+	},
+	DockerRuntime: {
+		Packages: PackageMap{
+			DebianFamily: {
+				ArchCommon: {
+					Common: {"docker.io"},
+				},
+			},
+			Fedora: {
+				ArchCommon: {
+					Common: {"moby-engine"},
+				},
+			},
+			SUSEFamily: {
+				ArchCommon: {
+					Common: {"docker"},
+				},
+			},
+			ArchFamily: {
+				ArchCommon: {
+					Common: {"docker"},
+				},
+			},
+			AlpineFamily: {
+				ArchCommon: {
+					Common: {"docker", "docker-openrc"},
+				},
+			},
+		},
+		Services:       []string{"docker"},
+		OpenRCServices: []string{"docker"},
+		// Rotate the container logs so they dont fill the persistent partition
+		Files: map[string]string{
+			"/etc/docker/daemon.json": "{\n  \"log-driver\": \"json-file\",\n  \"log-opts\": {\n    \"max-size\": \"10m\",\n    \"max-file\": \"3\"\n  }\n}\n",
+		},
+	},
+	CrioRuntime: {
+		Packages: PackageMap{
+			Fedora: {
+				ArchCommon: {
+					Common: {"cri-o", "cri-tools"},
+				},
+			},
+			SUSEFamily: {
+				ArchCommon: {
+					Common: {"cri-o", "cri-tools"},
+				},
+			},
+			ArchFamily: {
+				ArchCommon: {
+					Common: {"cri-o", "cri-tools"},
+				},
+			},
+			AlpineFamily: {
+				ArchCommon: {
+					Common: {"cri-o", "cri-o-openrc", "cri-tools"},
+				},
+			},
+		},
+		Services:       []string{"crio"},
+		OpenRCServices: []string{"crio"},
+		SystemdFiles: map[string]string{
+			"/etc/crio/crio.conf.d/10-kairos.conf": "[crio.runtime]\ncgroup_manager = \"systemd\"\n",
+		},
+	},
+}
+
+// GetContainerRuntime returns the config for the given container runtime, checking that its available on the system
+func GetContainerRuntime(s System, runtime string) (ContainerRuntimeConfig, error) {
+	runtimeConfig, ok := ContainerRuntimes[ContainerRuntime(runtime)]
+	if !ok {
+		return ContainerRuntimeConfig{}, fmt.Errorf("invalid container runtime: %s, possible values are %s, %s and %s", runtime, ContainerdRuntime, DockerRuntime, CrioRuntime)
+	}
+	if !hasPackages(GetVersionMaps(s, runtimeConfig.Packages)) {
+		return ContainerRuntimeConfig{}, fmt.Errorf("container runtime %s is not available on %s", runtime, s.Distro)
+	}
+	return runtimeConfig, nil
+}
+
+// hasPackages returns true if any of the version maps has packages
+func hasPackages(maps []VersionMap) bool {
+	for _, m := range maps {
+		if len(m) > 0 {
+			return true
+		}
+	}
+	return false
+}
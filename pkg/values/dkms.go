@@ -0,0 +1,62 @@
+package values
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ModuleBuilder is the tool used to build out-of-tree kernel modules from source packages
+type ModuleBuilder string
+
+const (
+	Dkms    ModuleBuilder = "dkms"
+	Akmods  ModuleBuilder = "akmods"
+	NoBuild ModuleBuilder = ""
+)
+
+// GetModuleBuilder returns the tool used to build out-of-tree modules on the given system
+// The RedHat family ships the module sources as akmod packages, the rest use dkms
+func GetModuleBuilder(s System) (ModuleBuilder, error) {
+	switch s.Family {
+	case DebianFamily, SUSEFamily:
+		return Dkms, nil
+	case RedHatFamily:
+		return Akmods, nil
+	default:
+		return NoBuild, fmt.Errorf("building out-of-tree kernel modules is not supported on %s", s.Distro)
+	}
+}
+
+// ModuleBuilderPackages returns the packages needed to build the modules, excluding the kernel headers
+func ModuleBuilderPackages(builder ModuleBuilder) []string {
+	if builder == Akmods {
+		return []string{"akmods"}
+	}
+	return []string{"dkms"}
+}
+
+// KernelHeadersPackage returns the package providing the headers for the given kernel version, as found under /lib/modules
+func KernelHeadersPackage(s System, kernel string) string {
+	switch s.Family {
+	case DebianFamily:
+		return fmt.Sprintf("linux-headers-%s", kernel)
+	case SUSEFamily:
+		// 6.4.0-150600.23.22-default is provided by kernel-default-devel
+		flavor := kernel[strings.LastIndex(kernel, "-")+1:]
+		return fmt.Sprintf("kernel-%s-devel", flavor)
+	case AlpineFamily:
+		// 6.6.58-0-lts is provided by linux-lts-dev
+		flavor := kernel[strings.LastIndex(kernel, "-")+1:]
+		return fmt.Sprintf("linux-%s-dev", flavor)
+	default:
+		return fmt.Sprintf("kernel-devel-%s", kernel)
+	}
+}
+
+// ModuleBuildCommand returns the command that builds all the installed module sources for the given kernel
+func ModuleBuildCommand(builder ModuleBuilder, kernel string) string {
+	if builder == Akmods {
+		return fmt.Sprintf("akmods --force --kernels %s", kernel)
+	}
+	return fmt.Sprintf("dkms autoinstall -k %s", kernel)
+}
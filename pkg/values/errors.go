@@ -0,0 +1,52 @@
+package values
+
+import "regexp"
+
+// ErrorHint is a remediation hint for the build errors whose output matches the pattern
+type ErrorHint struct {
+	Pattern *regexp.Regexp
+	Hint    string
+}
+
+// RepoUnreachable and RepoMismatch match the package manager errors of a mirror that is down or in the middle of a
+// sync, the ones worth retrying on another mirror
+var (
+	RepoUnreachable = regexp.MustCompile(`Temporary failure resolving|Could not resolve|Failed to download|Curl error|Cannot download|Connection timed out|Network is unreachable|temporary error \(try again later\)`)
+	RepoMismatch    = regexp.MustCompile(`Hash Sum mismatch|checksum doesn't match|Checksum mismatch|BAD signature|UNTRUSTED signature`)
+)
+
+// ErrorHints are the hints for the common build errors, checked in order
+var ErrorHints = []ErrorHint{
+	{
+		Pattern: regexp.MustCompile(`No space left on device`),
+		Hint:    "The build ran out of disk space, free some space on the builder or increase the storage of the build container",
+	},
+	{
+		Pattern: regexp.MustCompile(`Could not get lock|Waiting for cache lock|database is locked|Unable to lock the administration directory`),
+		Hint:    "Another package manager process is holding the lock, make sure nothing else is installing packages during the build",
+	},
+	{
+		Pattern: RepoUnreachable,
+		Hint:    "The package repositories could not be reached, check the network and DNS of the builder or the configured mirrors",
+	},
+	{
+		Pattern: RepoMismatch,
+		Hint:    "The downloaded packages do not match the repo metadata, usually a mirror in the middle of a sync. Retry the build or use another mirror",
+	},
+	{
+		Pattern: regexp.MustCompile(`NO_PUBKEY|GPG error|public key .* not installed|Signature verification failed|is not signed`),
+		Hint:    "The signing keys of a package repository are missing or expired, update the base image or import the repo keys",
+	},
+	{
+		Pattern: regexp.MustCompile(`Unable to locate package|No match for argument|No package .* available|not found in package names|unable to select packages|Package .* has no installation candidate`),
+		Hint:    "A package is not available in the enabled repos, check that the distro version is supported and that the needed repos (like EPEL or non-free) are enabled",
+	},
+	{
+		Pattern: regexp.MustCompile(`Unmet dependencies|conflicting requests|nothing provides|Problem: .* conflicts`),
+		Hint:    "The package dependencies could not be resolved, usually from mixing packages of several distro releases. Update the base image and retry",
+	},
+	{
+		Pattern: regexp.MustCompile(`dracut.*(FAILED|ERROR)|Cannot find module`),
+		Hint:    "The initrd could not be built, check that the kernel modules for the installed kernel are present under /lib/modules",
+	},
+}
@@ -0,0 +1,230 @@
+package values
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+)
+
+// Feature is an optional system feature that needs extra packages and setup
+type Feature string
+
+func (f Feature) String() string {
+	return string(f)
+}
+
+const (
+	FipsFeature            Feature = "fips"
+	SelinuxFeature         Feature = "selinux"
+	MultipathFeature       Feature = "multipath"
+	AuditFeature           Feature = "audit"
+	StorageFeature         Feature = "storage"
+	NvidiaContainerFeature Feature = "nvidia-container"
+)
+
+// FeatureConfig is everything a feature adds to the system
+type FeatureConfig struct {
+	Packages       PackageMap // Packages to install
+	Services       []string   // Services to enable on systemd systems
+	OpenRCServices []string   // Services to add to the default runlevel on openrc systems
+	DracutModules  []string   // dracut modules to add to the initrd
+	// Default config files, written before the initrd is built so dracut includes them, and only if the system has none
+	Files map[string]string
+}
+
+// Features are the supported features
+// fips only adds the userspace packages here, the fips dracut module is set up with the fips option
+var Features = map[Feature]FeatureConfig{
+	FipsFeature: {
+		Packages: PackageMap{
+			RedHatFamily: {
+				ArchCommon: {
+					Common: {"crypto-policies-scripts"}, // fips-mode-setup
+					// The dracut module moved into dracut itself on 9
+					"<9": {"dracut-fips"},
+				},
+			},
+			OpenSUSELeap: {
+				ArchCommon: {
+					Common: {"dracut-fips"},
+				},
+			},
+			SLES: {
+				ArchCommon: {
+					Common: {"dracut-fips"},
+				},
+			},
+		},
+	},
+	SelinuxFeature: {
+		Packages: PackageMap{
+			DebianFamily: {
+				ArchCommon: {
+					Common: {"selinux-basics", "selinux-policy-default", "policycoreutils"},
+				},
+			},
+			RedHatFamily: {
+				ArchCommon: {
+					Common: {"selinux-policy-targeted", "policycoreutils", "container-selinux"},
+				},
+			},
+			SUSEFamily: {
+				ArchCommon: {
+					Common: {"selinux-policy-targeted", "policycoreutils", "container-selinux"},
+				},
+			},
+		},
+	},
+	MultipathFeature: {
+		Packages: PackageMap{
+			DebianFamily: {
+				ArchCommon: {
+					Common: {"multipath-tools", "open-iscsi"},
+				},
+			},
+			RedHatFamily: {
+				ArchCommon: {
+					Common: {"device-mapper-multipath", "iscsi-initiator-utils"},
+				},
+			},
+			SUSEFamily: {
+				ArchCommon: {
+					Common: {"multipath-tools", "open-iscsi"},
+				},
+			},
+			ArchFamily: {
+				ArchCommon: {
+					Common: {"multipath-tools", "open-iscsi"},
+				},
+			},
+			AlpineFamily: {
+				ArchCommon: {
+					Common: {"multipath-tools", "multipath-tools-openrc", "open-iscsi", "open-iscsi-openrc"},
+				},
+			},
+		},
+		Services:       []string{"multipathd", "iscsid"},
+		OpenRCServices: []string{"multipathd", "iscsid"},
+		DracutModules:  []string{"multipath", "iscsi"},
+		// multipathd does nothing without a config on the RedHat family, so SAN boot disks would not get their paths
+		// merged in the initrd
+		Files: map[string]string{
+			"/etc/multipath.conf": "defaults {\n    user_friendly_names yes\n    find_multipaths yes\n}\n",
+		},
+	},
+	// The log forwarder is set up on top with the audit options, see LogForwarders
+	AuditFeature: {
+		Packages: PackageMap{
+			DebianFamily: {
+				ArchCommon: {
+					// The syslog plugin is not in auditd
+					Common: {"auditd", "audispd-plugins"},
+				},
+			},
+			RedHatFamily: {
+				ArchCommon: {
+					Common: {"audit"},
+				},
+			},
+			SUSEFamily: {
+				ArchCommon: {
+					Common: {"audit"},
+				},
+			},
+			ArchFamily: {
+				ArchCommon: {
+					Common: {"audit"},
+				},
+			},
+			AlpineFamily: {
+				ArchCommon: {
+					Common: {"audit", "audit-openrc"},
+				},
+			},
+		},
+		Services:       []string{"auditd"},
+		OpenRCServices: []string{"auditd"},
+	},
+	// The prerequisites of Longhorn and Rook/Ceph on the nodes. multipathd is not enabled, as Longhorn needs it to stay
+	// away from its devices, use the multipath feature for that
+	StorageFeature: {
+		Packages: PackageMap{
+			DebianFamily: {
+				ArchCommon: {
+					Common: {"open-iscsi", "nfs-common", "multipath-tools", "cryptsetup"},
+				},
+			},
+			RedHatFamily: {
+				ArchCommon: {
+					Common: {"iscsi-initiator-utils", "nfs-utils", "device-mapper-multipath", "cryptsetup"},
+				},
+			},
+			SUSEFamily: {
+				ArchCommon: {
+					Common: {"open-iscsi", "nfs-client", "multipath-tools", "cryptsetup"},
+				},
+			},
+			ArchFamily: {
+				ArchCommon: {
+					Common: {"open-iscsi", "nfs-utils", "multipath-tools", "cryptsetup"},
+				},
+			},
+			AlpineFamily: {
+				ArchCommon: {
+					Common: {"open-iscsi", "open-iscsi-openrc", "nfs-utils", "nfs-utils-openrc", "multipath-tools", "cryptsetup"},
+				},
+			},
+		},
+		Services:       []string{"iscsid"},
+		OpenRCServices: []string{"iscsid"},
+	},
+	// The NVIDIA container toolkit, it needs the nvidia option for the repos and the driver. The container runtime is set
+	// up to use it by default, see NvidiaRuntimeCommands and NvidiaRuntimeFiles
+	NvidiaContainerFeature: {
+		Packages: PackageMap{
+			DebianFamily: {
+				ArchCommon: {
+					Common: {"nvidia-container-toolkit"},
+				},
+			},
+			RedHatFamily: {
+				ArchCommon: {
+					Common: {"nvidia-container-toolkit"},
+				},
+			},
+			SUSEFamily: {
+				ArchCommon: {
+					Common: {"nvidia-container-toolkit"},
+				},
+			},
+		},
+	},
+}
+
+// EnabledFeatures returns the features enabled in the config, sorted, checking that they are available on the system
+// The fips option enables the fips feature too
+func EnabledFeatures(s System, c config.Config) ([]Feature, error) {
+	var features []Feature
+	for _, name := range c.Features {
+		feature := Feature(name)
+		featureConfig, ok := Features[feature]
+		if !ok {
+			return nil, fmt.Errorf("invalid feature: %s, possible values are %s, %s, %s, %s, %s and %s", name, FipsFeature, SelinuxFeature, MultipathFeature, AuditFeature, StorageFeature, NvidiaContainerFeature)
+		}
+		// fips has no packages on some distros as the support comes with the base packages
+		if feature != FipsFeature && !hasPackages(GetVersionMaps(s, featureConfig.Packages)) {
+			return nil, fmt.Errorf("feature %s is not available on %s", name, s.Distro)
+		}
+		if feature == NvidiaContainerFeature && !c.Nvidia {
+			return nil, fmt.Errorf("feature %s needs the nvidia option, which adds the NVIDIA repos and driver", name)
+		}
+		features = append(features, feature)
+	}
+	if c.Fips {
+		features = append(features, FipsFeature)
+	}
+	sort.Slice(features, func(i, j int) bool { return features[i] < features[j] })
+	return slices.Compact(features), nil
+}
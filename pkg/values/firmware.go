@@ -0,0 +1,127 @@
+package values
+
+import "fmt"
+
+// FirmwareLevel selects how much firmware is installed with the kernel
+type FirmwareLevel string
+
+const (
+	// FirmwareDefault keeps the firmware packages that kairos has always installed for each distro
+	FirmwareDefault FirmwareLevel = ""
+	FirmwareNone    FirmwareLevel = "none"
+	FirmwareMinimal FirmwareLevel = "minimal"
+	FirmwareFull    FirmwareLevel = "full"
+)
+
+// FirmwarePackages are the firmware packages to install for each level
+// Ubuntu and the RedHat family kernels depend on their full firmware package, so on those none and minimal cannot trim it
+// Debian needs the non-free-firmware component for the full level, which is enabled on the before-install stage
+var FirmwarePackages = map[FirmwareLevel]PackageMap{
+	FirmwareDefault: {
+		Debian: {
+			ArchCommon: {
+				Common: {"firmware-linux-free"},
+			},
+		},
+	},
+	FirmwareNone: {
+		AlpineFamily: {
+			ArchCommon: {
+				// Satisfies the linux-firmware-any dependency of the kernel without installing any firmware
+				Common: {"linux-firmware-none"},
+			},
+		},
+	},
+	FirmwareMinimal: {
+		Debian: {
+			ArchCommon: {
+				Common: {"firmware-linux-free"},
+			},
+		},
+		SUSEFamily: {
+			ArchCommon: {
+				Common: {
+					"kernel-firmware-network",
+					"kernel-firmware-realtek",
+					"kernel-firmware-usb-network",
+				},
+			},
+		},
+		AlpineFamily: {
+			ArchCommon: {
+				Common: {
+					"linux-firmware-other",
+					"linux-firmware-rtl_nic",
+				},
+			},
+		},
+	},
+	FirmwareFull: {
+		Ubuntu: {
+			ArchCommon: {
+				Common: {"linux-firmware"},
+			},
+		},
+		Debian: {
+			ArchCommon: {
+				Common: {
+					"firmware-linux-free",
+					"firmware-linux-nonfree",
+					"firmware-misc-nonfree",
+				},
+			},
+		},
+		RedHatFamily: {
+			ArchCommon: {
+				Common: {"linux-firmware"},
+			},
+		},
+		SUSEFamily: {
+			ArchCommon: {
+				Common: {"kernel-firmware-all"},
+			},
+			ArchARM64: {
+				Common: {"bcm43xx-firmware"},
+			},
+		},
+		AlpineFamily: {
+			ArchCommon: {
+				Common: {"linux-firmware"},
+			},
+		},
+	},
+}
+
+// FirmwareDefaultGrubPackages are the default firmware packages that came with the grub packages on SUSE, so they
+// are only installed on the default level when not building for trusted boot, same as before the firmware levels
+var FirmwareDefaultGrubPackages = PackageMap{
+	SUSEFamily: {
+		ArchAMD64: {
+			Common: {"kernel-firmware-all"},
+		},
+		ArchARM64: {
+			Common: {
+				"bcm43xx-firmware",
+				"kernel-firmware-ath10k",
+				"kernel-firmware-ath11k",
+				"kernel-firmware-atheros",
+				"kernel-firmware-bluetooth",
+				"kernel-firmware-brcm",
+				"kernel-firmware-iwlwifi",
+				"kernel-firmware-network",
+				"kernel-firmware-realtek",
+				"kernel-firmware-serial",
+				"kernel-firmware-usb-network",
+			},
+		},
+	},
+}
+
+// GetFirmwarePackages returns the firmware packages for the given level
+func GetFirmwarePackages(level string) (PackageMap, error) {
+	pkgs, ok := FirmwarePackages[FirmwareLevel(level)]
+	if !ok {
+		return nil, fmt.Errorf("invalid firmware level: %s, possible values are %s, %s or %s", level, FirmwareNone, FirmwareMinimal, FirmwareFull)
+	}
+	return pkgs, nil
+}
@@ -0,0 +1,183 @@
+package values
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+)
+
+// PackageGroup is a set of packages for a feature that can be enabled or disabled in the config
+type PackageGroup struct {
+	Packages       PackageMap
+	Services       []string // Services to enable on systemd systems, if the packages ship them
+	OpenRCServices []string // Services to add to the default runlevel on openrc systems
+	// Default groups are enabled unless disabled in the config, except on trusted boot images which are kept small
+	Default bool
+}
+
+const (
+	ExtendedGroup    = "extended"
+	WirelessGroup    = "wireless"
+	DebugToolsGroup  = "debug-tools"
+	VmwareToolsGroup = "vmware-tools"
+)
+
+// ExtendedPackages are nice to have tools that are not needed to boot, installed on non trusted boot images unless the
+// extended group is disabled
+var ExtendedPackages = PackageMap{
+	DebianFamily: {
+		ArchCommon: {
+			Common: {
+				"lldpd",
+				"snmpd",
+				"kbd",            // Keyboard configuration
+				"squashfs-tools", // For squashfs support, probably needs to be part of BasePackages
+			},
+		},
+	},
+	SUSEFamily: {
+		ArchCommon: {
+			Common: {"nethogs", "patch", "iw"},
+		},
+	},
+	Ubuntu: {
+		ArchCommon: {
+			Common: {"zfsutils-linux"},
+		},
+	},
+}
+
+// PackageGroups are the package groups that can be selected in the config
+var PackageGroups = map[string]PackageGroup{
+	// Tools that were always installed on non trusted boot images
+	ExtendedGroup: {
+		Packages: ExtendedPackages,
+		Default:  true,
+	},
+	WirelessGroup: {
+		Packages: PackageMap{
+			DebianFamily: {
+				ArchCommon: {
+					Common: {"iw", "wireless-regdb", "wpasupplicant"},
+				},
+			},
+			RedHatFamily: {
+				ArchCommon: {
+					Common: {"iw", "wireless-regdb", "wpa_supplicant"},
+				},
+			},
+			SUSEFamily: {
+				ArchCommon: {
+					Common: {"iw", "wireless-regdb", "wpa_supplicant"},
+				},
+			},
+			ArchFamily: {
+				ArchCommon: {
+					Common: {"iw", "wireless-regdb", "wpa_supplicant"},
+				},
+			},
+			AlpineFamily: {
+				ArchCommon: {
+					Common: {"iw", "wireless-regdb", "wpa_supplicant", "wpa_supplicant-openrc"},
+				},
+			},
+		},
+	},
+	DebugToolsGroup: {
+		Packages: PackageMap{
+			DebianFamily: {
+				ArchCommon: {
+					Common: {"strace", "tcpdump", "lsof", "htop"},
+				},
+			},
+			// htop is on EPEL for the RedHat clones
+			RedHatFamily: {
+				ArchCommon: {
+					Common: {"strace", "tcpdump", "lsof"},
+				},
+			},
+			Fedora: {
+				ArchCommon: {
+					Common: {"htop"},
+				},
+			},
+			SUSEFamily: {
+				ArchCommon: {
+					Common: {"strace", "tcpdump", "lsof", "htop"},
+				},
+			},
+			ArchFamily: {
+				ArchCommon: {
+					Common: {"strace", "tcpdump", "lsof", "htop"},
+				},
+			},
+			AlpineFamily: {
+				ArchCommon: {
+					Common: {"strace", "tcpdump", "lsof", "htop"},
+				},
+			},
+		},
+	},
+	VmwareToolsGroup: {
+		Packages: PackageMap{
+			DebianFamily: {
+				ArchCommon: {
+					Common: {"open-vm-tools"},
+				},
+			},
+			RedHatFamily: {
+				ArchCommon: {
+					Common: {"open-vm-tools"},
+				},
+			},
+			SUSEFamily: {
+				ArchCommon: {
+					Common: {"open-vm-tools"},
+				},
+			},
+			ArchFamily: {
+				ArchCommon: {
+					Common: {"open-vm-tools"},
+				},
+			},
+			AlpineFamily: {
+				ArchCommon: {
+					Common: {"open-vm-tools", "open-vm-tools-openrc"},
+				},
+			},
+		},
+		// The unit is named after the package on the Debian family and after the daemon on the rest
+		Services:       []string{"open-vm-tools", "vmtoolsd"},
+		OpenRCServices: []string{"open-vm-tools"},
+	},
+}
+
+// EnabledPackageGroups returns the names of the package groups to install, sorted: the default ones unless disabled
+// plus the ones enabled in the config
+func EnabledPackageGroups(s System, groups config.PackageGroups) ([]string, error) {
+	for _, name := range append(slices.Clone(groups.Enable), groups.Disable...) {
+		if _, ok := PackageGroups[name]; !ok {
+			names := make([]string, 0, len(PackageGroups))
+			for n := range PackageGroups {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("invalid package group: %s, possible values are %s", name, strings.Join(names, ", "))
+		}
+	}
+
+	var enabled []string
+	for name, group := range PackageGroups {
+		if slices.Contains(groups.Disable, name) {
+			continue
+		}
+		if slices.Contains(groups.Enable, name) || (group.Default && !s.TrustedBoot) {
+			enabled = append(enabled, name)
+		}
+	}
+	sort.Strings(enabled)
+	return enabled, nil
+}
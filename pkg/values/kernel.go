@@ -0,0 +1,57 @@
+package values
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+)
+
+// CustomKernelInstallCommand returns the command to install a local kernel package file with the package manager of the system,
+// so the dependencies of the package are resolved from the repos
+func CustomKernelInstallCommand(s System, file string) (string, error) {
+	ext := filepath.Ext(file)
+	switch s.Family {
+	case DebianFamily:
+		if ext == ".deb" {
+			return fmt.Sprintf("apt-get install -y %s", file), nil
+		}
+	case RedHatFamily:
+		if ext == ".rpm" {
+			return fmt.Sprintf("dnf install -y %s", file), nil
+		}
+	case SUSEFamily:
+		if ext == ".rpm" {
+			// The package is verified by its checksum instead of a signature
+			return fmt.Sprintf("zypper --non-interactive install --allow-unsigned-rpm %s", file), nil
+		}
+	case AlpineFamily:
+		if ext == ".apk" {
+			return fmt.Sprintf("apk add --allow-untrusted %s", file), nil
+		}
+	default:
+		return "", fmt.Errorf("custom kernel packages are not supported on %s", s.Distro)
+	}
+	return "", fmt.Errorf("kernel package %s is not a valid package for %s", filepath.Base(file), s.Distro)
+}
+
+// UbuntuTrustedBootKernelCommand installs the latest generic kernel image and modules on Ubuntu trusted boot images,
+// which have no kernel in KernelPackagesTrustedBoot. The packages are named like linux-image-5.4.0-104-generic and
+// linux-modules-5.4.0-104-generic, and it fails if there is none
+const UbuntuTrustedBootKernelCommand = `version=$(apt-cache search linux-image | sed -nE 's/^linux-image-([0-9]+\.[0-9]+\.[0-9]+-[0-9]+)-generic .*/\1/p' | sort -V | tail -n1) && ` +
+	`test -n "$version" && DEBIAN_FRONTEND=noninteractive apt-get install -y linux-image-${version}-generic linux-modules-${version}-generic`
+
+// kernelCmdlineUnsafe are the characters that can't go in the grub extra_cmdline, as it is set in a double quoted string
+// where they would end the string, expand a variable or escape the next character
+const kernelCmdlineUnsafe = "\"$\\\n"
+
+// ValidateKernelCmdline checks that the extra kernel cmdline arguments in the config can be set on the grub bootargs
+func ValidateKernelCmdline(c config.Config) error {
+	for _, arg := range c.Kernel.Cmdline {
+		if strings.ContainsAny(arg, kernelCmdlineUnsafe) {
+			return fmt.Errorf("invalid kernel cmdline argument %q, it can't have double quotes, $, backslashes or newlines", arg)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package values
+
+import (
+	"fmt"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+)
+
+// RKE2Prefix is where the rke2 tarball is unpacked, with the binaries in /usr/bin and the units in
+// /usr/lib/systemd/system. The installer default of /usr/local is persistent on Kairos, so not part of the image
+const RKE2Prefix = "/usr"
+
+// KubernetesServices are the services of each kubernetes provider, for the server and the agent. They are not enabled
+// on the image, the provider enables the one for the node role on boot
+var KubernetesServices = map[config.KubernetesProvider][]string{
+	config.K3sProvider:  {"k3s", "k3s-agent"},
+	config.K0sProvider:  {"k0scontroller", "k0sworker"},
+	config.RKE2Provider: {"rke2-server", "rke2-agent"},
+}
+
+// LatestKubernetesVersion is the default of the k8sversion flag. It is not passed to the installers, which would take
+// it as a release tag that does not exist
+const LatestKubernetesVersion = "latest"
+
+// KubernetesVersion returns the kubernetes version pinned in the config, empty to let the installer pick the latest
+func KubernetesVersion(c config.Config) string {
+	if c.KubernetesVersion == LatestKubernetesVersion {
+		return ""
+	}
+	return c.KubernetesVersion
+}
+
+// CheckKubernetesProviderSupport returns an error if the kubernetes provider can't be installed on the system, so a
+// standard image fails before running anything instead of shipping without its kubernetes services
+func CheckKubernetesProviderSupport(s System, provider config.KubernetesProvider) error {
+	// rke2 only ships systemd units
+	if provider == config.RKE2Provider && s.Family == AlpineFamily {
+		return fmt.Errorf("kubernetes provider %s is not supported on %s as it requires systemd, possible values are %s and %s", provider, s.Distro, config.K3sProvider, config.K0sProvider)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package values
+
+import "strings"
+
+// LocalePackages are the packages needed to generate and use a locale.
+// The lang param is the language part of the configured locale, so en_US.UTF-8 results in glibc-langpack-en
+var LocalePackages = PackageMap{
+	DebianFamily: {
+		ArchCommon: {
+			Common: {
+				"locales", // Brings locale-gen
+			},
+		},
+	},
+	RedHatFamily: {
+		ArchCommon: {
+			Common: {
+				"glibc-langpack-{{.lang}}",
+			},
+		},
+	},
+	SUSEFamily: {
+		ArchCommon: {
+			Common: {
+				"glibc-locale-base",
+			},
+		},
+	},
+	AlpineFamily: {
+		ArchCommon: {
+			Common: {
+				"musl-locales",
+			},
+		},
+	},
+}
+
+// KeymapPackages are the packages needed to set the console keymap
+var KeymapPackages = PackageMap{
+	DebianFamily: {
+		ArchCommon: {
+			Common: {
+				"keyboard-configuration",
+			},
+		},
+	},
+	RedHatFamily: {
+		ArchCommon: {
+			Common: {
+				"kbd",
+			},
+		},
+	},
+	SUSEFamily: {
+		ArchCommon: {
+			Common: {
+				"kbd",
+			},
+		},
+	},
+	AlpineFamily: {
+		ArchCommon: {
+			Common: {
+				// The binary keymaps that the keymaps service loads
+				"kbd-bkeymaps",
+			},
+		},
+	},
+}
+
+// TimezonePackages are the packages that ship the zoneinfo files
+var TimezonePackages = PackageMap{
+	DebianFamily: {
+		ArchCommon: {
+			Common: {
+				"tzdata",
+			},
+		},
+	},
+	RedHatFamily: {
+		ArchCommon: {
+			Common: {
+				"tzdata",
+			},
+		},
+	},
+	SUSEFamily: {
+		ArchCommon: {
+			Common: {
+				"timezone",
+			},
+		},
+	},
+	AlpineFamily: {
+		ArchCommon: {
+			Common: {
+				"tzdata",
+			},
+		},
+	},
+}
+
+// LocaleLanguage returns the language part of a locale, so en_US.UTF-8 returns en
+func LocaleLanguage(locale string) string {
+	lang, _, _ := strings.Cut(locale, ".")
+	lang, _, _ = strings.Cut(lang, "_")
+	return lang
+}
+
+// LocaleCharset returns the charset part of a locale, defaulting to UTF-8 if its not set
+func LocaleCharset(locale string) string {
+	_, charset, found := strings.Cut(locale, ".")
+	if !found || charset == "" {
+		return "UTF-8"
+	}
+	return charset
+}
@@ -0,0 +1,41 @@
+package values
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+)
+
+// MatrixResult are the packages of a system of a matrix, or why they could not be resolved
+type MatrixResult struct {
+	System   System
+	Packages []string
+	Err      error
+}
+
+// ResolveMatrix returns the packages of each of the systems with the package options of the config, like GetPackages,
+// in the same order as the systems. They are resolved in parallel and share the parsed templates and constraints, so
+// a matrix of dozens of distros, versions and arches costs little more than a single system
+func ResolveMatrix(systems []System, c config.Config, l sdkTypes.KairosLogger) []MatrixResult {
+	results := make([]MatrixResult, len(systems))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(runtime.GOMAXPROCS(0), len(systems)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				pkgs, err := GetPackages(systems[i], c, l)
+				results[i] = MatrixResult{System: systems[i], Packages: pkgs, Err: err}
+			}
+		}()
+	}
+	for i := range systems {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,82 @@
+package values
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+)
+
+// testMatrix returns a system for each version of some distros and both arches, covering the templates and the
+// codename, service pack and pre-release constraints
+func testMatrix() []System {
+	versions := map[Distro][]string{
+		Ubuntu:       {"20.04", "22.04", "24.04", "24.10"},
+		Debian:       {"11", "12", "13"},
+		Fedora:       {"40", "41"},
+		RockyLinux:   {"8", "9"},
+		Alpine:       {"3.19", "3.21", "3.22.0_rc1"},
+		OpenSUSELeap: {"15.5", "15.6"},
+		SLES:         {"15-SP5"},
+	}
+	var systems []System
+	for distro, distroVersions := range versions {
+		for _, version := range distroVersions {
+			for _, arch := range []Architecture{ArchAMD64, ArchARM64} {
+				systems = append(systems, System{Name: distro.String(), Distro: distro, Family: DistroFamilies[distro], Version: version,
+					Arch: arch, Model: Generic, Variant: config.CoreVariant})
+			}
+		}
+	}
+	return systems
+}
+
+// TestResolveMatrixParallel resolves the same matrix from several goroutines at once, which share the caches of the
+// parsed templates and constraints, and checks that they all match resolving each system on its own. Run it with
+// -race to catch unsafe access to the caches
+func TestResolveMatrixParallel(t *testing.T) {
+	systems := testMatrix()
+	c := config.Config{Model: Generic.String(), Variant: config.CoreVariant}
+	l := sdkTypes.NewNullLogger()
+
+	results := make([][]MatrixResult, 8)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = ResolveMatrix(systems, c, l)
+		}()
+	}
+	wg.Wait()
+
+	for i, s := range systems {
+		want, wantErr := GetPackages(s, c, l)
+		for _, result := range results {
+			got := result[i]
+			if got.System != s {
+				t.Fatalf("result %d is for %s %s, expected %s %s", i, got.System.Distro, got.System.Version, s.Distro, s.Version)
+			}
+			if (got.Err == nil) != (wantErr == nil) || !reflect.DeepEqual(got.Packages, want) {
+				t.Errorf("%s %s %s: got %v, %v from the matrix and %v, %v on its own", s.Distro, s.Version, s.Arch,
+					got.Packages, got.Err, want, wantErr)
+			}
+		}
+	}
+}
+
+// BenchmarkResolveMatrix resolves the packages of a matrix of distros, versions and arches at once
+func BenchmarkResolveMatrix(b *testing.B) {
+	systems := testMatrix()
+	c := config.Config{Model: Generic.String(), Variant: config.CoreVariant}
+	l := sdkTypes.NewNullLogger()
+	for range b.N {
+		for _, result := range ResolveMatrix(systems, c, l) {
+			if result.Err != nil {
+				b.Fatal(result.Err)
+			}
+		}
+	}
+}
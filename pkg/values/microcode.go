@@ -0,0 +1,36 @@
+package values
+
+// MicrocodePackages are the cpu microcode packages, only available on amd64
+// AMD microcode on the RedHat family comes with linux-firmware, which the kernel already depends on
+// Debian needs the non-free-firmware component, which is enabled on the before-install stage
+var MicrocodePackages = PackageMap{
+	DebianFamily: {
+		ArchAMD64: {
+			Common: {
+				"intel-microcode",
+				"amd64-microcode",
+			},
+		},
+	},
+	RedHatFamily: {
+		ArchAMD64: {
+			Common: {"microcode_ctl"},
+		},
+	},
+	SUSEFamily: {
+		ArchAMD64: {
+			Common: {
+				"ucode-intel",
+				"ucode-amd",
+			},
+		},
+	},
+	AlpineFamily: {
+		ArchAMD64: {
+			Common: {
+				"intel-ucode",
+				"amd-ucode",
+			},
+		},
+	},
+}
@@ -0,0 +1,25 @@
+package values
+
+import "regexp"
+
+// MirrorRetries is how many times a package manager command that failed on the mirror is retried on it, before
+// moving to the next mirror
+const MirrorRetries = 2
+
+// MirrorErrors match the errors of a mirror that is down or overloaded, on top of RepoUnreachable and RepoMismatch.
+// They are not in the error hints as apt reports both unreachable and mid sync mirrors as "Failed to fetch"
+var MirrorErrors = regexp.MustCompile(`Failed to fetch|50[234] (Bad Gateway|Service Unavailable|Gateway Time-?out)|Status code: 5\d\d`)
+
+// MirrorFailure returns true if the package manager output is from a failure of the mirror, and not of the packages
+func MirrorFailure(out string) bool {
+	return RepoUnreachable.MatchString(out) || RepoMismatch.MatchString(out) || MirrorErrors.MatchString(out)
+}
+
+// RepoRefreshCommands are the commands that refresh the repo metadata of each family, run after switching mirrors
+var RepoRefreshCommands = map[Family]string{
+	DebianFamily: "apt-get update",
+	RedHatFamily: "dnf makecache",
+	SUSEFamily:   "zypper --non-interactive refresh",
+	AlpineFamily: "apk update",
+	ArchFamily:   "pacman -Sy --noconfirm",
+}
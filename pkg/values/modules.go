@@ -0,0 +1,8 @@
+package values
+
+// BlacklistedModules are the kernel modules that are blacklisted by default as they are useless on Kairos systems
+var BlacklistedModules = []string{
+	"floppy",   // No floppy drives around, and it slows down the boot on VMs trying to probe it
+	"pcspkr",   // Beeps
+	"snd_pcsp", // Same as above, via ALSA
+}
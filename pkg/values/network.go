@@ -0,0 +1,157 @@
+package values
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+)
+
+// NetworkStack is the network manager used by the system
+type NetworkStack string
+
+func (n NetworkStack) String() string {
+	return string(n)
+}
+
+const (
+	NetworkdStack       NetworkStack = "networkd"
+	NetworkManagerStack NetworkStack = "networkmanager"
+	ConnmanStack        NetworkStack = "connman"
+)
+
+// NetworkStackConfig is everything needed to set up a network stack on the system
+type NetworkStackConfig struct {
+	Packages       PackageMap        // Packages to install
+	Services       []string          // Services to enable on systemd systems
+	OpenRCServices []string          // Services to add to the boot runlevel on openrc systems
+	Files          map[string]string // Default config files, with a DHCP config for all the wired interfaces
+}
+
+// NetworkStacks are the supported network stacks
+// If none is selected in the config, the defaults for the family are kept as they are
+var NetworkStacks = map[NetworkStack]NetworkStackConfig{
+	NetworkdStack: {
+		Packages: PackageMap{
+			// On the Debian family networkd comes with the systemd package
+			Fedora: {
+				ArchCommon: {
+					Common: {"systemd-networkd"},
+				},
+			},
+			SUSEFamily: {
+				ArchCommon: {
+					Common: {"systemd-network"},
+				},
+			},
+		},
+		Services: []string{"systemd-networkd", "systemd-resolved"},
+		Files: map[string]string{
+			"/etc/systemd/network/20-kairos-dhcp.network": "[Match]\nName=en* eth*\n\n[Network]\nDHCP=yes\n",
+		},
+	},
+	NetworkManagerStack: {
+		Packages: PackageMap{
+			DebianFamily: {
+				ArchCommon: {
+					Common: {"network-manager"},
+				},
+			},
+			RedHatFamily: {
+				ArchCommon: {
+					Common: {"NetworkManager"},
+				},
+			},
+			SUSEFamily: {
+				ArchCommon: {
+					Common: {"NetworkManager"},
+				},
+			},
+			AlpineFamily: {
+				ArchCommon: {
+					Common: {"networkmanager", "networkmanager-openrc"},
+				},
+			},
+		},
+		Services:       []string{"NetworkManager"},
+		OpenRCServices: []string{"networkmanager"},
+		Files: map[string]string{
+			"/etc/NetworkManager/system-connections/kairos-dhcp.nmconnection": "[connection]\nid=kairos-dhcp\ntype=ethernet\nautoconnect=true\nautoconnect-priority=-100\n\n[ipv4]\nmethod=auto\n\n[ipv6]\nmethod=auto\n",
+		},
+	},
+	ConnmanStack: {
+		Packages: PackageMap{
+			DebianFamily: {
+				ArchCommon: {
+					Common: {"connman"},
+				},
+			},
+			RedHatFamily: {
+				ArchCommon: {
+					Common: {"connman"},
+				},
+			},
+			SUSEFamily: {
+				ArchCommon: {
+					Common: {"connman"},
+				},
+			},
+			AlpineFamily: {
+				ArchCommon: {
+					Common: {"connman"},
+				},
+			},
+		},
+		Services:       []string{"connman"},
+		OpenRCServices: []string{"connman"},
+		// connman does DHCP on all the wired interfaces by default
+		Files: map[string]string{
+			"/etc/connman/main.conf": "[General]\nPreferredTechnologies=ethernet,wifi\nSingleConnectedTechnology=false\n",
+		},
+	},
+}
+
+// GetNetworkStack returns the config for the given network stack, checking that its supported on the system
+func GetNetworkStack(s System, stack string) (NetworkStackConfig, error) {
+	stackConfig, ok := NetworkStacks[NetworkStack(stack)]
+	if !ok {
+		return NetworkStackConfig{}, fmt.Errorf("invalid network stack: %s, possible values are %s, %s and %s", stack, NetworkdStack, NetworkManagerStack, ConnmanStack)
+	}
+	if s.Family == AlpineFamily && NetworkStack(stack) == NetworkdStack {
+		return NetworkStackConfig{}, fmt.Errorf("network stack %s is not supported on %s as it requires systemd", stack, s.Distro)
+	}
+	return stackConfig, nil
+}
+
+// UsesResolved returns if the network stack in the config leaves DNS to systemd-resolved. Without a stack the defaults
+// of the Debian and RedHat families do, while NetworkManager and connman write resolv.conf themselves
+func UsesResolved(c config.Config) bool {
+	stack := NetworkStack(c.NetworkStack)
+	if stack == "" {
+		return true
+	}
+	return slices.Contains(NetworkStacks[stack].Services, "systemd-resolved")
+}
+
+// removeOtherNetworkServices removes the services that belong to network stacks other than the selected one
+func removeOtherNetworkServices(services []string, stack NetworkStack) []string {
+	other := map[string]bool{}
+	for name, stackConfig := range NetworkStacks {
+		if name == stack {
+			continue
+		}
+		for _, svc := range stackConfig.Services {
+			other[svc] = true
+		}
+		for _, svc := range stackConfig.OpenRCServices {
+			other[svc] = true
+		}
+	}
+	var filtered []string
+	for _, svc := range services {
+		if !other[svc] {
+			filtered = append(filtered, svc)
+		}
+	}
+	return filtered
+}
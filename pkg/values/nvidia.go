@@ -0,0 +1,162 @@
+package values
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+)
+
+// NvidiaPackages are the packages for the NVIDIA proprietary driver, the container toolkit comes with the
+// nvidia-container feature. They come from the NVIDIA repos, which are added before the install stage
+// The driver is built via dkms on Debian and RedHat families, so the kernel headers are needed.
+// SUSE provides prebuilt kmp packages for the default kernel
+var NvidiaPackages = PackageMap{
+	Ubuntu: {
+		ArchCommon: {
+			">=20.04, <24.10": {
+				"linux-headers-generic-hwe-{{.version}}",
+			},
+			// Same as the kernel, 24.10 uses the headers of the 24.04 hwe kernel
+			">=24.10, <25.04": {"linux-headers-generic-hwe-24.04"},
+			">=25.04": {
+				"linux-headers-generic-hwe-{{.version}}",
+			},
+			Common: {
+				"cuda-drivers",
+			},
+		},
+	},
+	Debian: {
+		ArchAMD64: {
+			Common: {"linux-headers-amd64"},
+		},
+		ArchARM64: {
+			Common: {"linux-headers-arm64"},
+		},
+		ArchCommon: {
+			Common: {
+				"cuda-drivers",
+			},
+		},
+	},
+	RedHatFamily: {
+		ArchCommon: {
+			Common: {
+				"kernel-devel",
+				"kernel-headers",
+				"nvidia-driver",
+				"nvidia-driver-cuda",
+				"kmod-nvidia-open-dkms",
+			},
+		},
+	},
+	SUSEFamily: {
+		ArchCommon: {
+			Common: {
+				"nvidia-open-driver-G06-signed-kmp-default",
+				"nvidia-compute-utils-G06",
+			},
+		},
+	},
+}
+
+// nvidiaCudaArch returns the arch name used on the NVIDIA cuda repos
+func nvidiaCudaArch(arch Architecture) string {
+	if arch == ArchARM64 {
+		return "sbsa"
+	}
+	return "x86_64"
+}
+
+// NvidiaRepoCommands returns the commands to add the NVIDIA driver and container toolkit repos to the system
+func NvidiaRepoCommands(s System) ([]string, error) {
+	cudaArch := nvidiaCudaArch(s.Arch)
+	switch s.Family {
+	case DebianFamily:
+		// cuda repos are named like ubuntu2404 or debian12
+		repo := fmt.Sprintf("https://developer.download.nvidia.com/compute/cuda/repos/%s%s/%s", s.Distro, strings.ReplaceAll(s.Version, ".", ""), cudaArch)
+		commands := []string{
+			// This runs before the base packages are installed, so we need to bring the tools ourselves
+			"apt-get update",
+			"apt-get install -y --no-install-recommends ca-certificates curl gnupg",
+		}
+		if s.Distro == Debian {
+			// The driver depends on packages from contrib
+			commands = append(commands, "sed -i 's/^Components: main.*$/& contrib/' /etc/apt/sources.list.d/debian.sources")
+		}
+		return append(commands, []string{
+			fmt.Sprintf("curl -fsSL -o /tmp/cuda-keyring.deb %s/cuda-keyring_1.1-1_all.deb", repo),
+			"dpkg -i /tmp/cuda-keyring.deb",
+			"rm -f /tmp/cuda-keyring.deb",
+			"curl -fsSL https://nvidia.github.io/libnvidia-container/gpgkey | gpg --dearmor -o /usr/share/keyrings/nvidia-container-toolkit-keyring.gpg",
+			"curl -fsSL https://nvidia.github.io/libnvidia-container/stable/deb/nvidia-container-toolkit.list | sed 's#deb https://#deb [signed-by=/usr/share/keyrings/nvidia-container-toolkit-keyring.gpg] https://#g' > /etc/apt/sources.list.d/nvidia-container-toolkit.list",
+		}...), nil
+	case RedHatFamily:
+		// cuda repos are named like rhel9 or fedora40, rocky and alma use the rhel ones
+		major, _, _ := strings.Cut(s.Version, ".")
+		name := fmt.Sprintf("rhel%s", major)
+		if s.Distro == Fedora {
+			name = fmt.Sprintf("fedora%s", major)
+		}
+		return []string{
+			fmt.Sprintf("curl -fsSL -o /etc/yum.repos.d/cuda-%[1]s.repo https://developer.download.nvidia.com/compute/cuda/repos/%[1]s/%[2]s/cuda-%[1]s.repo", name, cudaArch),
+			"curl -fsSL -o /etc/yum.repos.d/nvidia-container-toolkit.repo https://nvidia.github.io/libnvidia-container/stable/rpm/nvidia-container-toolkit.repo",
+		}, nil
+	case SUSEFamily:
+		repo := "https://download.nvidia.com/opensuse/tumbleweed"
+		if s.Distro != OpenSUSETumbleweed {
+			repo = fmt.Sprintf("https://download.nvidia.com/opensuse/leap/%s", s.Version)
+		}
+		return []string{
+			fmt.Sprintf("zypper --non-interactive addrepo --refresh %s nvidia", repo),
+			"zypper --non-interactive addrepo --refresh https://nvidia.github.io/libnvidia-container/stable/rpm/nvidia-container-toolkit.repo",
+			"zypper --non-interactive --gpg-auto-import-keys refresh",
+		}, nil
+	default:
+		return nil, fmt.Errorf("the NVIDIA driver is not supported on %s", s.Distro)
+	}
+}
+
+const (
+	// NvidiaRuntime is the runtime handler name the toolkit registers
+	NvidiaRuntime = "nvidia"
+	// NvidiaK3sConfig is a k3s config drop-in, merged with the config.yaml that the provider writes on boot. k3s adds the
+	// nvidia runtime to its containerd on its own when it finds the toolkit, but keeps runc as the default
+	NvidiaK3sConfig = "/etc/rancher/k3s/config.yaml.d/90-kairos-nvidia.yaml"
+	// NvidiaRKE2Config is the same for rke2, which finds the toolkit like k3s
+	NvidiaRKE2Config = "/etc/rancher/rke2/config.yaml.d/90-kairos-nvidia.yaml"
+	// NvidiaK0sConfig is a drop-in for the containerd embedded in k0s, which merges the CRI plugin config of the files
+	// in /etc/k0s/containerd.d
+	NvidiaK0sConfig = "/etc/k0s/containerd.d/nvidia.toml"
+)
+
+// NvidiaRuntimeCommands returns the commands that set the nvidia runtime as the default of the container runtime in the
+// config, on top of the config it already has. Empty if no container runtime is selected
+func NvidiaRuntimeCommands(c config.Config) []string {
+	switch ContainerRuntime(c.ContainerRuntime) {
+	case ContainerdRuntime, DockerRuntime, CrioRuntime:
+		return []string{fmt.Sprintf("nvidia-ctk runtime configure --runtime=%s --set-as-default", c.ContainerRuntime)}
+	}
+	return nil
+}
+
+// NvidiaRuntimeFiles returns the files that set the nvidia runtime as the default of the kubernetes provider on
+// standard images, so GPU workloads run without a RuntimeClass. Empty on core images
+func NvidiaRuntimeFiles(c config.Config) map[string]string {
+	if c.Variant != config.StandardVariant {
+		return nil
+	}
+	switch c.KubernetesProvider {
+	case config.K3sProvider:
+		return map[string]string{NvidiaK3sConfig: fmt.Sprintf("default-runtime: %s\n", NvidiaRuntime)}
+	case config.RKE2Provider:
+		return map[string]string{NvidiaRKE2Config: fmt.Sprintf("default-runtime: %s\n", NvidiaRuntime)}
+	case config.K0sProvider:
+		return map[string]string{NvidiaK0sConfig: fmt.Sprintf("version = 2\n\n"+
+			"[plugins.\"io.containerd.grpc.v1.cri\".containerd]\n  default_runtime_name = \"%[1]s\"\n\n"+
+			"[plugins.\"io.containerd.grpc.v1.cri\".containerd.runtimes.%[1]s]\n  runtime_type = \"io.containerd.runc.v2\"\n\n"+
+			"[plugins.\"io.containerd.grpc.v1.cri\".containerd.runtimes.%[1]s.options]\n  BinaryName = \"/usr/bin/nvidia-container-runtime\"\n", NvidiaRuntime)}
+	}
+	return nil
+}
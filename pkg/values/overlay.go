@@ -0,0 +1,124 @@
+package values
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// OverlayMaps are the embedded package maps that overlays can change, by the name used on the overlay files
+var OverlayMaps = map[string]PackageMap{
+	"base":                BasePackages,
+	"kernel":              KernelPackages,
+	"kernel_trusted_boot": KernelPackagesTrustedBoot,
+	"grub":                GrubPackages,
+	"systemd":             SystemdPackages,
+	"immucore":            ImmucorePackages,
+	"live":                LivePackages,
+	"extended":            ExtendedPackages,
+	"remove":              RemovePackages,
+	"kernel_models":       KernelPackagesModels,
+}
+
+// PackageOverlay is a file with extra entries for the embedded package maps, in yaml or json
+type PackageOverlay struct {
+	Packages []OverlayEntry `yaml:"packages" json:"packages"`
+}
+
+// OverlayEntry is a list of packages for a map, distro or family, arch and version constraint
+type OverlayEntry struct {
+	// Map is the name of the package map, see OverlayMaps
+	Map string `yaml:"map" json:"map"`
+	// Distro or Family select the key of the map, only one of them can be set
+	Distro string `yaml:"distro,omitempty" json:"distro,omitempty"`
+	Family string `yaml:"family,omitempty" json:"family,omitempty"`
+	// Arch defaults to common to both arches
+	Arch string `yaml:"arch,omitempty" json:"arch,omitempty"`
+	// Version is the constraint on the distro version, defaults to common to all versions
+	Version  string   `yaml:"version,omitempty" json:"version,omitempty"`
+	Packages []string `yaml:"packages" json:"packages"`
+	// Replace replaces the embedded packages for the same map, distro or family, arch and version instead of adding to them
+	Replace bool `yaml:"replace,omitempty" json:"replace,omitempty"`
+}
+
+// key returns the distro or family key of the entry in the package map
+func (e OverlayEntry) key() (DistroFamilyInterface, error) {
+	switch {
+	case e.Distro != "" && e.Family != "":
+		return nil, fmt.Errorf("only one of distro or family can be set")
+	case e.Distro != "":
+		return Distro(e.Distro), nil
+	case e.Family != "":
+		return Family(e.Family), nil
+	}
+	return nil, fmt.Errorf("one of distro or family is required")
+}
+
+// LoadPackageOverlay applies the entries of the overlay file on top of the embedded package maps
+// Overlays are applied in the order they are loaded, so a later overlay adds to or replaces what the previous ones set
+func LoadPackageOverlay(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var overlay PackageOverlay
+	// json is valid yaml, so this covers both
+	if err = yaml.Unmarshal(data, &overlay); err != nil {
+		return fmt.Errorf("could not parse the package overlay %s: %w", path, err)
+	}
+
+	for i, entry := range overlay.Packages {
+		packageMap, ok := OverlayMaps[entry.Map]
+		if !ok {
+			return fmt.Errorf("package overlay %s entry %d: unknown map %q", path, i, entry.Map)
+		}
+		key, err := entry.key()
+		if err != nil {
+			return fmt.Errorf("package overlay %s entry %d: %w", path, i, err)
+		}
+		arch := ArchCommon
+		if entry.Arch != "" {
+			arch = Architecture(entry.Arch)
+		}
+		if arch != ArchCommon && arch != ArchAMD64 && arch != ArchARM64 {
+			return fmt.Errorf("package overlay %s entry %d: unknown arch %q", path, i, entry.Arch)
+		}
+		version := entry.Version
+		if version == "" {
+			version = Common
+		}
+		family := Family(entry.Family)
+		if entry.Distro != "" {
+			family = DistroFamilies[Distro(entry.Distro)]
+		}
+		// Check the entry like the embedded maps, so a malformed constraint or template fails on load and not halfway
+		// through the build, or worse never matches
+		var distros []Distro
+		for distro, distroFamily := range DistroFamilies {
+			if distro == Distro(entry.Distro) || (entry.Distro == "" && distroFamily == family) {
+				distros = append(distros, distro)
+			}
+		}
+		if len(distros) == 0 {
+			return fmt.Errorf("package overlay %s entry %d: unknown distro or family %v", path, i, key)
+		}
+		if errs := validateVersionMap(fmt.Sprintf("package overlay %s entry %d", path, i), distros, arch, VersionMap{version: entry.Packages}); len(errs) > 0 {
+			return errors.Join(errs...)
+		}
+
+		if packageMap[key] == nil {
+			packageMap[key] = map[Architecture]VersionMap{}
+		}
+		if packageMap[key][arch] == nil {
+			packageMap[key][arch] = VersionMap{}
+		}
+		if entry.Replace {
+			packageMap[key][arch][version] = entry.Packages
+		} else {
+			packageMap[key][arch][version] = append(packageMap[key][arch][version], entry.Packages...)
+		}
+	}
+	return nil
+}
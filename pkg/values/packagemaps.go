@@ -2,12 +2,13 @@ package values
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/kairos-io/kairos-init/pkg/config"
+	"sort"
+	"strings"
 
-	semver "github.com/hashicorp/go-version"
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
 )
-import "text/template"
 
 // packagemaps is a map of packages to install for each distro.
 // so we can deal with stupid different names between distros.
@@ -16,30 +17,30 @@ import "text/template"
 // So we can store the packages for each distro and architecture independently
 // Except common packages, which are named the same across all distros
 // Packages can be templated, so we can pass a map of parameters to replace in the package name
-// So we can transform "linux-image-generic-hwe-{{.VERSION}}" into the proper version for each ubuntu release
-// the params are not hardcoded or autogenerated anywhere yet.
-// Ideally the System struct should have a method to generate the params for the packages automatically
-// based on the distro and version, so we can pass them to the installer without anything from our side.
+// So we can transform "linux-image-generic-hwe-{{.version}}" into the proper version for each ubuntu release
+// The params are generated from the system with System.TemplateParams, and the sprig functions are available to
+// transform them, like {{.version | trimSuffix ".10"}} or {{if semverCompare ">=24.04" .version}}pkg{{end}}
+// Packages that render to an empty string are skipped
 // Either we set also a Common key for the common packages, or we just duplicate them for both arches if needed
 //
 
-// CommonPackages are packages that are named the same across all distros and arches
+// CommonPackages are packages that are named the same across all distros and arches, see PackageReasons for why
 var CommonPackages = []string{
-	"file",       // Basic tool.
-	"gawk",       // Basic tool.
-	"iptables",   // Basic tool.
-	"less",       // Basic tool.
-	"nano",       // Basic tool.
-	"sudo",       // Basic tool. Needed for the user to be able to run commands as root
-	"tar",        // Basic tool.
-	"zstd",       // Compression support for zstd
-	"rsync",      // Install, upgrade, reset use it to sync the files
-	"lvm2",       // Seems to be used to support rpi3 only
-	"jq",         // No idea why we need it, check if we can drop it?
-	"dosfstools", // For the fat32 partition on EFI systems
-	"e2fsprogs",  // mkfs support for ext2/3/4
-	"parted",     // Partitioning support, check if we need it anymore
-	"logrotate",  // Log rotation support
+	"file",
+	"gawk",
+	"iptables",
+	"less",
+	"nano",
+	"sudo",
+	"tar",
+	"zstd",
+	"rsync",
+	"lvm2",
+	"jq",
+	"dosfstools",
+	"e2fsprogs",
+	"parted",
+	"logrotate",
 }
 
 // DistroFamilyInterface is an interface to get the value of a distro or family
@@ -49,12 +50,29 @@ type DistroFamilyInterface interface{}
 // PackageMap is a map of packages to install for each distro and architecture plus a VersionMap to filter on
 type PackageMap map[DistroFamilyInterface]map[Architecture]VersionMap
 
-// ModelPackageMap is a map of packages to install for each distro, architecture and model plus a VersionMap to filter on
-type ModelPackageMap map[DistroFamilyInterface]map[Architecture]map[Model]VersionMap
-
 // VersionMap is a map of a constraint to a list of packages
+// Constraints are semver constraints on the distro version, with codenames allowed in place of versions (">=bookworm")
+// and bare codenames matching any of them ("jammy,noble"), see Codenames
+// Packages prefixed with ! are exclusions, they remove the package if another matching entry adds it, so a distro can
+// drop a package that its family adds. Distro entries take precedence over family ones and arch specific over common
+// ones, so an exclusion can't remove a package added by a more specific entry. Variants of the same package that
+// can't be installed together are listed on PackageConflicts, and only the most specific one is kept
+// Constraints can also select the models and arches they apply to with "model=rpi4" or "arch=arm64" parts, see
+// ModelConstraintPrefix and ArchConstraintPrefix
 type VersionMap map[string][]string
 
+// ModelConstraintPrefix marks a part of a VersionMap constraint as a model, so "model=rpi3, model=rpi4, >=22.04" only
+// applies to those boards on 22.04 and newer. Several model parts match any of them, and constraints without model
+// parts apply to all models
+const ModelConstraintPrefix = "model="
+
+// ArchConstraintPrefix marks a part of a VersionMap constraint as an arch, so a package only needed on arm64 for the
+// newer releases can be listed as "arch=arm64, >=24.04" on the ArchCommon map, next to the packages for both arches
+const ArchConstraintPrefix = "arch="
+
+// rpiModels is the constraint for the Raspberry Pi boards
+const rpiModels = "model=rpi3, model=rpi4"
+
 // ImmucorePackages are the minimum set of packages that immucore needs.
 // Otherwise you wont be able to build the initrd with immucore on it.
 // This packages are removed afterwards, so we can keep the image as small as possible
@@ -62,14 +80,37 @@ var ImmucorePackages = PackageMap{
 	DebianFamily: {
 		ArchCommon: {
 			Common: {
-				"dracut",            // To build the initrd
-				"dracut-network",    // Network-legacy support for dracut
-				"isc-dhcp-common",   // Network-legacy support for dracut, basic tools
-				"isc-dhcp-client",   // Network-legacy support for dracut, basic tools
-				"cloud-guest-utils", // This brings growpart, so we can resize the partitions
+				"dracut",
+				"dracut-network",
+				"isc-dhcp-common",
+				"isc-dhcp-client",
+				"cloud-guest-utils",
+			},
+		},
+	},
+	RedHatFamily: {
+		ArchCommon: {
+			Common: {
+				"dracut",
+				"dracut-network",
+				"dhcp-client",
+			},
+		},
+	},
+	SUSEFamily: {
+		ArchCommon: {
+			Common: {
+				"dracut",
+				"dhcp-client",
 			},
 		},
 	},
+}
+
+// LivePackages are the packages that the initrd needs to boot the live and installer media, from a squashfs or over
+// the network. Like ImmucorePackages they are removed once the initrd is built, and images that are only installed to
+// disk can skip them with the no_live option for a smaller initrd
+var LivePackages = PackageMap{
 	Ubuntu: {
 		ArchCommon: {
 			">=22.04": {
@@ -87,21 +128,16 @@ var ImmucorePackages = PackageMap{
 	RedHatFamily: {
 		ArchCommon: {
 			Common: {
-				"dracut",
 				"dracut-live",
-				"dracut-network",
 				"dracut-squash",
 				"squashfs-tools",
-				"dhcp-client",
 			},
 		},
 	},
 	SUSEFamily: {
 		ArchCommon: {
 			Common: {
-				"dracut",
 				"squashfs",
-				"dhcp-client",
 			},
 		},
 	},
@@ -112,25 +148,27 @@ var ImmucorePackages = PackageMap{
 var KernelPackages = PackageMap{
 	Ubuntu: {
 		ArchCommon: {
-			">=20.04, != 24.10": {
+			">=20.04, <24.10": {
+				// This is a template, so we can replace the version with the actual version of the system
+				"linux-image-generic-hwe-{{.version}}",
+			},
+			// Somehow 24.10 uses the 24.04 hwe kernel
+			">=24.10, <25.04": {"linux-image-generic-hwe-24.04"},
+			">=25.04": {
 				// This is a template, so we can replace the version with the actual version of the system
 				"linux-image-generic-hwe-{{.version}}",
 			},
-			// Somehow 24.10 uses the 22.04 hwe kernel
-			"24.10": {"linux-image-generic-hwe-24.04"},
 		},
 	},
 	Debian: {
 		ArchAMD64: {
 			Common: {
 				"linux-image-amd64",
-				"firmware-linux-free",
 			},
 		},
 		ArchARM64: {
 			Common: {
 				"linux-image-arm64",
-				"firmware-linux-free",
 			},
 		},
 	},
@@ -168,13 +206,11 @@ var KernelPackagesTrustedBoot = PackageMap{
 		ArchAMD64: {
 			Common: {
 				"linux-image-amd64",
-				"firmware-linux-free",
 			},
 		},
 		ArchARM64: {
 			Common: {
 				"linux-image-arm64",
-				"firmware-linux-free",
 			},
 		},
 	},
@@ -203,14 +239,148 @@ var KernelPackagesTrustedBoot = PackageMap{
 	},
 }
 
+// KernelPackagesGA are the GA kernel packages for Ubuntu, selected with the ga kernel flavor
+// HWE kernels sometimes regress on specific hardware, while the GA one stays on the release kernel version
+var KernelPackagesGA = PackageMap{
+	Ubuntu: {
+		ArchCommon: {
+			Common: {"linux-image-generic"},
+		},
+	},
+}
+
+// KernelPackagesCloud are the cloud tuned kernel packages for Ubuntu, selected with the aws, azure, gcp or oracle kernel flavors
+// The flavor is passed as the kernelFlavor template param. The modules-extra package brings the drivers that the cloud
+// kernels split out, which are needed when the image is also booted outside of that cloud
+var KernelPackagesCloud = PackageMap{
+	Ubuntu: {
+		ArchCommon: {
+			Common: {
+				"linux-image-{{.kernelFlavor}}",
+				"linux-modules-extra-{{.kernelFlavor}}",
+			},
+		},
+	},
+}
+
+// KernelPackagesRealtime are the PREEMPT_RT kernel packages, selected with the realtime kernel flavor
+// Ubuntu only ships it with a PRO account and Fedora does not ship it at all, so they are not supported
+// RedHat derivatives ship it on a separate repo that is enabled before install
+var KernelPackagesRealtime = PackageMap{
+	Debian: {
+		ArchAMD64: {
+			Common: {
+				"linux-image-rt-amd64",
+			},
+		},
+		ArchARM64: {
+			Common: {
+				"linux-image-rt-arm64",
+			},
+		},
+	},
+	RockyLinux: {
+		ArchCommon: {
+			Common: {
+				"kernel-rt",
+				"kernel-rt-modules",
+				"kernel-rt-modules-extra",
+			},
+		},
+	},
+	AlmaLinux: {
+		ArchCommon: {
+			Common: {
+				"kernel-rt",
+				"kernel-rt-modules",
+				"kernel-rt-modules-extra",
+			},
+		},
+	},
+	RedHat: {
+		ArchCommon: {
+			Common: {
+				"kernel-rt",
+				"kernel-rt-modules",
+				"kernel-rt-modules-extra",
+			},
+		},
+	},
+	SUSEFamily: {
+		ArchCommon: {
+			Common: {
+				"kernel-rt",
+			},
+		},
+	},
+	AlpineFamily: {
+		ArchCommon: {
+			Common: {
+				"linux-rt",
+			},
+		},
+	},
+}
+
+// KernelPackagesPinned are the kernel packages for a pinned kernel version, selected with the kernel version option
+// The version is passed as the kernelVersion template param and its format is the distro one, so for example
+// 6.8.0-45 on Ubuntu, 6.1.0-25 on Debian, 5.14.0-427.13.1.el9_4 on RedHat or 6.4.0-150600.23.22.1 on SUSE
+var KernelPackagesPinned = PackageMap{
+	Ubuntu: {
+		ArchCommon: {
+			Common: {
+				"linux-image-{{.kernelVersion}}-generic",
+				"linux-modules-{{.kernelVersion}}-generic",
+				"linux-modules-extra-{{.kernelVersion}}-generic",
+			},
+		},
+	},
+	Debian: {
+		ArchAMD64: {
+			Common: {
+				"linux-image-{{.kernelVersion}}-amd64",
+			},
+		},
+		ArchARM64: {
+			Common: {
+				"linux-image-{{.kernelVersion}}-arm64",
+			},
+		},
+	},
+	RedHatFamily: {
+		ArchCommon: {
+			Common: {
+				"kernel-{{.kernelVersion}}",
+				"kernel-modules-{{.kernelVersion}}",
+				"kernel-modules-extra-{{.kernelVersion}}",
+			},
+		},
+	},
+	AlpineFamily: {
+		ArchCommon: {
+			Common: {
+				// apk keeps the pinned version in the world file, so this also holds it
+				"linux-lts={{.kernelVersion}}",
+			},
+		},
+	},
+	SUSEFamily: {
+		ArchCommon: {
+			Common: {
+				"kernel-default={{.kernelVersion}}",
+			},
+		},
+	},
+}
+
 // BasePackages is a map of packages to install for each distro and architecture.
 // This comprises the base packages that are needed for the system to work on a Kairos system
 var BasePackages = PackageMap{
 	DebianFamily: {
 		ArchCommon: {
 			Common: {
-				"ca-certificates", // Basic certificates for secure communication
-				"curl",            // Basic tool. Also needed for netbooting as it is used to download the netboot artifacts. On rockylinux conflicts with curl-minimal
+				"ca-certificates",
+				"curl",
 				"binutils",
 				"conntrack",
 				"console-setup",
@@ -251,9 +421,9 @@ var BasePackages = PackageMap{
 				"publicsuffix",
 				"python3-pynvim",
 				"shared-mime-info",
-				"systemd", // Basic tool.
+				"systemd",
 				"systemd-timesyncd",
-				"systemd-sysv", // provides reboot and shutdown commands. like what? they are just symlinks to systemctl lol
+				"systemd-sysv",
 				"xauth",
 				"xclip",
 				"xdg-user-dirs",
@@ -266,7 +436,7 @@ var BasePackages = PackageMap{
 	SUSEFamily: {
 		ArchCommon: {
 			Common: {
-				"curl", // Basic tool. Also needed for netbooting as it is used to download the netboot artifacts. On rockylinux conflicts with curl-minimal
+				"curl",
 				"bash-completion",
 				"conntrack-tools",
 				"cryptsetup",
@@ -308,7 +478,7 @@ var BasePackages = PackageMap{
 	AlpineFamily: {
 		ArchCommon: {
 			Common: {
-				"curl", // Basic tool. Also needed for netbooting as it is used to download the netboot artifacts. On rockylinux conflicts with curl-minimal
+				"curl",
 				"bash",
 				"bash-completion",
 				"blkid",
@@ -386,19 +556,19 @@ var BasePackages = PackageMap{
 	RedHatFamily: {
 		ArchCommon: {
 			Common: {
-				"gdisk",                // Yip requires it for partitioning, maybe BasePackages
-				"audit",                // For audit support, check if needed?
-				"cracklib-dicts",       // Password dictionary support
-				"cloud-utils-growpart", // grow partition use. Check if yip still needs it?
-				"device-mapper",        // Device mapper support, needed for lvm and cryptsetup
+				"gdisk",
+				"audit",
+				"cracklib-dicts",
+				"cloud-utils-growpart",
+				"device-mapper",
 				"openssh-server",
 				"openssh-clients",
 				"polkit",
 				"qemu-guest-agent",
-				"systemd", // Basic tool.
+				"systemd",
 				"systemd-resolved",
-				"which",      // Basic tool. Basepackages?
-				"cryptsetup", // For encrypted partitions support, needed for trusted boot and dracut building
+				"which",
+				"cryptsetup",
 			},
 		},
 	},
@@ -418,20 +588,20 @@ var BasePackages = PackageMap{
 		ArchCommon: {
 			Common: {
 				// TODO: Check if we need all of these packages, some of them are probably not needed or can go into the family?
-				"fdisk", // Yip requires it for partitioning
+				"fdisk",
 				"conntrack",
-				"console-data",      // Console font support
-				"cloud-guest-utils", // Yip requires it, this brings growpart, so we can resize the partitions
+				"console-data",
+				"cloud-guest-utils",
 				"gettext",
-				"systemd-container",      // Not sure if needed?
-				"ubuntu-advantage-tools", // For ubuntu advantage support, enablement of ubuntu services
-				"tpm2-tools",             // For TPM support, mainly trusted boot
-				"dmsetup",                // Device mapper support, needed for lvm and cryptsetup
+				"systemd-container",
+				"ubuntu-advantage-tools",
+				"tpm2-tools",
+				"dmsetup",
 				"networkd-dispatcher",
 				"packagekit-tools",
 				"publicsuffix",
 				"xdg-user-dirs",
-				"zfsutils-linux", // For zfs tools (zfs and zpool)
+				"zfsutils-linux",
 			},
 			">=24.04": {
 				"systemd-resolved", // For systemd-resolved support, added as a separate package on 24.04
@@ -441,30 +611,20 @@ var BasePackages = PackageMap{
 	Fedora: {
 		ArchCommon: {
 			Common: {
-				"haveged",          // Random number generator, check if needed?
-				"systemd-networkd", // Not available in other distros, too old version maybe?
+				"haveged",
+				"systemd-networkd",
 			},
 		},
 	},
 }
 
-// GrubPackages is a map of packages to install for each distro and architecture.
-// TODO: Check why some packages we only install on amd64 and not on arm64?? Like neovim???
-// Note: some of the packages seems to be only installed here as we dont have any size restraints
-// And we dont want to have Trusted Boot have those packages, as we want it small.
-// we should probably move those into a new PackageMap called ExtendedPackages or something like that
-// instead of merging them with grub packages.
+// GrubPackages are the grub and shim packages to install for each distro and architecture, only on non trusted boot
+// images. Only bootloader packages go here, the extra tools that used to be merged here are on ExtendedPackages
 var GrubPackages = PackageMap{
 	DebianFamily: {
 		ArchCommon: {
 			Common: {
-				"kbd",            // Keyboard configuration
-				"lldpd",          // For lldp support, check if needed?
-				"shim-signed",    // For secure boot support
-				"snmpd",          // For snmp support, check if needed? Move to BasePackages if so?
-				"squashfs-tools", // For squashfs support, probably needs to be part of BasePackages
-				//"zfsutils-linux",        // For zfs tools (zfs and zpool), probably needs to be part of BasePackages
-				// Requires a repo add for Debian
+				"shim-signed", // For secure boot support
 			},
 		},
 		ArchAMD64: {
@@ -522,40 +682,18 @@ var GrubPackages = PackageMap{
 	SUSEFamily: {
 		ArchCommon: {
 			Common: {
-				"nethogs",
-				"patch",
 				"shim",
-				"iw",
 			},
 		},
 		ArchAMD64: {
 			Common: {
 				"grub2-i386-pc",
 				"grub2-x86_64-efi",
-				"kernel-firmware-all",
 			},
 		},
 		ArchARM64: {
 			Common: {
-				"bcm43xx-firmware",
 				"grub2-arm64-efi",
-				"kernel-firmware-ath10k",
-				"kernel-firmware-ath11k",
-				"kernel-firmware-atheros",
-				"kernel-firmware-bluetooth",
-				"kernel-firmware-brcm",
-				"kernel-firmware-iwlwifi",
-				"kernel-firmware-network",
-				"kernel-firmware-realtek",
-				"kernel-firmware-serial",
-				"kernel-firmware-usb-network",
-			},
-		},
-	},
-	Ubuntu: {
-		ArchCommon: {
-			Common: {
-				"zfsutils-linux", // For zfs tools (zfs and zpool) We put it here because this package is useless for the Trusted Boot variant and we want to keep that part as ligth as possible
 			},
 		},
 	},
@@ -584,105 +722,60 @@ var SystemdPackages = PackageMap{
 }
 
 // KernelPackagesModels is a map of packages to install for each distro and architecture for models that are not generic
-// Usually its just kernels and firmware packages that are model specific
+// Usually its just kernels and firmware packages that are model specific, the constraints select the models
 // TODO(debian): Needs to run `sed -i 's/^Components: main.*$/& non-free-firmware/' /etc/apt/sources.list.d/debian.sources` before installing the firmware for RPI devices
-var KernelPackagesModels = ModelPackageMap{
+var KernelPackagesModels = PackageMap{
 	Debian: {
 		ArchARM64: {
-			Rpi4: {
-				Common: {
-					"linux-image-arm64",
-					"firmware-linux-free",
-					"raspi-firmware",
-				},
-			},
-			Rpi3: {
-				Common: {
-					"linux-image-arm64",
-					"firmware-linux-free",
-					"raspi-firmware",
-				},
+			rpiModels: {
+				"linux-image-arm64",
+				"firmware-linux-free",
+				"raspi-firmware",
 			},
 		},
 	},
 	Arch: {
 		ArchARM64: {
-			Rpi3: {
-				Common: {"linux-rpi"},
-			},
-			Rpi4: {
-				Common: {"linux-rpi"},
-			},
+			rpiModels: {"linux-rpi"},
 		},
 	},
 	Ubuntu: {
 		ArchARM64: {
-			Rpi3: {
-				Common: {
-					"linux-raspi",
-				},
-				"20.04": {"linux-firmware-raspi2"},
-				"22.04": {"linux-firmware-raspi", "linux-modules-extra-raspi"},
-				">=20.04, != 24.10": {
-					// This is a template, so we can replace the version with the actual version of the system
-					"linux-image-generic-hwe-{{.version}}",
-				},
-				// Somehow 24.10 uses the 22.04 hwe kernel
-				"24.10": {"linux-image-generic-hwe-24.04"},
-			},
-			Rpi4: {
-				Common: {
-					"linux-raspi",
-				},
-				"20.04": {"linux-firmware-raspi2"},
-				"22.04": {"linux-firmware-raspi", "linux-modules-extra-raspi"},
-				">=20.04, != 24.10": {
-					// This is a template, so we can replace the version with the actual version of the system
-					"linux-image-generic-hwe-{{.version}}",
-				},
-				// Somehow 24.10 uses the 22.04 hwe kernel
-				"24.10": {"linux-image-generic-hwe-24.04"},
+			rpiModels: {
+				"linux-raspi",
+			},
+			rpiModels + ", 20.04": {"linux-firmware-raspi2"},
+			rpiModels + ", 22.04": {"linux-firmware-raspi", "linux-modules-extra-raspi"},
+			rpiModels + ", >=20.04, <24.10": {
+				// This is a template, so we can replace the version with the actual version of the system
+				"linux-image-generic-hwe-{{.version}}",
+			},
+			// Somehow 24.10 uses the 24.04 hwe kernel
+			rpiModels + ", >=24.10, <25.04": {"linux-image-generic-hwe-24.04"},
+			rpiModels + ", >=25.04": {
+				// This is a template, so we can replace the version with the actual version of the system
+				"linux-image-generic-hwe-{{.version}}",
 			},
 		},
 	},
 	SUSEFamily: {
 		ArchARM64: {
-			Rpi3: {
-				Common: {
-					"kernel-default",
-					"raspberrypi-eeprom",
-					"raspberrypi-firmware",
-					"raspberrypi-firmware-dt",
-					"sysconfig",
-					"sysconfig-netconfig",
-					"sysvinit-tools",
-					"wireless-tools",
-					"wpa_supplicant",
-				},
-			},
-			Rpi4: {
-				Common: {
-					"kernel-default",
-					"raspberrypi-eeprom",
-					"raspberrypi-firmware",
-					"raspberrypi-firmware-dt",
-					"sysconfig",
-					"sysconfig-netconfig",
-					"sysvinit-tools",
-					"wireless-tools",
-					"wpa_supplicant",
-				},
+			rpiModels: {
+				"kernel-default",
+				"raspberrypi-eeprom",
+				"raspberrypi-firmware",
+				"raspberrypi-firmware-dt",
+				"sysconfig",
+				"sysconfig-netconfig",
+				"sysvinit-tools",
+				"wireless-tools",
+				"wpa_supplicant",
 			},
 		},
 	},
 	AlpineFamily: {
 		ArchARM64: {
-			Rpi3: {
-				Common: {"linux-rpi"},
-			},
-			Rpi4: {
-				Common: {"linux-rpi"},
-			},
+			rpiModels: {"linux-rpi"},
 		},
 	},
 }
@@ -692,111 +785,409 @@ var KernelPackagesModels = ModelPackageMap{
 func PackageListToTemplate(packages []string, params map[string]string, l sdkTypes.KairosLogger) ([]string, error) {
 	var finalPackages []string
 	for _, pkg := range packages {
-		var result bytes.Buffer
-		tmpl, err := template.New("versionTemplate").Parse(pkg)
-		if err != nil {
-			l.Logger.Error().Err(err).Str("package", pkg).Msg("Error parsing template.")
-			return []string{}, err
+		rendered := strings.TrimSpace(pkg)
+		if isTemplate(pkg) {
+			var result bytes.Buffer
+			tmpl, err := packageTemplate(pkg)
+			if err != nil {
+				l.Logger.Error().Err(err).Str("package", pkg).Msg("Error parsing template.")
+				return []string{}, err
+			}
+			err = tmpl.Execute(&result, params)
+			if err != nil {
+				l.Logger.Error().Err(err).Str("package", pkg).Msg("Error executing template.")
+				return []string{}, err
+			}
+			rendered = strings.TrimSpace(result.String())
 		}
-		err = tmpl.Execute(&result, params)
-		if err != nil {
+		// Rendering to nothing is how a template skips a package, like {{if ...}}pkg{{end}}
+		if rendered == "" {
+			continue
+		}
+		if strings.ContainsAny(rendered, " \t\n\r") {
+			err := fmt.Errorf("package template %q renders to %q, it has to render to a single package or to nothing", pkg, rendered)
 			l.Logger.Error().Err(err).Str("package", pkg).Msg("Error executing template.")
 			return []string{}, err
 		}
-		finalPackages = append(finalPackages, result.String())
+		finalPackages = append(finalPackages, rendered)
 	}
-	return finalPackages, nil
+	// Different templates can render to the same package
+	return uniquePackages(finalPackages), nil
 }
 
-func GetPackages(s System, l sdkTypes.KairosLogger) ([]string, error) {
-	mergedPkgs := CommonPackages
+// GetPackages returns the packages to install on the system with the package options of the given config, sorted and
+// without duplicates. It only depends on its arguments, so packages can be resolved for several configs at once
+func GetPackages(s System, c config.Config, l sdkTypes.KairosLogger) ([]string, error) {
+	provenance, err := GetPackageProvenance(s, c, l)
+	if err != nil {
+		return nil, err
+	}
+	pkgs := make([]string, 0, len(provenance))
+	for _, pkg := range provenance {
+		pkgs = append(pkgs, pkg.Name)
+	}
+	return pkgs, nil
+}
 
+// GetPackageProvenance returns the packages to install on the system like GetPackages, with the map, key and
+// constraint that selected each of them
+func GetPackageProvenance(s System, c config.Config, l sdkTypes.KairosLogger) ([]PackageProvenance, error) {
+	// Check the version before going over the maps, so an unparseable one fails the build naming it even when only
+	// common entries would be checked. Systems without a version, like Arch, only fail if a constraint needs it
+	if SystemVersion(s) != "" {
+		if _, err := ParseSystemVersion(s); err != nil {
+			return nil, fmt.Errorf("cannot select the packages, refusing to build an image without its kernel and base "+
+				"packages: %w", err)
+		}
+	}
+	if err := ValidateProfile(c); err != nil {
+		return nil, err
+	}
+	recovery := c.Profile == config.RecoveryProfile
 	// Go over all packages maps
-	filteredPackages := []VersionMap{
-		BasePackages[s.Distro][ArchCommon], // Common packages to both arches
-		BasePackages[s.Family][ArchCommon], // Common packages to both arches by family
-		BasePackages[s.Distro][s.Arch],     // Specific packages for the arch
-		BasePackages[s.Family][s.Arch],     // Specific packages for the arch by family
+	// The common packages go through the filter too, so the exclusions of the maps apply to them
+	sources := []PackageSource{{Map: "common", Versions: VersionMap{Common: CommonPackages}}}
+	if recovery {
+		sources = append(sources, GetPackageSources(s, "recovery", RecoveryPackages)...)
+	} else {
+		sources = append(sources, GetPackageSources(s, "base", BasePackages)...)
 	}
+	kernelPackages := KernelPackages
+	kernelPackagesTrustedBoot := KernelPackagesTrustedBoot
+	kernelMap, kernelMapTrustedBoot := "kernel", "kernel_trusted_boot"
+	switch c.Kernel.Flavor {
+	case "":
+	case config.RealtimeKernelFlavor:
+		if s.Model != Generic {
+			return nil, fmt.Errorf("the %s kernel flavor is not supported for the %s model", config.RealtimeKernelFlavor, s.Model)
+		}
+		available, err := FilterPackagesOnConstraint(s, l, GetVersionMaps(s, KernelPackagesRealtime))
+		if err != nil {
+			return nil, err
+		}
+		if len(available) == 0 {
+			return nil, fmt.Errorf("the %s kernel flavor is not available for %s %s", config.RealtimeKernelFlavor, s.Distro, s.Version)
+		}
+		kernelPackages = KernelPackagesRealtime
+		kernelPackagesTrustedBoot = KernelPackagesRealtime
+		kernelMap, kernelMapTrustedBoot = "kernel_realtime", "kernel_realtime"
+	case config.GAKernelFlavor:
+		if s.Distro == Ubuntu {
+			kernelPackages = KernelPackagesGA
+			kernelPackagesTrustedBoot = KernelPackagesGA
+			kernelMap, kernelMapTrustedBoot = "kernel_ga", "kernel_ga"
+		}
+	case config.AWSKernelFlavor, config.AzureKernelFlavor, config.GCPKernelFlavor, config.OracleKernelFlavor:
+		if s.Distro != Ubuntu {
+			return nil, fmt.Errorf("the %s kernel flavor is only available on %s", c.Kernel.Flavor, Ubuntu)
+		}
+		if s.Model != Generic {
+			return nil, fmt.Errorf("the %s kernel flavor is not supported for the %s model", c.Kernel.Flavor, s.Model)
+		}
+		kernelPackages = KernelPackagesCloud
+		kernelPackagesTrustedBoot = KernelPackagesCloud
+		kernelMap, kernelMapTrustedBoot = "kernel_cloud", "kernel_cloud"
+	default:
+		return nil, fmt.Errorf("invalid kernel flavor: %s, possible values are %s", c.Kernel.Flavor,
+			strings.Join([]string{config.RealtimeKernelFlavor, config.GAKernelFlavor, config.AWSKernelFlavor, config.AzureKernelFlavor, config.GCPKernelFlavor, config.OracleKernelFlavor}, ", "))
+	}
+	if c.Kernel.Version != "" {
+		if c.Kernel.Flavor != "" {
+			return nil, fmt.Errorf("pinning the kernel version is not supported for the %s kernel flavor", c.Kernel.Flavor)
+		}
+		if s.Model != Generic {
+			return nil, fmt.Errorf("pinning the kernel version is not supported for the %s model", s.Model)
+		}
+		available, err := FilterPackagesOnConstraint(s, l, GetVersionMaps(s, KernelPackagesPinned))
+		if err != nil {
+			return nil, err
+		}
+		if len(available) == 0 {
+			return nil, fmt.Errorf("pinning the kernel version is not supported for %s %s", s.Distro, s.Version)
+		}
+		kernelPackages = KernelPackagesPinned
+		kernelPackagesTrustedBoot = KernelPackagesPinned
+		kernelMap, kernelMapTrustedBoot = "kernel_pinned", "kernel_pinned"
+	}
+	if c.Kernel.Source != "" {
+		if c.Kernel.Flavor != "" || c.Kernel.Version != "" {
+			return nil, fmt.Errorf("a custom kernel source cannot be used together with a kernel flavor or version")
+		}
+		// The custom kernel is installed on its own stage after the base packages, see stages.GetCustomKernelStage
+		kernelPackages = PackageMap{}
+		kernelPackagesTrustedBoot = PackageMap{}
+	}
+
 	// If trusted boot is enabled, we need to install the trusted boot packages
-	if config.DefaultConfig.TrustedBoot {
+	if s.TrustedBoot {
 		// Kernel packages by model
-		if config.DefaultConfig.Model == Generic.String() {
-			filteredPackages = append(filteredPackages, KernelPackagesTrustedBoot[s.Distro][ArchCommon]) // Common kernel packages to both arches
-			filteredPackages = append(filteredPackages, KernelPackagesTrustedBoot[s.Family][ArchCommon]) // Common kernel packages to both arches by family
-			filteredPackages = append(filteredPackages, KernelPackagesTrustedBoot[s.Distro][s.Arch])     // Specific kernel packages for the arch
-			filteredPackages = append(filteredPackages, KernelPackagesTrustedBoot[s.Family][s.Arch])     // Specific kernel packages for the arch by family
+		if s.Model == Generic {
+			sources = append(sources, GetPackageSources(s, kernelMapTrustedBoot, kernelPackagesTrustedBoot)...)
 		} else {
 			// Get specific packages for the model
 			// TODO: No support for trusted boot on models yet, so this part is probably useless for now?
-			filteredPackages = append(filteredPackages, KernelPackagesModels[s.Distro][ArchCommon][Model(config.DefaultConfig.Model)])
-			filteredPackages = append(filteredPackages, KernelPackagesModels[s.Family][ArchCommon][Model(config.DefaultConfig.Model)])
-			filteredPackages = append(filteredPackages, KernelPackagesModels[s.Distro][s.Arch][Model(config.DefaultConfig.Model)])
-			filteredPackages = append(filteredPackages, KernelPackagesModels[s.Family][s.Arch][Model(config.DefaultConfig.Model)])
+			sources = append(sources, GetPackageSources(s, "kernel_models", KernelPackagesModels)...)
 		}
 		// Install only systemd-boot packages
-		filteredPackages = append(filteredPackages, SystemdPackages[s.Distro][ArchCommon])
-		filteredPackages = append(filteredPackages, SystemdPackages[s.Family][ArchCommon])
-		filteredPackages = append(filteredPackages, SystemdPackages[s.Distro][s.Arch])
-		filteredPackages = append(filteredPackages, SystemdPackages[s.Family][s.Arch])
+		sources = append(sources, GetPackageSources(s, "systemd", SystemdPackages)...)
 	} else {
-		if config.DefaultConfig.Model == Generic.String() {
-			filteredPackages = append(filteredPackages, KernelPackages[s.Distro][ArchCommon]) // Common kernel packages to both arches
-			filteredPackages = append(filteredPackages, KernelPackages[s.Family][ArchCommon]) // Common kernel packages to both arches by family
-			filteredPackages = append(filteredPackages, KernelPackages[s.Distro][s.Arch])     // Specific kernel packages for the arch
-			filteredPackages = append(filteredPackages, KernelPackages[s.Family][s.Arch])     // Specific kernel packages for the arch by family
+		if s.Model == Generic {
+			sources = append(sources, GetPackageSources(s, kernelMap, kernelPackages)...)
 		} else {
 			// Get specific packages for the model
-			filteredPackages = append(filteredPackages, KernelPackagesModels[s.Distro][ArchCommon][Model(config.DefaultConfig.Model)])
-			filteredPackages = append(filteredPackages, KernelPackagesModels[s.Family][ArchCommon][Model(config.DefaultConfig.Model)])
-			filteredPackages = append(filteredPackages, KernelPackagesModels[s.Distro][s.Arch][Model(config.DefaultConfig.Model)])
-			filteredPackages = append(filteredPackages, KernelPackagesModels[s.Family][s.Arch][Model(config.DefaultConfig.Model)])
+			sources = append(sources, GetPackageSources(s, "kernel_models", KernelPackagesModels)...)
 		}
 		// install grub and immucore packages
-		filteredPackages = append(filteredPackages, GrubPackages[s.Distro][ArchCommon])
-		filteredPackages = append(filteredPackages, GrubPackages[s.Family][ArchCommon])
-		filteredPackages = append(filteredPackages, GrubPackages[s.Distro][s.Arch])
-		filteredPackages = append(filteredPackages, GrubPackages[s.Family][s.Arch])
-		filteredPackages = append(filteredPackages, ImmucorePackages[s.Distro][ArchCommon])
-		filteredPackages = append(filteredPackages, ImmucorePackages[s.Family][ArchCommon])
-		filteredPackages = append(filteredPackages, ImmucorePackages[s.Distro][s.Arch])
-		filteredPackages = append(filteredPackages, ImmucorePackages[s.Family][s.Arch])
+		sources = append(sources, GetPackageSources(s, "grub", GrubPackages)...)
+		sources = append(sources, GetPackageSources(s, "immucore", ImmucorePackages)...)
+		if !c.NoLive {
+			sources = append(sources, GetPackageSources(s, "live", LivePackages)...)
+		}
+	}
+
+	// Packages for the selected groups, the recovery profile has none as they are not needed to boot
+	if !recovery {
+		groups, err := EnabledPackageGroups(s, c.PackageGroups)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range groups {
+			sources = append(sources, GetPackageSources(s, "group "+name, PackageGroups[name].Packages)...)
+		}
+	}
+
+	// Packages for the enabled features
+	features, err := EnabledFeatures(s, c)
+	if err != nil {
+		return nil, err
+	}
+	for _, feature := range features {
+		sources = append(sources, GetPackageSources(s, "feature "+feature.String(), Features[feature].Packages)...)
+	}
+
+	// Log forwarder of the audit feature
+	forwarder, err := GetLogForwarder(s, c)
+	if err != nil {
+		return nil, err
+	}
+	if forwarder != "" {
+		sources = append(sources, GetPackageSources(s, "log forwarder "+forwarder.String(), LogForwarders[forwarder].Packages)...)
+	}
+
+	// Firmware packages for the selected level
+	firmwarePackages, err := GetFirmwarePackages(c.Firmware)
+	if err != nil {
+		return nil, err
+	}
+	sources = append(sources, GetPackageSources(s, "firmware", firmwarePackages)...)
+	if FirmwareLevel(c.Firmware) == FirmwareDefault && !c.TrustedBoot {
+		sources = append(sources, GetPackageSources(s, "firmware grub", FirmwareDefaultGrubPackages)...)
+	}
+
+	// CPU microcode, the map only has entries for amd64
+	if c.Microcode {
+		sources = append(sources, GetPackageSources(s, "microcode", MicrocodePackages)...)
+	}
+
+	// Extra packages for the localization options
+	if c.Localization.Locale != "" {
+		sources = append(sources, GetPackageSources(s, "locale", LocalePackages)...)
+	}
+	if c.Localization.Keymap != "" {
+		sources = append(sources, GetPackageSources(s, "keymap", KeymapPackages)...)
+	}
+	if c.Localization.Timezone != "" {
+		sources = append(sources, GetPackageSources(s, "timezone", TimezonePackages)...)
+	}
+
+	// NVIDIA driver, the repos are added on the before-install stage
+	if c.Nvidia {
+		sources = append(sources, GetPackageSources(s, "nvidia", NvidiaPackages)...)
+	}
+
+	// zfs module and tools, the repos are added on the before-install stage
+	if c.Zfs {
+		sources = append(sources, GetPackageSources(s, "zfs", ZfsPackages)...)
 	}
 
-	mergedPkgs = append(mergedPkgs, FilterPackagesOnConstraint(s, l, filteredPackages)...)
+	// Network stack packages, if one was selected
+	if c.NetworkStack != "" {
+		stack, err := GetNetworkStack(s, c.NetworkStack)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, GetPackageSources(s, "network "+c.NetworkStack, stack.Packages)...)
+	}
 
-	return mergedPkgs, nil
+	// Time sync daemon packages, if one was selected, replacing the default one
+	if c.TimeSync != "" {
+		timeSync, err := GetTimeSyncSource(s, c.TimeSync, l)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, timeSync)
+	}
+
+	// zram swap packages
+	if c.Swap.Zram != "" {
+		if _, err := GetZramPackages(s, l); err != nil {
+			return nil, err
+		}
+		sources = append(sources, GetPackageSources(s, "zram", ZramPackages)...)
+	}
+
+	// Container runtime packages, if one was selected
+	if c.ContainerRuntime != "" {
+		runtime, err := GetContainerRuntime(s, c.ContainerRuntime)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, GetPackageSources(s, "container runtime "+c.ContainerRuntime, runtime.Packages)...)
+	}
+
+	return FilterPackageSources(s, l, sources)
+}
+
+// GetVersionMaps returns the VersionMaps from the PackageMap that apply to the system
+// Common to both arches by distro and family first, then the specific ones for the arch
+func GetVersionMaps(s System, m PackageMap) []VersionMap {
+	return []VersionMap{
+		m[s.Distro][ArchCommon],
+		m[s.Family][ArchCommon],
+		m[s.Distro][s.Arch],
+		m[s.Family][s.Arch],
+	}
 }
 
 // FilterPackagesOnConstraint filters the packages based on the system version and the constraints in the package map
-func FilterPackagesOnConstraint(s System, l sdkTypes.KairosLogger, pkgsToFilter []VersionMap) []string {
-	// Go over each list of packages
-	var pkgs []string
-	systemVersion, err := semver.NewVersion(s.Version)
+func FilterPackagesOnConstraint(s System, l sdkTypes.KairosLogger, pkgsToFilter []VersionMap) ([]string, error) {
+	sources := make([]PackageSource, 0, len(pkgsToFilter))
+	for _, versions := range pkgsToFilter {
+		sources = append(sources, PackageSource{Versions: versions})
+	}
+	filtered, err := FilterPackageSources(s, l, sources)
 	if err != nil {
-		return pkgs
+		return nil, err
 	}
-	for _, packages := range pkgsToFilter {
+	var pkgs []string
+	for _, pkg := range filtered {
+		pkgs = append(pkgs, pkg.Name)
+	}
+	return pkgs, nil
+}
+
+// FilterPackageSources filters the packages of the sources based on the system version and their constraints, and
+// returns them sorted and without duplicates with the source that selected them
+// A constraint that can't be checked, like one with a version when the system version is unparseable, is an error
+// instead of skipping its packages, as an image with missing packages is worse than a failed build
+func FilterPackageSources(s System, l sdkTypes.KairosLogger, sources []PackageSource) ([]PackageProvenance, error) {
+	// Go over each list of packages
+	var pkgs []PackageProvenance
+	systemVersion := SystemVersion(s)
+	for _, source := range sources {
 		// for each package map, check if the version matches the constraint
-		for constraint, values := range packages {
+		// Go over the constraints in order so the debug logs are the same on each run
+		constraints := make([]string, 0, len(source.Versions))
+		for constraint := range source.Versions {
+			constraints = append(constraints, constraint)
+		}
+		sort.Strings(constraints)
+		for _, constraint := range constraints {
+			values := source.Versions[constraint]
 			// Add them if they are common
-			l.Logger.Debug().Str("constraint", constraint).Str("version", systemVersion.String()).Msg("Checking constraint")
+			l.Logger.Debug().Str("constraint", constraint).Str("version", systemVersion).Msg("Checking constraint")
 			if constraint == Common {
 				l.Logger.Debug().Strs("packages", values).Msg("Adding common packages")
-				pkgs = append(pkgs, values...)
+				pkgs = append(pkgs, source.provenance(constraint, values)...)
 				continue
 			}
-			semverConstraint, err := semver.NewConstraint(constraint)
+			match, err := constraintMatches(s, constraint)
 			if err != nil {
-				l.Logger.Error().Err(err).Str("constraint", constraint).Msg("Error parsing constraint.")
-				continue
+				if source.Map != "" {
+					return nil, fmt.Errorf("%s map constraint %q: %w", source.Map, constraint, err)
+				}
+				return nil, fmt.Errorf("constraint %q: %w", constraint, err)
 			}
 			// Also add them if the constraint matches
-			if semverConstraint.Check(systemVersion) {
+			if match {
 				l.Logger.Debug().Strs("packages", values).Msg("Constraint matches, adding packages")
-				pkgs = append(pkgs, values...)
+				pkgs = append(pkgs, source.provenance(constraint, values)...)
+			}
+		}
+	}
+	return uniqueProvenance(resolveConflicts(applyExclusions(pkgs, l), l)), nil
+}
+
+// uniquePackages returns the packages sorted and without duplicates, as a package can be listed by both the distro and
+// its family, so the install commands and the manifest are the same on each run
+func uniquePackages(pkgs []string) []string {
+	unique := make([]string, 0, len(pkgs))
+	seen := map[string]bool{}
+	for _, pkg := range pkgs {
+		if seen[pkg] {
+			continue
+		}
+		seen[pkg] = true
+		unique = append(unique, pkg)
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+// uniqueProvenance is uniquePackages keeping the first source that selected each package
+func uniqueProvenance(pkgs []PackageProvenance) []PackageProvenance {
+	first := map[string]int{}
+	names := make([]string, 0, len(pkgs))
+	for i, pkg := range pkgs {
+		if _, seen := first[pkg.Name]; seen {
+			continue
+		}
+		first[pkg.Name] = i
+		names = append(names, pkg.Name)
+	}
+	// Sorting the names and not the entries, as moving the entries around is most of the time of resolving packages
+	sort.Strings(names)
+	unique := make([]PackageProvenance, 0, len(names))
+	for _, name := range names {
+		unique = append(unique, pkgs[first[name]])
+	}
+	return unique
+}
+
+// ExclusionPrefix marks a package entry as an exclusion, see VersionMap
+const ExclusionPrefix = "!"
+
+// applyExclusions removes the excluded packages and the exclusion entries from the list
+// An exclusion only removes the packages added with the same or lower precedence, so a distro entry overrides its
+// family but a family entry can't drop what a distro entry asks for, see PackageSource.precedence
+func applyExclusions(pkgs []PackageProvenance, l sdkTypes.KairosLogger) []PackageProvenance {
+	excluded := map[string]int{}
+	for _, pkg := range pkgs {
+		if strings.HasPrefix(pkg.Name, ExclusionPrefix) {
+			name := strings.TrimPrefix(pkg.Name, ExclusionPrefix)
+			if precedence, ok := excluded[name]; !ok || pkg.precedence > precedence {
+				excluded[name] = pkg.precedence
+			}
+		}
+	}
+	if len(excluded) == 0 {
+		return pkgs
+	}
+	var filtered []PackageProvenance
+	for _, pkg := range pkgs {
+		if strings.HasPrefix(pkg.Name, ExclusionPrefix) {
+			continue
+		}
+		// Exclusions also drop the pinned entries of the package
+		name, _ := SplitPackageVersion(pkg.Name)
+		if precedence, ok := excluded[name]; ok {
+			if pkg.precedence <= precedence {
+				continue
 			}
+			l.Logger.Debug().Str("package", pkg.Name).Str("map", pkg.Map).Str("key", pkg.Key).Msg("Keeping excluded package as it was added with a higher precedence")
 		}
+		filtered = append(filtered, pkg)
 	}
-	return pkgs
+	l.Logger.Debug().Interface("excluded", excluded).Msg("Excluded packages")
+	return filtered
 }
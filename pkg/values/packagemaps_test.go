@@ -0,0 +1,147 @@
+package values
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+)
+
+// FuzzFilterPackagesOnConstraint checks that any constraint and system version either selects the package or not, or
+// fails, and that the cached parsing gives the same result on each call
+func FuzzFilterPackagesOnConstraint(f *testing.F) {
+	f.Add("24.04", "noble", ">=22.04, <24.10", "linux-image-generic")
+	f.Add("24.04", "", "jammy,noble", "linux-image-generic")
+	f.Add("22.04", "jammy", ">=focal", "linux-image-generic-hwe-{{.version}}")
+	f.Add("15-SP5", "", "~> 15.5", "kernel-default")
+	f.Add("3.21.0_rc1", "", ">=3.19, arch=amd64", "grub-efi")
+	f.Add("12", "bookworm", "model=rpi4, >=12", "raspi-firmware")
+	f.Add("", "", Common, "!systemd-timesyncd")
+	f.Add("24.04", "noble", "arch=riscv64", "grub-efi")
+	f.Add("24.04", "noble", ">=", "grub-efi")
+	f.Add("24.04", "noble", ",", "grub-efi")
+	f.Add("not.a.version", "", ">=22.04", "grub-efi")
+	f.Add("24.04", "noble", ">=unknown", "grub-efi")
+	f.Fuzz(func(t *testing.T, version, codename, constraint, pkg string) {
+		s := System{Distro: Ubuntu, Family: DebianFamily, Version: version, Codename: codename, Arch: ArchAMD64, Model: Generic}
+		l := sdkTypes.NewNullLogger()
+		pkgs, err := FilterPackagesOnConstraint(s, l, []VersionMap{{constraint: {pkg}}})
+		again, againErr := FilterPackagesOnConstraint(s, l, []VersionMap{{constraint: {pkg}}})
+		if (err == nil) != (againErr == nil) || !reflect.DeepEqual(pkgs, again) {
+			t.Fatalf("constraint %q on %q gave %v, %v and then %v, %v", constraint, version, pkgs, err, again, againErr)
+		}
+		if err != nil {
+			return
+		}
+		if len(pkgs) > 1 || (len(pkgs) == 1 && pkgs[0] != pkg) {
+			t.Fatalf("constraint %q on %q selected %v from %q", constraint, version, pkgs, pkg)
+		}
+		if constraint == Common && !strings.HasPrefix(pkg, ExclusionPrefix) && len(pkgs) == 0 {
+			t.Fatalf("common package %q was not selected", pkg)
+		}
+	})
+}
+
+// FuzzPackageListToTemplate checks that any package template renders to a single package or to nothing, or fails,
+// instead of panicking or returning names the package manager would split
+func FuzzPackageListToTemplate(f *testing.F) {
+	f.Add("linux-image-generic")
+	f.Add("linux-image-generic-hwe-{{.version}}")
+	f.Add("{{if eq .arch \"arm64\"}}grub-efi-arm64{{end}}")
+	f.Add("{{.missing}}")
+	f.Add("{{.version")
+	f.Add("{{ printf \"%s %s\" .distro .arch }}")
+	f.Add("language-pack-{{ .lang }}")
+	f.Add("  ")
+	f.Fuzz(func(t *testing.T, pkg string) {
+		s := System{Distro: Ubuntu, Family: DebianFamily, Version: "24.04", Codename: "noble", Arch: ArchARM64, Model: Generic}
+		params := s.TemplateParams(config.Config{})
+		l := sdkTypes.NewNullLogger()
+		pkgs, err := PackageListToTemplate([]string{pkg}, params, l)
+		if err != nil {
+			return
+		}
+		if len(pkgs) > 1 {
+			t.Fatalf("template %q rendered to several packages %v", pkg, pkgs)
+		}
+		for _, rendered := range pkgs {
+			if rendered == "" || strings.ContainsAny(rendered, " \t\n\r") {
+				t.Fatalf("template %q rendered to %q", pkg, rendered)
+			}
+		}
+	})
+}
+
+// TestGetPackagesUnique checks that a package listed by the distro and its family, and by the common and arch entries,
+// is installed once and that the packages come sorted, so the install commands and the manifest are the same each run
+func TestGetPackagesUnique(t *testing.T) {
+	original, ok := BasePackages[Ubuntu]
+	t.Cleanup(func() {
+		if ok {
+			BasePackages[Ubuntu] = original
+		} else {
+			delete(BasePackages, Ubuntu)
+		}
+	})
+	// curl is also on the Debian family common entry
+	BasePackages[Ubuntu] = map[Architecture]VersionMap{
+		ArchCommon: {Common: {"zstd", "curl"}},
+		ArchAMD64:  {">=24.04": {"curl", "zstd"}},
+	}
+
+	s := System{Distro: Ubuntu, Family: DebianFamily, Version: "24.04", Codename: "noble", Arch: ArchAMD64, Model: Generic, Variant: config.CoreVariant}
+	c := config.Config{Model: Generic.String(), Variant: config.CoreVariant}
+	l := sdkTypes.NewNullLogger()
+	pkgs, err := GetPackages(s, c, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkg := range []string{"curl", "zstd"} {
+		if i := slices.Index(pkgs, pkg); i < 0 || slices.Contains(pkgs[i+1:], pkg) {
+			t.Errorf("%s is not listed once in %v", pkg, pkgs)
+		}
+	}
+	if !slices.IsSorted(pkgs) {
+		t.Errorf("packages are not sorted: %v", pkgs)
+	}
+	for range 5 {
+		again, err := GetPackages(s, c, l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(pkgs, again) {
+			t.Fatalf("packages changed between runs: %v and then %v", pkgs, again)
+		}
+	}
+
+	// The provenance keeps the most general source that selected the package first, the distro common entry
+	provenance, err := GetPackageProvenance(s, c, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var curl []PackageProvenance
+	for _, pkg := range provenance {
+		if pkg.Name == "curl" {
+			curl = append(curl, pkg)
+		}
+	}
+	if len(curl) != 1 || curl[0].Map != "base" || curl[0].Key != Ubuntu.String() || curl[0].Arch != ArchCommon.String() {
+		t.Errorf("expected a single curl from the ubuntu common base entry, got %+v", curl)
+	}
+}
+
+// BenchmarkGetPackages resolves the packages of a single system, with the templates and constraints already cached
+// after the first iteration like on a real build
+func BenchmarkGetPackages(b *testing.B) {
+	s := System{Distro: Ubuntu, Family: DebianFamily, Version: "24.04", Codename: "noble", Arch: ArchAMD64, Model: Generic, Variant: config.CoreVariant}
+	c := config.Config{Model: Generic.String(), Variant: config.CoreVariant}
+	l := sdkTypes.NewNullLogger()
+	for range b.N {
+		if _, err := GetPackages(s, c, l); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package values
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PinSeparator separates the name and the version of a pinned package entry, like "openssl=3.0.13-*"
+// Entries use the same syntax on every distro and are translated to the one of the package manager on install, see
+// PackageInstallName. A trailing * on the version matches any version with that prefix, only on apt and dnf
+const PinSeparator = "="
+
+// SplitPackageVersion returns the name and the pinned version of a package entry, the version is empty if not pinned
+func SplitPackageVersion(pkg string) (string, string) {
+	name, version, _ := strings.Cut(pkg, PinSeparator)
+	return name, version
+}
+
+// ValidatePackagePin checks that a pinned package entry can be installed on the given family
+func ValidatePackagePin(family Family, pkg string) error {
+	name, version := SplitPackageVersion(pkg)
+	if !strings.Contains(pkg, PinSeparator) {
+		return nil
+	}
+	if name == "" || version == "" {
+		return fmt.Errorf("pinned package %q needs a name and a version", pkg)
+	}
+	if strings.Contains(version, "*") && !strings.HasSuffix(version, "*") || strings.Count(version, "*") > 1 {
+		return fmt.Errorf("pinned package %q can only have a * at the end of the version", pkg)
+	}
+	switch family {
+	case ArchFamily:
+		return fmt.Errorf("pinned package %q: pacman can't install a given version from the repos", pkg)
+	case AlpineFamily, SUSEFamily:
+		if strings.HasSuffix(version, "*") {
+			return fmt.Errorf("pinned package %q: version wildcards are only supported on apt and dnf", pkg)
+		}
+	}
+	return nil
+}
+
+// PackageInstallName returns the package entry in the syntax of the package manager of the system: name=version on
+// apt, apk and zypper and name-version on dnf
+func PackageInstallName(s System, pkg string) (string, error) {
+	name, version := SplitPackageVersion(pkg)
+	if version == "" {
+		return pkg, nil
+	}
+	if err := ValidatePackagePin(s.Family, pkg); err != nil {
+		return "", err
+	}
+	if s.Family == RedHatFamily {
+		return fmt.Sprintf("%s-%s", name, version), nil
+	}
+	return pkg, nil
+}
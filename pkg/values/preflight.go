@@ -0,0 +1,36 @@
+package values
+
+const (
+	mib int64 = 1 << 20
+	gib int64 = 1 << 30
+)
+
+// PreflightDisk is about the free space that the install stage needs on the rootfs for each family, with the
+// downloaded packages still in the cache. The standard variant and the optional features need more, override it with
+// the preflight options in that case
+var PreflightDisk = map[Family]int64{
+	DebianFamily: 3 * gib,
+	RedHatFamily: 3*gib + 512*mib,
+	SUSEFamily:   3*gib + 512*mib,
+	AlpineFamily: 1*gib + 512*mib,
+	ArchFamily:   3*gib + 512*mib,
+}
+
+// PreflightInitDisk is the free space that the init stage needs on the rootfs, mostly for the initrd and the
+// kernel links under /boot
+const PreflightInitDisk = 512 * mib
+
+// PreflightTmp is the free space needed where the initrd is built, as dracut copies every module it includes there
+// before packing them
+const PreflightTmp = 768 * mib
+
+// PreflightMemory is the available memory needed for the package installs and the initrd compression
+const PreflightMemory = 512 * mib
+
+// InitrdTmpDir returns the dir where the initrd of the family is built
+func InitrdTmpDir(family Family) string {
+	if family == AlpineFamily {
+		return "/tmp"
+	}
+	return "/var/tmp"
+}
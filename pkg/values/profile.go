@@ -0,0 +1,131 @@
+package values
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+)
+
+// RecoveryPackages are the packages the recovery profile installs instead of BasePackages: systemd, the partitioning
+// and encryption tools and what the agent needs to download, on top of the common packages. The rest of the base
+// packages are there for the active system, which the recovery one only resets or upgrades
+var RecoveryPackages = PackageMap{
+	DebianFamily: {
+		ArchCommon: {
+			Common: {
+				"ca-certificates",
+				"curl",
+				"cryptsetup",
+				"gdisk",
+				"systemd",
+				"systemd-sysv",
+			},
+		},
+	},
+	Debian: {
+		ArchCommon: {
+			">=13": {
+				"systemd-cryptsetup",
+			},
+		},
+	},
+	Ubuntu: {
+		ArchCommon: {
+			Common: {
+				"fdisk",
+				"cloud-guest-utils",
+				"tpm2-tools",
+				"dmsetup",
+			},
+		},
+	},
+	RedHatFamily: {
+		ArchCommon: {
+			Common: {
+				"gdisk",
+				"cloud-utils-growpart",
+				"device-mapper",
+				"systemd",
+				"which",
+				"cryptsetup",
+			},
+		},
+	},
+	SUSEFamily: {
+		ArchCommon: {
+			Common: {
+				"curl",
+				"cryptsetup",
+				"device-mapper",
+				"growpart",
+				"gptfdisk",
+				"systemd",
+				"which",
+			},
+		},
+	},
+	AlpineFamily: {
+		ArchCommon: {
+			Common: {
+				"curl",
+				"blkid",
+				"busybox-openrc",
+				"ca-certificates",
+				"cloud-utils-growpart",
+				"coreutils",
+				"cryptsetup",
+				"device-mapper-udev",
+				"dosfstools",
+				"e2fsprogs",
+				"e2fsprogs-extra",
+				"efibootmgr",
+				"eudev",
+				"findmnt",
+				"openrc",
+				"sgdisk",
+				"util-linux",
+				"which",
+			},
+		},
+	},
+}
+
+// ValidateProfile checks the profile of the config, and that the options for things that the profile doesn't install
+// are not set, as they would be silently ignored
+func ValidateProfile(c config.Config) error {
+	switch c.Profile {
+	case "":
+		return nil
+	case config.RecoveryProfile:
+	default:
+		return fmt.Errorf("invalid profile: %s, possible values are %s", c.Profile, config.RecoveryProfile)
+	}
+	var set []string
+	if c.Variant == config.StandardVariant {
+		set = append(set, "the standard variant")
+	}
+	if len(c.PackageGroups.Enable) > 0 {
+		set = append(set, "package_groups")
+	}
+	if len(c.Features) > 0 || c.Fips {
+		set = append(set, "features")
+	}
+	if c.NetworkStack != "" {
+		set = append(set, "network_stack")
+	}
+	if c.ContainerRuntime != "" {
+		set = append(set, "container_runtime")
+	}
+	if c.Nvidia {
+		set = append(set, "nvidia")
+	}
+	if c.Zfs {
+		set = append(set, "zfs")
+	}
+	if len(set) > 0 {
+		return fmt.Errorf("the %s profile only installs what the recovery system needs to boot and reset the node, "+
+			"it can't be used with %s", c.Profile, strings.Join(set, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package values
+
+import (
+	"fmt"
+	"slices"
+
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+)
+
+// PackageSource is a VersionMap to filter, with the package map and key it comes from
+type PackageSource struct {
+	Map      string
+	Key      DistroFamilyInterface
+	Arch     Architecture
+	Versions VersionMap
+}
+
+// PackageProvenance is a package selected for the system, with the map, key and constraint that selected it
+type PackageProvenance struct {
+	Name       string `json:"name"`
+	Map        string `json:"map,omitempty"`
+	Key        string `json:"key,omitempty"`
+	Arch       string `json:"arch,omitempty"`
+	Constraint string `json:"constraint"`
+	Reason     string `json:"reason,omitempty"`
+	Owner      string `json:"owner,omitempty"`
+	// precedence of the source, see PackageSource.precedence
+	precedence int
+}
+
+// Package is why a package of a map entry is installed, so the manifest can answer why it is on the image
+type Package struct {
+	Name string
+	// Reason is what the package is needed for
+	Reason string
+	// Owner is the kairos component or feature that needs it, so its known who to ask before dropping it
+	Owner string
+}
+
+// PackageReasons are why the packages of the maps are installed, by the map name that the provenance records and then
+// by the distro or family of the map entry, so a package listed on several entries keeps the reason of each. The common
+// list is not under a distro or family, so it has a nil key
+var PackageReasons = map[string]map[DistroFamilyInterface][]Package{
+	"common": {
+		nil: {
+			{Name: "file", Reason: "Basic tool", Owner: "base"},
+			{Name: "gawk", Reason: "Basic tool", Owner: "base"},
+			{Name: "iptables", Reason: "Basic tool", Owner: "base"},
+			{Name: "less", Reason: "Basic tool", Owner: "base"},
+			{Name: "nano", Reason: "Basic tool", Owner: "base"},
+			{Name: "sudo", Reason: "Basic tool. Needed for the user to be able to run commands as root", Owner: "base"},
+			{Name: "tar", Reason: "Basic tool", Owner: "base"},
+			{Name: "zstd", Reason: "Compression support for zstd", Owner: "base"},
+			{Name: "rsync", Reason: "Install, upgrade, reset use it to sync the files", Owner: KairosAgentComponent},
+			{Name: "lvm2", Reason: "Seems to be used to support rpi3 only", Owner: KairosAgentComponent},
+			{Name: "jq", Reason: "No idea why we need it, check if we can drop it?"},
+			{Name: "dosfstools", Reason: "For the fat32 partition on EFI systems", Owner: "yip"},
+			{Name: "e2fsprogs", Reason: "mkfs support for ext2/3/4", Owner: "yip"},
+			{Name: "parted", Reason: "Partitioning support, check if we need it anymore", Owner: "yip"},
+			{Name: "logrotate", Reason: "Log rotation support", Owner: "base"},
+		},
+	},
+	"immucore": {
+		DebianFamily: {
+			{Name: "dracut", Reason: "To build the initrd", Owner: ImmucoreComponent},
+			{Name: "dracut-network", Reason: "Network-legacy support for dracut", Owner: ImmucoreComponent},
+			{Name: "isc-dhcp-common", Reason: "Network-legacy support for dracut, basic tools", Owner: ImmucoreComponent},
+			{Name: "isc-dhcp-client", Reason: "Network-legacy support for dracut, basic tools", Owner: ImmucoreComponent},
+			{Name: "cloud-guest-utils", Reason: "Brings growpart, so we can resize the partitions", Owner: "yip"},
+		},
+	},
+	"base": {
+		DebianFamily: {
+			{Name: "ca-certificates", Reason: "Basic certificates for secure communication", Owner: "base"},
+			{Name: "curl", Reason: "Basic tool. Also needed for netbooting as it is used to download the netboot artifacts. On rockylinux conflicts with curl-minimal", Owner: KairosAgentComponent},
+			{Name: "systemd", Reason: "Basic tool", Owner: "base"},
+			{Name: "systemd-sysv", Reason: "Provides the reboot and shutdown commands as symlinks to systemctl", Owner: "base"},
+		},
+		SUSEFamily: {
+			{Name: "curl", Reason: "Basic tool. Also needed for netbooting as it is used to download the netboot artifacts. On rockylinux conflicts with curl-minimal", Owner: KairosAgentComponent},
+		},
+		AlpineFamily: {
+			{Name: "curl", Reason: "Basic tool. Also needed for netbooting as it is used to download the netboot artifacts. On rockylinux conflicts with curl-minimal", Owner: KairosAgentComponent},
+		},
+		RedHatFamily: {
+			{Name: "gdisk", Reason: "Yip requires it for partitioning, maybe BasePackages", Owner: "yip"},
+			{Name: "audit", Reason: "For audit support, check if needed?"},
+			{Name: "cracklib-dicts", Reason: "Password dictionary support", Owner: "base"},
+			{Name: "cloud-utils-growpart", Reason: "Grow partition use. Check if yip still needs it?", Owner: "yip"},
+			{Name: "device-mapper", Reason: "Device mapper support, needed for lvm and cryptsetup", Owner: ImmucoreComponent},
+			{Name: "systemd", Reason: "Basic tool", Owner: "base"},
+			{Name: "which", Reason: "Basic tool. Basepackages?", Owner: "base"},
+			{Name: "cryptsetup", Reason: "For encrypted partitions support, needed for trusted boot and dracut building", Owner: ImmucoreComponent},
+		},
+		Ubuntu: {
+			{Name: "fdisk", Reason: "Yip requires it for partitioning", Owner: "yip"},
+			{Name: "console-data", Reason: "Console font support", Owner: "base"},
+			{Name: "cloud-guest-utils", Reason: "Yip requires it, this brings growpart, so we can resize the partitions", Owner: "yip"},
+			{Name: "systemd-container", Reason: "Not sure if needed?"},
+			{Name: "ubuntu-advantage-tools", Reason: "For ubuntu advantage support, enablement of ubuntu services", Owner: "base"},
+			{Name: "tpm2-tools", Reason: "For TPM support, mainly trusted boot", Owner: KairosAgentComponent},
+			{Name: "dmsetup", Reason: "Device mapper support, needed for lvm and cryptsetup", Owner: ImmucoreComponent},
+			{Name: "zfsutils-linux", Reason: "For zfs tools (zfs and zpool)"},
+		},
+		Fedora: {
+			{Name: "haveged", Reason: "Random number generator, check if needed?"},
+			{Name: "systemd-networkd", Reason: "Not available in other distros, too old version maybe?", Owner: "base"},
+		},
+	},
+	"grub": {
+		DebianFamily: {
+			{Name: "shim-signed", Reason: "For secure boot support", Owner: "base"},
+		},
+	},
+	"group " + ExtendedGroup: {
+		DebianFamily: {
+			{Name: "lldpd", Reason: "For lldp support, check if needed?"},
+			{Name: "snmpd", Reason: "For snmp support, check if needed?"},
+			{Name: "kbd", Reason: "Keyboard configuration", Owner: "base"},
+			{Name: "squashfs-tools", Reason: "For squashfs support, probably needs to be part of BasePackages"},
+		},
+		Ubuntu: {
+			{Name: "zfsutils-linux", Reason: "For zfs tools (zfs and zpool), the full zfs support is the zfs option"},
+		},
+	},
+}
+
+// LookupPackage returns why the package of the map entry is installed, ignoring the pinned version
+func LookupPackage(mapName string, key DistroFamilyInterface, name string) (Package, bool) {
+	name, _ = SplitPackageVersion(name)
+	for _, pkg := range PackageReasons[mapName][key] {
+		if pkg.Name == name {
+			return pkg, true
+		}
+	}
+	return Package{}, false
+}
+
+// GetPackageSources returns the sources from the PackageMap that apply to the system, in the same order as
+// GetVersionMaps, named after the given map
+func GetPackageSources(s System, name string, m PackageMap) []PackageSource {
+	return []PackageSource{
+		{Map: name, Key: s.Distro, Arch: ArchCommon, Versions: m[s.Distro][ArchCommon]},
+		{Map: name, Key: s.Family, Arch: ArchCommon, Versions: m[s.Family][ArchCommon]},
+		{Map: name, Key: s.Distro, Arch: s.Arch, Versions: m[s.Distro][s.Arch]},
+		{Map: name, Key: s.Family, Arch: s.Arch, Versions: m[s.Family][s.Arch]},
+	}
+}
+
+// provenance returns the packages of a constraint of the source with their provenance
+func (p PackageSource) provenance(constraint string, pkgs []string) []PackageProvenance {
+	result := make([]PackageProvenance, 0, len(pkgs))
+	var key string
+	if p.Key != nil {
+		key = fmt.Sprint(p.Key)
+	}
+	precedence := p.precedence()
+	for _, pkg := range pkgs {
+		entry := PackageProvenance{
+			Name:       pkg,
+			Map:        p.Map,
+			Key:        key,
+			Arch:       p.Arch.String(),
+			Constraint: constraint,
+			precedence: precedence,
+		}
+		if known, ok := LookupPackage(p.Map, p.Key, pkg); ok {
+			entry.Reason, entry.Owner = known.Reason, known.Owner
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// precedence returns how specific the source is: distro entries win over family ones and arch specific entries over
+// the common ones, in that order. Sources without a key, like the lists given to FilterPackagesOnConstraint, have the
+// lowest one
+func (p PackageSource) precedence() int {
+	var precedence int
+	switch p.Key.(type) {
+	case Family:
+		precedence = 1
+	case Distro:
+		precedence = 3
+	default:
+		return 0
+	}
+	if p.Arch != ArchCommon {
+		precedence++
+	}
+	return precedence
+}
+
+// PackageConflicts are sets of packages that can't be installed together, usually variants of the same package
+var PackageConflicts = [][]string{
+	{"curl", "curl-minimal"},
+	{"systemd-timesyncd", "chrony", "ntp", "ntpsec"},
+	{"iptables-legacy", "iptables-nft"},
+}
+
+// resolveConflicts checks the packages against PackageConflicts, keeping the one added with the highest precedence
+// when several of a set are selected. If there is no single one with the highest precedence they are all kept and
+// the conflict logged, as the maps need fixing
+func resolveConflicts(pkgs []PackageProvenance, l sdkTypes.KairosLogger) []PackageProvenance {
+	drop := map[string]bool{}
+	for _, conflict := range PackageConflicts {
+		var found []PackageProvenance
+		for _, pkg := range pkgs {
+			name, _ := SplitPackageVersion(pkg.Name)
+			if slices.Contains(conflict, name) {
+				found = append(found, pkg)
+			}
+		}
+		if len(found) < 2 {
+			continue
+		}
+		winner := found[0]
+		tie := false
+		for _, pkg := range found[1:] {
+			switch {
+			case pkg.precedence > winner.precedence:
+				winner, tie = pkg, false
+			case pkg.precedence == winner.precedence && pkg.Name != winner.Name:
+				tie = true
+			}
+		}
+		if tie {
+			l.Logger.Error().Interface("packages", found).Msg("Conflicting packages selected with the same precedence")
+			continue
+		}
+		for _, pkg := range found {
+			if pkg.Name != winner.Name {
+				l.Logger.Warn().Str("package", pkg.Name).Str("map", pkg.Map).Str("key", pkg.Key).Str("replaced_by", winner.Name).
+					Msg("Dropping conflicting package in favor of a more specific entry")
+				drop[pkg.Name] = true
+			}
+		}
+	}
+	if len(drop) == 0 {
+		return pkgs
+	}
+	var filtered []PackageProvenance
+	for _, pkg := range pkgs {
+		if !drop[pkg.Name] {
+			filtered = append(filtered, pkg)
+		}
+	}
+	return filtered
+}
+
+// RenderPackageProvenance renders the package templates of the provenance list with the given params, like
+// PackageListToTemplate does for the package names
+func RenderPackageProvenance(pkgs []PackageProvenance, params map[string]string, l sdkTypes.KairosLogger) ([]PackageProvenance, error) {
+	var rendered []PackageProvenance
+	for _, pkg := range pkgs {
+		names, err := PackageListToTemplate([]string{pkg.Name}, params, l)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			pkg.Name = name
+			rendered = append(rendered, pkg)
+		}
+	}
+	return rendered, nil
+}
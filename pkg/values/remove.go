@@ -0,0 +1,29 @@
+package values
+
+// RemovePackages are packages that base images may ship and that have no place on a kairos image, removed on the init
+// stage if installed. Packages that the install stage asked for are kept, and overlays can add entries or keep one with
+// an exclusion
+var RemovePackages = PackageMap{
+	DebianFamily: {
+		ArchCommon: {
+			Common: {
+				"unattended-upgrades", // Upgrades are done by replacing the image, not in place
+			},
+		},
+	},
+	Ubuntu: {
+		ArchCommon: {
+			Common: {
+				"snapd",  // Snaps are not supported on the immutable rootfs
+				"apport", // Crash reports, needs a writable /var/crash and sends them upstream
+			},
+		},
+	},
+	RedHatFamily: {
+		ArchCommon: {
+			Common: {
+				"dnf-automatic", // Upgrades are done by replacing the image, not in place
+			},
+		},
+	},
+}
@@ -0,0 +1,42 @@
+package values
+
+// BootChainFiles are the globs for the signed files of the secure boot chain for each family and arch, in boot order: shim, grub and kernel
+// Alpine has no signed boot chain, and trusted boot images are signed with the user keys when building the UKI
+var BootChainFiles = map[Family]map[Architecture][]string{
+	DebianFamily: {
+		ArchAMD64: {
+			"/usr/lib/shim/shimx64.efi.signed*",
+			"/usr/lib/grub/x86_64-efi-signed/grubx64.efi.signed",
+			"/boot/vmlinuz",
+		},
+		ArchARM64: {
+			"/usr/lib/shim/shimaa64.efi.signed*",
+			"/usr/lib/grub/arm64-efi-signed/grubaa64.efi.signed",
+			"/boot/vmlinuz",
+		},
+	},
+	RedHatFamily: {
+		ArchAMD64: {
+			"/boot/efi/EFI/*/shimx64.efi",
+			"/boot/efi/EFI/*/grubx64.efi",
+			"/boot/vmlinuz",
+		},
+		ArchARM64: {
+			"/boot/efi/EFI/*/shimaa64.efi",
+			"/boot/efi/EFI/*/grubaa64.efi",
+			"/boot/vmlinuz",
+		},
+	},
+	SUSEFamily: {
+		ArchAMD64: {
+			"/usr/share/efi/x86_64/shim.efi",
+			"/usr/share/efi/x86_64/grub.efi",
+			"/boot/vmlinuz",
+		},
+		ArchARM64: {
+			"/usr/share/efi/aarch64/shim.efi",
+			"/usr/share/efi/aarch64/grub.efi",
+			"/boot/vmlinuz",
+		},
+	},
+}
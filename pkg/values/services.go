@@ -0,0 +1,171 @@
+package values
+
+import (
+	"slices"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+)
+
+// servicemaps work the same way as the packagemaps, they are keyed by distro or family
+// and the family entries are merged with the distro entries for the running system.
+// Default services are only touched if the unit is there, as not all base images ship the same set of services
+
+// ServiceMap is a map of services to handle for each distro or family on systemd based systems
+type ServiceMap map[DistroFamilyInterface]Services
+
+// Services are the services to enable, disable or mask
+type Services struct {
+	Enable  []string
+	Disable []string
+	Mask    []string
+}
+
+// OpenRCServiceMap is a map of services to handle for each distro or family on openrc based systems
+type OpenRCServiceMap map[DistroFamilyInterface]OpenRCServices
+
+// OpenRCServices are the services to enable, keyed by runlevel, and the services to disable from all runlevels
+// There is no masking on openrc
+type OpenRCServices struct {
+	Enable  map[string][]string
+	Disable []string
+}
+
+// SystemdServices are the default services that we handle on systemd systems
+var SystemdServices = ServiceMap{
+	DebianFamily: {
+		Enable: []string{
+			"ssh",
+			"systemd-networkd",
+			"systemd-timesyncd",
+		},
+		Disable: []string{
+			"unattended-upgrades",     // We dont want the system to upgrade itself, upgrades are done via kairos
+			"apt-daily.timer",         // Same as above
+			"apt-daily-upgrade.timer", // Same as above
+		},
+	},
+	RedHatFamily: {
+		Enable: []string{
+			"sshd",
+			"systemd-resolved",
+			"qemu-guest-agent",
+		},
+		Disable: []string{
+			"dnf-makecache",
+			"dnf-makecache.timer",
+		},
+	},
+	Fedora: {
+		Enable: []string{
+			"systemd-networkd", // Only Fedora ships systemd-networkd on the RedHat family
+		},
+	},
+	SUSEFamily: {
+		Enable: []string{
+			"sshd",
+			"qemu-guest-agent",
+		},
+	},
+}
+
+// OpenRCServicesMap are the default services that we handle on openrc systems
+var OpenRCServicesMap = OpenRCServiceMap{
+	AlpineFamily: {
+		Enable: map[string][]string{
+			"sysinit": {
+				"udev",
+				"udev-trigger",
+				"cgroups",
+			},
+			"boot": {
+				"sshd",
+				"connman",
+				"acpid",
+				"hwclock",
+				"syslog",
+				"ntpd",
+				"qemu-guest-agent",
+			},
+			"default": {
+				"crond",
+				"fail2ban",
+			},
+		},
+	},
+}
+
+// GetServices returns the merged systemd services for the given system and config
+func GetServices(s System, c config.Config) Services {
+	var services Services
+	for _, key := range []DistroFamilyInterface{s.Family, s.Distro} {
+		services.Enable = append(services.Enable, SystemdServices[key].Enable...)
+		services.Disable = append(services.Disable, SystemdServices[key].Disable...)
+		services.Mask = append(services.Mask, SystemdServices[key].Mask...)
+	}
+	if stack := NetworkStack(c.NetworkStack); stack != "" {
+		services.Enable = append(removeOtherNetworkServices(services.Enable, stack), NetworkStacks[stack].Services...)
+	}
+	if timeSync := TimeSync(c.TimeSync); timeSync != "" {
+		services.Enable = append(removeTimeSyncServices(services.Enable, timeSync), TimeSyncs[timeSync].Services...)
+	}
+	if runtime, ok := ContainerRuntimes[ContainerRuntime(c.ContainerRuntime)]; ok {
+		services.Enable = append(services.Enable, runtime.Services...)
+	}
+	groups, _ := EnabledPackageGroups(s, c.PackageGroups)
+	for _, name := range groups {
+		services.Enable = append(services.Enable, PackageGroups[name].Services...)
+	}
+	features, _ := EnabledFeatures(s, c)
+	for _, feature := range features {
+		services.Enable = append(services.Enable, Features[feature].Services...)
+	}
+	if forwarder, _ := GetLogForwarder(s, c); forwarder != "" {
+		services.Enable = append(services.Enable, LogForwarders[forwarder].Services...)
+	}
+	return services
+}
+
+// GetOpenRCServices returns the merged openrc services for the given system and config
+func GetOpenRCServices(s System, c config.Config) OpenRCServices {
+	services := OpenRCServices{Enable: map[string][]string{}}
+	for _, key := range []DistroFamilyInterface{s.Family, s.Distro} {
+		for runlevel, svcs := range OpenRCServicesMap[key].Enable {
+			services.Enable[runlevel] = append(services.Enable[runlevel], svcs...)
+		}
+		services.Disable = append(services.Disable, OpenRCServicesMap[key].Disable...)
+	}
+	if stack := NetworkStack(c.NetworkStack); stack != "" {
+		// Network services go into the boot runlevel
+		for runlevel, svcs := range services.Enable {
+			services.Enable[runlevel] = removeOtherNetworkServices(svcs, stack)
+		}
+		services.Enable["boot"] = append(services.Enable["boot"], NetworkStacks[stack].OpenRCServices...)
+	}
+	if timeSync := TimeSync(c.TimeSync); timeSync != "" {
+		// Time sync services go into the boot runlevel, like the busybox ntpd
+		for runlevel, svcs := range services.Enable {
+			services.Enable[runlevel] = removeTimeSyncServices(svcs, timeSync)
+		}
+		services.Enable["boot"] = append(services.Enable["boot"], TimeSyncs[timeSync].OpenRCServices...)
+	}
+	if runtime, ok := ContainerRuntimes[ContainerRuntime(c.ContainerRuntime)]; ok {
+		services.Enable["default"] = append(services.Enable["default"], runtime.OpenRCServices...)
+	}
+	groups, _ := EnabledPackageGroups(s, c.PackageGroups)
+	for _, name := range groups {
+		services.Enable["default"] = append(services.Enable["default"], PackageGroups[name].OpenRCServices...)
+	}
+	features, _ := EnabledFeatures(s, c)
+	for _, feature := range features {
+		services.Enable["default"] = append(services.Enable["default"], Features[feature].OpenRCServices...)
+	}
+	if forwarder, _ := GetLogForwarder(s, c); forwarder != "" {
+		for runlevel, svcs := range services.Enable {
+			services.Enable[runlevel] = slices.DeleteFunc(svcs, func(svc string) bool {
+				return slices.Contains(LogForwarders[forwarder].OpenRCReplaces, svc)
+			})
+		}
+		services.Enable["default"] = append(services.Enable["default"], LogForwarders[forwarder].OpenRCServices...)
+	}
+	return services
+}
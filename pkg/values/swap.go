@@ -0,0 +1,114 @@
+package values
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+)
+
+// ZramPackages are the packages to set up zram swap: zram-generator on systemd systems, which creates the swap from its
+// config on boot, and zram-init on Alpine
+var ZramPackages = PackageMap{
+	Ubuntu: {
+		ArchCommon: {
+			">=22.04": {"systemd-zram-generator"},
+		},
+	},
+	Debian: {
+		ArchCommon: {
+			">=12": {"systemd-zram-generator"},
+		},
+	},
+	Fedora: {
+		ArchCommon: {
+			Common: {"zram-generator"},
+		},
+	},
+	OpenSUSETumbleweed: {
+		ArchCommon: {
+			Common: {"zram-generator"},
+		},
+	},
+	ArchFamily: {
+		ArchCommon: {
+			Common: {"zram-generator"},
+		},
+	},
+	AlpineFamily: {
+		ArchCommon: {
+			Common: {"zram-init", "zram-init-openrc"},
+		},
+	},
+}
+
+const (
+	// ZramGeneratorConfig is the zram-generator config, which takes precedence over the defaults some distros ship
+	ZramGeneratorConfig = "/etc/systemd/zram-generator.conf"
+	// ZramInitConfig is the zram-init config on Alpine, sourced by its openrc service
+	ZramInitConfig = "/etc/conf.d/zram-init"
+	// ZramInitService is the zram-init openrc service, added to the boot runlevel
+	ZramInitService = "zram-init"
+	// SwapFile is created on first boot on the persistent partition, as the rootfs is read only and a swapfile in the
+	// image would only make it bigger
+	SwapFile = "/usr/local/swapfile"
+	// SwapFileService creates and enables the swapfile on boot
+	SwapFileService = "kairos-swapfile"
+	// LiveModeFile is created by immucore when booting the live media, where /usr/local is not persistent
+	LiveModeFile = "/run/cos/live_mode"
+)
+
+// GetZramPackages returns the zram packages for the system, checking that zram is available on it
+func GetZramPackages(s System, l sdkTypes.KairosLogger) ([]string, error) {
+	pkgs, err := FilterPackagesOnConstraint(s, l, GetVersionMaps(s, ZramPackages))
+	if err != nil {
+		return nil, err
+	}
+	if len(pkgs) == 0 {
+		return nil, fmt.Errorf("zram swap is not available on %s %s, use a swap file instead", s.Distro, SystemVersion(s))
+	}
+	return pkgs, nil
+}
+
+// ParseZramSize parses the zram size of the swap config, either a percent of the RAM like "50%" or a size in MiB like
+// "2048". One of them is returned, the other is 0
+func ParseZramSize(size string) (percent int, mib int, err error) {
+	value, isPercent := strings.CutSuffix(strings.TrimSpace(size), "%")
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 || (isPercent && n > 100) {
+		return 0, 0, fmt.Errorf("invalid zram size %q, it has to be a percent of the RAM like 50%% or a size in MiB like 2048", size)
+	}
+	if isPercent {
+		return n, 0, nil
+	}
+	return 0, n, nil
+}
+
+// ZramConfig returns the zram config file for the family and its content, with zstd compression
+func ZramConfig(s System, size string) (string, string, error) {
+	percent, mib, err := ParseZramSize(size)
+	if err != nil {
+		return "", "", err
+	}
+	if s.Family == AlpineFamily {
+		// The config is sourced by the service, so the percent is worked out from the RAM on boot
+		size := strconv.Itoa(mib)
+		if percent > 0 {
+			size = fmt.Sprintf("$(( $(awk '/^MemTotal:/ {print $2}' /proc/meminfo) * %d / 100 / 1024 ))", percent)
+		}
+		return ZramInitConfig, fmt.Sprintf("# Generated by kairos-init\nload_on_start=yes\nunload_on_stop=yes\nnum_devices=1\n"+
+			"type0=swap\nflag0=\nsize0=%s\nalgo0=zstd\n", size), nil
+	}
+	zramSize := strconv.Itoa(mib)
+	if percent > 0 {
+		zramSize = fmt.Sprintf("ram * %d / 100", percent)
+	}
+	return ZramGeneratorConfig, fmt.Sprintf("# Generated by kairos-init\n[zram0]\nzram-size = %s\ncompression-algorithm = zstd\n", zramSize), nil
+}
+
+// SwapFileScript returns the commands that create the swapfile of the given size in MiB if it is not there, and enable
+// it. The size is not checked again on the next boots, so changing it needs the swapfile removed
+func SwapFileScript(mib int) string {
+	return fmt.Sprintf("[ -f %[1]s ] || { fallocate -l %[2]dM %[1]s.tmp && chmod 600 %[1]s.tmp && mkswap %[1]s.tmp && mv %[1]s.tmp %[1]s; }; swapon %[1]s", SwapFile, mib)
+}
@@ -0,0 +1,17 @@
+package values
+
+// DefaultSysctl are the sysctl values that every Kairos system needs, mainly for networking and kubernetes
+var DefaultSysctl = map[string]string{
+	"net.ipv4.ip_forward":                 "1",      // Needed for pod networking
+	"net.ipv6.conf.all.forwarding":        "1",      // Same as above but for ipv6
+	"net.bridge.bridge-nf-call-iptables":  "1",      // Bridged traffic needs to go through iptables for kube-proxy and CNIs
+	"net.bridge.bridge-nf-call-ip6tables": "1",      // Same as above but for ipv6
+	"fs.inotify.max_user_instances":       "8192",   // Default is too low for kubernetes nodes with lots of pods
+	"fs.inotify.max_user_watches":         "524288", // Same as above
+}
+
+// DefaultKernelModules are the modules that need to be loaded on boot for the DefaultSysctl values to apply
+var DefaultKernelModules = []string{
+	"br_netfilter", // Provides the net.bridge.* sysctl keys
+	"overlay",      // Needed by container runtimes
+}
@@ -0,0 +1,154 @@
+package values
+
+import (
+	"fmt"
+	"slices"
+
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+)
+
+// TimeSync is the daemon that keeps the system clock in sync
+type TimeSync string
+
+func (t TimeSync) String() string {
+	return string(t)
+}
+
+const (
+	TimesyncdTimeSync TimeSync = "timesyncd"
+	ChronyTimeSync    TimeSync = "chrony"
+)
+
+// TimeSyncConfig is everything needed to set up a time sync daemon on the system
+type TimeSyncConfig struct {
+	Packages       PackageMap // Packages to install
+	Services       []string   // Services to enable on systemd systems, the ones without a unit are skipped
+	OpenRCServices []string   // Services to add to the boot runlevel on openrc systems
+	OpenRCReplaces []string   // Services removed from the runlevels on openrc systems, like the busybox ntpd
+}
+
+// TimeSyncs are the supported time sync daemons
+// If none is selected in the config, the defaults for the family are kept as they are
+var TimeSyncs = map[TimeSync]TimeSyncConfig{
+	TimesyncdTimeSync: {
+		Packages: PackageMap{
+			// On the SUSE and Arch families timesyncd comes with the systemd package
+			DebianFamily: {
+				ArchCommon: {
+					Common: {"systemd-timesyncd"},
+				},
+			},
+		},
+		Services: []string{"systemd-timesyncd"},
+	},
+	ChronyTimeSync: {
+		Packages: PackageMap{
+			DebianFamily: {
+				ArchCommon: {
+					Common: {"chrony"},
+				},
+			},
+			RedHatFamily: {
+				ArchCommon: {
+					Common: {"chrony"},
+				},
+			},
+			SUSEFamily: {
+				ArchCommon: {
+					Common: {"chrony"},
+				},
+			},
+			ArchFamily: {
+				ArchCommon: {
+					Common: {"chrony"},
+				},
+			},
+			AlpineFamily: {
+				ArchCommon: {
+					Common: {"chrony", "chrony-openrc"},
+				},
+			},
+		},
+		// The unit is chrony on the Debian family and chronyd on the rest
+		Services:       []string{"chrony", "chronyd"},
+		OpenRCServices: []string{"chronyd"},
+		OpenRCReplaces: []string{"ntpd"},
+	},
+}
+
+// GetTimeSync returns the config for the given time sync daemon, checking that its supported on the system
+func GetTimeSync(s System, timeSync string) (TimeSyncConfig, error) {
+	timeSyncConfig, ok := TimeSyncs[TimeSync(timeSync)]
+	if !ok {
+		return TimeSyncConfig{}, fmt.Errorf("invalid time sync: %s, possible values are %s and %s", timeSync, TimesyncdTimeSync, ChronyTimeSync)
+	}
+	if TimeSync(timeSync) == TimesyncdTimeSync {
+		switch s.Family {
+		case AlpineFamily:
+			return TimeSyncConfig{}, fmt.Errorf("time sync %s is not supported on %s as it requires systemd", timeSync, s.Distro)
+		case RedHatFamily:
+			return TimeSyncConfig{}, fmt.Errorf("time sync %s is not supported on %s as its not in the distro repos", timeSync, s.Distro)
+		}
+	}
+	return timeSyncConfig, nil
+}
+
+// GetTimeSyncSource returns the source with the packages of the selected time sync daemon and the exclusions of the
+// packages of the others. It takes the highest precedence, so the selected daemon replaces the default one of the base
+// maps instead of conflicting with it, see PackageConflicts
+func GetTimeSyncSource(s System, timeSync string, l sdkTypes.KairosLogger) (PackageSource, error) {
+	timeSyncConfig, err := GetTimeSync(s, timeSync)
+	if err != nil {
+		return PackageSource{}, err
+	}
+	pkgs, err := FilterPackagesOnConstraint(s, l, GetVersionMaps(s, timeSyncConfig.Packages))
+	if err != nil {
+		return PackageSource{}, err
+	}
+	others, err := OtherTimeSyncPackages(s, timeSync, l)
+	if err != nil {
+		return PackageSource{}, err
+	}
+	for _, pkg := range others {
+		pkgs = append(pkgs, ExclusionPrefix+pkg)
+	}
+	return PackageSource{Map: "time sync " + timeSync, Key: s.Distro, Arch: s.Arch, Versions: VersionMap{Common: pkgs}}, nil
+}
+
+// OtherTimeSyncPackages returns the packages of the time sync daemons other than the selected one, without the ones
+// the selected one needs too
+func OtherTimeSyncPackages(s System, timeSync string, l sdkTypes.KairosLogger) ([]string, error) {
+	selected, err := FilterPackagesOnConstraint(s, l, GetVersionMaps(s, TimeSyncs[TimeSync(timeSync)].Packages))
+	if err != nil {
+		return nil, err
+	}
+	var others []string
+	for name, other := range TimeSyncs {
+		if name.String() == timeSync {
+			continue
+		}
+		pkgs, err := FilterPackagesOnConstraint(s, l, GetVersionMaps(s, other.Packages))
+		if err != nil {
+			return nil, err
+		}
+		for _, pkg := range pkgs {
+			if !slices.Contains(selected, pkg) {
+				others = append(others, pkg)
+			}
+		}
+	}
+	return uniquePackages(others), nil
+}
+
+// removeTimeSyncServices removes the services of all the time sync daemons and the ones the selected one replaces, so
+// the selected one is only enabled once after adding its services back
+func removeTimeSyncServices(services []string, timeSync TimeSync) []string {
+	return slices.DeleteFunc(services, func(svc string) bool {
+		for _, timeSyncConfig := range TimeSyncs {
+			if slices.Contains(timeSyncConfig.Services, svc) || slices.Contains(timeSyncConfig.OpenRCServices, svc) {
+				return true
+			}
+		}
+		return slices.Contains(TimeSyncs[timeSync].OpenRCReplaces, svc)
+	})
+}
@@ -0,0 +1,50 @@
+package values
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// TrustedBootSupport are the distros that trusted boot images boot on, with the VersionMap constraint of their
+// supported versions. The other distros get the packages too, but their kernel, initrd and systemd are not set up to
+// be assembled into a signed UKI, so the image would not boot
+var TrustedBootSupport = map[Distro]string{
+	Ubuntu: ">=22.04",
+	Fedora: Common,
+}
+
+// CheckTrustedBootSupport returns why a trusted boot image can't be built for the system, nil if it can. It is checked
+// before anything runs, instead of finding out when booting the image
+func CheckTrustedBootSupport(s System) error {
+	constraint, ok := TrustedBootSupport[s.Distro]
+	if !ok {
+		supported := make([]string, 0, len(TrustedBootSupport))
+		for distro, versions := range TrustedBootSupport {
+			if versions == Common {
+				supported = append(supported, distro.String())
+			} else {
+				supported = append(supported, fmt.Sprintf("%s %s", distro, versions))
+			}
+		}
+		slices.Sort(supported)
+		return fmt.Errorf("trusted boot is not supported on %s, only on %s, the image would not boot", s.Distro, strings.Join(supported, " and "))
+	}
+	if s.Arch != ArchAMD64 {
+		return fmt.Errorf("trusted boot is only supported on %s, not on %s", ArchAMD64, s.Arch)
+	}
+	if s.Model != "" && s.Model != Generic {
+		return fmt.Errorf("trusted boot is not supported on the %s model, only on %s images", s.Model, Generic)
+	}
+	if constraint == Common {
+		return nil
+	}
+	match, err := constraintMatches(s, constraint)
+	if err != nil {
+		return fmt.Errorf("checking the trusted boot support of %s %s: %w", s.Distro, s.Version, err)
+	}
+	if !match {
+		return fmt.Errorf("trusted boot is not supported on %s %s, only on %s", s.Distro, SystemVersion(s), constraint)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package values
+
+// UdevRuleMap is a map of udev rules to install for each distro or family, with the Common key applying to all of them
+// The inner map is the name of the rules file to its content
+type UdevRuleMap map[DistroFamilyInterface]map[string]string
+
+// ModelUdevRuleMap is a map of udev rules to install for each model
+type ModelUdevRuleMap map[Model]map[string]string
+
+// UdevRules are the udev rules that Kairos needs on the system
+var UdevRules = UdevRuleMap{
+	DebianFamily: {
+		"60-kairos-tpm.rules": tpmUdevRules,
+	},
+	RedHatFamily: {
+		"60-kairos-tpm.rules": tpmUdevRules,
+	},
+	SUSEFamily: {
+		"60-kairos-tpm.rules": tpmUdevRules,
+	},
+	// eudev has no systemd tag and there is no tss group on Alpine, so devices are only accessible by root
+	AlpineFamily: {
+		"60-kairos-tpm.rules": `# TPM devices, used by kcrypt to unlock encrypted partitions
+KERNEL=="tpm[0-9]*", MODE="0600", OWNER="root"
+KERNEL=="tpmrm[0-9]*", MODE="0600", OWNER="root"
+`,
+	},
+}
+
+// UdevRulesModels are the udev rules that are specific to a model
+var UdevRulesModels = ModelUdevRuleMap{
+	Rpi3: {
+		"60-kairos-rpi.rules": rpiUdevRules,
+	},
+	Rpi4: {
+		"60-kairos-rpi.rules": rpiUdevRules,
+	},
+}
+
+const tpmUdevRules = `# TPM devices, used by kcrypt and systemd-cryptenroll to unlock encrypted partitions
+KERNEL=="tpm[0-9]*", TAG+="systemd", MODE="0660", OWNER="tss"
+KERNEL=="tpmrm[0-9]*", TAG+="systemd", MODE="0660", GROUP="tss"
+`
+
+const rpiUdevRules = `# VideoCore devices on the Raspberry Pi
+SUBSYSTEM=="vchiq", GROUP="video", MODE="0660"
+SUBSYSTEM=="vcio", GROUP="video", MODE="0660"
+# Stable name for the SD card, as mmcblk numbering changes depending on the attached devices
+KERNEL=="mmcblk[0-9]", SUBSYSTEMS=="mmc", ATTRS{type}=="SD", SYMLINK+="sdcard"
+KERNEL=="mmcblk[0-9]p[0-9]*", SUBSYSTEMS=="mmc", ATTRS{type}=="SD", SYMLINK+="sdcard%n"
+`
+
+// GetUdevRules returns the merged udev rules for the given system and model
+// Later entries override earlier ones with the same name, so distro rules override family rules and model rules override both
+func GetUdevRules(s System, model string) map[string]string {
+	rules := map[string]string{}
+	for _, key := range []DistroFamilyInterface{Common, s.Family, s.Distro} {
+		for name, content := range UdevRules[key] {
+			rules[name] = content
+		}
+	}
+	for name, content := range UdevRulesModels[Model(model)] {
+		rules[name] = content
+	}
+	return rules
+}
@@ -0,0 +1,13 @@
+package values
+
+// DefaultUserName is the name of the user created when no name is given in the config
+const DefaultUserName = "kairos"
+
+// AdminGroups are the groups that give admin access on each family, the created user is added to them
+var AdminGroups = map[Family][]string{
+	DebianFamily: {"sudo"},
+	RedHatFamily: {"wheel"},
+	SUSEFamily:   {"wheel"},
+	AlpineFamily: {"wheel"},
+	ArchFamily:   {"wheel"},
+}
@@ -0,0 +1,271 @@
+package values
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+	semver "github.com/hashicorp/go-version"
+)
+
+// Models are the supported models
+var Models = []Model{Generic, Rpi3, Rpi4, AgxOrin}
+
+// modelArches are the arches of the boards, a constraint for one of them on another arch never matches
+var modelArches = map[Model]Architecture{
+	Rpi3:    ArchARM64,
+	Rpi4:    ArchARM64,
+	AgxOrin: ArchARM64,
+}
+
+// AllPackageMaps returns all the embedded package maps by name, including the ones of the optional features
+func AllPackageMaps() map[string]PackageMap {
+	maps := map[string]PackageMap{
+		"kernel_ga":       KernelPackagesGA,
+		"kernel_cloud":    KernelPackagesCloud,
+		"kernel_realtime": KernelPackagesRealtime,
+		"kernel_pinned":   KernelPackagesPinned,
+		"microcode":       MicrocodePackages,
+		"locale":          LocalePackages,
+		"keymap":          KeymapPackages,
+		"timezone":        TimezonePackages,
+		"nvidia":          NvidiaPackages,
+		"zfs":             ZfsPackages,
+		"cloudinit":       CloudInitPackages,
+		"recovery":        RecoveryPackages,
+		"zram":            ZramPackages,
+		"firmware grub":   FirmwareDefaultGrubPackages,
+	}
+	for name, m := range OverlayMaps {
+		maps[name] = m
+	}
+	for level, m := range FirmwarePackages {
+		maps["firmware "+string(level)] = m
+	}
+	for name, group := range PackageGroups {
+		maps["group "+name] = group.Packages
+	}
+	for name, stack := range NetworkStacks {
+		maps["network "+name.String()] = stack.Packages
+	}
+	for name, feature := range Features {
+		maps["feature "+name.String()] = feature.Packages
+	}
+	for name, runtime := range ContainerRuntimes {
+		maps["container runtime "+name.String()] = runtime.Packages
+	}
+	for name, timeSync := range TimeSyncs {
+		maps["time sync "+name.String()] = timeSync.Packages
+	}
+	for name, forwarder := range LogForwarders {
+		maps["log forwarder "+name.String()] = forwarder.Packages
+	}
+	return maps
+}
+
+// ValidatePackageMaps checks every embedded package map: the keys are known distros, families and arches, the
+// constraints parse and can match the key they are under, the packages are valid templates and the PackageReasons are
+// of packages listed on the entries they are under
+func ValidatePackageMaps() []error {
+	var errs []error
+	maps := AllPackageMaps()
+	names := make([]string, 0, len(maps))
+	for name := range maps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		errs = append(errs, ValidatePackageMap(name, maps[name])...)
+	}
+	errs = append(errs, validateVersionMap("common", nil, ArchCommon, VersionMap{Common: CommonPackages})...)
+	errs = append(errs, validatePackageReasons(maps)...)
+	return errs
+}
+
+// validatePackageReasons checks that each reason is of a package that the map lists under the same distro or family,
+// so a reason doesn't outlive the entry it was written for
+func validatePackageReasons(maps map[string]PackageMap) []error {
+	var errs []error
+	names := make([]string, 0, len(PackageReasons))
+	for name := range PackageReasons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m, ok := maps[name]
+		if name == "common" {
+			m, ok = PackageMap{nil: {ArchCommon: {Common: CommonPackages}}}, true
+		}
+		if !ok {
+			errs = append(errs, fmt.Errorf("reasons: unknown map %q", name))
+			continue
+		}
+		for key, pkgs := range PackageReasons[name] {
+			listed := map[string]bool{}
+			for _, versions := range m[key] {
+				for _, list := range versions {
+					for _, pkg := range list {
+						pkg, _ = SplitPackageVersion(pkg)
+						listed[pkg] = true
+					}
+				}
+			}
+			for _, pkg := range pkgs {
+				if !listed[pkg.Name] {
+					errs = append(errs, fmt.Errorf("reasons: %s %v: %s is not listed on the map", name, key, pkg.Name))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// ValidatePackageMap checks a single package map, see ValidatePackageMaps
+func ValidatePackageMap(name string, m PackageMap) []error {
+	var errs []error
+	for key, arches := range m {
+		var distros []Distro
+		switch k := key.(type) {
+		case Distro:
+			if _, ok := DistroFamilies[k]; !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown distro %q", name, k))
+				continue
+			}
+			distros = []Distro{k}
+		case Family:
+			for distro, family := range DistroFamilies {
+				if family == k {
+					distros = append(distros, distro)
+				}
+			}
+			if len(distros) == 0 {
+				errs = append(errs, fmt.Errorf("%s: unknown family %q", name, k))
+				continue
+			}
+		case string:
+			// Common to all distros, like the cloud-init package
+			if k != Common {
+				errs = append(errs, fmt.Errorf("%s: key %q is not a distro or family", name, k))
+				continue
+			}
+			for distro := range DistroFamilies {
+				distros = append(distros, distro)
+			}
+		default:
+			errs = append(errs, fmt.Errorf("%s: key %v is not a distro or family", name, key))
+			continue
+		}
+		for arch, versions := range arches {
+			where := fmt.Sprintf("%s %v/%s", name, key, arch)
+			if arch != ArchCommon && arch != ArchAMD64 && arch != ArchARM64 {
+				errs = append(errs, fmt.Errorf("%s: unknown arch %q", where, arch))
+				continue
+			}
+			errs = append(errs, validateVersionMap(where, distros, arch, versions)...)
+		}
+	}
+	return errs
+}
+
+// validateVersionMap checks the constraints and packages of a VersionMap for the given distros and arch
+func validateVersionMap(where string, distros []Distro, arch Architecture, versions VersionMap) []error {
+	var errs []error
+	for constraint, pkgs := range versions {
+		if constraint != Common {
+			if err := validateConstraint(distros, arch, constraint); err != nil {
+				errs = append(errs, fmt.Errorf("%s: constraint %q: %w", where, constraint, err))
+			}
+		}
+		for _, conflict := range PackageConflicts {
+			var found []string
+			for _, pkg := range pkgs {
+				if name, _ := SplitPackageVersion(pkg); slices.Contains(conflict, name) {
+					found = append(found, pkg)
+				}
+			}
+			if len(found) > 1 {
+				errs = append(errs, fmt.Errorf("%s: constraint %q: conflicting packages %s", where, constraint, strings.Join(found, ", ")))
+			}
+		}
+		for _, pkg := range pkgs {
+			if strings.TrimSpace(strings.TrimPrefix(pkg, ExclusionPrefix)) == "" {
+				errs = append(errs, fmt.Errorf("%s: constraint %q: empty package name", where, constraint))
+				continue
+			}
+			if _, err := template.New("versionTemplate").Funcs(sprig.TxtFuncMap()).Parse(pkg); err != nil {
+				errs = append(errs, fmt.Errorf("%s: package %q: %w", where, pkg, err))
+			}
+			for _, family := range families(distros) {
+				if err := ValidatePackagePin(family, pkg); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", where, err))
+					break
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// validateConstraint checks that a constraint parses and can match under the given distros and arch
+func validateConstraint(distros []Distro, arch Architecture, constraint string) error {
+	var versions []string
+	for _, part := range strings.Split(constraint, ",") {
+		part = strings.TrimSpace(part)
+		switch {
+		case part == "":
+			return fmt.Errorf("empty part")
+		case strings.HasPrefix(part, ModelConstraintPrefix):
+			model := Model(strings.TrimPrefix(part, ModelConstraintPrefix))
+			if !slices.Contains(Models, model) {
+				return fmt.Errorf("unknown model %q", model)
+			}
+			if modelArch, ok := modelArches[model]; ok && arch != ArchCommon && arch != modelArch {
+				return fmt.Errorf("model %s is %s only, it never matches under %s", model, modelArch, arch)
+			}
+			continue
+		case strings.HasPrefix(part, ArchConstraintPrefix):
+			partArch := Architecture(strings.TrimPrefix(part, ArchConstraintPrefix))
+			if partArch != ArchAMD64 && partArch != ArchARM64 {
+				return fmt.Errorf("unknown arch %q", partArch)
+			}
+			if arch != ArchCommon && arch != partArch {
+				return fmt.Errorf("arch %s never matches under %s", partArch, arch)
+			}
+			continue
+		}
+		value := strings.TrimLeft(part, "<>=!~ ")
+		if !codenameRegex.MatchString(value) {
+			versions = append(versions, part)
+			continue
+		}
+		known := false
+		for _, distro := range distros {
+			if _, ok := Codenames[distro][value]; ok {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown codename %s", value)
+		}
+	}
+	if len(versions) > 0 {
+		if _, err := semver.NewConstraint(strings.Join(versions, ", ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// families returns the families of the distros
+func families(distros []Distro) []Family {
+	var result []Family
+	for _, distro := range distros {
+		if !slices.Contains(result, DistroFamilies[distro]) {
+			result = append(result, DistroFamilies[distro])
+		}
+	}
+	return result
+}
@@ -0,0 +1,49 @@
+package values
+
+import "testing"
+
+// TestValidatePackageMaps fails on any embedded package map entry that kairos-init validate would reject, so a broken
+// constraint or template fails CI instead of the image build
+func TestValidatePackageMaps(t *testing.T) {
+	for _, err := range ValidatePackageMaps() {
+		t.Error(err)
+	}
+}
+
+func TestValidatePackageMapErrors(t *testing.T) {
+	tests := map[string]PackageMap{
+		"unknown distro":   {Distro("plan9"): {ArchCommon: {Common: {"grub"}}}},
+		"unknown arch":     {Ubuntu: {Architecture("riscv64"): {Common: {"grub"}}}},
+		"bad constraint":   {Ubuntu: {ArchCommon: {">=24.04,": {"grub"}}}},
+		"unknown codename": {Ubuntu: {ArchCommon: {">=bookworm": {"grub"}}}},
+		"bad template":     {Ubuntu: {ArchCommon: {Common: {"linux-image-{{.version"}}}},
+	}
+	for name, m := range tests {
+		if errs := ValidatePackageMap(name, m); len(errs) == 0 {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestValidatePackageReasons(t *testing.T) {
+	maps := map[string]PackageMap{"base": {DebianFamily: {ArchCommon: {Common: {"curl"}}}}}
+	original := PackageReasons
+	t.Cleanup(func() { PackageReasons = original })
+
+	// curl is listed by the Debian family, not by Ubuntu or by the RedHat family
+	PackageReasons = map[string]map[DistroFamilyInterface][]Package{"base": {DebianFamily: {{Name: "curl"}}}}
+	if errs := validatePackageReasons(maps); len(errs) != 0 {
+		t.Errorf("expected no errors, got %v", errs)
+	}
+	for name, reasons := range map[string]map[string]map[DistroFamilyInterface][]Package{
+		"other distro": {"base": {Ubuntu: {{Name: "curl"}}}},
+		"other family": {"base": {RedHatFamily: {{Name: "curl"}}}},
+		"not listed":   {"base": {DebianFamily: {{Name: "wget"}}}},
+		"unknown map":  {"extra": {DebianFamily: {{Name: "curl"}}}},
+	} {
+		PackageReasons = reasons
+		if errs := validatePackageReasons(maps); len(errs) == 0 {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -1,5 +1,11 @@
 package values
 
+import (
+	"strings"
+
+	"github.com/kairos-io/kairos-init/pkg/config"
+)
+
 // Common Used for packages that are common to whatever key
 const Common = "common"
 
@@ -53,6 +59,21 @@ const (
 	SUSEFamily    Family = "suse"
 )
 
+// DistroFamilies are the supported distros with their family
+var DistroFamilies = map[Distro]Family{
+	Debian:             DebianFamily,
+	Ubuntu:             DebianFamily,
+	Fedora:             RedHatFamily,
+	RockyLinux:         RedHatFamily,
+	AlmaLinux:          RedHatFamily,
+	RedHat:             RedHatFamily,
+	Arch:               ArchFamily,
+	Alpine:             AlpineFamily,
+	OpenSUSELeap:       SUSEFamily,
+	OpenSUSETumbleweed: SUSEFamily,
+	SLES:               SUSEFamily,
+}
+
 type Model string              // Model is the type of the system
 func (m Model) String() string { return string(m) }
 
@@ -64,19 +85,41 @@ const (
 )
 
 type System struct {
-	Name    string
-	Distro  Distro
-	Family  Family
-	Version string
-	Arch    Architecture
+	Name    string       `json:"name"`
+	Distro  Distro       `json:"distro"`
+	Family  Family       `json:"family"`
+	Version string       `json:"version"`
+	Arch    Architecture `json:"arch"`
+	// Codename is the release codename from the os-release, if the distro has them
+	Codename string `json:"codename,omitempty"`
+	// Variant is the variant being built, standard images get the kubernetes provider stack on top of core
+	Variant config.Variant `json:"variant,omitempty"`
+	// Model is the model being built, generic or a board like rpi4
+	Model Model `json:"model,omitempty"`
+	// TrustedBoot is set when building a trusted boot image, which changes the kernel and bootloader packages
+	TrustedBoot bool `json:"trusted_boot,omitempty"`
 }
 
-// GetTemplateParams returns a map of parameters that can be used in a template
-func GetTemplateParams(s System) map[string]string {
+// TemplateParams returns the parameters available to the package templates, like {{.version}} or {{.major}}
+// The version falls back to the one of the codename if the os-release has none, see SystemVersion. The localization
+// and kernel params come from the given config
+func (s System) TemplateParams(c config.Config) map[string]string {
+	version := SystemVersion(s)
+	major, minor, _ := strings.Cut(version, ".")
+	minor, _, _ = strings.Cut(minor, ".")
 	return map[string]string{
-		"distro":  s.Distro.String(),
-		"version": s.Version,
-		"arch":    s.Arch.String(),
-		"family":  s.Family.String(),
+		"distro":   s.Distro.String(),
+		"version":  version,
+		"major":    major,
+		"minor":    minor,
+		"codename": s.Codename,
+		"arch":     s.Arch.String(),
+		"family":   s.Family.String(),
+		"variant":  s.Variant.String(),
+		"model":    s.Model.String(),
+		"lang":     LocaleLanguage(c.Localization.Locale),
+		// Only set when the kernel is pinned, see KernelPackagesPinned
+		"kernelVersion": c.Kernel.Version,
+		"kernelFlavor":  c.Kernel.Flavor,
 	}
 }
@@ -45,8 +45,14 @@ func setProperRepo(arch string, url string) string {
 	return data
 }
 
-func GetProviderPackage(arch string) string {
-	return setProperRepo(arch, providerPackage)
+// GetProviderPackage returns the provider package for the arch, at the given version or the pinned one if empty
+func GetProviderPackage(arch string, version string) string {
+	pkg := providerPackage
+	if version != "" {
+		repo, _, _ := strings.Cut(providerPackage, ":")
+		pkg = fmt.Sprintf("%s:provider-kairos-system-%s", repo, strings.TrimPrefix(version, "v"))
+	}
+	return setProperRepo(arch, pkg)
 }
 
 func GetEdgeVPNPackage(arch string) string {
@@ -0,0 +1,88 @@
+package values
+
+import "fmt"
+
+// ZfsPackages are the packages for the zfs module and tools.
+// Ubuntu ships the module with the kernel, Debian and RedHat families build it with dkms, while SUSE and Alpine
+// have prebuilt modules for their default kernels
+var ZfsPackages = PackageMap{
+	Ubuntu: {
+		ArchCommon: {
+			Common: {
+				"zfsutils-linux",
+				"zfs-dracut",
+			},
+		},
+	},
+	Debian: {
+		ArchAMD64: {
+			Common: {"linux-headers-amd64"},
+		},
+		ArchARM64: {
+			Common: {"linux-headers-arm64"},
+		},
+		ArchCommon: {
+			Common: {
+				"zfs-dkms",
+				"zfsutils-linux",
+				"zfs-dracut",
+			},
+		},
+	},
+	RedHatFamily: {
+		ArchCommon: {
+			Common: {
+				"kernel-devel",
+				"zfs",
+				"zfs-dracut",
+			},
+		},
+	},
+	SUSEFamily: {
+		ArchCommon: {
+			Common: {
+				"zfs",
+				"zfs-kmp-default",
+			},
+		},
+	},
+	AlpineFamily: {
+		ArchCommon: {
+			Common: {
+				"zfs",
+				"zfs-lts",
+			},
+		},
+	},
+}
+
+// ZfsRepoCommands returns the commands to add the repos that provide zfs to the system
+// Ubuntu and Alpine have it on their default repos
+func ZfsRepoCommands(s System) ([]string, error) {
+	switch s.Distro {
+	case Ubuntu, Alpine:
+		return []string{}, nil
+	case Debian:
+		// zfs-dkms is on contrib due to the license
+		return []string{"sed -i 's/^Components: main.*$/& contrib/' /etc/apt/sources.list.d/debian.sources"}, nil
+	case Fedora:
+		return []string{`dnf install -y https://zfsonlinux.org/fedora/zfs-release-2-5$(rpm --eval "%{dist}").noarch.rpm`}, nil
+	case RockyLinux, AlmaLinux, RedHat:
+		// dkms comes from epel
+		return []string{
+			"dnf install -y epel-release",
+			`dnf install -y https://zfsonlinux.org/epel/zfs-release-2-3$(rpm --eval "%{dist}").noarch.rpm`,
+		}, nil
+	case OpenSUSELeap, OpenSUSETumbleweed:
+		repo := "openSUSE_Tumbleweed"
+		if s.Distro == OpenSUSELeap {
+			repo = fmt.Sprintf("openSUSE_Leap_%s", s.Version)
+		}
+		return []string{
+			fmt.Sprintf("zypper --non-interactive addrepo --refresh https://download.opensuse.org/repositories/filesystems/%s/filesystems.repo", repo),
+			"zypper --non-interactive --gpg-auto-import-keys refresh",
+		}, nil
+	default:
+		return nil, fmt.Errorf("zfs is not supported on %s", s.Distro)
+	}
+}